@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 
@@ -106,17 +105,21 @@ type sirsiChangePassResponse struct {
 //	  --header 'Content-Type: application/json' \
 //	  --data '{"barcode": "C000011111", "password": "PASS"}'
 func (svc *serviceContext) checkPassword(c *gin.Context) {
+	ctx := c.Request.Context()
 	var passReq struct {
 		UserBarcode string `json:"barcode"`
 		Password    string `json:"password"`
 	}
 	err := c.ShouldBindJSON(&passReq)
 	if err != nil {
-		log.Printf("ERROR: Unable to parse check password request: %s", err.Error())
+		logf(ctx, "ERROR: Unable to parse check password request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	log.Printf("INFO: check password for %s", passReq.UserBarcode)
+	if svc.throttleTarget(c, "patron", passReq.UserBarcode) == false {
+		return
+	}
+	logf(ctx, "INFO: check password for %s", redactID(passReq.UserBarcode))
 	data := struct {
 		AlternateID string `json:"alternateID"`
 		Password    string `json:"password"`
@@ -124,14 +127,16 @@ func (svc *serviceContext) checkPassword(c *gin.Context) {
 		AlternateID: passReq.UserBarcode,
 		Password:    passReq.Password,
 	}
-	_, sirsiErr := svc.sirsiPost(svc.HTTPClient, "/user/patron/authenticate", data)
+	_, sirsiErr := svc.ILS.authenticatePatron(ctx, data)
 	if sirsiErr != nil {
 		if sirsiErr.StatusCode == 401 {
 			// unauthorized. some accounts have the computeID in the barcode field... try that
-			log.Printf("INFO: alt id password check failed; try barcode")
-			if svc.checkBarcodePassword(passReq.UserBarcode, passReq.Password) {
+			logf(ctx, "INFO: alt id password check failed; try barcode")
+			if svc.checkBarcodePassword(ctx, passReq.UserBarcode, passReq.Password) {
+				svc.loginSucceeded("patron", passReq.UserBarcode)
 				c.String(http.StatusOK, "valid")
 			} else {
+				svc.loginFailed(c, "patron", passReq.UserBarcode)
 				c.String(http.StatusUnauthorized, "invalid")
 			}
 			return
@@ -140,19 +145,21 @@ func (svc *serviceContext) checkPassword(c *gin.Context) {
 		// go an error response, parse parse it and log results
 		errMsgs, err := svc.handleSirsiErrorResponse(sirsiErr)
 		if err != nil {
-			log.Printf("ERROR: check pass for alt id %s  failed: %s", passReq.UserBarcode, sirsiErr.string())
+			logf(ctx, "ERROR: check pass for alt id %s  failed: %s", redactID(passReq.UserBarcode), sirsiErr.string())
 			c.String(http.StatusInternalServerError, sirsiErr.Message)
 			return
 		}
-		log.Printf("INFO: unsuccessful check pass for alt id %s: %v", passReq.UserBarcode, errMsgs.MessageList)
+		logf(ctx, "INFO: unsuccessful check pass for alt id %s: %v", redactID(passReq.UserBarcode), errMsgs.MessageList)
+		svc.loginFailed(c, "patron", passReq.UserBarcode)
 		c.String(http.StatusUnauthorized, "invalid")
 		return
 	}
 
+	svc.loginSucceeded("patron", passReq.UserBarcode)
 	c.String(http.StatusOK, "valid")
 }
 
-func (svc *serviceContext) checkBarcodePassword(computeID, pass string) bool {
+func (svc *serviceContext) checkBarcodePassword(ctx context.Context, computeID, pass string) bool {
 	data := struct {
 		Barcode  string `json:"barcode"`
 		Password string `json:"password"`
@@ -160,13 +167,13 @@ func (svc *serviceContext) checkBarcodePassword(computeID, pass string) bool {
 		Barcode:  computeID,
 		Password: pass,
 	}
-	_, sirsiErr := svc.sirsiPost(svc.HTTPClient, "/user/patron/authenticate", data)
+	_, sirsiErr := svc.ILS.authenticatePatron(ctx, data)
 	if sirsiErr != nil {
 		errMsgs, err := svc.handleSirsiErrorResponse(sirsiErr)
 		if err != nil {
-			log.Printf("ERROR: check pass for barcode %s failed: %s", computeID, sirsiErr.string())
+			logf(ctx, "ERROR: check pass for barcode %s failed: %s", redactID(computeID), sirsiErr.string())
 		} else {
-			log.Printf("INFO: unsuccessful check pass for barcode %s: %v", computeID, errMsgs.MessageList)
+			logf(ctx, "INFO: unsuccessful check pass for barcode %s: %v", redactID(computeID), errMsgs.MessageList)
 		}
 		return false
 	}
@@ -178,6 +185,7 @@ func (svc *serviceContext) checkBarcodePassword(computeID, pass string) bool {
 //	  --header 'Content-Type: application/json' \
 //	  --data '{"barcode": "C000011111", "currPassword": "PASS!", "newPassword": "NEW"}'
 func (svc *serviceContext) changePassword(c *gin.Context) {
+	ctx := c.Request.Context()
 	var passReq struct {
 		CurrPassword string `json:"currPassword"`
 		NewPassword  string `json:"newPassword"`
@@ -185,12 +193,12 @@ func (svc *serviceContext) changePassword(c *gin.Context) {
 	}
 	err := c.ShouldBindJSON(&passReq)
 	if err != nil {
-		log.Printf("ERROR: Unable to parse change password request: %s", err.Error())
+		logf(ctx, "ERROR: Unable to parse change password request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	log.Printf("INFO: change password for %s; first sign in...", passReq.UserBarcode)
+	logf(ctx, "INFO: change password for %s; first sign in...", redactID(passReq.UserBarcode))
 	loginReq := struct {
 		Login    string `json:"login"`
 		Password string `json:"password"`
@@ -198,14 +206,14 @@ func (svc *serviceContext) changePassword(c *gin.Context) {
 		Login:    passReq.UserBarcode,
 		Password: passReq.CurrPassword,
 	}
-	sessionToken, loginErr := svc.startPatronSession(loginReq)
+	sessionToken, loginErr := svc.startPatronSession(ctx, loginReq)
 	if loginErr != nil {
-		log.Printf("ERROR: unable to start patron %s session for password change: %s", passReq.UserBarcode, loginErr.Message)
+		logf(ctx, "ERROR: unable to start patron %s session for password change: %s", redactID(passReq.UserBarcode), loginErr.Message)
 		c.String(loginErr.StatusCode, loginErr.Message)
 		return
 	}
 
-	log.Printf("INFO: %s signed in; change password...", passReq.UserBarcode)
+	logf(ctx, "INFO: %s signed in; change password...", redactID(passReq.UserBarcode))
 	changeReq := struct {
 		NewPass  string `json:"newPassword"`
 		CurrPass string `json:"currentPassword"`
@@ -213,9 +221,9 @@ func (svc *serviceContext) changePassword(c *gin.Context) {
 		NewPass:  passReq.NewPassword,
 		CurrPass: passReq.CurrPassword,
 	}
-	cErr := svc.sendPaswordChangeRequest(changeReq, sessionToken)
+	cErr := svc.sendPaswordChangeRequest(ctx, changeReq, sessionToken)
 	if cErr != nil {
-		log.Printf("INFO: password change failed: %s", cErr.string())
+		logf(ctx, "INFO: password change failed: %s", cErr.string())
 		c.String(cErr.StatusCode, cErr.Message)
 		return
 	}
@@ -228,12 +236,8 @@ func (svc *serviceContext) changePassword(c *gin.Context) {
 // In thee forgot case there are 2 scenarios:
 //  1. First attempt: the changeReq will include newPassword and resetPasswordToken but sessionToken will an empty string
 //  2. Each other attempt: changeReq only includes newPassword and sessionToken will be set
-func (svc *serviceContext) sendPaswordChangeRequest(changeReq any, sessionToken string) *requestError {
-	payloadBytes, _ := json.Marshal(changeReq)
-	url := fmt.Sprintf("%s/user/patron/changeMyPassword", svc.SirsiConfig.WebServicesURL)
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
-	svc.setSirsiHeaders(req, "", sessionToken)
-	changeResp, changeErr := svc.sendRequest("sirsi", svc.HTTPClient, req)
+func (svc *serviceContext) sendPaswordChangeRequest(ctx context.Context, changeReq any, sessionToken string) *requestError {
+	changeResp, changeErr := svc.ILS.changePassword(ctx, changeReq, sessionToken)
 	if changeErr != nil {
 		// this only happens in a invalid request or http error. Just return the raw error code and message; there
 		// will be no Sirsi messageList present as the request failed outright.
@@ -242,8 +246,8 @@ func (svc *serviceContext) sendPaswordChangeRequest(changeReq any, sessionToken
 
 	// NOTE: when a password fails for history or complexity requirements, the response will be SUCCESS
 	// but the payoad will include an errorMessage and new sessionTolem
-	log.Printf("INFO: raw change password response: %s", changeResp)
-	log.Printf("INFO: parse change response to see if it was success or fail")
+	logf(ctx, "INFO: raw change password response: %s", changeResp)
+	logf(ctx, "INFO: parse change response to see if it was success or fail")
 	var jsonResp sirsiChangePassResponse
 	respErr := json.Unmarshal(changeResp, &jsonResp)
 	if respErr != nil {
@@ -256,12 +260,12 @@ func (svc *serviceContext) sendPaswordChangeRequest(changeReq any, sessionToken
 		reqErr := requestError{StatusCode: http.StatusBadRequest, Message: string(failBytes)}
 		return &reqErr
 	}
-	log.Printf("INFO: password change succeeded")
+	logf(ctx, "INFO: password change succeeded")
 	return nil
 }
 
-func (svc *serviceContext) startPatronSession(loginPayload any) (string, *requestError) {
-	loginResp, sirsiErr := svc.sirsiPost(svc.HTTPClient, "/user/patron/login", loginPayload)
+func (svc *serviceContext) startPatronSession(ctx context.Context, loginPayload any) (string, *requestError) {
+	loginResp, sirsiErr := svc.ILS.patronLogin(ctx, loginPayload)
 	if sirsiErr != nil {
 		return "", sirsiErr
 	}
@@ -278,16 +282,20 @@ func (svc *serviceContext) startPatronSession(loginPayload any) (string, *reques
 
 // curl -X POST http://localhost:8185/users/C000011111/forgot_password
 func (svc *serviceContext) forgotPassword(c *gin.Context) {
+	ctx := c.Request.Context()
 	var req struct {
 		UserBarcode string `json:"userBarcode"`
 	}
 	qpErr := c.ShouldBindJSON(&req)
 	if qpErr != nil {
-		log.Printf("ERROR: invalid forgot password payload: %v", qpErr)
+		logf(ctx, "ERROR: invalid forgot password payload: %v", qpErr)
 		c.String(http.StatusBadRequest, "Invalid request")
 		return
 	}
-	log.Printf("INFO: user %s forgot password", req.UserBarcode)
+	if svc.throttleTarget(c, "patron", req.UserBarcode) == false {
+		return
+	}
+	logf(ctx, "INFO: user %s forgot password", redactID(req.UserBarcode))
 	data := struct {
 		Barcode  string `json:"barcode"`
 		ResetURL string `json:"resetPasswordUrl"`
@@ -295,9 +303,9 @@ func (svc *serviceContext) forgotPassword(c *gin.Context) {
 		Barcode:  req.UserBarcode,
 		ResetURL: fmt.Sprintf("%s/signin?token=<RESET_PASSWORD_TOKEN>", svc.VirgoURL),
 	}
-	_, sirsiErr := svc.sirsiPost(svc.HTTPClient, "/user/patron/resetMyPassword", data)
+	_, sirsiErr := svc.ILS.resetPassword(ctx, data)
 	if sirsiErr != nil {
-		log.Printf("ERROR: %s forgot password failed: %s", req.UserBarcode, sirsiErr.string())
+		logf(ctx, "ERROR: %s forgot password failed: %s", redactID(req.UserBarcode), sirsiErr.string())
 		c.String(sirsiErr.StatusCode, sirsiErr.Message)
 		return
 	}
@@ -312,6 +320,7 @@ func (svc *serviceContext) forgotPassword(c *gin.Context) {
 // IMPORTANT: if the request fails, the response will include a sessionToken. Extract this token and send it in the
 // response. This session will be passed back in subsequent attempts
 func (svc *serviceContext) resetPassword(c *gin.Context) {
+	ctx := c.Request.Context()
 	var qp struct {
 		Token   string `json:"token"`       // the initial password reset token from the email. Used on the first attempt
 		Session string `json:"session"`     // session returned from failed reset attempts. used in all subsequent attempts
@@ -320,7 +329,7 @@ func (svc *serviceContext) resetPassword(c *gin.Context) {
 
 	qpErr := c.ShouldBindJSON(&qp)
 	if qpErr != nil {
-		log.Printf("ERROR: invalid reset password payload: %v", qpErr)
+		logf(ctx, "ERROR: invalid reset password payload: %v", qpErr)
 		c.String(http.StatusBadRequest, "invalid request")
 		return
 	}
@@ -328,14 +337,14 @@ func (svc *serviceContext) resetPassword(c *gin.Context) {
 	var payload any
 	if qp.Session != "" {
 		// always prefer session over the reset token
-		log.Printf("INFO: reset password with session %s", qp.Session)
+		logf(ctx, "INFO: reset password with session from a prior attempt")
 		payload = struct {
 			Password string `json:"newPassword"`
 		}{
 			Password: qp.NewPass,
 		}
 	} else {
-		log.Printf("INFO: reset password with reset token %s", qp.Token)
+		logf(ctx, "INFO: reset password with reset token")
 		payload = struct {
 			Password   string `json:"newPassword"`
 			ResetToken string `json:"resetPasswordToken"`
@@ -345,9 +354,9 @@ func (svc *serviceContext) resetPassword(c *gin.Context) {
 		}
 	}
 
-	cErr := svc.sendPaswordChangeRequest(payload, qp.Session)
+	cErr := svc.sendPaswordChangeRequest(ctx, payload, qp.Session)
 	if cErr != nil {
-		log.Printf("INFO: password change failed: %s", cErr.string())
+		logf(ctx, "INFO: password change failed: %s", cErr.string())
 		c.String(cErr.StatusCode, cErr.Message)
 		return
 	}
@@ -361,17 +370,18 @@ func (svc *serviceContext) resetPassword(c *gin.Context) {
 //					"email": "louffoster@gmail.com", "phone": "N/A", "address1": "123 fake", "address2": "",
 //					"city": "Charlottesville", "state": "VA", "zip":"220902"}'
 func (svc *serviceContext) registerNewUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	var tmpAcct tmpAccount
 	qpErr := c.ShouldBindJSON(&tmpAcct)
 	if qpErr != nil {
-		log.Printf("ERROR: invalid change register user payload: %v", qpErr)
+		logf(ctx, "ERROR: invalid change register user payload: %v", qpErr)
 		c.String(http.StatusBadRequest, "Invalid request")
 		return
 	}
 	newUserBytes, _ := json.Marshal(tmpAcct)
-	log.Printf("INFO: register new user [%s]", newUserBytes)
+	logf(ctx, "INFO: register new user [%s]", newUserBytes)
 
-	log.Printf("INFO: create sirsi register payload")
+	logf(ctx, "INFO: create sirsi register payload")
 	payload := sirsiRegistration{
 		FirstName:        tmpAcct.FirstName,
 		LastName:         tmpAcct.LastName,
@@ -387,15 +397,15 @@ func (svc *serviceContext) registerNewUser(c *gin.Context) {
 	}
 	err := payload.validate()
 	if err != nil {
-		log.Printf("INFO: bad register request: %s", err.Error())
+		logf(ctx, "INFO: bad register request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	log.Printf("INFO: post user registration")
-	resp, sirsiErr := svc.sirsiPost(svc.HTTPClient, "/user/patron/register", payload)
+	logf(ctx, "INFO: post user registration")
+	resp, sirsiErr := svc.ILS.registerPatron(ctx, payload)
 	if sirsiErr != nil {
-		log.Printf("WARNING: token password change failed: %s", sirsiErr.string())
+		logf(ctx, "WARNING: token password change failed: %s", sirsiErr.string())
 		var msg sirsiMessageList
 		err := json.Unmarshal([]byte(sirsiErr.Message), &msg)
 		if err != nil {
@@ -409,14 +419,13 @@ func (svc *serviceContext) registerNewUser(c *gin.Context) {
 	var regResp sirsiRegistrationResponse
 	parsErr := json.Unmarshal(resp, &regResp)
 	if parsErr != nil {
-		log.Printf("ERROR: unable to parse registration response: %s", parsErr.Error())
+		logf(ctx, "ERROR: unable to parse registration response: %s", parsErr.Error())
 		c.String(http.StatusInternalServerError, parsErr.Error())
 		return
 	}
 
 	// registration was successful, now update the altID with TEMP barcode
-	log.Printf("INFO: update temp user %s (%s) registration with temp barcode and circhistory",
-		regResp.Patron.Key, regResp.Barcode)
+	logf(ctx, "INFO: update temp user %s registration with temp barcode and circhistory", regResp.Patron.Key)
 	idPayload := struct {
 		Resource         string `json:"@resource"`
 		Key              string `json:"@key"`
@@ -431,32 +440,26 @@ func (svc *serviceContext) registerNewUser(c *gin.Context) {
 		PreferredAddress: "3",
 	}
 
-	payloadBytes, _ := json.Marshal(idPayload)
-	url := fmt.Sprintf("%s/user/patron/key/%s", svc.SirsiConfig.WebServicesURL, idPayload.Key)
-	req, _ := http.NewRequest("PUT", url, bytes.NewBuffer(payloadBytes))
-	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.SessionToken)
-	req.Header.Set("Accept", "application/vnd.sirsidynix.roa.resource.v2+json")
-	req.Header.Set("Content-Type", "application/vnd.sirsidynix.roa.resource.v2+json")
-	req.Header.Set("SD-Working-LibraryID", svc.SirsiConfig.Library)
-	_, changeErr := svc.sendRequest("sirsi", svc.HTTPClient, req)
+	_, changeErr := svc.ILS.updatePatron(ctx, idPayload.Key, idPayload)
 	if changeErr != nil {
-		log.Printf("WARNING: unable to update temp user %s: %s", regResp.Patron.Key, changeErr.string())
+		logf(ctx, "WARNING: unable to update temp user %s: %s", regResp.Patron.Key, changeErr.string())
 	}
 
 	c.String(http.StatusOK, "registration success")
 }
 
 func (svc *serviceContext) activateUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	token := c.Param("token")
-	log.Printf("INFO: activate new account with %s", token)
+	logf(ctx, "INFO: activate new account")
 	req := struct {
 		Token string `json:"activationToken"`
 	}{
 		Token: token,
 	}
-	resp, sirsiErr := svc.sirsiPost(svc.HTTPClient, "/user/patron/activate", req)
+	resp, sirsiErr := svc.ILS.activatePatron(ctx, req)
 	if sirsiErr != nil {
-		log.Printf("ERROR: activate failed: %s", sirsiErr.string())
+		logf(ctx, "ERROR: activate failed: %s", sirsiErr.string())
 		c.String(sirsiErr.StatusCode, sirsiErr.Message)
 		return
 	}
@@ -464,12 +467,12 @@ func (svc *serviceContext) activateUser(c *gin.Context) {
 	var actResp sirsiActivateResponse
 	parsErr := json.Unmarshal(resp, &actResp)
 	if parsErr != nil {
-		log.Printf("ERROR: unable to parse activate response: %s", parsErr)
+		logf(ctx, "ERROR: unable to parse activate response: %s", parsErr)
 		c.String(http.StatusInternalServerError, parsErr.Error())
 		return
 	}
 	if actResp.Success == false {
-		log.Printf("INFO: activate %s returned success=false", token)
+		logf(ctx, "INFO: activate returned success=false")
 		c.String(http.StatusUnprocessableEntity, "failed")
 		return
 	}
@@ -482,25 +485,26 @@ func (svc *serviceContext) activateUser(c *gin.Context) {
 //	  --header 'Content-Type: application/json' \
 //	  --data '{"username":"USER", "password": "PASS"}'
 func (svc *serviceContext) staffLogin(c *gin.Context) {
+	ctx := c.Request.Context()
 	var loginReq struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 	err := c.ShouldBindJSON(&loginReq)
 	if err != nil {
-		log.Printf("ERROR: Unable to parse staff login request: %s", err.Error())
+		logf(ctx, "ERROR: Unable to parse staff login request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	log.Printf("INFO: staff %s login request", loginReq.Username)
-	req := sirsiStaffLoginReq{
-		Login:    loginReq.Username,
-		Password: loginReq.Password,
+	if svc.throttleTarget(c, "staff", loginReq.Username) == false {
+		return
 	}
-	resp, sirsiErr := svc.sirsiPost(svc.HTTPClient, "/user/staff/login", req)
+	logf(ctx, "INFO: staff %s login request", redactID(loginReq.Username))
+	resp, sirsiErr := svc.ILS.staffLogin(ctx, loginReq.Username, loginReq.Password)
 	if sirsiErr != nil {
-		log.Printf("ERROR: staff login failed: %s", sirsiErr.string())
+		logf(ctx, "ERROR: staff login failed: %s", sirsiErr.string())
 		if sirsiErr.StatusCode == http.StatusUnauthorized {
+			svc.loginFailed(c, "staff", loginReq.Username)
 			c.String(http.StatusUnauthorized, "invalid username or password")
 		} else {
 			c.String(sirsiErr.StatusCode, sirsiErr.Message)
@@ -510,10 +514,11 @@ func (svc *serviceContext) staffLogin(c *gin.Context) {
 	var respObj sirsiSigniResponse
 	parseErr := json.Unmarshal(resp, &respObj)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse loging reqponse for %s: %s", loginReq.Username, parseErr.Error())
+		logf(ctx, "ERROR: unable to parse loging reqponse for %s: %s", redactID(loginReq.Username), parseErr.Error())
 		c.String(http.StatusInternalServerError, parseErr.Error())
 		return
 	}
-	log.Printf("INFO: %s logged in successfully", loginReq.Username)
+	logf(ctx, "INFO: %s logged in successfully", redactID(loginReq.Username))
+	svc.loginSucceeded("staff", loginReq.Username)
 	c.JSON(http.StatusOK, respObj)
 }
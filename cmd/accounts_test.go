@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	h := newTestHarness(t)
+	h.run(t, []routeTest{
+		{name: "invalid request", method: "POST", path: "/users/check_password", body: `{"barcode": `, status: http.StatusBadRequest},
+		{name: "authenticates by alternate id", method: "POST", path: "/users/check_password", body: `{"barcode": "mst3k", "password": "fixture-pin"}`,
+			status: http.StatusOK, contains: []string{"valid"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/user/patron/authenticate")
+				if len(reqs) != 1 || strings.Contains(string(reqs[0].body), `"alternateID":"mst3k"`) == false {
+					t.Errorf("expected an authenticate request for mst3k")
+				}
+			}},
+		{name: "sirsi message list", method: "POST", path: "/users/check_password", body: `{"barcode": "mst3k", "password": "fixture-pin"}`,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/patron/authenticate",
+					sirsiMessageResponse(http.StatusBadRequest, "userPINLocked", "The user PIN is locked."))
+			},
+			status: http.StatusUnauthorized, contains: []string{"invalid"}},
+		{name: "sirsi system error", method: "POST", path: "/users/check_password", body: `{"barcode": "mst3k", "password": "fixture-pin"}`,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/patron/authenticate", fakeResponse{status: http.StatusInternalServerError, body: "internal failure"})
+			},
+			status: http.StatusInternalServerError, contains: []string{"internal failure"}},
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	h := newTestHarness(t)
+	change := `{"barcode": "C000011111", "currPassword": "fixture-pin", "newPassword": "n3w-pin"}`
+
+	h.run(t, []routeTest{
+		{name: "invalid request", method: "POST", path: "/users/change_password", body: `{"barcode": `, status: http.StatusBadRequest},
+		{name: "password changed", method: "POST", path: "/users/change_password", body: change,
+			status: http.StatusOK, contains: []string{"password changed"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				login := h.sirsi.received("POST", "/user/patron/login")
+				if len(login) != 1 || strings.Contains(string(login[0].body), `"login":"C000011111"`) == false {
+					t.Fatalf("expected a patron login for C000011111")
+				}
+				reqs := h.sirsi.received("POST", "/user/patron/changeMyPassword")
+				if len(reqs) != 1 || reqs[0].header.Get("x-sirs-sessionToken") != "fixture-patron-mst3k" {
+					t.Fatalf("expected a password change with the patron session")
+				}
+				var payload map[string]string
+				json.Unmarshal(reqs[0].body, &payload)
+				if payload["newPassword"] != "n3w-pin" || payload["currentPassword"] != "fixture-pin" {
+					t.Errorf("unexpected change password payload %s", reqs[0].body)
+				}
+			}},
+		{name: "wrong current password", method: "POST", path: "/users/change_password",
+			body:   `{"barcode": "C000011111", "currPassword": "guess", "newPassword": "n3w-pin"}`,
+			status: http.StatusUnauthorized, contains: []string{"Unable to log in."},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/user/patron/changeMyPassword")) != 0 {
+					t.Errorf("expected no password change")
+				}
+			}},
+		{name: "new password rejected", method: "POST", path: "/users/change_password",
+			body:   `{"barcode": "C000011111", "currPassword": "fixture-pin", "newPassword": ""}`,
+			status: http.StatusBadRequest, contains: []string{`"errorMessage":"The new PIN is invalid."`, `"sessionToken":"fixture-reset"`}},
+		{name: "sirsi system error", method: "POST", path: "/users/change_password", body: change,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/patron/changeMyPassword", fakeResponse{status: http.StatusInternalServerError, body: "internal failure"})
+			},
+			status: http.StatusInternalServerError, contains: []string{"internal failure"}},
+	})
+}
+
+func TestForgotPassword(t *testing.T) {
+	h := newTestHarness(t)
+	h.run(t, []routeTest{
+		{name: "invalid request", method: "POST", path: "/users/forgot_password", body: `{"userBarcode": `, status: http.StatusBadRequest},
+		{name: "reset email requested", method: "POST", path: "/users/forgot_password", body: `{"userBarcode": "C000011111"}`,
+			status: http.StatusOK, contains: []string{"ok"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/user/patron/resetMyPassword")
+				if len(reqs) != 1 {
+					t.Fatalf("expected a reset request, got %d", len(reqs))
+				}
+				var payload map[string]string
+				json.Unmarshal(reqs[0].body, &payload)
+				if payload["barcode"] != "C000011111" || payload["resetPasswordUrl"] != "https://search.lib.virginia.edu/signin?token=<RESET_PASSWORD_TOKEN>" {
+					t.Errorf("unexpected reset payload %s", reqs[0].body)
+				}
+			}},
+		{name: "unknown patron", method: "POST", path: "/users/forgot_password", body: `{"userBarcode": "C999999999"}`,
+			status: http.StatusNotFound, contains: []string{"Could not find a(n) /user/patron record."}},
+	})
+}
+
+func TestResetPassword(t *testing.T) {
+	h := newTestHarness(t)
+	h.run(t, []routeTest{
+		{name: "invalid request", method: "POST", path: "/users/reset_password", body: `{"token": `, status: http.StatusBadRequest},
+		{name: "reset with token", method: "POST", path: "/users/reset_password", body: `{"token": "reset-token", "newPassword": "n3w-pin"}`,
+			status: http.StatusOK, contains: []string{"password changed"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/user/patron/changeMyPassword")
+				if len(reqs) != 1 || reqs[0].header.Get("x-sirs-sessionToken") != "" ||
+					strings.Contains(string(reqs[0].body), `"resetPasswordToken":"reset-token"`) == false {
+					t.Errorf("expected a password change with the reset token")
+				}
+			}},
+		{name: "reset with session", method: "POST", path: "/users/reset_password",
+			body:   `{"token": "reset-token", "session": "fixture-reset", "newPassword": "n3w-pin"}`,
+			status: http.StatusOK, contains: []string{"password changed"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/user/patron/changeMyPassword")
+				if len(reqs) != 1 || reqs[0].header.Get("x-sirs-sessionToken") != "fixture-reset" ||
+					strings.Contains(string(reqs[0].body), "resetPasswordToken") {
+					t.Errorf("expected a password change with the session from the failed attempt")
+				}
+			}},
+		{name: "new password rejected", method: "POST", path: "/users/reset_password", body: `{"token": "reset-token", "newPassword": ""}`,
+			status: http.StatusBadRequest, contains: []string{`"errorMessage":"The new PIN is invalid."`, `"sessionToken":"fixture-reset"`}},
+		{name: "expired token", method: "POST", path: "/users/reset_password", body: `{"newPassword": "n3w-pin"}`,
+			status: http.StatusUnauthorized, contains: []string{"The session has timed out."}},
+	})
+}
+
+func TestRegisterUser(t *testing.T) {
+	h := newTestHarness(t)
+	register := `{"firstName": "Tom", "lastName": "Servo", "password": "s3rvo", "email": "servo@example.com", "phone": "434-555-1212",
+		"address1": "1 Satellite Way", "city": "Charlottesville", "state": "VA", "zip": "22904"}`
+
+	h.run(t, []routeTest{
+		{name: "missing client credentials", method: "POST", path: "/users/register", body: register, status: http.StatusUnauthorized},
+		{name: "invalid request", method: "POST", path: "/users/register", body: `{"firstName": `, headers: clientAuth("virgo"),
+			status: http.StatusBadRequest},
+		{name: "missing fields", method: "POST", path: "/users/register", body: `{"firstName": "Tom"}`, headers: clientAuth("virgo"),
+			status: http.StatusBadRequest, contains: []string{"last name is reqired", "zip is reqired"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/user/patron/register")) != 0 {
+					t.Errorf("expected no registration")
+				}
+			}},
+		{name: "registered", method: "POST", path: "/users/register", body: register, headers: clientAuth("virgo"),
+			status: http.StatusOK, contains: []string{"registration success"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/user/patron/register")
+				if len(reqs) != 1 {
+					t.Fatalf("expected a registration, got %d", len(reqs))
+				}
+				var reg sirsiRegistration
+				json.Unmarshal(reqs[0].body, &reg)
+				if reg.LastName != "Servo" || reg.AddressLine3 != "Charlottesville, VA" || reg.PreferredAddress != "3" ||
+					reg.ActivationURL != "https://search.lib.virginia.edu/api/activateTempAccount/" {
+					t.Errorf("unexpected registration payload %s", reqs[0].body)
+				}
+				updates := h.sirsi.received("PUT", "/user/patron/key/800001")
+				if len(updates) != 1 {
+					t.Fatalf("expected an update of the new patron, got %d", len(updates))
+				}
+				var update map[string]string
+				json.Unmarshal(updates[0].body, &update)
+				if update["alternateID"] != "TEMP800001" || update["keepCircHistory"] != "CIRCRULE" {
+					t.Errorf("expected the temp barcode to be set, got %v", update)
+				}
+			}},
+		{name: "sirsi message list", method: "POST", path: "/users/register", body: register, headers: clientAuth("virgo"),
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/patron/register",
+					sirsiMessageResponse(http.StatusBadRequest, "duplicateEmail", "The email address is already registered."))
+			},
+			status: http.StatusBadRequest, contains: []string{"The email address is already registered."},
+			excludes: []string{"messageList"}},
+		{name: "sirsi system error", method: "POST", path: "/users/register", body: register, headers: clientAuth("virgo"),
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/patron/register", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+			},
+			status: http.StatusInternalServerError, contains: []string{"sirsi is down"}},
+	})
+}
+
+func TestActivateUser(t *testing.T) {
+	h := newTestHarness(t)
+	h.run(t, []routeTest{
+		{name: "activated", method: "GET", path: "/users/activate/act-token", status: http.StatusOK, contains: []string{"activated"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/user/patron/activate")
+				if len(reqs) != 1 || strings.Contains(string(reqs[0].body), `"activationToken":"act-token"`) == false {
+					t.Errorf("expected an activation with the token")
+				}
+			}},
+		{name: "not activated", method: "GET", path: "/users/activate/act-token",
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/patron/activate", fakeResponse{status: http.StatusOK, body: `{"success": false}`})
+			},
+			status: http.StatusUnprocessableEntity, contains: []string{"failed"}},
+		{name: "sirsi error", method: "GET", path: "/users/activate/act-token",
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/patron/activate",
+					sirsiMessageResponse(http.StatusNotFound, "tokenNotFound", "The activation token was not found."))
+			},
+			status: http.StatusNotFound, contains: []string{"The activation token was not found."}},
+	})
+}
+
+func TestStaffLogin(t *testing.T) {
+	h := newTestHarness(t)
+	h.run(t, []routeTest{
+		{name: "invalid request", method: "POST", path: "/users/sirsi_staff_login", body: `{"username": `, status: http.StatusBadRequest},
+		{name: "logged in", method: "POST", path: "/users/sirsi_staff_login", body: `{"username": "leo", "password": "secret"}`,
+			status: http.StatusOK, contains: []string{`"sessionToken":"fixture-staff-leo-`}},
+		{name: "invalid password", method: "POST", path: "/users/sirsi_staff_login", body: `{"username": "leo", "password": ""}`,
+			status: http.StatusUnauthorized, contains: []string{"invalid username or password"}},
+		{name: "sirsi system error", method: "POST", path: "/users/sirsi_staff_login", body: `{"username": "leo", "password": "secret"}`,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/staff/login", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+			},
+			status: http.StatusServiceUnavailable, contains: []string{"sirsi is down"}},
+	})
+}
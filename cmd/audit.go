@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// auditEvent is an access decision on protected data that should be kept for review
+type auditEvent struct {
+	Action   string // the kind of data requested, like patron_data
+	Route    string
+	Target   string // the patron whose data was requested
+	Caller   string // the user ID from the virgo jwt, if there was a valid one
+	Role     string
+	ClientIP string
+	Allowed  bool
+	Reason   string
+}
+
+// auditHook receives audit events for the request being handled with ctx
+type auditHook func(ctx context.Context, evt auditEvent)
+
+// logAuditEvent is the default audit hook; events are written to the service log with audit=true so they can be filtered
+func logAuditEvent(ctx context.Context, evt auditEvent) {
+	level := slog.LevelWarn
+	msg := "access denied"
+	if evt.Allowed {
+		level = slog.LevelInfo
+		msg = "access granted"
+	}
+	slog.Log(ctx, level, msg, "audit", true, "action", evt.Action, "route", evt.Route, "target", evt.Target,
+		"caller", evt.Caller, "role", evt.Role, "client_ip", evt.ClientIP, "reason", evt.Reason)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// noticeAutoRenew is the kind of the auto-renew summary notice. Patrons opt in to auto-renew, so the summary
+// is always sent to them and is not listed with the notices that can be turned off.
+const noticeAutoRenew = "auto_renew"
+
+// autoRenewRun is the outcome of the last auto-renew of a patron's checkouts
+type autoRenewRun struct {
+	Time    time.Time          `json:"time"`
+	Results []renewResponseRec `json:"results"`
+}
+
+// autoRenewItem is a renewed or failed checkout in the auto-renew summary email
+type autoRenewItem struct {
+	Title      string `json:"title"`
+	CallNumber string `json:"callNumber"`
+	Barcode    string `json:"barcode"`
+	DueDate    string `json:"dueDate"`
+	Message    string `json:"message"`
+}
+
+type autoRenewSummary struct {
+	Renewed []autoRenewItem `json:"renewed"`
+	Failed  []autoRenewItem `json:"failed"`
+}
+
+// autoRenewDue is an auto-renew summary that could not be emailed; it is sent with the results of the next run
+type autoRenewDue struct {
+	Keys    []string         `json:"keys"`
+	Summary autoRenewSummary `json:"summary"`
+}
+
+func (ns *noticeStore) setAutoRenew(computeID string, enabled bool) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if enabled {
+		ns.state.AutoRenew[computeID] = true
+	} else {
+		delete(ns.state.AutoRenew, computeID)
+	}
+}
+
+func (ns *noticeStore) autoRenewEnabled(computeID string) bool {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	return ns.state.AutoRenew[computeID]
+}
+
+// autoRenewPatrons returns the patrons that have turned on auto-renew, in order
+func (ns *noticeStore) autoRenewPatrons() []string {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	out := make([]string, 0, len(ns.state.AutoRenew))
+	for id := range ns.state.AutoRenew {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (ns *noticeStore) lastAutoRenew(computeID string) *autoRenewRun {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if run, ok := ns.state.AutoRenewals[computeID]; ok {
+		return &run
+	}
+	return nil
+}
+
+func (ns *noticeStore) setLastAutoRenew(computeID string, run autoRenewRun) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.state.AutoRenewals[computeID] = run
+}
+
+// autoRenewUnsent returns the auto-renew results of a patron that have not been emailed yet, if any
+func (ns *noticeStore) autoRenewUnsent(computeID string) *autoRenewDue {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if due, ok := ns.state.AutoRenewDue[computeID]; ok {
+		return &due
+	}
+	return nil
+}
+
+// setAutoRenewUnsent keeps auto-renew results to email later; nil clears them once they are sent
+func (ns *noticeStore) setAutoRenewUnsent(computeID string, due *autoRenewDue) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if due == nil {
+		delete(ns.state.AutoRenewDue, computeID)
+	} else {
+		ns.state.AutoRenewDue[computeID] = *due
+	}
+}
+
+// autoRenewCandidates returns the checkouts due within days that are renewable and have not already been tried
+// for their current due date
+func (svc *serviceContext) autoRenewCandidates(checkouts []checkoutDetails, days int, now time.Time) []checkoutDetails {
+	out := make([]checkoutDetails, 0)
+	for _, co := range checkouts {
+		due, err := time.Parse(time.RFC3339, co.Due)
+		if err != nil || now.After(due) || due.Sub(now) > time.Duration(days)*24*time.Hour {
+			continue
+		}
+		if co.renewable() == false || svc.Notices.wasSent(autoRenewKey(co)) {
+			continue
+		}
+		out = append(out, co)
+	}
+	return out
+}
+
+// autoRenewKey records that a checkout was tried, so a failed renewal is not tried again until the due date changes
+func autoRenewKey(co checkoutDetails) string {
+	return fmt.Sprintf("renew:%s:%s", co.Barcode, co.Due)
+}
+
+// autoRenew renews the checkouts of patrons that have turned on auto-renew when they are due within the
+// configured days, and emails each patron a summary. At most MaxItems renewals are attempted in a run, with
+// a pause between each, so a run does not flood sirsi; patrons not reached are handled in the next run.
+func (svc *serviceContext) autoRenew(ctx context.Context, cfg autoRenewConfig) {
+	patrons := svc.Notices.autoRenewPatrons()
+	logf(ctx, "INFO: auto-renew checkouts for %d patrons", len(patrons))
+	if len(patrons) == 0 {
+		return
+	}
+	if err := svc.SirsiSession.ensureSession(); err != nil {
+		logf(ctx, "ERROR: unable to auto-renew: %s", err.string())
+		return
+	}
+	now := time.Now()
+	attempted := 0
+	for _, computeID := range patrons {
+		if ctx.Err() != nil {
+			logf(ctx, "WARNING: auto-renew stopped: %s", ctx.Err().Error())
+			break
+		}
+		if cfg.MaxItems > 0 && attempted >= cfg.MaxItems {
+			logf(ctx, "WARNING: auto-renew limit of %d renewals reached; remaining patrons wait for the next run", cfg.MaxItems)
+			break
+		}
+		checkouts, err := svc.getSirsiUserCheckouts(ctx, computeID)
+		if err != nil {
+			logf(ctx, "ERROR: unable to get %s checkouts for auto-renew: %s", computeID, err.string())
+			continue
+		}
+		candidates := svc.autoRenewCandidates(checkouts, cfg.Days, now)
+		unsent := svc.Notices.autoRenewUnsent(computeID)
+		if len(candidates) == 0 && unsent == nil {
+			continue
+		}
+
+		run := autoRenewRun{Time: now, Results: make([]renewResponseRec, 0)}
+		var due autoRenewDue
+		if unsent != nil {
+			logf(ctx, "INFO: %s has auto-renew results from an earlier run that were not emailed", computeID)
+			due = *unsent
+		}
+		renewed := 0
+		for _, co := range candidates {
+			if (cfg.MaxItems > 0 && attempted >= cfg.MaxItems) || ctx.Err() != nil {
+				break
+			}
+			if attempted > 0 && cfg.Pause > 0 {
+				select {
+				case <-time.After(time.Duration(cfg.Pause) * time.Millisecond):
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
+			attempted++
+			result := svc.issueReneqRequest(ctx, co.Barcode)
+			svc.Notices.markSent(autoRenewKey(co))
+			due.Keys = append(due.Keys, fmt.Sprintf("auto_renew:%s:%s", co.Barcode, co.Due))
+			run.Results = append(run.Results, result)
+			item := autoRenewItem{Title: co.Title, CallNumber: co.CallNumber, Barcode: co.Barcode, DueDate: co.Due, Message: result.Message}
+			if result.Success {
+				renewed++
+				item.DueDate = result.DueDate
+				due.Summary.Renewed = append(due.Summary.Renewed, item)
+			} else {
+				due.Summary.Failed = append(due.Summary.Failed, item)
+			}
+		}
+		if len(run.Results) > 0 {
+			logf(ctx, "INFO: auto-renewed %d of %d checkouts for %s", renewed, len(run.Results), computeID)
+			svc.Notices.setLastAutoRenew(computeID, run)
+		}
+
+		// the results are kept until the summary is sent so a failed email is tried again in the next run
+		summary := due.Summary
+		n := notice{ComputeID: computeID, Kind: noticeAutoRenew, Keys: due.Keys, Template: "auto_renew", Data: summary,
+			Subject: fmt.Sprintf("Library items renewed: %d renewed, %d not renewed", len(summary.Renewed), len(summary.Failed))}
+		if _, err := svc.sendNotice(ctx, n); err != nil {
+			logf(ctx, "ERROR: unable to send auto-renew summary to %s; it will be sent with the next run: %s", computeID, err.Error())
+			svc.Notices.setAutoRenewUnsent(computeID, &due)
+		} else {
+			svc.Notices.setAutoRenewUnsent(computeID, nil)
+		}
+	}
+
+	if err := svc.Notices.save(); err != nil {
+		logf(ctx, "ERROR: unable to save notice state: %s", err.Error())
+	}
+	logf(ctx, "INFO: auto-renew done; %d renewals attempted", attempted)
+}
+
+// runAutoRenew auto-renews checkouts every interval until the service exits
+func (svc *serviceContext) runAutoRenew(cfg autoRenewConfig) {
+	interval := time.Duration(cfg.Interval) * time.Hour
+	log.Printf("INFO: auto-renew checkouts due within %d days every %s", cfg.Days, interval)
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(withRequestID(context.Background(), newRequestID()), interval)
+		svc.autoRenew(ctx, cfg)
+		cancel()
+	}
+}
+
+// GET /users/:compute_id/auto_renew : whether auto-renew is on for a patron, and the results of the last run
+func (svc *serviceContext) getAutoRenew(c *gin.Context) {
+	computeID := c.Param("compute_id")
+	out := struct {
+		Enabled bool          `json:"enabled"`
+		LastRun *autoRenewRun `json:"lastRun"`
+	}{Enabled: svc.Notices.autoRenewEnabled(computeID), LastRun: svc.Notices.lastAutoRenew(computeID)}
+	c.JSON(http.StatusOK, out)
+}
+
+// PUT /users/:compute_id/auto_renew : turn auto-renew on or off for a patron with {"enabled": true}
+func (svc *serviceContext) updateAutoRenew(c *gin.Context) {
+	computeID := c.Param("compute_id")
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		logf(c.Request.Context(), "ERROR: invalid auto-renew request for %s", computeID)
+		c.String(http.StatusBadRequest, "enabled is required")
+		return
+	}
+	logf(c.Request.Context(), "INFO: %s sets auto-renew to %t", computeID, *req.Enabled)
+	svc.Notices.setAutoRenew(computeID, *req.Enabled)
+	if err := svc.Notices.save(); err != nil {
+		logf(c.Request.Context(), "ERROR: unable to save auto-renew setting: %s", err.Error())
+		c.String(http.StatusInternalServerError, "unable to save auto-renew setting")
+		return
+	}
+	svc.getAutoRenew(c)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateCheckouts changes the checkouts of a patron response with update, which is called with each circ record
+func updateCheckouts(t *testing.T, resp fakeResponse, update func(i int, rec map[string]any)) fakeResponse {
+	t.Helper()
+	var patron map[string]any
+	if err := json.Unmarshal([]byte(resp.body), &patron); err != nil {
+		t.Fatalf("unable to parse patron: %s", err.Error())
+	}
+	for i, rec := range patron["fields"].(map[string]any)["circRecordList"].([]any) {
+		update(i, rec.(map[string]any)["fields"].(map[string]any))
+	}
+	out, _ := json.Marshal(patron)
+	return fakeResponse{status: http.StatusOK, body: string(out)}
+}
+
+func TestAutoRenew(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	soon := time.Now().Add(24 * time.Hour)
+	checkouts := updateCheckouts(t, mst3kWithCheckouts(t, soon, soon, soon.Add(9*24*time.Hour), soon, soon),
+		func(i int, rec map[string]any) {
+			switch i {
+			case 3:
+				rec["recallDueDate"] = "2024-03-05"
+			case 4:
+				item := rec["item"].(map[string]any)["fields"].(map[string]any)
+				item["holdRecordList"] = []any{map[string]any{"fields": map[string]any{"status": "PLACED"}}}
+			}
+		})
+	cfg := autoRenewConfig{Days: 2, MaxItems: 10}
+	run := func(t *testing.T, resp fakeResponse, renewals ...fakeResponse) []smtpMessage {
+		t.Helper()
+		h.sirsi.reset()
+		h.smtp.reset()
+		h.sirsi.override("GET", "/user/patron/alternateID/mst3k", resp, resp)
+		h.sirsi.override("POST", "/circulation/circRecord/renew", renewals...)
+		h.svc.autoRenew(context.Background(), cfg)
+		return h.smtp.sent()
+	}
+
+	h.run(t, []routeTest{
+		{name: "off by default", method: "GET", path: "/users/mst3k/auto_renew", headers: auth,
+			status: http.StatusOK, contains: []string{`"enabled":false`, `"lastRun":null`}},
+		{name: "requires enabled", method: "PUT", path: "/users/mst3k/auto_renew", body: `{}`, headers: auth,
+			status: http.StatusBadRequest},
+		{name: "requires the patron", method: "PUT", path: "/users/abc9z/auto_renew", body: `{"enabled": true}`, headers: auth,
+			status: http.StatusForbidden},
+		{name: "clients can read it", method: "GET", path: "/users/mst3k/auto_renew", headers: map[string]string{apiKeyHeader: "virgo-key"},
+			status: http.StatusOK},
+		{name: "clients cannot change it", method: "PUT", path: "/users/mst3k/auto_renew", body: `{"enabled": true}`,
+			headers: map[string]string{apiKeyHeader: "virgo-key", "Authorization": auth["Authorization"]}, status: http.StatusForbidden,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.Notices.autoRenewEnabled("mst3k") {
+					t.Errorf("expected auto-renew to be unchanged")
+				}
+			}},
+		{name: "turn on", method: "PUT", path: "/users/mst3k/auto_renew", body: `{"enabled": true}`, headers: auth,
+			status: http.StatusOK, contains: []string{`"enabled":true`}},
+	})
+
+	t.Run("renews eligible checkouts", func(t *testing.T) {
+		sent := run(t, checkouts, fakeResponse{}, sirsiMessageResponse(http.StatusBadRequest, "renewLimitReached", "Renewal limit reached."))
+		renewed := h.sirsi.received("POST", "/circulation/circRecord/renew")
+		if len(renewed) != 2 {
+			t.Fatalf("expected 2 renewals, got %d", len(renewed))
+		}
+		if len(sent) != 1 {
+			t.Fatalf("expected a summary email, got %d", len(sent))
+		}
+		for _, want := range []string{"RENEWED", "NOT RENEWED", "Renewal limit reached."} {
+			if strings.Contains(sent[0].Data, want) == false {
+				t.Errorf("summary does not contain %s", want)
+			}
+		}
+	})
+	h.run(t, []routeTest{
+		{name: "results are recorded", method: "GET", path: "/users/mst3k/auto_renew", headers: auth, status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var out struct {
+					LastRun autoRenewRun `json:"lastRun"`
+				}
+				json.Unmarshal(resp.Body.Bytes(), &out)
+				if len(out.LastRun.Results) != 2 || out.LastRun.Results[0].Success == false || out.LastRun.Results[1].Success ||
+					out.LastRun.Results[1].Message != "Renewal limit reached." {
+					t.Errorf("unexpected results %+v", out.LastRun.Results)
+				}
+			}},
+	})
+	t.Run("checkouts are only tried once for a due date", func(t *testing.T) {
+		if sent := run(t, checkouts); len(sent) != 0 || len(h.sirsi.received("POST", "/circulation/circRecord/renew")) != 0 {
+			t.Errorf("expected no renewals or email")
+		}
+	})
+	t.Run("run limit", func(t *testing.T) {
+		cfg.MaxItems = 1
+		defer func() { cfg.MaxItems = 10 }()
+		later := soon.Add(time.Hour)
+		run(t, mst3kWithCheckouts(t, later, later))
+		if renewed := h.sirsi.received("POST", "/circulation/circRecord/renew"); len(renewed) != 1 {
+			t.Errorf("expected 1 renewal, got %d", len(renewed))
+		}
+	})
+	t.Run("failed summary is sent with the next run", func(t *testing.T) {
+		port := h.svc.SMTP.Port
+		h.svc.SMTP.Port = 1
+		later := soon.Add(3 * time.Hour)
+		sent := run(t, mst3kWithCheckouts(t, later))
+		h.svc.SMTP.Port = port
+		if len(sent) != 0 || len(h.sirsi.received("POST", "/circulation/circRecord/renew")) != 1 {
+			t.Fatalf("expected a renewal and no email")
+		}
+		if unsent := h.svc.Notices.autoRenewUnsent("mst3k"); unsent == nil || len(unsent.Summary.Renewed) != 1 {
+			t.Fatalf("expected the results to be kept, got %+v", unsent)
+		}
+
+		sent = run(t, mst3kWithCheckouts(t, later))
+		if len(h.sirsi.received("POST", "/circulation/circRecord/renew")) != 0 {
+			t.Errorf("expected no renewals")
+		}
+		if len(sent) != 1 || strings.Contains(sent[0].Data, "RENEWED") == false {
+			t.Fatalf("expected the summary to be sent, got %d emails", len(sent))
+		}
+		if h.svc.Notices.autoRenewUnsent("mst3k") != nil {
+			t.Errorf("expected the results to be cleared once sent")
+		}
+	})
+	t.Run("pause stops when cancelled", func(t *testing.T) {
+		h.sirsi.reset()
+		later := soon.Add(4 * time.Hour)
+		h.sirsi.override("GET", "/user/patron/alternateID/mst3k", mst3kWithCheckouts(t, later, later))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		h.svc.autoRenew(ctx, autoRenewConfig{Days: 2, MaxItems: 10, Pause: 60000})
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the run to stop when cancelled, took %s", elapsed)
+		}
+		if renewed := h.sirsi.received("POST", "/circulation/circRecord/renew"); len(renewed) != 1 {
+			t.Errorf("expected 1 renewal, got %d", len(renewed))
+		}
+	})
+	t.Run("turned off", func(t *testing.T) {
+		h.svc.Notices.setAutoRenew("mst3k", false)
+		later := soon.Add(2 * time.Hour)
+		run(t, mst3kWithCheckouts(t, later))
+		if renewed := h.sirsi.received("POST", "/circulation/circRecord/renew"); len(renewed) != 0 {
+			t.Errorf("expected no renewals, got %d", len(renewed))
+		}
+	})
+}
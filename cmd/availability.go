@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -99,6 +101,7 @@ type availItem struct {
 	IsVideo           bool
 	MicroformURL      string
 	Volume            string
+	CallKey           string
 	SCLocation        string
 }
 
@@ -127,15 +130,21 @@ func (ai *availItem) toHoldableItem(notes string) holdableItem {
 		// aeon request URL
 		loc = "SC-Ivy"
 	}
-	return holdableItem{
+	out := holdableItem{
 		Barcode:    ai.Barcode,
 		CallNumber: cn,
 		Location:   loc,
 		Library:    ai.Library,
 		SCNotes:    notes,
 		Notice:     ai.Notice,
+		Volume:     ai.Volume,
 		Requests:   make([]string, 0),
 	}
+	if ai.Volume != "" {
+		// volumes can be requested with a volume hold on the call
+		out.CallKey = ai.CallKey
+	}
+	return out
 }
 
 type boundWithRec struct {
@@ -172,128 +181,119 @@ type libraryItems struct {
 
 // u2419229
 func (svc *serviceContext) getAvailability(c *gin.Context) {
+	ctx := c.Request.Context()
 	catKey := c.Param("cat_key")
+	data, reqErr := svc.getAvailabilityData(ctx, catKey)
+	if reqErr != nil {
+		c.String(reqErr.StatusCode, reqErr.Message)
+		return
+	}
+	availResp := svc.buildAvailabilityResponse(patronFromClaims(c), data, nil)
+	if availResp.RequestOptions.hasOptions() == false {
+		logf(ctx, "INFO: %s has no request options", catKey)
+		availResp.RequestOptions = nil
+	}
 
+	c.JSON(http.StatusOK, availResp)
+}
+
+// buildAvailabilityResponse generates the availability response for a patron from shared availability data.
+// The reasons for each request option are recorded in the trace when it is not nil.
+func (svc *serviceContext) buildAvailabilityResponse(patron optionPatron, data *availabilityData, trace *optionTrace) *availabilityResponse {
 	availResp := availabilityResponse{
-		TitleID:        catKey,
+		TitleID:        data.TitleID,
 		Libraries:      make([]*libraryItems, 0),
-		BoundWith:      make([]boundWithParent, 0),
+		BoundWith:      data.BoundWith,
 		RequestOptions: createRequestOptions(),
 	}
 
-	items := make([]availItem, 0)
-	matched, _ := regexp.MatchString(`^u\d*$`, catKey)
-	if !matched {
-		log.Printf("INFO: key %s not in sirsi", catKey)
+	// data is shared by all requests for this title; work with a copy of the items
+	items := slices.Clone(data.Items)
+	if data.InSirsi {
+		svc.addLibraryItems(&availResp, items)
+		svc.addSirsiRequestOptions(patron, &availResp, items, trace)
 	} else {
-		log.Printf("INFO: get availability for %s", catKey)
-		notFound := false
-		bibResp, sirsiErr := svc.getSirsiItem(catKey)
-		if sirsiErr != nil {
-			log.Printf("ERROR: get sirsi item %s failed: %s", catKey, sirsiErr.string())
-			if sirsiErr.StatusCode != 404 {
-				c.String(sirsiErr.StatusCode, sirsiErr.Message)
-				return
-			}
-			log.Printf("WARN: %s was not found in sirsi", catKey)
-			notFound = true
-		}
-
-		if notFound == false {
-			availResp.TitleID = bibResp.Key
+		trace.decide("sirsi", false, "%s is not a sirsi title; no scan or hold options", data.TitleID)
+	}
 
-			// parse sirsi data into an easier to manage format
-			items = svc.parseItemsFromSirsi(catKey, bibResp)
-			svc.addLibraryItems(&availResp, items)
-			svc.addBoundWithItems(&availResp, bibResp)
-			svc.addSirsiRequestOptions(c, &availResp, items)
-		}
+	// Now use the solr doc for this item to add and extra options for special collections, streaming video and health science
+	solrDoc := data.SolrDoc
+	if solrDoc == nil {
+		trace.decide("solr", false, "no solr document; no aeon, hsl scan or streaming options")
+		return &availResp
+	}
+	log.Printf("INFO: update reserve options based on solr doc")
+	if len(data.SCItems) > 0 {
+		// every aeon item is uniquely able to be requested and will have its own request URL
+		svc.addLibraryItems(&availResp, data.SCItems)
+		items = append(items, data.SCItems...)
 	}
+	svc.addAeonRequestOptions(&availResp, solrDoc, items, trace)
 
-	// Now pull the solr doc for this item and use it to add and extra options for special collections, streaming video and health science
-	solrDoc, solrErr := svc.getSolrDoc(catKey)
-	if solrErr != nil {
-		log.Printf("ERROR: %s", solrErr.Error())
+	if patron.HomeLibrary == "HEALTHSCI" {
+		// scans will be blocked for HEALTHSCI users in addSirsiRequestOptions.
+		// Add the directLink for thoose users here
+		trace.decide("hslScan", true, "home library is HEALTHSCI")
+		svc.addHSLScanOption(solrDoc, &availResp)
 	} else {
-		log.Printf("INFO: update reserve options based on solr doc")
-		scItems := svc.extractSpecialCollectionsItems(&availResp, solrDoc)
-		if len(scItems) > 0 {
-			// every aeon item is uniquely able to be requested and will have its own request URL
-			svc.addLibraryItems(&availResp, scItems)
-			items = append(items, scItems...)
+		trace.decide("hslScan", false, "home library %s is not HEALTHSCI", patron.HomeLibrary)
+	}
+	if patron.CanPlaceReserve {
+		svc.addStreamingVideoOption(solrDoc, &availResp, trace)
+	} else {
+		trace.decide("streaming", false, "patron cannot place reserves")
+	}
+	return &availResp
+}
+
+// getMicroformURL returns the microform record of a title. It is set by tag 856 subfield u with a value like
+// "https://search.lib.virginia.edu/sources/uva_library/items/u123" that links to another catalog record.
+// The microform request option is only offered when the microform feature is enabled.
+func getMicroformURL(catKey string, bibResp *sirsiBibResponse) string {
+	for _, field := range bibResp.Fields.Bib.Fields {
+		if field.Tag != "856" {
+			continue
 		}
-		svc.addAeonRequestOptions(&availResp, solrDoc, items)
-
-		claims, err := getVirgoClaims(c)
-		if err != nil {
-			log.Printf("ERROR: unable to get claims: %s", err.Error())
-		} else {
-			if claims.HomeLibrary == "HEALTHSCI" {
-				// scans will be blocked for HEALTHSCI users in addSirsiRequestOptions.
-				// Add the directLink for thoose users here
-				svc.addHSLScanOption(solrDoc, &availResp)
+		for _, subF := range field.Subfields {
+			if subF.Code != "u" || strings.Contains(subF.Data, "/sources/uva_library/items/u") == false {
+				continue
 			}
-			if claims.CanPlaceReserve {
-				svc.addStreamingVideoOption(solrDoc, &availResp)
+			pathBits := strings.Split(subF.Data, "/")
+			identifier := pathBits[len(pathBits)-1]
+			if identifier != catKey {
+				log.Printf("INFO: %s contains tag 856u with a value indicating it is a microform", catKey)
+				return subF.Data
 			}
+			log.Printf("INFO: %s contains tag 856u with a value matching currrent cat key; do not use for microform request", catKey)
 		}
 	}
+	return ""
+}
 
-	if availResp.RequestOptions.hasOptions() == false {
-		log.Printf("INFO: %s has no request options", catKey)
-		availResp.RequestOptions = nil
-	}
-
-	c.JSON(http.StatusOK, availResp)
+// isSirsiKey returns true for cat keys that are found in sirsi; those in the form u2419229
+func (svc *serviceContext) isSirsiKey(catKey string) bool {
+	matched, _ := regexp.MatchString(`^u\d*$`, catKey)
+	return matched
 }
 
-func (svc *serviceContext) parseItemsFromSirsi(catKey string, bibResp *sirsiBibResponse) []availItem {
-	log.Printf("INFO: process items for %s", catKey)
+func (svc *serviceContext) parseItemsFromSirsi(ctx context.Context, catKey string, bibResp *sirsiBibResponse) []availItem {
+	logf(ctx, "INFO: process items for %s", catKey)
 	out := make([]availItem, 0)
 
-	// microform flag is set if tag 856 subfield u is set with a value like:
-	// "https://search.lib.virginia.edu/sources/uva_library/item/u"
-	microformURL := ""
-
-	// TODO REMOVE THIS COMMENTED BLOCK TO ENABLE MICROFORM
-	// DISABLE MICROFORM LOGIC. WITHOUT THIS, THERE WILL BE NO NEW OPTIONS IN CLIENT UI
-	//
-	// for _, field := range bibResp.Fields.Bib.Fields {
-	// 	if field.Tag == "856" {
-	// 		for _, subF := range field.Subfields {
-	// 			if subF.Code == "u" {
-	// 				if strings.Contains(subF.Data, "/sources/uva_library/items/u") {
-	// 					pathBits := strings.Split(subF.Data, "/")
-	// 					identifier := pathBits[len(pathBits)-1]
-	// 					if identifier != catKey {
-	// 						microformURL = subF.Data
-	// 						log.Printf("INFO: %s contains tag 856u with a value indicating it is a microform", catKey)
-	// 						break
-	// 					} else {
-	// 						log.Printf("INFO: %s contains tag 856u with a value matching currrent cat key; do not use for microform request", catKey)
-	// 					}
-	// 				}
-	// 			}
-	// 		}
-	// 	}
-	// 	if microformURL != "" {
-	// 		break
-	// 	}
-	// }
-
+	microformURL := getMicroformURL(catKey, bibResp)
 	for _, callRec := range bibResp.Fields.CallList {
 		if callRec.Fields.Shadowed {
-			log.Printf("INFO: callRec key %s is shadowed; not adding to availability list", callRec.Key)
+			logf(ctx, "INFO: callRec key %s is shadowed; not adding to availability list", callRec.Key)
 			continue
 		}
 		for _, itemRec := range callRec.Fields.ItemList {
 			if itemRec.Fields.Shadowed {
-				log.Printf("INFO: itemRec key %s is shadowed; not adding to availability list", itemRec.Key)
+				logf(ctx, "INFO: itemRec key %s is shadowed; not adding to availability list", itemRec.Key)
 				continue
 			}
 			currLoc := svc.Locations.find(itemRec.Fields.CurrentLocation.Key)
 			if currLoc.Shadowed || currLoc.Online {
-				log.Printf("INFO: location %s is shadowed; not adding to availability list", currLoc.Key)
+				logf(ctx, "INFO: location %s is shadowed; not adding to availability list", currLoc.Key)
 				continue
 			}
 
@@ -308,26 +308,26 @@ func (svc *serviceContext) parseItemsFromSirsi(catKey string, bibResp *sirsiBibR
 
 			item.Barcode = itemRec.Fields.Barcode
 			item.Volume = callRec.Fields.Volumetric
+			item.CallKey = callRec.Key
 			item.LibraryID = callRec.Fields.Library.Key
 			item.Library = callRec.Fields.Library.Fields.Description
 			item.CurrentLocationID = itemRec.Fields.CurrentLocation.Key
 			item.CurrentLocation = itemRec.Fields.CurrentLocation.Fields.Description
 			item.HomeLocationID = itemRec.Fields.HomeLocation.Key
-			item.Notice = svc.getItemNotice(item)
-			item.IsVideo = isVideo(itemRec.Fields.ItemType.Key)
-			item.Unavailable = svc.Locations.isUnavailable(item.CurrentLocationID)
+			item.Notice = svc.getItemNotice(ctx, item)
+			item.IsVideo = svc.Rules.isVideo(itemRec.Fields.ItemType.Key)
+			item.Unavailable = svc.Rules.isUnavailable(item.CurrentLocationID)
 			out = append(out, item)
 		}
 	}
 	return out
 }
 
-func (svc *serviceContext) extractSpecialCollectionsItems(result *availabilityResponse, solrDoc *solrDocument) []availItem {
+func (svc *serviceContext) extractSpecialCollectionsItems(solrDoc *solrDocument) []availItem {
 	out := make([]availItem, 0)
 	if solrDoc.SCAvailability == "" {
 		return out
 	}
-	result.TitleID = solrDoc.ID
 
 	type solrItem struct {
 		Library         string `json:"library"`
@@ -406,12 +406,8 @@ func openURLQuery(baseURL string, doc *solrDocument) string {
 	return fmt.Sprintf("%s/illiad.dll?%s", baseURL, query.Encode())
 }
 
-func (svc *serviceContext) getSirsiItem(catKey string) (*sirsiBibResponse, *requestError) {
-	cleanKey := cleanCatKey(catKey)
-	fields := "boundWithList{*},bib{*},callList{dispCallNumber,volumetric,shadowed,library{description},"
-	fields += "itemList{barcode,copyNumber,shadowed,itemType{key},homeLocation{key},currentLocation{key,description,shadowed}}}"
-	url := fmt.Sprintf("/catalog/bib/key/%s?includeFields=%s", cleanKey, fields)
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.SlowHTTPClient, url)
+func (svc *serviceContext) getSirsiItem(ctx context.Context, catKey string) (*sirsiBibResponse, *requestError) {
+	sirsiRaw, sirsiErr := svc.ILS.getBib(ctx, catKey)
 	if sirsiErr != nil {
 		return nil, sirsiErr
 	}
@@ -427,7 +423,33 @@ func (svc *serviceContext) getSirsiItem(catKey string) (*sirsiBibResponse, *requ
 	return &bibResp, nil
 }
 
-func (svc *serviceContext) addBoundWithItems(resp *availabilityResponse, bibResp *sirsiBibResponse) {
+// getSirsiItems gets the bibs for a list of cat keys with a single sirsi search. The result is keyed
+// by the sirsi bib key; keys that are not in sirsi are omitted
+func (svc *serviceContext) getSirsiItems(ctx context.Context, catKeys []string) (map[string]*sirsiBibResponse, *requestError) {
+	sirsiRaw, sirsiErr := svc.ILS.getBibs(ctx, catKeys)
+	if sirsiErr != nil {
+		return nil, sirsiErr
+	}
+
+	var searchResp struct {
+		TotalResults int                `json:"totalResults"`
+		Result       []sirsiBibResponse `json:"result"`
+	}
+	parseErr := json.Unmarshal(sirsiRaw, &searchResp)
+	if parseErr != nil {
+		re := requestError{
+			StatusCode: http.StatusInternalServerError,
+			Message:    fmt.Sprintf("unable to parse sirsi search response: %s", parseErr.Error())}
+		return nil, &re
+	}
+	out := make(map[string]*sirsiBibResponse)
+	for _, bib := range searchResp.Result {
+		out[bib.Key] = &bib
+	}
+	return out, nil
+}
+
+func (svc *serviceContext) getBoundWithItems(bibResp *sirsiBibResponse) []boundWithParent {
 	// sample: sources/uva_library/items/u3315175
 	log.Printf("INFO: add bound with for %s", bibResp.Key)
 	out := make([]boundWithParent, 0)
@@ -454,21 +476,10 @@ func (svc *serviceContext) addBoundWithItems(resp *availabilityResponse, bibResp
 	}
 
 	log.Printf("INFO: add bound with for %s has completed", bibResp.Key)
-	resp.BoundWith = out
-}
-
-func isVideo(itemTypeID string) bool {
-	videos := []string{"VIDEOJRNL", "VIDEO-DVD", "VIDEO-DISC", "VIDEO-CASS", "RSRV-VID4", "RSRV-VID24"}
-	vid := false
-	for _, val := range videos {
-		if val == itemTypeID {
-			vid = true
-		}
-	}
-	return vid
+	return out
 }
 
-func (svc *serviceContext) getItemNotice(item availItem) string {
+func (svc *serviceContext) getItemNotice(ctx context.Context, item availItem) string {
 	if svc.Locations.isIvyStacks((item.HomeLocationID)) {
 		return `Part or all of this collection is housed in <a href="https://library.virginia.edu/locations/ivy" target="_blank">Ivy Stacks</a> and requires 72 hours notice to retrieve.`
 	}
@@ -476,12 +487,10 @@ func (svc *serviceContext) getItemNotice(item availItem) string {
 		return svc.Locations.mediumRareMessage()
 	}
 
-	if svc.Locations.isCourseReserve((item.CurrentLocationID)) {
-		crURL := fmt.Sprintf("%s/course_reserves?item_id=%s", svc.SirsiConfig.ScriptURL, item.Barcode)
-		req, _ := http.NewRequest("GET", crURL, nil)
-		rawResp, crErr := svc.sendRequest("sirsi", svc.HTTPClient, req)
+	if svc.Locations.isCourseReserve((item.CurrentLocationID)) && ctx.Err() == nil {
+		rawResp, crErr := svc.ILS.getCourseReserveInfo(ctx, item.Barcode)
 		if crErr != nil {
-			log.Printf("ERROR: unable to get course reser info for %s: %s", item.Barcode, crErr.Message)
+			logf(ctx, "ERROR: unable to get course reser info for %s: %s", item.Barcode, crErr.Message)
 			return ""
 		}
 
@@ -493,7 +502,7 @@ func (svc *serviceContext) getItemNotice(item availItem) string {
 		}
 		parsErr := json.Unmarshal(rawResp, &crResponse)
 		if parsErr != nil {
-			log.Printf("ERROR: unable to parse course_reserve response: %s", parsErr.Error())
+			logf(ctx, "ERROR: unable to parse course_reserve response: %s", parsErr.Error())
 			return ""
 		}
 
@@ -518,9 +527,9 @@ func (svc *serviceContext) isNonCirculating(item availItem) bool {
 }
 
 func (svc *serviceContext) getAvailabilityList(c *gin.Context) {
-	log.Printf("INFO: get availability list")
+	logf(c.Request.Context(), "INFO: get availability list")
 	resp := availabilityListResponse{}
-	resp.AvailabilityList.Locations = svc.Locations.Records
-	resp.AvailabilityList.Libraries = svc.Libraries.Records
+	resp.AvailabilityList.Locations = svc.Locations.records()
+	resp.AvailabilityList.Libraries = svc.Libraries.records()
 	c.JSON(http.StatusOK, resp)
 }
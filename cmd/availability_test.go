@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestAvailability(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	hslClaims := mst3kClaims()
+	hslClaims.HomeLibrary = "HEALTHSCI"
+
+	h.run(t, []routeTest{
+		{name: "missing jwt", method: "GET", path: "/availability/u2419229", status: http.StatusUnauthorized},
+		{name: "invalid jwt", method: "GET", path: "/availability/u2419229", status: http.StatusUnauthorized,
+			headers: map[string]string{"Authorization": "Bearer undefined"}},
+		{name: "sirsi and special collections items", method: "GET", path: "/availability/u2419229", headers: auth,
+			status:   http.StatusOK,
+			contains: []string{`"title_id":"2419229"`, `"id":"ALDERMAN"`, `"id":"SPEC-COLL"`, `"barcode":"X000111111"`, `"aeonURL"`},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var avail availabilityResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &avail); err != nil {
+					t.Fatalf("unable to parse response: %s", err.Error())
+				}
+				if avail.RequestOptions == nil {
+					t.Fatalf("expected request options")
+				}
+				opts := make(map[string][]string)
+				for _, item := range avail.RequestOptions.Items {
+					opts[item.Barcode] = append(opts[item.Barcode], item.Requests...)
+				}
+				if len(opts["X000111111"]) != 2 || opts["X000111111"][0] != "scan" || opts["X000111111"][1] != "hold" {
+					t.Errorf("expected scan and hold options for X000111111, got %v", opts["X000111111"])
+				}
+				if len(opts["X000111113"]) != 1 || opts["X000111113"][0] != "aeon" {
+					t.Errorf("expected aeon option for X000111113, got %v", opts["X000111113"])
+				}
+			}},
+		{name: "each volume is a request option", method: "GET", path: "/availability/u3330001", headers: auth,
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var avail availabilityResponse
+				json.Unmarshal(resp.Body.Bytes(), &avail)
+				if avail.RequestOptions == nil || len(avail.RequestOptions.Items) != 3 {
+					t.Fatalf("expected an option for each volume, got %s", resp.Body.String())
+				}
+				for i, item := range avail.RequestOptions.Items {
+					if item.Volume != fmt.Sprintf("v.%d", i+1) || item.CallKey != fmt.Sprintf("3330001:%d", i+1) {
+						t.Errorf("unexpected volume option %+v", item)
+					}
+				}
+			}},
+		{name: "course reserve notice and video reserve", method: "GET", path: "/availability/u5841451", headers: auth,
+			status:   http.StatusOK,
+			contains: []string{"This item is on course reserves", "Course Name: Film and the Law", "Instructor: Klaus, Ann", `"videoReserve"`}},
+		{name: "streaming video", method: "GET", path: "/availability/u7770001", headers: auth,
+			status:   http.StatusOK,
+			contains: []string{`"libraries":[]`, `"streamingVideoReserve":true`}},
+		{name: "health sciences user gets hsl scan link", method: "GET", path: "/availability/u2419229",
+			headers:  map[string]string{"Authorization": bearer(t, hslClaims)},
+			status:   http.StatusOK,
+			contains: []string{`"hsaScanURL":"https://hsilliad.example.edu/illiad.dll?`},
+			excludes: []string{`"scan"`}},
+		{name: "not in sirsi or solr", method: "GET", path: "/availability/u9999999", headers: auth,
+			status:   http.StatusOK,
+			contains: []string{`"title_id":"u9999999"`, `"libraries":[]`},
+			excludes: []string{"request_options"}},
+		{name: "non sirsi key", method: "GET", path: "/availability/uva-lib:123456", headers: auth,
+			status:   http.StatusOK,
+			contains: []string{`"libraries":[]`},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("GET", "/catalog/bib/key/uva-lib:123456")) > 0 {
+					t.Errorf("non sirsi key was requested from sirsi")
+				}
+			}},
+		{name: "sirsi failure is returned", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/key/2419229", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+			},
+			status:   http.StatusServiceUnavailable,
+			contains: []string{"sirsi is down"}},
+		{name: "availability list", method: "GET", path: "/availability/list", status: http.StatusOK,
+			contains: []string{`"availability_list"`, `"key":"ALDERMAN"`, `"key":"LAW-RESV"`}},
+	})
+}
+
+func TestAvailabilityCache(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.AvailabilityCache = newAvailabilityCache(time.Minute)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	hslClaims := mst3kClaims()
+	hslClaims.HomeLibrary = "HEALTHSCI"
+	adminClaims := mst3kClaims()
+	adminClaims.Role = v4jwt.Admin
+	admin := map[string]string{"Authorization": bearer(t, adminClaims)}
+
+	// lookups returns the number of sirsi bib and solr requests made for u2419229
+	lookups := func(h *testHarness) (int, int) {
+		return len(h.sirsi.received("GET", "/catalog/bib/key/2419229")), len(h.solr.received("GET", "/test_core/select"))
+	}
+	expectLookups := func(t *testing.T, h *testHarness, sirsi, solr int) {
+		t.Helper()
+		if gotSirsi, gotSolr := lookups(h); gotSirsi != sirsi || gotSolr != solr {
+			t.Errorf("expected %d sirsi and %d solr requests, got %d and %d", sirsi, solr, gotSirsi, gotSolr)
+		}
+	}
+	firstResponse := ""
+
+	h.run(t, []routeTest{
+		{name: "sirsi failure is not cached", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/key/2419229", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+			},
+			status: http.StatusServiceUnavailable},
+		{name: "uncached title is loaded", method: "GET", path: "/availability/u2419229", headers: auth,
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				expectLookups(t, h, 1, 1)
+				firstResponse = resp.Body.String()
+			}},
+		{name: "cached title", method: "GET", path: "/availability/u2419229", headers: auth,
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				expectLookups(t, h, 0, 0)
+				if resp.Body.String() != firstResponse {
+					t.Errorf("cached response differs from original:\n%s\n%s", firstResponse, resp.Body.String())
+				}
+			}},
+		{name: "cached title with user specific options", method: "GET", path: "/availability/u2419229",
+			headers:  map[string]string{"Authorization": bearer(t, hslClaims)},
+			status:   http.StatusOK,
+			contains: []string{`"hsaScanURL"`},
+			excludes: []string{`"scan"`},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				expectLookups(t, h, 0, 0)
+			}},
+		{name: "placing a hold purges the title", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				resp := h.do("POST", "/requests/hold", `{"pickupLibrary": "CLEMONS", "itemBarcode": "X000111111"}`, auth)
+				if resp.Code != http.StatusOK {
+					t.Fatalf("place hold failed: %d %s", resp.Code, resp.Body.String())
+				}
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				expectLookups(t, h, 1, 1)
+			}},
+		{name: "renew purges the title", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				resp := h.do("POST", "/requests/renew", `{"computing_id": "mst3k", "barcodes": ["X000111112"]}`, auth)
+				if resp.Code != http.StatusOK {
+					t.Fatalf("renew failed: %d %s", resp.Code, resp.Body.String())
+				}
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				expectLookups(t, h, 1, 1)
+			}},
+		{name: "filling a hold purges the title", method: "GET", path: "/availability/u5841451", headers: auth,
+			setup: func(h *testHarness) {
+				h.do("GET", "/availability/u5841451", "", auth)
+				resp := h.do("POST", "/requests/fill_hold/X000222221", "", leoStaff())
+				if resp.Code != http.StatusOK {
+					t.Fatalf("fill hold failed: %d %s", resp.Code, resp.Body.String())
+				}
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if reqs := h.sirsi.received("GET", "/catalog/bib/key/5841451"); len(reqs) != 2 {
+					t.Errorf("expected title to be reloaded after fill hold, got %d sirsi requests", len(reqs))
+				}
+			}},
+		{name: "purge requires admin", method: "DELETE", path: "/availability/cache/u2419229", headers: auth,
+			status: http.StatusForbidden},
+		{name: "admin purge", method: "DELETE", path: "/availability/cache/u2419229", headers: admin,
+			status: http.StatusOK, contains: []string{"u2419229 purged"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.AvailabilityCache.get("u2419229") != nil {
+					t.Errorf("u2419229 is still cached")
+				}
+			}},
+		{name: "admin purge of uncached title", method: "DELETE", path: "/availability/cache/u2419229", headers: admin,
+			status: http.StatusNotFound, contains: []string{"u2419229 is not cached"}},
+	})
+}
+
+func TestBatchAvailability(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	batch := `{"items": ["u2419229", "u5841451", "u9999999", "uva-lib:123456", "u2419229"]}`
+	tooMany := make([]string, 0)
+	for i := 0; i <= maxBatchAvailability; i++ {
+		tooMany = append(tooMany, fmt.Sprintf(`"u%d"`, i))
+	}
+
+	// parseBatch parses a batch response and checks that it contains the expected titles
+	parseBatch := func(t *testing.T, resp *httptest.ResponseRecorder) map[string]batchAvailabilityResult {
+		t.Helper()
+		var out map[string]batchAvailabilityResult
+		if err := json.Unmarshal(resp.Body.Bytes(), &out); err != nil {
+			t.Fatalf("unable to parse response: %s", err.Error())
+		}
+		if len(out) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(out))
+		}
+		return out
+	}
+
+	h.run(t, []routeTest{
+		{name: "missing jwt", method: "POST", path: "/availability/batch", body: batch, status: http.StatusUnauthorized},
+		{name: "invalid request", method: "POST", path: "/availability/batch", body: `{"items": `, headers: auth,
+			status: http.StatusBadRequest},
+		{name: "no items", method: "POST", path: "/availability/batch", body: `{"items": [" "]}`, headers: auth,
+			status: http.StatusBadRequest, contains: []string{"at least one item is required"}},
+		{name: "too many items", method: "POST", path: "/availability/batch", headers: auth,
+			body:   fmt.Sprintf(`{"items": [%s]}`, strings.Join(tooMany, ",")),
+			status: http.StatusBadRequest, contains: []string{fmt.Sprintf("no more than %d items", maxBatchAvailability)}},
+		{name: "bulk lookup", method: "POST", path: "/availability/batch", body: batch, headers: auth,
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				out := parseBatch(t, resp)
+				for key, res := range out {
+					if res.Status != http.StatusOK || res.Availability == nil {
+						t.Errorf("expected availability for %s, got %+v", key, res)
+					}
+				}
+				if out["u9999999"].Availability.RequestOptions != nil || len(out["u9999999"].Availability.Libraries) != 0 {
+					t.Errorf("expected no availability for u9999999")
+				}
+
+				// each title should match the single title response
+				single := h.do("GET", "/availability/u2419229", "", auth)
+				batchJSON, _ := json.Marshal(out["u2419229"].Availability)
+				if string(batchJSON) != single.Body.String() {
+					t.Errorf("batch response differs from single response:\n%s\n%s", batchJSON, single.Body.String())
+				}
+
+				search := h.sirsi.received("GET", "/catalog/bib/search")
+				if len(search) != 1 || strings.Contains(search[0].query.Get("q"), "2419229{CKEY} OR 5841451{CKEY} OR 9999999{CKEY}") == false {
+					t.Errorf("expected one sirsi search for the sirsi keys")
+				}
+				if len(h.sirsi.received("GET", "/catalog/bib/key/5841451")) != 0 {
+					t.Errorf("unexpected individual sirsi lookup")
+				}
+				solr := h.solr.received("GET", "/test_core/select")
+				if len(solr) != 2 || solr[0].query.Get("q") != `id:("u2419229" OR "u5841451" OR "u9999999" OR "uva-lib:123456")` {
+					t.Errorf("expected one solr query for all keys, got %d", len(solr))
+				}
+			}},
+		{name: "bulk sirsi failure falls back to individual lookups", method: "POST", path: "/availability/batch", body: batch, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/search", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+				h.sirsi.override("GET", "/catalog/bib/key/5841451", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				out := parseBatch(t, resp)
+				if out["u5841451"].Status != http.StatusServiceUnavailable || out["u5841451"].Error != "sirsi is down" || out["u5841451"].Availability != nil {
+					t.Errorf("expected error result for u5841451, got %+v", out["u5841451"])
+				}
+				if out["u2419229"].Status != http.StatusOK || len(out["u2419229"].Availability.Libraries) == 0 {
+					t.Errorf("expected availability for u2419229, got %+v", out["u2419229"])
+				}
+				if len(h.sirsi.received("GET", "/catalog/bib/key/2419229")) != 1 {
+					t.Errorf("expected individual sirsi lookup for u2419229")
+				}
+			}},
+		{name: "cached titles", method: "POST", path: "/availability/batch", body: batch, headers: auth,
+			setup: func(h *testHarness) {
+				h.svc.AvailabilityCache = newAvailabilityCache(time.Minute)
+				h.do("POST", "/availability/batch", batch, auth)
+				h.sirsi.reset()
+				h.solr.reset()
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				parseBatch(t, resp)
+				if len(h.sirsi.received("GET", "/catalog/bib/search")) != 0 || len(h.solr.received("GET", "/test_core/select")) != 0 {
+					t.Errorf("expected cached titles to be used")
+				}
+			}},
+	})
+}
+
+func TestRunBatchWorkers(t *testing.T) {
+	catKeys := make([]string, 0)
+	for i := 0; i < 3*batchAvailabilityWorkers; i++ {
+		catKeys = append(catKeys, fmt.Sprintf("u%d", i))
+	}
+	var mutex sync.Mutex
+	running, most := 0, 0
+	done := make([]string, 0)
+	runBatchWorkers(context.Background(), catKeys, func(catKey string) {
+		mutex.Lock()
+		running++
+		most = max(most, running)
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		running--
+		done = append(done, catKey)
+		mutex.Unlock()
+	})
+	if len(done) != len(catKeys) {
+		t.Errorf("expected %d lookups, got %d", len(catKeys), len(done))
+	}
+	if most != batchAvailabilityWorkers {
+		t.Errorf("expected %d concurrent lookups, got %d", batchAvailabilityWorkers, most)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := 0
+	runBatchWorkers(ctx, catKeys, func(catKey string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		started++
+		cancel()
+	})
+	if started == 0 || started > batchAvailabilityWorkers {
+		t.Errorf("expected lookups to stop once cancelled, got %d", started)
+	}
+}
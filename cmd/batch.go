@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchAvailability is the maximum number of titles accepted by a batch availability request
+const maxBatchAvailability = 100
+
+// batchAvailabilityWorkers limits the number of titles that are looked up individually at the same time
+const batchAvailabilityWorkers = 8
+
+type batchAvailabilityResult struct {
+	Status       int                   `json:"status"`
+	Availability *availabilityResponse `json:"availability,omitempty"`
+	Error        string                `json:"error,omitempty"`
+}
+
+// POST /availability/batch : availability for a list of titles. The response is a map of cat key
+// to a result that contains either the availability for the title or the error encountered getting it
+func (svc *serviceContext) getBatchAvailability(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req struct {
+		Items []string `json:"items"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		logf(ctx, "INFO: unable to parse batch availability request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	catKeys := make([]string, 0)
+	for _, key := range req.Items {
+		key = strings.TrimSpace(key)
+		if key != "" && slices.Contains(catKeys, key) == false {
+			catKeys = append(catKeys, key)
+		}
+	}
+	if len(catKeys) == 0 {
+		c.String(http.StatusBadRequest, "at least one item is required")
+		return
+	}
+	if len(catKeys) > maxBatchAvailability {
+		logf(ctx, "INFO: batch availability request for %d items rejected", len(catKeys))
+		c.String(http.StatusBadRequest, fmt.Sprintf("no more than %d items may be requested", maxBatchAvailability))
+		return
+	}
+	logf(ctx, "INFO: get batch availability for %v", catKeys)
+
+	dataMap, errMap := svc.getBatchAvailabilityData(ctx, catKeys)
+	if ctx.Err() != nil {
+		reqErr := contextError(ctx)
+		logf(ctx, "INFO: batch availability for %d items stopped: %s", len(catKeys), reqErr.Message)
+		c.String(reqErr.StatusCode, reqErr.Message)
+		return
+	}
+	patron := patronFromClaims(c)
+	out := make(map[string]*batchAvailabilityResult)
+	for _, catKey := range catKeys {
+		if reqErr, failed := errMap[catKey]; failed {
+			out[catKey] = &batchAvailabilityResult{Status: reqErr.StatusCode, Error: reqErr.Message}
+			continue
+		}
+		availResp := svc.buildAvailabilityResponse(patron, dataMap[catKey], nil)
+		if availResp.RequestOptions.hasOptions() == false {
+			availResp.RequestOptions = nil
+		}
+		out[catKey] = &batchAvailabilityResult{Status: http.StatusOK, Availability: availResp}
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// getBatchAvailabilityData gets availability data for a list of titles. Cached titles are used as-is, and
+// the rest are loaded with one sirsi bib search and one solr query, then built with limited concurrency. If
+// either bulk lookup fails, the titles are loaded individually so failures are reported per title.
+func (svc *serviceContext) getBatchAvailabilityData(ctx context.Context, catKeys []string) (map[string]*availabilityData, map[string]*requestError) {
+	dataMap := make(map[string]*availabilityData)
+	errMap := make(map[string]*requestError)
+	uncached := make([]string, 0)
+	sirsiKeys := make([]string, 0)
+	for _, catKey := range catKeys {
+		if cached := svc.AvailabilityCache.get(catKey); cached != nil {
+			dataMap[catKey] = cached
+			continue
+		}
+		uncached = append(uncached, catKey)
+		if svc.isSirsiKey(catKey) {
+			sirsiKeys = append(sirsiKeys, catKey)
+		}
+	}
+	if len(uncached) == 0 {
+		logf(ctx, "INFO: all %d batch titles are cached", len(catKeys))
+		return dataMap, errMap
+	}
+
+	var bibs map[string]*sirsiBibResponse
+	var solrDocs map[string]*solrDocument
+	var sirsiErr *requestError
+	var solrErr error
+	var wg sync.WaitGroup
+	if len(sirsiKeys) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bibs, sirsiErr = svc.getSirsiItems(ctx, sirsiKeys)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		solrDocs, solrErr = svc.getSolrDocs(ctx, uncached)
+	}()
+	wg.Wait()
+	if ctx.Err() != nil {
+		return dataMap, errMap
+	}
+
+	var mutex sync.Mutex
+	if sirsiErr == nil && solrErr == nil {
+		runBatchWorkers(ctx, uncached, func(catKey string) {
+			var bibResp *sirsiBibResponse
+			if svc.isSirsiKey(catKey) {
+				bibResp = bibs[cleanCatKey(catKey)]
+			}
+			data := svc.newAvailabilityData(ctx, catKey, bibResp, solrDocs[catKey])
+			mutex.Lock()
+			defer mutex.Unlock()
+			if ctx.Err() != nil {
+				// lookups made while building the data, such as item notices, may have been skipped
+				errMap[catKey] = contextError(ctx)
+				return
+			}
+			svc.AvailabilityCache.put(catKey, data)
+			dataMap[catKey] = data
+		})
+		return dataMap, errMap
+	}
+
+	if sirsiErr != nil {
+		logf(ctx, "ERROR: batch sirsi search failed: %s", sirsiErr.string())
+	}
+	if solrErr != nil {
+		logf(ctx, "ERROR: batch solr query failed: %s", solrErr.Error())
+	}
+	logf(ctx, "INFO: get availability for %d batch titles individually", len(uncached))
+	runBatchWorkers(ctx, uncached, func(catKey string) {
+		data, reqErr := svc.getAvailabilityData(ctx, catKey)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if reqErr != nil {
+			errMap[catKey] = reqErr
+		} else {
+			dataMap[catKey] = data
+		}
+	})
+	return dataMap, errMap
+}
+
+// runBatchWorkers calls lookup for each title, at most batchAvailabilityWorkers at a time, and waits for
+// them to finish. No more lookups are started once the context is cancelled or out of time.
+func runBatchWorkers(ctx context.Context, catKeys []string, lookup func(catKey string)) {
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, batchAvailabilityWorkers)
+	for _, catKey := range catKeys {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			lookup(catKey)
+		}()
+	}
+	wg.Wait()
+}
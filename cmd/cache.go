@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+// availabilityData is the user independent portion of an availability response. It is built from
+// the sirsi bib and the solr document for a title and is shared by all requests for that title.
+// It must be treated as read-only once it has been cached.
+type availabilityData struct {
+	TitleID   string
+	InSirsi   bool
+	Items     []availItem
+	BoundWith []boundWithParent
+	SolrDoc   *solrDocument
+	SCItems   []availItem
+}
+
+type availabilityCacheEntry struct {
+	data      *availabilityData
+	barcodes  []string
+	expiresAt time.Time
+}
+
+// availabilityCache is a TTL cache of availabilityData keyed by cat key. Item barcodes are indexed so
+// circulation events that only know the item barcode can purge the title. A zero TTL disables caching.
+type availabilityCache struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*availabilityCacheEntry
+	barcodes  map[string]string
+	lastSweep time.Time
+}
+
+func newAvailabilityCache(ttl time.Duration) *availabilityCache {
+	return &availabilityCache{
+		ttl:       ttl,
+		entries:   make(map[string]*availabilityCacheEntry),
+		barcodes:  make(map[string]string),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ac *availabilityCache) enabled() bool {
+	return ac.ttl > 0
+}
+
+// get returns the cached data for a cat key, or nil if there is no unexpired entry
+func (ac *availabilityCache) get(catKey string) *availabilityData {
+	if ac.enabled() == false {
+		return nil
+	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	entry, found := ac.entries[catKey]
+	if found == false {
+		return nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		ac.removeLocked(catKey)
+		return nil
+	}
+	return entry.data
+}
+
+func (ac *availabilityCache) put(catKey string, data *availabilityData) {
+	if ac.enabled() == false {
+		return
+	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if time.Since(ac.lastSweep) > ac.ttl {
+		ac.sweepLocked()
+	}
+
+	ac.removeLocked(catKey)
+	entry := availabilityCacheEntry{data: data, expiresAt: time.Now().Add(ac.ttl)}
+	for _, items := range [][]availItem{data.Items, data.SCItems} {
+		for _, item := range items {
+			if item.Barcode != "" {
+				entry.barcodes = append(entry.barcodes, item.Barcode)
+				ac.barcodes[item.Barcode] = catKey
+			}
+		}
+	}
+	ac.entries[catKey] = &entry
+}
+
+// purge removes a cat key from the cache. It returns true if the key was cached
+func (ac *availabilityCache) purge(catKey string) bool {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	_, found := ac.entries[catKey]
+	if found {
+		log.Printf("INFO: purge %s from availability cache", catKey)
+		ac.removeLocked(catKey)
+	}
+	return found
+}
+
+// purgeBarcode removes the title containing the item barcode from the cache
+func (ac *availabilityCache) purgeBarcode(barcode string) bool {
+	ac.mutex.Lock()
+	catKey, found := ac.barcodes[barcode]
+	ac.mutex.Unlock()
+	if found == false {
+		return false
+	}
+	return ac.purge(catKey)
+}
+
+func (ac *availabilityCache) removeLocked(catKey string) {
+	entry, found := ac.entries[catKey]
+	if found == false {
+		return
+	}
+	for _, bc := range entry.barcodes {
+		if ac.barcodes[bc] == catKey {
+			delete(ac.barcodes, bc)
+		}
+	}
+	delete(ac.entries, catKey)
+}
+
+func (ac *availabilityCache) sweepLocked() {
+	now := time.Now()
+	for key, entry := range ac.entries {
+		if now.After(entry.expiresAt) {
+			ac.removeLocked(key)
+		}
+	}
+	ac.lastSweep = now
+}
+
+// getAvailabilityData returns the cached availability data for a cat key, loading it from sirsi and
+// solr if it is not cached. Data is only cached when both lookups complete without a system error.
+func (svc *serviceContext) getAvailabilityData(ctx context.Context, catKey string) (*availabilityData, *requestError) {
+	if cached := svc.AvailabilityCache.get(catKey); cached != nil {
+		logf(ctx, "INFO: availability cache hit for %s", catKey)
+		return cached, nil
+	}
+
+	var bibResp *sirsiBibResponse
+	if svc.isSirsiKey(catKey) == false {
+		logf(ctx, "INFO: key %s not in sirsi", catKey)
+	} else {
+		logf(ctx, "INFO: get availability for %s", catKey)
+		var sirsiErr *requestError
+		bibResp, sirsiErr = svc.getSirsiItem(ctx, catKey)
+		if sirsiErr != nil {
+			logf(ctx, "ERROR: get sirsi item %s failed: %s", catKey, sirsiErr.string())
+			if sirsiErr.StatusCode != 404 {
+				return nil, sirsiErr
+			}
+			logf(ctx, "WARN: %s was not found in sirsi", catKey)
+		}
+	}
+
+	cacheable := true
+	solrDoc, solrErr := svc.getSolrDoc(ctx, catKey)
+	if solrErr != nil {
+		logf(ctx, "ERROR: %s", solrErr.Error())
+		// a missing document is a valid result, but any other failure should be retried on the next request
+		cacheable = errors.Is(solrErr, errNoSolrDoc)
+	}
+
+	data := svc.newAvailabilityData(ctx, catKey, bibResp, solrDoc)
+	if ctx.Err() != nil {
+		// lookups made while building the data, such as item notices, may have been skipped
+		return nil, contextError(ctx)
+	}
+	if cacheable {
+		svc.AvailabilityCache.put(catKey, data)
+	}
+	return data, nil
+}
+
+// newAvailabilityData builds the availability data for a title from its sirsi bib and solr document; either may be nil
+func (svc *serviceContext) newAvailabilityData(ctx context.Context, catKey string, bibResp *sirsiBibResponse, solrDoc *solrDocument) *availabilityData {
+	data := availabilityData{
+		TitleID:   catKey,
+		Items:     make([]availItem, 0),
+		BoundWith: make([]boundWithParent, 0),
+		SCItems:   make([]availItem, 0),
+	}
+	if bibResp != nil {
+		// parse sirsi data into an easier to manage format
+		data.InSirsi = true
+		data.TitleID = bibResp.Key
+		data.Items = svc.parseItemsFromSirsi(ctx, catKey, bibResp)
+		data.BoundWith = svc.getBoundWithItems(bibResp)
+	}
+	if solrDoc != nil {
+		data.SolrDoc = solrDoc
+		data.SCItems = svc.extractSpecialCollectionsItems(solrDoc)
+		if solrDoc.SCAvailability != "" {
+			data.TitleID = solrDoc.ID
+		}
+	}
+	return &data
+}
+
+// DELETE /availability/cache/:cat_key : admin request to remove a title from the availability cache
+func (svc *serviceContext) purgeAvailabilityCache(c *gin.Context) {
+	catKey := c.Param("cat_key")
+	claims, err := getVirgoClaims(c)
+	if err != nil {
+		logf(c.Request.Context(), "ERROR: attempt to purge availability cache with bad claims: %s", err.Error())
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+	if claims.Role != v4jwt.Admin {
+		logf(c.Request.Context(), "ERROR: non-admin user %s attempted to purge %s from the availability cache", claims.UserID, catKey)
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+
+	if svc.AvailabilityCache.purge(catKey) == false {
+		logf(c.Request.Context(), "INFO: %s was not in the availability cache", catKey)
+		c.String(http.StatusNotFound, "%s is not cached", catKey)
+		return
+	}
+	c.String(http.StatusOK, "%s purged", catKey)
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 )
 
+// renewAllWorkers limits the number of renewals sent to sirsi at the same time for a renew all request
+const renewAllWorkers = 4
+
 type renewRequest struct {
 	ComputingID string   `json:"computing_id"`
 	Barcodes    []string `json:"barcodes"`
@@ -37,10 +43,11 @@ type sirsiRenewResponse struct {
 }
 
 func (svc *serviceContext) renewCheckouts(c *gin.Context) {
+	ctx := c.Request.Context()
 	var req renewRequest
 	err := c.ShouldBindJSON(&req)
 	if err != nil {
-		log.Printf("INFO: Unable to parse hold request: %s", err.Error())
+		logf(ctx, "INFO: Unable to parse hold request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
@@ -50,46 +57,72 @@ func (svc *serviceContext) renewCheckouts(c *gin.Context) {
 		c.String(http.StatusUnauthorized, "you are not authorized to issue a renew request")
 		return
 	}
+	if req.ComputingID != "" && strings.EqualFold(req.ComputingID, v4Claims.UserID) == false {
+		logf(ctx, "WARNING: user %s attempted to renew checkouts for %s", v4Claims.UserID, req.ComputingID)
+		svc.Audit(ctx, auditEvent{Action: "renew", Route: c.FullPath(), Target: req.ComputingID, Caller: v4Claims.UserID,
+			Role: v4Claims.Role.String(), ClientIP: c.ClientIP(), Reason: "caller is not the patron"})
+		c.String(http.StatusForbidden, "checkouts can only be renewed by the patron")
+		return
+	}
+
+	// renewals use the staff session, so only renew items that are checked out to the caller
+	checkouts, coErr := svc.getSirsiUserCheckouts(ctx, v4Claims.UserID)
+	if coErr != nil {
+		logf(ctx, "ERROR: unable to get user %s checkouts to verify renewal: %s", v4Claims.UserID, coErr.string())
+		c.String(coErr.StatusCode, coErr.Message)
+		return
+	}
+	owned := make(map[string]bool)
+	for _, co := range checkouts {
+		owned[strings.ToUpper(co.Barcode)] = true
+	}
 
-	log.Printf("INFO: user %s requests renew %+v", v4Claims.Barcode, req.Barcodes)
+	logf(ctx, "INFO: user %s requests renew of %d items", v4Claims.UserID, len(req.Barcodes))
 	out := make([]renewResponseRec, 0)
 	for _, renewBC := range req.Barcodes {
-		out = append(out, svc.issueReneqRequest(renewBC))
+		if ctx.Err() != nil {
+			// items that were not attempted are reported as failed rather than left out of the response
+			out = append(out, renewResponseRec{Barcode: renewBC, Success: false, Message: contextError(ctx).Message})
+			continue
+		}
+		if owned[strings.ToUpper(strings.TrimSpace(renewBC))] == false {
+			logf(ctx, "WARNING: user %s attempted to renew %s, which is not checked out to them", v4Claims.UserID, renewBC)
+			out = append(out, renewResponseRec{Barcode: renewBC, Success: false, Message: "item is not checked out to you"})
+			continue
+		}
+		out = append(out, svc.issueReneqRequest(ctx, renewBC))
 	}
 
 	c.JSON(http.StatusOK, out)
 }
 
-func (svc *serviceContext) issueReneqRequest(renewBC string) renewResponseRec {
-	log.Printf("INFO: issue renew request for %s", renewBC)
-	payload := struct {
-		Barcode string `json:"itemBarcode"`
-	}{
-		Barcode: renewBC,
-	}
-	fields := "circRecord{checkOutDate,dueDate,renewalDate,status,recallDueDate}"
-	rawRenewResp, rawErr := svc.sirsiPost(svc.HTTPClient, fmt.Sprintf("/circulation/circRecord/renew?includeFields=%s", fields), payload)
+func (svc *serviceContext) issueReneqRequest(ctx context.Context, renewBC string) renewResponseRec {
+	logf(ctx, "INFO: issue renew request for %s", renewBC)
+	rawRenewResp, rawErr := svc.ILS.renew(ctx, renewBC)
 	if rawErr != nil {
-		log.Printf("INFO: unable to renew %s: %s", renewBC, rawErr.Message)
+		logf(ctx, "INFO: unable to renew %s: %s", renewBC, rawErr.Message)
+		svc.Metrics.renewals.WithLabelValues(outcomeLabel(false)).Inc()
 		parsedErr, err := svc.handleSirsiErrorResponse(rawErr)
 		if err != nil {
-			log.Printf("ERROR: unable to parse sirsi failed response: %s", err.Message)
+			logf(ctx, "ERROR: unable to parse sirsi failed response: %s", err.Message)
 			return renewResponseRec{
 				Barcode: renewBC, Success: false, Message: rawErr.Message,
 			}
 		}
 		reason := parsedErr.MessageList[0].Message
-		log.Printf("INFO: renew %s fail reason: %s", renewBC, reason)
+		logf(ctx, "INFO: renew %s fail reason: %s", renewBC, reason)
 		return renewResponseRec{
 			Barcode: renewBC, Success: false, Message: reason,
 		}
 	}
 
+	svc.AvailabilityCache.purgeBarcode(renewBC)
+	svc.Metrics.renewals.WithLabelValues(outcomeLabel(true)).Inc()
 	var renewResp sirsiRenewResponse
 	respRec := renewResponseRec{Barcode: renewBC, Success: true}
 	parseErr := json.Unmarshal(rawRenewResp, &renewResp)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse renew %s response: %s", renewBC, parseErr.Error())
+		logf(ctx, "ERROR: unable to parse renew %s response: %s", renewBC, parseErr.Error())
 	} else {
 		respRec.DueDate = renewResp.CircRecord.Fields.DueDate
 		respRec.RenewDate = renewResp.CircRecord.Fields.RenewalDate
@@ -99,3 +132,106 @@ func (svc *serviceContext) issueReneqRequest(renewBC string) renewResponseRec {
 	return respRec
 
 }
+
+//	curl --request POST \
+//	  --url http://localhost:8185/requests/renew/all \
+//	  --header 'Authorization: Bearer PATRON_JWT' \
+//	  --header 'Accept: text/event-stream' \
+//	  --data '{"computing_id": "mst3k"}'
+//
+// renew all of the renewable checkouts of the patron making the request. Renewals are made in parallel, and each
+// result is streamed back as it completes; as newline delimited JSON by default, or as server sent events if the
+// caller accepts text/event-stream. The X-Total-Count header has the number of renewals that will be streamed.
+func (svc *serviceContext) renewAll(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req struct {
+		ComputingID string `json:"computing_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ComputingID == "" {
+		logf(ctx, "INFO: invalid renew all request")
+		c.String(http.StatusBadRequest, "computing_id is required")
+		return
+	}
+
+	v4Claims, claimErr := getVirgoClaims(c)
+	if claimErr != nil {
+		c.String(http.StatusUnauthorized, "you are not authorized to issue a renew request")
+		return
+	}
+	if strings.EqualFold(req.ComputingID, v4Claims.UserID) == false {
+		logf(ctx, "WARNING: user %s attempted to renew all checkouts for %s", v4Claims.UserID, req.ComputingID)
+		svc.Audit(ctx, auditEvent{Action: "renew_all", Route: c.FullPath(), Target: req.ComputingID, Caller: v4Claims.UserID,
+			Role: v4Claims.Role.String(), ClientIP: c.ClientIP(), Reason: "caller is not the patron"})
+		c.String(http.StatusForbidden, "checkouts can only be renewed by the patron")
+		return
+	}
+
+	checkouts, err := svc.getSirsiUserCheckouts(ctx, req.ComputingID)
+	if err != nil {
+		logf(ctx, "ERROR: unable to get user %s checkouts to renew: %s", req.ComputingID, err.string())
+		c.String(err.StatusCode, err.Message)
+		return
+	}
+	barcodes := make([]string, 0)
+	for _, co := range checkouts {
+		if co.renewable() {
+			barcodes = append(barcodes, co.Barcode)
+		}
+	}
+	logf(ctx, "INFO: user %s requests renew of all %d renewable checkouts of %d", v4Claims.UserID, len(barcodes), len(checkouts))
+
+	results := make(chan renewResponseRec)
+	go func() {
+		var wg sync.WaitGroup
+		workers := make(chan struct{}, renewAllWorkers)
+		for _, renewBC := range barcodes {
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				// items that were not attempted are reported as failed rather than left out of the stream
+				results <- renewResponseRec{Barcode: renewBC, Success: false, Message: contextError(ctx).Message}
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-workers
+					wg.Done()
+				}()
+				results <- svc.issueReneqRequest(ctx, renewBC)
+			}()
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	sse := strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Header("X-Total-Count", strconv.Itoa(len(barcodes)))
+	c.Status(http.StatusOK)
+	renewed := 0
+	for rec := range results {
+		if rec.Success {
+			renewed++
+		}
+		line, _ := json.Marshal(rec)
+		if sse {
+			fmt.Fprintf(c.Writer, "event: renew\ndata: %s\n\n", line)
+		} else {
+			fmt.Fprintf(c.Writer, "%s\n", line)
+		}
+		c.Writer.Flush()
+	}
+	if sse {
+		fmt.Fprintf(c.Writer, "event: done\ndata: {\"renewed\":%d,\"failed\":%d}\n\n", renewed, len(barcodes)-renewed)
+		c.Writer.Flush()
+	}
+	logf(ctx, "INFO: renewed %d of %d checkouts for %s", renewed, len(barcodes), req.ComputingID)
+}
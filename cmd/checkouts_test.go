@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenew(t *testing.T) {
+	h := newTestHarness(t)
+	var events []auditEvent
+	h.svc.Audit = func(ctx context.Context, evt auditEvent) { events = append(events, evt) }
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+
+	h.run(t, []routeTest{
+		{name: "renews checkouts of the caller", method: "POST", path: "/requests/renew", headers: auth,
+			body: `{"computing_id": "mst3k", "barcodes": ["x000111112", "X000222221"]}`, status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var out []renewResponseRec
+				json.Unmarshal(resp.Body.Bytes(), &out)
+				if len(out) != 2 || out[0].Success == false || out[1].Success || out[1].Message != "item is not checked out to you" {
+					t.Errorf("expected only the caller's checkout to renew, got %+v", out)
+				}
+				renewed := h.sirsi.received("POST", "/circulation/circRecord/renew")
+				if len(renewed) != 1 || strings.Contains(string(renewed[0].body), "x000111112") == false {
+					t.Errorf("expected one renewal to be sent to sirsi, got %d", len(renewed))
+				}
+			}},
+		{name: "computing id must be the caller", method: "POST", path: "/requests/renew", headers: auth,
+			body: `{"computing_id": "abc9z", "barcodes": ["X000111112"]}`, status: http.StatusForbidden,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/circulation/circRecord/renew")) != 0 {
+					t.Errorf("expected no renewals")
+				}
+				if len(events) != 1 || events[0].Action != "renew" || events[0].Caller != "mst3k" || events[0].Allowed {
+					t.Errorf("expected a denied audit event, got %+v", events)
+				}
+			}},
+		{name: "checkouts unavailable", method: "POST", path: "/requests/renew", headers: auth,
+			body: `{"computing_id": "mst3k", "barcodes": ["X000111112"]}`,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/user/patron/alternateID/mst3k", fakeResponse{status: http.StatusServiceUnavailable, body: "down"})
+			},
+			status: http.StatusServiceUnavailable,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/circulation/circRecord/renew")) != 0 {
+					t.Errorf("expected no renewals")
+				}
+			}},
+	})
+}
+
+func TestRenewAll(t *testing.T) {
+	h := newTestHarness(t)
+	var events []auditEvent
+	h.svc.Audit = func(ctx context.Context, evt auditEvent) { events = append(events, evt) }
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	sse := map[string]string{"Authorization": auth["Authorization"], "Accept": "text/event-stream"}
+	due := time.Now().Add(7 * 24 * time.Hour)
+	checkouts := updateCheckouts(t, mst3kWithCheckouts(t, due, due, due, due), func(i int, rec map[string]any) {
+		if i == 3 {
+			rec["recallDueDate"] = "2024-03-05"
+		}
+	})
+	body := `{"computing_id": "mst3k"}`
+	var start time.Time
+	setup := func(renewals ...fakeResponse) func(h *testHarness) {
+		return func(h *testHarness) {
+			h.sirsi.override("GET", "/user/patron/alternateID/mst3k", checkouts)
+			h.sirsi.override("POST", "/circulation/circRecord/renew", renewals...)
+		}
+	}
+	results := func(t *testing.T, resp *httptest.ResponseRecorder) []renewResponseRec {
+		t.Helper()
+		out := make([]renewResponseRec, 0)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var rec renewResponseRec
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatalf("invalid line [%s]: %s", scanner.Text(), err.Error())
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+
+	h.run(t, []routeTest{
+		{name: "computing id is required", method: "POST", path: "/requests/renew/all", body: `{}`, headers: auth,
+			status: http.StatusBadRequest},
+		{name: "requires a jwt", method: "POST", path: "/requests/renew/all", body: body, status: http.StatusUnauthorized},
+		{name: "checkouts unavailable", method: "POST", path: "/requests/renew/all", body: body, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/user/patron/alternateID/mst3k", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+			},
+			status: http.StatusServiceUnavailable, contains: []string{"sirsi is down"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/circulation/circRecord/renew")) != 0 {
+					t.Errorf("expected no renewals")
+				}
+			}},
+		{name: "only the patron can renew", method: "POST", path: "/requests/renew/all", body: `{"computing_id": "abc9z"}`,
+			headers: auth, status: http.StatusForbidden,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/circulation/circRecord/renew")) != 0 {
+					t.Errorf("expected no renewals")
+				}
+				if len(events) != 1 || events[0].Action != "renew_all" || events[0].Target != "abc9z" || events[0].Allowed {
+					t.Errorf("expected a denied audit event, got %+v", events)
+				}
+			}},
+		{name: "streams ndjson", method: "POST", path: "/requests/renew/all", body: body, headers: auth,
+			setup:  setup(fakeResponse{}, sirsiMessageResponse(http.StatusBadRequest, "renewLimitReached", "Renewal limit reached.")),
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if resp.Header().Get("Content-Type") != "application/x-ndjson" || resp.Header().Get("X-Total-Count") != "3" {
+					t.Errorf("unexpected headers %v", resp.Header())
+				}
+				recs := results(t, resp)
+				failed := 0
+				for _, rec := range recs {
+					if rec.Success == false {
+						failed++
+						if rec.Message != "Renewal limit reached." {
+							t.Errorf("unexpected failure %+v", rec)
+						}
+					}
+				}
+				if len(recs) != 3 || failed != 1 {
+					t.Errorf("expected 3 results with 1 failure, got %+v", recs)
+				}
+				for _, req := range h.sirsi.received("POST", "/circulation/circRecord/renew") {
+					if strings.Contains(string(req.body), "X000111113") {
+						t.Errorf("recalled item should not be renewed")
+					}
+				}
+			}},
+		{name: "streams server sent events", method: "POST", path: "/requests/renew/all", body: body, headers: sse,
+			setup: setup(), status: http.StatusOK,
+			contains: []string{"event: renew\ndata: {", `"barcode":"X000111110"`, "event: done\ndata: {\"renewed\":3,\"failed\":0}"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if strings.HasPrefix(resp.Header().Get("Content-Type"), "text/event-stream") == false {
+					t.Errorf("unexpected content type %s", resp.Header().Get("Content-Type"))
+				}
+			}},
+		{name: "renewals run in parallel", method: "POST", path: "/requests/renew/all", body: body, headers: auth,
+			setup: func(h *testHarness) {
+				many := mst3kWithCheckouts(t, due, due, due, due, due, due, due, due)
+				h.sirsi.override("GET", "/user/patron/alternateID/mst3k", many)
+				slow := fakeResponse{status: http.StatusOK, body: `{"circRecord": {"fields": {"status": "ACTIVE"}}}`, delay: 100 * time.Millisecond}
+				h.sirsi.override("POST", "/circulation/circRecord/renew", slow, slow, slow, slow, slow, slow, slow, slow)
+				start = time.Now()
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if recs := results(t, resp); len(recs) != 8 {
+					t.Errorf("expected 8 results, got %d", len(recs))
+				}
+				// 8 renewals of 100ms each take about 200ms with 4 workers
+				if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 700*time.Millisecond {
+					t.Errorf("expected renewals to run %d at a time, took %s", renewAllWorkers, elapsed)
+				}
+			}},
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// headers used by internal callers to identify themselves
+const (
+	apiKeyHeader       = "X-API-Key"
+	serviceTokenHeader = "X-Service-Token"
+)
+
+// scopes are the groups of internal routes a client may be allowed to call
+const (
+	scopeMetadata       = "metadata"
+	scopeCourseReserves = "course_reserves"
+	scopeRegister       = "register"
+	scopeFillHold       = "fill_hold"
+	scopePatronData     = "patron_data"
+)
+
+var clientScopes = []string{scopeMetadata, scopeCourseReserves, scopeRegister, scopeFillHold, scopePatronData}
+
+// maxServiceTokenLife is the longest a service token may be valid for. Clients are expected to mint a new
+// token for each call, or at least every few minutes, so a leaked token is of little use.
+const maxServiceTokenLife = time.Hour
+
+// clientConfig is an internal caller as listed in the clients file. A client authenticates with an API key
+// that hashes to one of APIKeys (hex encoded sha256), or a HS256 service token signed with TokenSecret
+// that has the client name as the issuer and an expiration time.
+type clientConfig struct {
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	APIKeys     []string `json:"apiKeys"`
+	TokenSecret string   `json:"tokenSecret"`
+}
+
+type serviceClient struct {
+	name        string
+	scopes      map[string]bool
+	tokenSecret []byte
+}
+
+// clientRegistry looks up internal clients by credential
+type clientRegistry struct {
+	byKeyHash map[string]*serviceClient
+	byName    map[string]*serviceClient
+}
+
+// loadClientsFile reads client configuration from a JSON file containing a list of clients
+func loadClientsFile(path string) ([]clientConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []clientConfig
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("invalid clients file %s: %s", path, err.Error())
+	}
+	return out, nil
+}
+
+func newClientRegistry(clients []clientConfig) (*clientRegistry, error) {
+	reg := clientRegistry{byKeyHash: make(map[string]*serviceClient), byName: make(map[string]*serviceClient)}
+	known := make(map[string]bool)
+	for _, s := range clientScopes {
+		known[s] = true
+	}
+	for _, cfg := range clients {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("client name is required")
+		}
+		if _, dup := reg.byName[cfg.Name]; dup {
+			return nil, fmt.Errorf("client %s is listed more than once", cfg.Name)
+		}
+		if len(cfg.APIKeys) == 0 && cfg.TokenSecret == "" {
+			return nil, fmt.Errorf("client %s has no api keys or token secret", cfg.Name)
+		}
+		client := serviceClient{name: cfg.Name, scopes: make(map[string]bool), tokenSecret: []byte(cfg.TokenSecret)}
+		for _, scope := range cfg.Scopes {
+			if known[scope] == false {
+				return nil, fmt.Errorf("client %s has unknown scope %s", cfg.Name, scope)
+			}
+			client.scopes[scope] = true
+		}
+		for _, hash := range cfg.APIKeys {
+			if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("client %s has an api key that is not a hex sha256 hash", cfg.Name)
+			}
+			if other, dup := reg.byKeyHash[hash]; dup {
+				return nil, fmt.Errorf("clients %s and %s share an api key", other.name, cfg.Name)
+			}
+			reg.byKeyHash[hash] = &client
+		}
+		reg.byName[cfg.Name] = &client
+	}
+	return &reg, nil
+}
+
+// hashAPIKey returns the hash of an api key as it is listed in the clients file
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the client for an api key or service token. The api key is used if both are present.
+func (reg *clientRegistry) authenticate(apiKey, token string) (*serviceClient, error) {
+	if apiKey != "" {
+		client, ok := reg.byKeyHash[hashAPIKey(apiKey)]
+		if ok == false {
+			return nil, fmt.Errorf("unknown api key")
+		}
+		return client, nil
+	}
+
+	var client *serviceClient
+	var claims jwt.StandardClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok == false {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		issuer := t.Claims.(*jwt.StandardClaims).Issuer
+		found, ok := reg.byName[issuer]
+		if ok == false || len(found.tokenSecret) == 0 {
+			return nil, fmt.Errorf("unknown issuer %s", issuer)
+		}
+		client = found
+		return found.tokenSecret, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid service token: %s", err.Error())
+	}
+	if claims.ExpiresAt == 0 || time.Until(time.Unix(claims.ExpiresAt, 0)) > maxServiceTokenLife {
+		return nil, fmt.Errorf("service token for %s must expire within %s", client.name, maxServiceTokenLife)
+	}
+	return client, nil
+}
+
+// hasClientCredentials returns true if the request includes an api key or service token
+func hasClientCredentials(c *gin.Context) bool {
+	return c.GetHeader(apiKeyHeader) != "" || c.GetHeader(serviceTokenHeader) != ""
+}
+
+// clientAuthMiddleware returns middleware that only allows internal clients with the scope through
+func (svc *serviceContext) clientAuthMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logf(c.Request.Context(), "INFO: authorize client access to %s for %s", redactedPath(c), scope)
+		if err := svc.authorizeClient(c, scope); err != nil {
+			c.AbortWithStatus(err.StatusCode)
+			return
+		}
+		c.Next()
+	}
+}
+
+// authorizeClient checks that the request has credentials for a client with the scope, and records the client
+// name in the request context. Failures are counted, logged and sent to the audit hook.
+func (svc *serviceContext) authorizeClient(c *gin.Context, scope string) *requestError {
+	evt := auditEvent{Action: scope, Route: c.FullPath(), Target: c.Param("compute_id"), Role: "client", ClientIP: c.ClientIP()}
+	deny := func(client string, err *requestError) *requestError {
+		logf(c.Request.Context(), "WARNING: client %s denied access to %s: %s", client, scope, err.Message)
+		svc.Metrics.clientRequests.WithLabelValues(client, scope, "denied").Inc()
+		evt.Caller = client
+		evt.Reason = err.Message
+		svc.Audit(c.Request.Context(), evt)
+		return err
+	}
+
+	if hasClientCredentials(c) == false {
+		return deny("unknown", &requestError{StatusCode: http.StatusUnauthorized, Message: "client credentials are required"})
+	}
+	client, err := svc.Clients.authenticate(c.GetHeader(apiKeyHeader), c.GetHeader(serviceTokenHeader))
+	if err != nil {
+		return deny("unknown", &requestError{StatusCode: http.StatusUnauthorized, Message: err.Error()})
+	}
+	c.Set("client", client.name)
+	if client.scopes[scope] == false {
+		return deny(client.name, &requestError{StatusCode: http.StatusForbidden, Message: "scope is not allowed"})
+	}
+
+	logf(c.Request.Context(), "INFO: authorized client %s for %s", client.name, scope)
+	svc.Metrics.clientRequests.WithLabelValues(client.name, scope, "allowed").Inc()
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// serviceToken returns fill hold headers with a service token from issuer, signed with secret, that expires after life
+func serviceToken(t *testing.T, issuer, secret string, life time.Duration) map[string]string {
+	t.Helper()
+	claims := jwt.StandardClaims{Issuer: issuer}
+	if life != 0 {
+		claims.ExpiresAt = time.Now().Add(life).Unix()
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("unable to sign service token: %s", err.Error())
+	}
+	return map[string]string{serviceTokenHeader: signed, "SirsiSessionToken": "leo-staff-session"}
+}
+
+func TestClientRegistry(t *testing.T) {
+	key := hashAPIKey("key")
+	tests := []struct {
+		name    string
+		clients []clientConfig
+		err     string
+	}{
+		{"valid", testClients, ""},
+		{"no name", []clientConfig{{APIKeys: []string{key}}}, "name is required"},
+		{"duplicate name", []clientConfig{{Name: "a", APIKeys: []string{key}}, {Name: "a", TokenSecret: "s"}}, "more than once"},
+		{"no credentials", []clientConfig{{Name: "a", Scopes: []string{scopeMetadata}}}, "no api keys or token secret"},
+		{"unknown scope", []clientConfig{{Name: "a", Scopes: []string{"everything"}, APIKeys: []string{key}}}, "unknown scope"},
+		{"plain api key", []clientConfig{{Name: "a", APIKeys: []string{"key"}}}, "not a hex sha256 hash"},
+		{"shared api key", []clientConfig{{Name: "a", APIKeys: []string{key}}, {Name: "b", APIKeys: []string{key}}}, "share an api key"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newClientRegistry(tc.clients)
+			if tc.err == "" && err != nil {
+				t.Errorf("unexpected error %s", err.Error())
+			}
+			if tc.err != "" && (err == nil || strings.Contains(err.Error(), tc.err) == false) {
+				t.Errorf("expected error containing [%s], got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	h := newTestHarness(t)
+	var events []auditEvent
+	h.svc.Audit = func(ctx context.Context, evt auditEvent) { events = append(events, evt) }
+	rights := `{"name": "CC BY", "uri": "http://creativecommons.org/licenses/by/4.0/"}`
+	expectDenied := func(client, reason string) func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+		return func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+			if len(events) == 0 {
+				t.Fatalf("expected an audit event")
+			}
+			evt := events[len(events)-1]
+			if evt.Allowed || evt.Caller != client || strings.Contains(evt.Reason, reason) == false {
+				t.Errorf("unexpected audit event %+v", evt)
+			}
+		}
+	}
+
+	h.run(t, []routeTest{
+		{name: "no credentials", method: "POST", path: "/metadata/u2419229/update_rights", body: rights,
+			status: http.StatusUnauthorized, check: expectDenied("unknown", "credentials are required")},
+		{name: "unknown api key", method: "POST", path: "/metadata/u2419229/update_rights", body: rights,
+			headers: map[string]string{apiKeyHeader: "guess"}, status: http.StatusUnauthorized,
+			check: expectDenied("unknown", "unknown api key")},
+		{name: "scope not allowed", method: "POST", path: "/metadata/u2419229/update_rights", body: rights,
+			headers: clientAuth("virgo"), status: http.StatusForbidden, check: expectDenied("virgo", "scope is not allowed")},
+		{name: "service token", method: "POST", path: "/requests/fill_hold/X000222221",
+			headers: serviceToken(t, "leo", "leo-token-secret", time.Minute), status: http.StatusOK},
+		{name: "service token with wrong secret", method: "POST", path: "/requests/fill_hold/X000222221",
+			headers: serviceToken(t, "leo", "guess", time.Minute), status: http.StatusUnauthorized,
+			check: expectDenied("unknown", "invalid service token")},
+		{name: "service token for client without a secret", method: "POST", path: "/metadata/u2419229/update_rights", body: rights,
+			headers: serviceToken(t, "tracksys", "", time.Minute), status: http.StatusUnauthorized,
+			check: expectDenied("unknown", "unknown issuer")},
+		{name: "expired service token", method: "POST", path: "/requests/fill_hold/X000222221",
+			headers: serviceToken(t, "leo", "leo-token-secret", -time.Minute), status: http.StatusUnauthorized,
+			check: expectDenied("unknown", "expired")},
+		{name: "service token without expiration", method: "POST", path: "/requests/fill_hold/X000222221",
+			headers: serviceToken(t, "leo", "leo-token-secret", 0), status: http.StatusUnauthorized,
+			check: expectDenied("unknown", "must expire")},
+		{name: "long lived service token", method: "POST", path: "/requests/fill_hold/X000222221",
+			headers: serviceToken(t, "leo", "leo-token-secret", 24*time.Hour), status: http.StatusUnauthorized,
+			check: expectDenied("unknown", "must expire")},
+		{name: "patron data for client", method: "GET", path: "/users/mst3k/holds", headers: clientAuth("virgo"),
+			status: http.StatusOK},
+		{name: "patron data for client without scope", method: "GET", path: "/users/mst3k/holds", headers: clientAuth("tracksys"),
+			status: http.StatusForbidden, check: expectDenied("tracksys", "scope is not allowed")},
+		{name: "client is counted", method: "GET", path: "/metrics", status: http.StatusOK,
+			contains: []string{`ils_connector_client_requests_total{client="leo",outcome="allowed",scope="fill_hold"} 1`,
+				`ils_connector_client_requests_total{client="unknown",outcome="denied",scope="fill_hold"} 4`,
+				`ils_connector_client_requests_total{client="virgo",outcome="allowed",scope="patron_data"} 1`,
+				`ils_connector_client_requests_total{client="tracksys",outcome="denied",scope="patron_data"} 1`}},
+	})
+}
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
 )
 
 type sirsiConfig struct {
@@ -19,6 +31,11 @@ type secretsConfig struct {
 	UserJWTKey  string
 }
 
+type ilsConfig struct {
+	Backend    string
+	FixtureDir string
+}
+
 type solrConfig struct {
 	URL  string
 	Core string
@@ -33,10 +50,49 @@ type smtpConfig struct {
 	DevMode bool
 }
 
+type upstreamConfig struct {
+	BreakerThreshold int
+	BreakerCooldown  int
+	Retries          int
+	RetryDelay       int
+}
+
+type throttleConfig struct {
+	IPRate           int
+	TargetRate       int
+	LockoutThreshold int
+	LockoutSeconds   int
+}
+
+type noticesConfig struct {
+	File         string
+	HoldInterval int
+	DueInterval  int
+	DueDays      []int
+	DueOnce      bool
+}
+
+type autoRenewConfig struct {
+	Interval int
+	Days     int
+	MaxItems int
+	Pause    int
+}
+
 type serviceConfig struct {
+	ConfigFile         string
+	PrintConfig        bool
 	Port               int
+	LogLevel           string
+	RedactFields       []string
+	TrustedProxies     []string
+	AvailabilityTTL    int
+	PolicyRefresh      int
+	RulesFile          string
+	Features           []string
 	Secrets            secretsConfig
 	Sirsi              sirsiConfig
+	ILS                ilsConfig
 	Solr               solrConfig
 	VirgoURL           string
 	UserInfoURL        string
@@ -44,105 +100,353 @@ type serviceConfig struct {
 	CourseReserveEmail string
 	LawReserveEmail    string
 	SMTP               smtpConfig
+	Upstream           upstreamConfig
+	Throttle           throttleConfig
+	Notices            noticesConfig
+	AutoRenew          autoRenewConfig
+	ClientsFile        string
+	Clients            []clientConfig
+}
+
+// secretSettings are redacted when the configuration is printed. Each can also be read from the file named by
+// its -file param, such as -sirsipass-file, to keep it off the command line.
+var secretSettings = []string{"jwtkey", "userkey", "sirsipass", "smtppass"}
+
+// configSetting is the effective value of a param and the layer it came from: default, file, env or flag
+type configSetting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+func (cs configSetting) String() string {
+	val := cs.Value
+	if val != "" && slices.Contains(secretSettings, cs.Name) {
+		val = "********"
+	}
+	return fmt.Sprintf("%-18s = [%s] (%s)", cs.Name, val, cs.Source)
+}
+
+// configEnvName is the environment variable for a param; ILS_SIRSIURL for -sirsiurl, ILS_SIRSIPASS_FILE for -sirsipass-file
+func configEnvName(name string) string {
+	return "ILS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
 }
 
 func loadConfiguration() *serviceConfig {
+	cfg, settings, err := parseConfiguration(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if cfg != nil && cfg.PrintConfig {
+		for _, cs := range settings {
+			fmt.Println(cs.String())
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err := initLogging(os.Stdout, cfg.LogLevel, cfg.RedactFields); err != nil {
+		log.Fatal(err.Error())
+	}
+	if cfg.ClientsFile == "" {
+		log.Printf("WARNING: no clients param; internal routes will reject all requests")
+	}
+	for _, cs := range settings {
+		log.Printf("[CONFIG] %s", cs.String())
+	}
+	return cfg
+}
+
+// parseConfiguration merges the param defaults, the YAML or TOML file named by -config, ILS_* environment variables
+// and command line flags, in that order, and validates the result. All problems are returned in a single error.
+// The settings are returned even when the configuration is invalid so they can be printed.
+func parseConfiguration(args []string, lookupEnv func(string) (string, bool)) (*serviceConfig, []configSetting, error) {
 	var cfg serviceConfig
-	flag.IntVar(&cfg.Port, "port", 8080, "Service port (default 8080)")
+	fs := flag.NewFlagSet("ils-connector-ws", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", "", "YAML or TOML file of params; environment variables and flags override it")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "Print the effective configuration with secrets redacted and exit")
+	fs.IntVar(&cfg.Port, "port", 8080, "Service port (default 8080)")
+	fs.StringVar(&cfg.LogLevel, "loglevel", "info", "Log level [debug|info|warn|error]")
+	redactFields := fs.String("redact", strings.Join(defaultRedactFields, ","), "Comma separated names of fields masked in log output")
+	proxies := fs.String("trustedproxies", "", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For is used for the client IP; none if not set")
 
 	// secrets and keys
-	flag.StringVar(&cfg.Secrets.VirgoJWTKey, "jwtkey", "", "JWT signature key")
-	flag.StringVar(&cfg.Secrets.UserJWTKey, "userkey", "", "Auth Shared secret for user service")
+	fs.StringVar(&cfg.Secrets.VirgoJWTKey, "jwtkey", "", "JWT signature key")
+	fs.StringVar(&cfg.Secrets.UserJWTKey, "userkey", "", "Auth Shared secret for user service")
+	for _, name := range secretSettings {
+		fs.String(name+"-file", "", fmt.Sprintf("File containing the %s param", name))
+	}
+	fs.StringVar(&cfg.ClientsFile, "clients", "", "JSON file listing the internal clients, their credentials and scopes")
 
 	// sirsi config
-	flag.StringVar(&cfg.Sirsi.WebServicesURL, "sirsiurl", "", "Sirsi web services url")
-	flag.StringVar(&cfg.Sirsi.ScriptURL, "sirsiscript", "", "Sirsi script services url")
-	flag.StringVar(&cfg.Sirsi.User, "sirsiuser", "", "Sirsi user")
-	flag.StringVar(&cfg.Sirsi.Password, "sirsipass", "", "Sirsi password")
-	flag.StringVar(&cfg.Sirsi.ClientID, "sirsiclient", "", "Sirsi client ID")
-	flag.StringVar(&cfg.Sirsi.Library, "sirsilibrary", "UVA-LIB", "Sirsi Library ID")
+	fs.StringVar(&cfg.Sirsi.WebServicesURL, "sirsiurl", "", "Sirsi web services url")
+	fs.StringVar(&cfg.Sirsi.ScriptURL, "sirsiscript", "", "Sirsi script services url")
+	fs.StringVar(&cfg.Sirsi.User, "sirsiuser", "", "Sirsi user")
+	fs.StringVar(&cfg.Sirsi.Password, "sirsipass", "", "Sirsi password")
+	fs.StringVar(&cfg.Sirsi.ClientID, "sirsiclient", "", "Sirsi client ID")
+	fs.StringVar(&cfg.Sirsi.Library, "sirsilibrary", "UVA-LIB", "Sirsi Library ID")
+
+	// ILS backend; sirsi for production, fixture for local testing with recorded sirsi responses
+	fs.StringVar(&cfg.ILS.Backend, "ils", "sirsi", "ILS backend [sirsi|fixture]")
+	fs.StringVar(&cfg.ILS.FixtureDir, "ilsfixtures", "./cmd/testdata/ils", "Directory containing fixture ILS data")
+
+	// availability cache
+	fs.IntVar(&cfg.AvailabilityTTL, "availttl", 300, "Seconds to cache title availability; 0 disables the cache")
+
+	// location and library policies
+	fs.IntVar(&cfg.PolicyRefresh, "policyrefresh", 24, "Hours between background refreshes of the sirsi locations and libraries")
+	features := fs.String("features", "", "Comma separated feature flags to enable at startup: "+strings.Join(knownFeatureNames(), ", "))
+	fs.StringVar(&cfg.RulesFile, "rules", "./data/circulation-rules.yaml", "YAML file of circulation rules; reload with POST /circulation/rules/reload")
 
 	// Solr config
-	flag.StringVar(&cfg.Solr.URL, "solr", "", "Solr URL")
-	flag.StringVar(&cfg.Solr.Core, "core", "test_core", "Solr core")
+	fs.StringVar(&cfg.Solr.URL, "solr", "", "Solr URL")
+	fs.StringVar(&cfg.Solr.Core, "core", "test_core", "Solr core")
 
 	// external services
-	flag.StringVar(&cfg.VirgoURL, "virgo", "", "URL to Virgo")
-	flag.StringVar(&cfg.UserInfoURL, "userinfo", "", "URL to user info service")
+	fs.StringVar(&cfg.VirgoURL, "virgo", "", "URL to Virgo")
+	fs.StringVar(&cfg.UserInfoURL, "userinfo", "", "URL to user info service")
 
 	// email / smtp
-	flag.StringVar(&cfg.CourseReserveEmail, "cremail", "", "Email recipient for course reserves requests")
-	flag.StringVar(&cfg.LawReserveEmail, "lawemail", "", "Law Email recipient for course reserves requests")
-	flag.StringVar(&cfg.SMTP.Host, "smtphost", "", "SMTP Host")
-	flag.IntVar(&cfg.SMTP.Port, "smtpport", 0, "SMTP Port")
-	flag.StringVar(&cfg.SMTP.User, "smtpuser", "", "SMTP User")
-	flag.StringVar(&cfg.SMTP.Pass, "smtppass", "", "SMTP Password")
-	flag.StringVar(&cfg.SMTP.Sender, "smtpsender", "virgo4@virginia.edu", "SMTP sender email")
-	flag.BoolVar(&cfg.SMTP.DevMode, "stubsmtp", false, "Log email insted of sending (dev mode)")
+	fs.StringVar(&cfg.CourseReserveEmail, "cremail", "", "Email recipient for course reserves requests")
+	fs.StringVar(&cfg.LawReserveEmail, "lawemail", "", "Law Email recipient for course reserves requests")
+	fs.StringVar(&cfg.SMTP.Host, "smtphost", "", "SMTP Host")
+	fs.IntVar(&cfg.SMTP.Port, "smtpport", 0, "SMTP Port")
+	fs.StringVar(&cfg.SMTP.User, "smtpuser", "", "SMTP User")
+	fs.StringVar(&cfg.SMTP.Pass, "smtppass", "", "SMTP Password")
+	fs.StringVar(&cfg.SMTP.Sender, "smtpsender", "virgo4@virginia.edu", "SMTP sender email")
+	fs.BoolVar(&cfg.SMTP.DevMode, "stubsmtp", false, "Log email insted of sending (dev mode)")
 
-	// Illiad communications
-	flag.StringVar(&cfg.HSILLiadURL, "hsilliad", "", "HS Illiad API URL")
+	// upstream circuit breakers and retries
+	fs.IntVar(&cfg.Upstream.BreakerThreshold, "breakerthreshold", 5, "Consecutive failures that open the circuit breaker for an upstream service; 0 disables")
+	fs.IntVar(&cfg.Upstream.BreakerCooldown, "breakercooldown", 30, "Seconds an open circuit breaker waits before probing the upstream service")
+	fs.IntVar(&cfg.Upstream.Retries, "retries", 2, "Retries for failed idempotent upstream requests")
+	fs.IntVar(&cfg.Upstream.RetryDelay, "retrydelay", 200, "Base delay in milliseconds before retrying an upstream request")
+
+	// password and login throttling
+	fs.IntVar(&cfg.Throttle.IPRate, "authiprate", 30, "Requests a minute to the password and login routes from one client IP; 0 disables")
+	fs.IntVar(&cfg.Throttle.TargetRate, "authtargetrate", 5, "Requests a minute to the password and login routes for one barcode or username; 0 disables")
+	fs.IntVar(&cfg.Throttle.LockoutThreshold, "lockoutthreshold", 5, "Consecutive failed logins that lock out a barcode or username; 0 disables")
+	fs.IntVar(&cfg.Throttle.LockoutSeconds, "lockoutseconds", 60, "Seconds of the first lockout; doubles for each further failure, up to an hour")
 
-	flag.Parse()
+	// patron notifications
+	fs.StringVar(&cfg.Notices.File, "noticefile", "", "JSON file that records notification opt-outs and sent notices; kept in memory if not set")
+	fs.IntVar(&cfg.Notices.HoldInterval, "holdpoll", 15, "Minutes between checks of watched patrons' holds for notifications; 0 disables")
+	fs.IntVar(&cfg.Notices.DueInterval, "duecheck", 24, "Hours between checks of watched patrons' checkouts for due date reminders; 0 disables")
+	dueDays := fs.String("duedays", "3,1", "Comma separated days before the due date to send reminders")
+	fs.BoolVar(&cfg.Notices.DueOnce, "dueonce", false, "Check due dates once and exit; with -stubsmtp the reminders are only logged")
 
-	if cfg.Secrets.VirgoJWTKey == "" {
-		log.Fatal("jwtkey param is required")
+	// auto-renew
+	fs.IntVar(&cfg.AutoRenew.Interval, "autorenewcheck", 24, "Hours between auto-renew runs for patrons that have turned it on; 0 disables")
+	fs.IntVar(&cfg.AutoRenew.Days, "autorenewdays", 2, "Auto-renew checkouts due within this many days")
+	fs.IntVar(&cfg.AutoRenew.MaxItems, "autorenewmax", 200, "Most renewals attempted in one auto-renew run; 0 is no limit")
+	fs.IntVar(&cfg.AutoRenew.Pause, "autorenewpause", 250, "Milliseconds between renewals in an auto-renew run")
+
+	// Illiad communications
+	fs.StringVar(&cfg.HSILLiadURL, "hsilliad", "", "HS Illiad API URL")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
 	}
-	if cfg.Secrets.UserJWTKey == "" {
-		log.Fatal("userkey param is required")
+
+	problems := make([]string, 0)
+	sources := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+	if _, set := sources["config"]; set == false {
+		if val, found := lookupEnv(configEnvName("config")); found {
+			cfg.ConfigFile = val
+			sources["config"] = "env"
+		}
 	}
-	if cfg.Sirsi.WebServicesURL == "" {
-		log.Fatal("sirsiurl param is required")
+
+	fileValues := make(map[string]string)
+	if cfg.ConfigFile != "" {
+		vals, err := readConfigFile(cfg.ConfigFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for name, val := range vals {
+			if fs.Lookup(name) == nil || name == "config" {
+				problems = append(problems, fmt.Sprintf("%s: unknown param %s", cfg.ConfigFile, name))
+				continue
+			}
+			fileValues[name] = val
+		}
 	}
-	if cfg.Sirsi.ScriptURL == "" {
-		log.Fatal("sirsiscript param is required")
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != "" {
+			return
+		}
+		if val, found := lookupEnv(configEnvName(f.Name)); found {
+			if err := fs.Set(f.Name, val); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", configEnvName(f.Name), err.Error()))
+			}
+			sources[f.Name] = "env"
+		} else if val, found := fileValues[f.Name]; found {
+			if err := fs.Set(f.Name, val); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", cfg.ConfigFile, err.Error()))
+			}
+			sources[f.Name] = "file"
+		}
+	})
+
+	for _, name := range secretSettings {
+		fileName := fs.Lookup(name + "-file").Value.String()
+		if fileName == "" {
+			continue
+		}
+		if fs.Lookup(name).Value.String() != "" {
+			problems = append(problems, fmt.Sprintf("%s and %s-file params cannot both be set", name, name))
+			continue
+		}
+		raw, err := os.ReadFile(fileName)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unable to read %s-file: %s", name, err.Error()))
+			continue
+		}
+		fs.Set(name, strings.TrimSpace(string(raw)))
+		sources[name] = fmt.Sprintf("%s-file", name)
 	}
-	if cfg.Sirsi.User == "" {
-		log.Fatal("sirsiuser param is required")
+
+	settings := make([]configSetting, 0)
+	fs.VisitAll(func(f *flag.Flag) {
+		src := sources[f.Name]
+		if src == "" {
+			src = "default"
+		}
+		settings = append(settings, configSetting{Name: f.Name, Value: f.Value.String(), Source: src})
+	})
+
+	problems = append(problems, cfg.validate(*redactFields, *dueDays, *features, *proxies)...)
+	if len(problems) > 0 {
+		return &cfg, settings, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
 	}
-	if cfg.Sirsi.Password == "" {
-		log.Fatal("sirsipass param is required")
+	return &cfg, settings, nil
+}
+
+// readConfigFile reads the params in a YAML (.yaml or .yml) or TOML (.toml) file. Keys are the param names;
+// lists are joined with commas.
+func readConfigFile(fileName string) (map[string]string, error) {
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %s", err.Error())
 	}
-	if cfg.Sirsi.ClientID == "" {
-		log.Fatal("sirsiclient param is required")
+	data := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &data)
+	case ".toml":
+		err = toml.Unmarshal(raw, &data)
+	default:
+		return nil, fmt.Errorf("config file %s must be .yaml, .yml or .toml", fileName)
 	}
-	if cfg.VirgoURL == "" {
-		log.Fatal("virgo param is required")
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %s", fileName, err.Error())
 	}
-	if cfg.UserInfoURL == "" {
-		log.Fatal("userinfo param is required")
+
+	out := make(map[string]string)
+	for name, val := range data {
+		switch v := val.(type) {
+		case []any:
+			vals := make([]string, 0, len(v))
+			for _, item := range v {
+				vals = append(vals, fmt.Sprint(item))
+			}
+			out[name] = strings.Join(vals, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("config file %s: %s must be a value or list", fileName, name)
+		default:
+			out[name] = fmt.Sprint(v)
+		}
 	}
-	if cfg.Solr.URL == "" || cfg.Solr.Core == "" {
-		log.Fatal("solr and core params are required")
+	return out, nil
+}
+
+// validate checks all params, finishes the list params and loads the clients file. It returns every problem found.
+func (cfg *serviceConfig) validate(redactFields, dueDays, features, proxies string) []string {
+	problems := make([]string, 0)
+	required := func(val, name string) {
+		if val == "" {
+			problems = append(problems, fmt.Sprintf("%s param is required", name))
+		}
 	}
-	if cfg.HSILLiadURL == "" {
-		log.Fatal("hsilliad param is required")
+
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid log level %s", cfg.LogLevel))
 	}
-	if cfg.CourseReserveEmail == "" {
-		log.Fatal("cremail param is required")
+	cfg.RedactFields = strings.Split(redactFields, ",")
+	cfg.Notices.DueDays = nil
+	for _, d := range strings.Split(dueDays, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(d))
+		if err != nil || days <= 0 {
+			problems = append(problems, "duedays param must be a list of positive numbers of days")
+			break
+		}
+		cfg.Notices.DueDays = append(cfg.Notices.DueDays, days)
 	}
-	if cfg.LawReserveEmail == "" {
-		log.Fatal("lawemail param is required")
+
+	cfg.TrustedProxies = nil
+	for _, proxy := range strings.Split(proxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				problems = append(problems, fmt.Sprintf("trustedproxies param: %s is not an IP or CIDR", proxy))
+				continue
+			}
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
 	}
 
-	log.Printf("[CONFIG] port          = [%d]", cfg.Port)
-	log.Printf("[CONFIG] sirsiurl      = [%s]", cfg.Sirsi.WebServicesURL)
-	log.Printf("[CONFIG] sirsiscript   = [%s]", cfg.Sirsi.ScriptURL)
-	log.Printf("[CONFIG] sirsiuser     = [%s]", cfg.Sirsi.User)
-	log.Printf("[CONFIG] sirsiclient   = [%s]", cfg.Sirsi.ClientID)
-	log.Printf("[CONFIG] sirsilibrary  = [%s]", cfg.Sirsi.Library)
-	log.Printf("[CONFIG] solr          = [%s]", cfg.Solr.URL)
-	log.Printf("[CONFIG] core          = [%s]", cfg.Solr.Core)
-	if cfg.SMTP.User != "" {
-		log.Printf("[CONFIG] smtpuser      = [%s]", cfg.SMTP.User)
+	enabled, err := parseFeatures(features)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("features param: %s", err.Error()))
 	}
-	log.Printf("[CONFIG] smtpsender    = [%s]", cfg.SMTP.Sender)
-	log.Printf("[CONFIG] stubsmtp      = [%t]", cfg.SMTP.DevMode)
-	log.Printf("[CONFIG] cremail       = [%s]", cfg.CourseReserveEmail)
-	log.Printf("[CONFIG] lawemail      = [%s]", cfg.LawReserveEmail)
-	log.Printf("[CONFIG] hsilliad      = [%s]", cfg.HSILLiadURL)
-	log.Printf("[CONFIG] virgo         = [%s]", cfg.VirgoURL)
-	log.Printf("[CONFIG] userinfo      = [%s]", cfg.UserInfoURL)
+	cfg.Features = enabled
 
-	return &cfg
+	if cfg.PolicyRefresh <= 0 {
+		problems = append(problems, "policyrefresh param must be a positive number of hours")
+	}
+	required(cfg.Secrets.VirgoJWTKey, "jwtkey")
+	required(cfg.Secrets.UserJWTKey, "userkey")
+	if cfg.ClientsFile != "" {
+		clients, err := loadClientsFile(cfg.ClientsFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		cfg.Clients = clients
+	}
+	if cfg.ILS.Backend != "sirsi" && cfg.ILS.Backend != "fixture" {
+		problems = append(problems, "ils param must be sirsi or fixture")
+	}
+	if cfg.ILS.Backend == "sirsi" {
+		required(cfg.Sirsi.WebServicesURL, "sirsiurl")
+		required(cfg.Sirsi.ScriptURL, "sirsiscript")
+		required(cfg.Sirsi.User, "sirsiuser")
+		required(cfg.Sirsi.Password, "sirsipass")
+		required(cfg.Sirsi.ClientID, "sirsiclient")
+	} else if cfg.Sirsi.User == "" {
+		// the fixture backend accepts any staff credentials; supply some for the service session
+		cfg.Sirsi.User = "fixture"
+		cfg.Sirsi.Password = "fixture"
+	}
+	required(cfg.VirgoURL, "virgo")
+	required(cfg.UserInfoURL, "userinfo")
+	required(cfg.Solr.URL, "solr")
+	required(cfg.Solr.Core, "core")
+	required(cfg.HSILLiadURL, "hsilliad")
+	required(cfg.CourseReserveEmail, "cremail")
+	required(cfg.LawReserveEmail, "lawemail")
+	return problems
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write %s: %s", name, err.Error())
+		}
+		return fn
+	}
+	required := map[string]string{"ILS_JWTKEY": "jwt", "ILS_USERKEY": "user", "ILS_ILS": "fixture", "ILS_VIRGO": "https://virgo",
+		"ILS_USERINFO": "https://userinfo", "ILS_SOLR": "https://solr", "ILS_HSILLIAD": "https://illiad",
+		"ILS_CREMAIL": "cr@virginia.edu", "ILS_LAWEMAIL": "law@virginia.edu"}
+	env := func(extra map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			if val, found := extra[name]; found {
+				return val, true
+			}
+			val, found := required[name]
+			return val, found
+		}
+	}
+	yamlFile := write("config.yaml", "port: 9000\nsolr: https://file-solr\nduedays: [7, 2]\nsirsipass-file: "+write("sirsipass", "s3cret\n")+"\n")
+	setting := func(settings []configSetting, name string) configSetting {
+		for _, cs := range settings {
+			if cs.Name == name {
+				return cs
+			}
+		}
+		return configSetting{}
+	}
+
+	t.Run("every problem is reported", func(t *testing.T) {
+		_, _, err := parseConfiguration([]string{"-ils", "sirsi", "-duedays", "x", "-trustedproxies", "10.0.0.0/8,proxy"}, env(map[string]string{"ILS_JWTKEY": "", "ILS_SOLR": ""}))
+		if err == nil {
+			t.Fatalf("expected an invalid configuration")
+		}
+		for _, want := range []string{"jwtkey param is required", "sirsiurl param is required", "sirsipass param is required",
+			"solr param is required", "duedays param must be", "trustedproxies param: proxy is not an IP or CIDR"} {
+			if strings.Contains(err.Error(), want) == false {
+				t.Errorf("expected [%s] in %s", want, err.Error())
+			}
+		}
+	})
+	t.Run("layers", func(t *testing.T) {
+		cfg, settings, err := parseConfiguration([]string{"-config", yamlFile, "-port", "9100"},
+			env(map[string]string{"ILS_SOLR": "https://env-solr", "ILS_SIRSIUSER": "staff"}))
+		if err != nil {
+			t.Fatalf("unexpected error %s", err.Error())
+		}
+		if cfg.Port != 9100 || cfg.Solr.URL != "https://env-solr" || cfg.Sirsi.Password != "s3cret" || cfg.Solr.Core != "test_core" {
+			t.Errorf("unexpected configuration %+v", cfg)
+		}
+		if len(cfg.Notices.DueDays) != 2 || cfg.Notices.DueDays[0] != 7 {
+			t.Errorf("expected due days from the file, got %v", cfg.Notices.DueDays)
+		}
+		for name, source := range map[string]string{"port": "flag", "solr": "env", "duedays": "file", "sirsipass": "sirsipass-file", "core": "default"} {
+			if got := setting(settings, name).Source; got != source {
+				t.Errorf("expected %s from %s, got %s", name, source, got)
+			}
+		}
+	})
+	t.Run("secrets are redacted", func(t *testing.T) {
+		_, settings, _ := parseConfiguration([]string{"-config", yamlFile}, env(nil))
+		if line := setting(settings, "sirsipass").String(); strings.Contains(line, "s3cret") || strings.Contains(line, "********") == false {
+			t.Errorf("secret was not redacted: %s", line)
+		}
+		if line := setting(settings, "port").String(); strings.Contains(line, "[9000] (file)") == false {
+			t.Errorf("expected the port from the file: %s", line)
+		}
+	})
+	t.Run("toml file", func(t *testing.T) {
+		fn := write("config.toml", "core = \"toml_core\"\nstubsmtp = true\nsirsiurl = 1\nbogus = \"x\"\n")
+		_, _, err := parseConfiguration(nil, env(map[string]string{"ILS_CONFIG": fn}))
+		if err == nil || strings.Contains(err.Error(), "unknown param bogus") == false {
+			t.Errorf("expected an unknown param error, got %v", err)
+		}
+		os.WriteFile(fn, []byte("core = \"toml_core\"\nstubsmtp = true\n"), 0644)
+		cfg, _, err := parseConfiguration(nil, env(map[string]string{"ILS_CONFIG": fn}))
+		if err != nil || cfg.Solr.Core != "toml_core" || cfg.SMTP.DevMode == false {
+			t.Errorf("unexpected configuration %+v: %v", cfg, err)
+		}
+	})
+	t.Run("secret and secret file", func(t *testing.T) {
+		_, _, err := parseConfiguration([]string{"-config", yamlFile, "-sirsipass", "x"}, env(nil))
+		if err == nil || strings.Contains(err.Error(), "sirsipass and sirsipass-file params cannot both be set") == false {
+			t.Errorf("expected a conflict, got %v", err)
+		}
+	})
+	t.Run("invalid env value", func(t *testing.T) {
+		_, _, err := parseConfiguration(nil, env(map[string]string{"ILS_PORT": "eighty"}))
+		if err == nil || strings.Contains(err.Error(), "ILS_PORT") == false {
+			t.Errorf("expected an invalid port, got %v", err)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -140,31 +141,25 @@ type reserveRequest struct {
 }
 
 func (svc *serviceContext) validateCourseReserves(c *gin.Context) {
+	ctx := c.Request.Context()
 	var req struct {
 		Items []string `json:"items"`
 	}
 	err := c.ShouldBindJSON(&req)
 	if err != nil {
-		log.Printf("INFO: Unable to parse validate reserves request: %s", err.Error())
+		logf(ctx, "INFO: Unable to parse validate reserves request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	log.Printf("INFO: validate course reserves %v", req.Items)
+	logf(ctx, "INFO: validate course reserves %v", req.Items)
 
 	idMap := make(map[string]string)
-	var bits []string
 	for _, key := range req.Items {
-		cleanKey := cleanCatKey(key)
-		idMap[cleanKey] = key
-		bits = append(bits, fmt.Sprintf("%s{CKEY}", cleanKey))
+		idMap[cleanCatKey(key)] = key
 	}
-	keys := strings.Join(bits, " OR ")
-	query := fmt.Sprintf("GENERAL:\"%s\"", keys)
-	fields := "callList{itemList{itemType,library}}"
-	uri := fmt.Sprintf("/catalog/bib/search?includeFields=%s&q=%s&ct=%d", fields, url.QueryEscape(query), len(req.Items))
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.HTTPClient, uri)
+	sirsiRaw, sirsiErr := svc.ILS.searchBibs(ctx, req.Items)
 	if sirsiErr != nil {
-		log.Printf("ERROR: reserve item lookup failed: %s", sirsiErr.Message)
+		logf(ctx, "ERROR: reserve item lookup failed: %s", sirsiErr.Message)
 		c.String(sirsiErr.StatusCode, sirsiErr.Message)
 		return
 	}
@@ -172,13 +167,19 @@ func (svc *serviceContext) validateCourseReserves(c *gin.Context) {
 	var resp sirsiBibSearchResp
 	parseErr := json.Unmarshal(sirsiRaw, &resp)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse search response: %s", parseErr.Error())
+		logf(ctx, "ERROR: unable to parse search response: %s", parseErr.Error())
 		c.String(http.StatusInternalServerError, parseErr.Error())
 		return
 	}
 
 	out := make([]validateRespRec, 0)
 	for cleanKey, origID := range idMap {
+		if ctx.Err() != nil {
+			reqErr := contextError(ctx)
+			logf(ctx, "INFO: course reserve validation stopped: %s", reqErr.Message)
+			c.String(reqErr.StatusCode, reqErr.Message)
+			return
+		}
 		respRec := validateRespRec{ID: origID, IsVideo: false, Reserve: false}
 
 		// find the item in the sirsi response if possible
@@ -189,21 +190,19 @@ func (svc *serviceContext) validateCourseReserves(c *gin.Context) {
 			}
 		}
 		if rec == nil {
-			log.Printf("INFO: %s not found in sirsi", origID)
+			logf(ctx, "INFO: %s not found in sirsi", origID)
 		} else {
 			for _, cl := range rec.Fields.CallList {
 				for _, item := range cl.Fields.ItemList {
 					itemType := item.Fields.ItemType.Key
-					respRec.IsVideo = isVideo(itemType)
+					respRec.IsVideo = svc.Rules.isVideo(itemType)
 					if respRec.IsVideo == true {
-						log.Printf("INFO: %s is video (%s) and may be a candidate for reserve", rec.Key, itemType)
+						logf(ctx, "INFO: %s is video (%s) and may be a candidate for reserve", rec.Key, itemType)
 						lib := rec.Fields.CallList[0].Fields.ItemList[0].Fields.Library.Key
-						if lib == "HEALTHSCI" || lib == "SPEC-COLL" {
-							log.Printf("INFO: cannot reserve %s: invalid library %s", respRec.ID, lib)
-						} else if lib == "LAW" && itemType == "VIDEO-DVD" {
-							log.Printf("INFO: cannot reserve %s: %s from %s", respRec.ID, itemType, lib)
+						if reason := svc.Rules.reserveBlocked(lib, itemType); reason != "" {
+							logf(ctx, "INFO: cannot reserve %s: %s", respRec.ID, reason)
 						} else {
-							log.Printf("INFO: reserve %s type %s from library %s is ok", respRec.ID, itemType, lib)
+							logf(ctx, "INFO: reserve %s type %s from library %s is ok", respRec.ID, itemType, lib)
 							respRec.Reserve = true
 							break
 						}
@@ -219,13 +218,13 @@ func (svc *serviceContext) validateCourseReserves(c *gin.Context) {
 		// they are actually a video/streaming video and flag correctly
 		// (sirsi have enout info to determine this completely)
 		if respRec.IsVideo == false || respRec.Reserve == false {
-			log.Printf("INFO: sirsi data has video %t and reserve %t; check solr doc", respRec.IsVideo, respRec.Reserve)
-			solrDoc, err := svc.getSolrDoc(respRec.ID)
+			logf(ctx, "INFO: sirsi data has video %t and reserve %t; check solr doc", respRec.IsVideo, respRec.Reserve)
+			solrDoc, err := svc.getSolrDoc(ctx, respRec.ID)
 			if err != nil {
-				log.Printf("ERROR: unable to get solr doc for %s: %s", respRec.ID, err.Error())
+				logf(ctx, "ERROR: unable to get solr doc for %s: %s", respRec.ID, err.Error())
 			} else {
 				if (solrDoc.Pool[0] == "video" && slices.Contains(solrDoc.Location, "Internet materials")) || slices.Contains(solrDoc.Source, "Avalon") {
-					log.Printf("INFO: per solr document, %s is a video", respRec.ID)
+					logf(ctx, "INFO: per solr document, %s is a video", respRec.ID)
 					respRec.IsVideo = true
 					respRec.Reserve = true
 				}
@@ -238,10 +237,11 @@ func (svc *serviceContext) validateCourseReserves(c *gin.Context) {
 }
 
 func (svc *serviceContext) createCourseReserves(c *gin.Context) {
+	ctx := c.Request.Context()
 	var reserveReq reserveRequest
 	err := c.ShouldBindJSON(&reserveReq)
 	if err != nil {
-		log.Printf("ERROR: Unable to parse request: %s", err.Error())
+		logf(ctx, "ERROR: Unable to parse request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
@@ -250,25 +250,25 @@ func (svc *serviceContext) createCourseReserves(c *gin.Context) {
 	reserveReq.Video = make([]*requestItem, 0)
 	reserveReq.NonVideo = make([]*requestItem, 0)
 	v4Claims, _ := getVirgoClaims(c)
-	log.Printf("INFO: %s requests creation of course reserves", v4Claims.UserID)
+	logf(ctx, "INFO: %s requests creation of course reserves", v4Claims.UserID)
 
 	// Iterate thru all of the requested items, pull availability and stuff it into
 	// an array based on type. Separate emails will go out for video / non-video
 	for _, item := range reserveReq.Items {
 		item.VirgoURL = fmt.Sprintf("%s/sources/%s/items/%s", svc.VirgoURL, item.Pool, item.CatalogKey)
-		avail, err := svc.getCourseReserveItemAvailability(item.CatalogKey)
+		avail, err := svc.getCourseReserveItemAvailability(ctx, item.CatalogKey)
 		if err != nil {
-			log.Printf("WARN: %s, ", err.Error())
+			logf(ctx, "WARN: %s, ", err.Error())
 		}
 		item.Availability = avail
 		if len(item.Availability) > reserveReq.MaxAvail {
 			reserveReq.MaxAvail = len(item.Availability)
 		}
 		if item.IsVideo {
-			log.Printf("INFO: %s : %s is a video", item.CatalogKey, item.Title)
+			logf(ctx, "INFO: %s : %s is a video", item.CatalogKey, item.Title)
 			reserveReq.Video = append(reserveReq.Video, &item)
 		} else {
-			log.Printf("INFO: %s : %s is not a video", item.CatalogKey, item.Title)
+			logf(ctx, "INFO: %s : %s is not a video", item.CatalogKey, item.Title)
 			reserveReq.NonVideo = append(reserveReq.NonVideo, &item)
 		}
 	}
@@ -289,12 +289,12 @@ func (svc *serviceContext) createCourseReserves(c *gin.Context) {
 		tpl := template.Must(template.New(templateFile).Funcs(funcs).ParseFiles(fmt.Sprintf("templates/%s", templateFile)))
 		err = tpl.Execute(&renderedEmail, reserveReq)
 		if err != nil {
-			log.Printf("ERROR: Unable to render %s: %s", templateFile, err.Error())
+			logf(ctx, "ERROR: Unable to render %s: %s", templateFile, err.Error())
 			c.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		log.Printf("Generate SMTP message for %s", templateFile)
+		logf(ctx, "Generate SMTP message for %s", templateFile)
 		// NOTES for recipient: For any reserve library location other than Law, the email should be sent to
 		// svc.CourseReserveEmail with the from address of the patron submitting the request.
 		// For Law it should send the email to svc.LawReserveEmail AND the patron
@@ -303,7 +303,7 @@ func (svc *serviceContext) createCourseReserves(c *gin.Context) {
 		from := svc.SMTP.Sender
 		subjectName := reserveReq.Request.Name
 		if reserveReq.Request.Library == "law" {
-			log.Printf("The reserve library is law. Send request to law %s and requestor %s from sender %s",
+			logf(ctx, "The reserve library is law. Send request to law %s and requestor %s from sender %s",
 				svc.LawReserveEmail, reserveReq.Request.Email, svc.SMTP.Sender)
 			to = append(to, svc.LawReserveEmail)
 			to = append(to, reserveReq.Request.Email)
@@ -311,7 +311,7 @@ func (svc *serviceContext) createCourseReserves(c *gin.Context) {
 				to = append(to, reserveReq.Request.InstructorEmail)
 			}
 		} else {
-			log.Printf("The reserve library is not law.")
+			logf(ctx, "The reserve library is not law.")
 			to = append(to, svc.CourseReserveEmail)
 			if reserveReq.Request.InstructorEmail != "" {
 				from = reserveReq.Request.InstructorEmail
@@ -326,7 +326,7 @@ func (svc *serviceContext) createCourseReserves(c *gin.Context) {
 		eRequest := emailRequest{Subject: subject, To: to, CC: cc, From: from, Body: renderedEmail.String()}
 		sendErr := svc.sendEmail(&eRequest)
 		if sendErr != nil {
-			log.Printf("ERROR: Unable to send reserve email: %s", sendErr.Error())
+			logf(ctx, "ERROR: Unable to send reserve email: %s", sendErr.Error())
 			c.String(http.StatusInternalServerError, sendErr.Error())
 			return
 		}
@@ -335,9 +335,10 @@ func (svc *serviceContext) createCourseReserves(c *gin.Context) {
 }
 
 func (svc *serviceContext) searchCourseReserves(c *gin.Context) {
+	ctx := c.Request.Context()
 	searchType := c.Query("type")
 	if searchType != "instructor_name" && searchType != "course_id" {
-		log.Printf("ERROR: invalid course reserves search type: %s", searchType)
+		logf(ctx, "ERROR: invalid course reserves search type: %s", searchType)
 		c.String(http.StatusBadRequest, fmt.Sprintf("%s is not a valid search type", searchType))
 		return
 	}
@@ -347,7 +348,7 @@ func (svc *serviceContext) searchCourseReserves(c *gin.Context) {
 		queryStr += "*"
 	}
 
-	log.Printf("INFO: search [%s] course reserves for [%s]", searchType, queryStr)
+	logf(ctx, "INFO: search [%s] course reserves for [%s]", searchType, queryStr)
 
 	fl := url.QueryEscape("id,reserve_id_course_name_a,title_a,work_primary_author_a,call_number_a")
 	queryParam := "reserve_id_a"
@@ -367,17 +368,17 @@ func (svc *serviceContext) searchCourseReserves(c *gin.Context) {
 	queryParam = fmt.Sprintf("%s:%s", queryParam, queryStr)
 	solrURL := fmt.Sprintf("select?fl=%s&q=%s&rows=5000", fl, queryParam)
 
-	respBytes, solrErr := svc.solrGet(solrURL)
+	respBytes, solrErr := svc.solrGet(ctx, solrURL)
 	if solrErr != nil {
-		log.Printf("ERROR: solr course reserves search failed: %s", solrErr.Message)
-		// c.String(solrErr
+		logf(ctx, "ERROR: solr course reserves search failed: %s", solrErr.Message)
+		c.String(solrErr.StatusCode, solrErr.Message)
 		return
 	}
 	var solrResp searchReservesResponse
 	if err := json.Unmarshal(respBytes, &solrResp); err != nil {
-		log.Printf("ERROR: unable to parse solr response: %s.", err.Error())
+		logf(ctx, "ERROR: unable to parse solr response: %s.", err.Error())
 	}
-	log.Printf("INFO: found [%d] matches", solrResp.Response.NumFound)
+	logf(ctx, "INFO: found [%d] matches", solrResp.Response.NumFound)
 
 	if searchType == "instructor_name" {
 		reserves := extractInstructorReserves(rawQueryStr, solrResp.Response.Docs)
@@ -389,13 +390,13 @@ func (svc *serviceContext) searchCourseReserves(c *gin.Context) {
 	c.JSON(http.StatusOK, reserves)
 }
 
-func (svc *serviceContext) getCourseReserveItemAvailability(catKey string) ([]availabilityInfo, error) {
-	log.Printf("INFO: check if item %s is available for course reserve", catKey)
-	bibResp, sirsiErr := svc.getSirsiItem(catKey)
+func (svc *serviceContext) getCourseReserveItemAvailability(ctx context.Context, catKey string) ([]availabilityInfo, error) {
+	logf(ctx, "INFO: check if item %s is available for course reserve", catKey)
+	bibResp, sirsiErr := svc.getSirsiItem(ctx, catKey)
 	if sirsiErr != nil {
 		return nil, fmt.Errorf("get sirsi item availability failed %s", sirsiErr.string())
 	}
-	availItems := svc.parseItemsFromSirsi(catKey, bibResp)
+	availItems := svc.parseItemsFromSirsi(ctx, catKey, bibResp)
 
 	out := make([]availabilityInfo, 0)
 	for _, availItem := range availItems {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateCourseReserves(t *testing.T) {
+	h := newTestHarness(t)
+
+	h.run(t, []routeTest{
+		{name: "invalid request", method: "POST", path: "/course_reserves/validate", headers: clientAuth("virgo"), body: `{"items": `,
+			status: http.StatusBadRequest},
+		{name: "video, book and streaming video", method: "POST", path: "/course_reserves/validate", headers: clientAuth("virgo"),
+			body:   `{"items": ["u5841451", "u2419229", "u7770001"]}`,
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var recs []validateRespRec
+				if err := json.Unmarshal(resp.Body.Bytes(), &recs); err != nil {
+					t.Fatalf("unable to parse response: %s", err.Error())
+				}
+				expect := map[string]validateRespRec{
+					"u5841451": {ID: "u5841451", IsVideo: true, Reserve: true},
+					"u2419229": {ID: "u2419229", IsVideo: false, Reserve: false},
+					"u7770001": {ID: "u7770001", IsVideo: true, Reserve: true},
+				}
+				if len(recs) != len(expect) {
+					t.Fatalf("expected %d results, got %d", len(expect), len(recs))
+				}
+				for _, rec := range recs {
+					if rec != expect[rec.ID] {
+						t.Errorf("expected %+v, got %+v", expect[rec.ID], rec)
+					}
+				}
+				reqs := h.sirsi.received("GET", "/catalog/bib/search")
+				if len(reqs) != 1 || strings.Contains(reqs[0].query.Get("q"), "5841451{CKEY} OR 2419229{CKEY}") == false {
+					t.Errorf("unexpected sirsi search query")
+				}
+			}},
+		{name: "sirsi search failure", method: "POST", path: "/course_reserves/validate", headers: clientAuth("virgo"), body: `{"items": ["u5841451"]}`,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/search", sirsiMessageResponse(http.StatusBadRequest, "invalidQuery", "The query is invalid."))
+			},
+			status: http.StatusBadRequest, contains: []string{`"code":"invalidQuery"`}},
+	})
+}
+
+func TestSearchCourseReserves(t *testing.T) {
+	h := newTestHarness(t)
+
+	h.run(t, []routeTest{
+		{name: "invalid search type", method: "GET", path: "/course_reserves/search?type=title&query=law",
+			status: http.StatusBadRequest, contains: []string{"title is not a valid search type"}},
+		{name: "course id", method: "GET", path: "/course_reserves/search?type=course_id&query=law",
+			status:   http.StatusOK,
+			contains: []string{`"courseID":"LAW 7001"`, `"courseName":"Film and the Law"`, `"instructorName":"Klaus, Ann"`, `"id":"u5841451"`},
+			excludes: []string{"HIST 2001", "FILM 2000"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.solr.received("GET", "/test_core/select")
+				if len(reqs) != 1 || reqs[0].query.Get("q") != "reserve_id_a:LAW*" {
+					t.Errorf("unexpected solr query")
+				}
+			}},
+		{name: "instructor", method: "GET", path: "/course_reserves/search?type=instructor_name&query=jeff",
+			status:   http.StatusOK,
+			contains: []string{`"instructorName":"Jefferson, Tom"`, `"courseID":"HIST 2001"`, `"title":"Notes on the state of Virginia"`},
+			excludes: []string{"Klaus"}},
+		{name: "solr failure", method: "GET", path: "/course_reserves/search?type=course_id&query=law",
+			setup: func(h *testHarness) {
+				h.solr.override("GET", "/test_core/select", fakeResponse{status: http.StatusServiceUnavailable, body: "solr is down"})
+			},
+			status: http.StatusServiceUnavailable, contains: []string{"solr is down"}},
+	})
+}
+
+func TestCreateCourseReserves(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	items := `"items": [
+		{"pool": "uva_library", "isVideo": true, "catalogKey": "u5841451", "title": "Casablanca", "period": "3 days"},
+		{"pool": "uva_library", "isVideo": false, "catalogKey": "u2419229", "title": "Notes on the state of Virginia", "period": "2 hours"}]`
+	lawReq := `{"userID": "mst3k", "request": {"onBehalfOf": "no", "name": "Mystery Science", "email": "mst3k@virginia.edu",
+		"course": "LAW 7001", "semester": "Fall", "library": "law", "period": "3 days"}, ` + items + `}`
+	behalfReq := `{"userID": "mst3k", "request": {"onBehalfOf": "yes", "instructorName": "Ann Klaus", "instructorEmail": "ak1@virginia.edu",
+		"name": "Mystery Science", "email": "mst3k@virginia.edu", "course": "FILM 2000", "semester": "Spring", "library": "clemons"}, ` + items + `}`
+
+	h.run(t, []routeTest{
+		{name: "missing jwt", method: "POST", path: "/course_reserves", body: lawReq, status: http.StatusUnauthorized},
+		{name: "invalid request", method: "POST", path: "/course_reserves", body: `{"items": 1}`, headers: auth,
+			status: http.StatusBadRequest},
+		{name: "law reserves", method: "POST", path: "/course_reserves", body: lawReq, headers: auth,
+			status: http.StatusOK, contains: []string{"Reserve emails sent"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				sent := h.smtp.sent()
+				if len(sent) != 2 {
+					t.Fatalf("expected video and non-video emails, got %d", len(sent))
+				}
+				for _, msg := range sent {
+					if msg.From != "virgo4@virginia.edu" {
+						t.Errorf("expected sender virgo4@virginia.edu, got %s", msg.From)
+					}
+					if slices.Equal(msg.To, []string{"lawreserves@virginia.edu", "mst3k@virginia.edu"}) == false {
+						t.Errorf("unexpected recipients %v", msg.To)
+					}
+					if strings.Contains(msg.Data, "Subject: Fall - Mystery Science: LAW 7001") == false {
+						t.Errorf("unexpected message %s", msg.Data)
+					}
+				}
+			}},
+		{name: "on behalf of instructor", method: "POST", path: "/course_reserves", body: behalfReq, headers: auth,
+			status: http.StatusOK, contains: []string{"Reserve emails sent"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				sent := h.smtp.sent()
+				if len(sent) != 2 {
+					t.Fatalf("expected video and non-video emails, got %d", len(sent))
+				}
+				for _, msg := range sent {
+					if msg.From != "ak1@virginia.edu" {
+						t.Errorf("expected sender ak1@virginia.edu, got %s", msg.From)
+					}
+					if slices.Equal(msg.To, []string{"reserves@virginia.edu", "mst3k@virginia.edu"}) == false {
+						t.Errorf("unexpected recipients %v", msg.To)
+					}
+					if strings.Contains(msg.Data, "Subject: Spring - Ann Klaus: FILM 2000") == false {
+						t.Errorf("unexpected message %s", msg.Data)
+					}
+				}
+			}},
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusClientClosedRequest is reported when the caller disconnects before a request completes
+const statusClientClosedRequest = 499
+
+// request deadline budgets. A budget is the total time a request may take, including all upstream
+// calls and retries; once it is spent, upstream calls still in flight are cancelled.
+const (
+	// single lookups in sirsi, solr or user-ws
+	shortBudget = 15 * time.Second
+	// requests that make several upstream calls, like availability and placing holds
+	standardBudget = 30 * time.Second
+	// requests that use the slow client or fan out to many upstream calls, like checkouts and batch availability
+	longBudget = 60 * time.Second
+	// requests that stream results as they complete, like renewing all checkouts
+	streamBudget = 5 * time.Minute
+)
+
+// routeBudgets are the routes that do not use the standard budget
+var routeBudgets = map[string]time.Duration{
+	"/healthcheck":                     shortBudget,
+	"/reauthenticate":                  shortBudget,
+	"/availability/list":               shortBudget,
+	"/availability/batch":              longBudget,
+	"/course_reserves":                 longBudget,
+	"/users/check_password":            shortBudget,
+	"/users/change_password":           shortBudget,
+	"/users/sirsi_staff_login":         shortBudget,
+	"/users/:compute_id/bills":         shortBudget,
+	"/users/:compute_id/checkouts":     longBudget,
+	"/users/:compute_id/checkouts.csv": longBudget,
+	"/users/:compute_id/holds":         longBudget,
+	"/requests/renew":                  longBudget,
+	"/requests/renew/all":              streamBudget,
+	"/requests/fill_hold/:barcode":     longBudget,
+}
+
+func routeBudget(route string) time.Duration {
+	if budget, ok := routeBudgets[route]; ok {
+		return budget
+	}
+	return standardBudget
+}
+
+// deadlineMiddleware limits the time spent on a request to the budget for its route. The deadline is
+// added to the request context, which the server also cancels if the caller disconnects.
+func deadlineMiddleware(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), routeBudget(c.FullPath()))
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+	if ctx.Err() != nil {
+		logf(ctx, "INFO: %s %s ended with %s", c.Request.Method, c.FullPath(), contextError(ctx).Message)
+	}
+}
+
+// contextError converts the error of a done context to a request error
+func contextError(ctx context.Context) *requestError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &requestError{StatusCode: http.StatusGatewayTimeout, Message: "request deadline exceeded"}
+	}
+	return &requestError{StatusCode: statusClientClosedRequest, Message: "request cancelled by client"}
+}
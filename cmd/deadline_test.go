@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setBudget changes the deadline budget for a route for the rest of the test
+func setBudget(t *testing.T, route string, budget time.Duration) {
+	prev, ok := routeBudgets[route]
+	routeBudgets[route] = budget
+	t.Cleanup(func() {
+		if ok {
+			routeBudgets[route] = prev
+		} else {
+			delete(routeBudgets, route)
+		}
+	})
+}
+
+func TestRequestDeadlines(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.AvailabilityCache = newAvailabilityCache(time.Minute)
+	h.svc.Breakers = h.svc.newCircuitBreakers(1, time.Minute)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	staff := leoStaff()
+	if err := h.svc.SirsiSession.ensureSession(); err != nil {
+		t.Fatalf("unable to start session: %s", err.string())
+	}
+	setBudget(t, "/availability/:cat_key", 50*time.Millisecond)
+	setBudget(t, "/requests/renew", 50*time.Millisecond)
+	setBudget(t, "/requests/fill_hold/:barcode", 150*time.Millisecond)
+
+	h.run(t, []routeTest{
+		{name: "slow upstream exceeds the budget", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/key/2419229", fakeResponse{delay: 200 * time.Millisecond})
+			},
+			status:   http.StatusGatewayTimeout,
+			contains: []string{"request deadline exceeded"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.Breakers["sirsi"].currentState() != breakerClosed {
+					t.Errorf("an exceeded budget should not count against the sirsi breaker")
+				}
+				if h.svc.AvailabilityCache.get("u2419229") != nil {
+					t.Errorf("incomplete availability was cached")
+				}
+			}},
+		{name: "remaining renewals are not attempted", method: "POST", path: "/requests/renew", headers: auth,
+			body: `{"computing_id": "mst3k", "barcodes": ["X000111110", "X000111111"]}`,
+			setup: func(h *testHarness) {
+				due := time.Now().Add(24 * time.Hour)
+				h.sirsi.override("GET", "/user/patron/alternateID/mst3k", mst3kWithCheckouts(t, due, due))
+				h.sirsi.override("POST", "/circulation/circRecord/renew", fakeResponse{delay: 200 * time.Millisecond})
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var out []renewResponseRec
+				json.Unmarshal(resp.Body.Bytes(), &out)
+				if len(out) != 2 || out[0].Success || out[1].Success || out[1].Message != "request deadline exceeded" {
+					t.Errorf("expected both renewals to fail, got %+v", out)
+				}
+				if n := len(h.sirsi.received("POST", "/circulation/circRecord/renew")); n != 1 {
+					t.Errorf("expected one renew request, got %d", n)
+				}
+			}},
+		{name: "checkout completes after untransit", method: "POST", path: "/requests/fill_hold/X000222223", headers: staff,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/item/barcode/X000222223", fakeResponse{status: http.StatusOK, body: transitItem})
+				h.sirsi.override("POST", "/circulation/transit/untransit", fakeResponse{delay: 100 * time.Millisecond})
+				h.sirsi.override("POST", "/circulation/circRecord/checkOut", fakeResponse{delay: 100 * time.Millisecond})
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var out barcodeScanResp
+				json.Unmarshal(resp.Body.Bytes(), &out)
+				if len(out.ErrorMessages) > 0 {
+					t.Errorf("expected checkout to succeed, got %+v", out.ErrorMessages)
+				}
+				if n := len(h.sirsi.received("POST", "/circulation/circRecord/checkOut")); n != 1 {
+					t.Errorf("expected one checkout request, got %d", n)
+				}
+			}},
+	})
+
+	t.Run("cancelled request is not sent upstream", func(t *testing.T) {
+		h.sirsi.reset()
+		h.solr.reset()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/availability/u5841451", nil).WithContext(ctx)
+		req.Header.Set("Authorization", auth["Authorization"])
+		resp := httptest.NewRecorder()
+		h.router.ServeHTTP(resp, req)
+		if resp.Code != statusClientClosedRequest {
+			t.Errorf("expected status %d, got %d: %s", statusClientClosedRequest, resp.Code, resp.Body.String())
+		}
+		if len(h.sirsi.received("GET", "/catalog/bib/key/5841451")) > 0 || len(h.solr.received("GET", "/test_core/select")) > 0 {
+			t.Errorf("upstream requests were made for a cancelled request")
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dueNoticeData is the data for the checkout notice templates
+type dueNoticeData struct {
+	Days      int
+	Checkouts []checkoutDetails
+}
+
+// dueNotices returns the reminder, recall and overdue notices for a patron's checkouts. leadDays are the days
+// before the due date that a reminder is sent; each checkout gets a reminder for the smallest lead time it is
+// within, so with 3 and 1 a patron is reminded 3 days before and again the day before. The due date is part
+// of each key, so a renewed checkout is reminded again.
+func dueNotices(ctx context.Context, computeID string, checkouts []checkoutDetails, leadDays []int, now time.Time) []notice {
+	leads := append([]int{}, leadDays...)
+	sort.Ints(leads)
+	reminders := make(map[int]*notice)
+	var recalled, overdue *notice
+	add := func(n **notice, template, subject, key string, co checkoutDetails) {
+		if *n == nil {
+			*n = &notice{ComputeID: computeID, Kind: noticeCheckouts, Template: template, Subject: subject, Data: &dueNoticeData{}}
+		}
+		(*n).Keys = append((*n).Keys, key)
+		data := (*n).Data.(*dueNoticeData)
+		data.Checkouts = append(data.Checkouts, co)
+	}
+
+	for _, co := range checkouts {
+		if co.RecallDueDate != "" {
+			key := fmt.Sprintf("recall:%s:%s", co.Barcode, co.RecallDueDate)
+			add(&recalled, "checkout_recalled", "Library items recalled", key, co)
+			continue
+		}
+		due, err := time.Parse(time.RFC3339, co.Due)
+		if err != nil {
+			logf(ctx, "WARNING: %s checkout %s has an invalid due date [%s]", computeID, co.Barcode, co.Due)
+			continue
+		}
+		if now.After(due) {
+			key := fmt.Sprintf("overdue:%s:%s", co.Barcode, co.Due)
+			add(&overdue, "checkout_overdue", "Library items overdue", key, co)
+			continue
+		}
+		days := int(math.Ceil(due.Sub(now).Hours() / 24))
+		for _, lead := range leads {
+			if days <= lead {
+				n := reminders[lead]
+				add(&n, "checkout_due", fmt.Sprintf("Library items due in %d days", lead), fmt.Sprintf("due:%s:%s:%d", co.Barcode, co.Due, lead), co)
+				n.Data.(*dueNoticeData).Days = lead
+				if lead == 1 {
+					n.Subject = "Library items due tomorrow"
+				}
+				reminders[lead] = n
+				break
+			}
+		}
+	}
+
+	out := make([]notice, 0)
+	for _, n := range []*notice{overdue, recalled} {
+		if n != nil {
+			out = append(out, *n)
+		}
+	}
+	for _, lead := range leads {
+		if n, ok := reminders[lead]; ok {
+			out = append(out, *n)
+		}
+	}
+	return out
+}
+
+// sendDueReminders emails the watched patrons about checkouts that are coming due, have been recalled or are
+// overdue. Patrons are watched once they have looked at their checkouts, and are dropped when they have none.
+func (svc *serviceContext) sendDueReminders(ctx context.Context, leadDays []int) {
+	patrons := svc.Notices.watched(noticeCheckouts)
+	logf(ctx, "INFO: check due dates for %d patrons", len(patrons))
+	if len(patrons) == 0 {
+		return
+	}
+	if err := svc.SirsiSession.ensureSession(); err != nil {
+		logf(ctx, "ERROR: unable to check due dates: %s", err.string())
+		return
+	}
+	now := time.Now()
+	sent := 0
+	for _, computeID := range patrons {
+		if ctx.Err() != nil {
+			logf(ctx, "WARNING: due date check stopped: %s", ctx.Err().Error())
+			break
+		}
+		checkouts, err := svc.getSirsiUserCheckouts(ctx, computeID)
+		if err != nil {
+			if err.StatusCode == http.StatusNotFound {
+				logf(ctx, "INFO: %s no longer exists; stop watching checkouts", computeID)
+				svc.Notices.unwatch(noticeCheckouts, computeID)
+			} else {
+				logf(ctx, "ERROR: unable to get %s checkouts: %s", computeID, err.string())
+			}
+			continue
+		}
+		if len(checkouts) == 0 {
+			logf(ctx, "INFO: %s has no checkouts; stop watching checkouts", computeID)
+			svc.Notices.unwatch(noticeCheckouts, computeID)
+			continue
+		}
+
+		for _, n := range dueNotices(ctx, computeID, checkouts, leadDays, now) {
+			ok, err := svc.sendNotice(ctx, n)
+			if err != nil {
+				logf(ctx, "ERROR: unable to send %s notice to %s: %s", n.Template, computeID, err.Error())
+				continue
+			}
+			if ok {
+				sent++
+			}
+		}
+	}
+
+	if err := svc.Notices.save(); err != nil {
+		logf(ctx, "ERROR: unable to save notice state: %s", err.Error())
+	}
+	logf(ctx, "INFO: due date check done; %d notices sent", sent)
+}
+
+// runDueReminders checks due dates every interval until the service exits
+func (svc *serviceContext) runDueReminders(interval time.Duration, leadDays []int) {
+	log.Printf("INFO: check due dates every %s with reminders %v days before", interval, leadDays)
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(withRequestID(context.Background(), newRequestID()), interval)
+		svc.sendDueReminders(ctx, leadDays)
+		cancel()
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDueNotices(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	due := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+	tests := []struct {
+		name      string
+		checkouts []checkoutDetails
+		templates []string
+		keys      []string
+	}{
+		{"not due soon", []checkoutDetails{{Barcode: "b1", Due: due(10 * 24 * time.Hour)}}, nil, nil},
+		{"due in 3 days", []checkoutDetails{{Barcode: "b1", Due: due(60 * time.Hour)}},
+			[]string{"checkout_due"}, []string{"due:b1:2024-03-04T00:00:00Z:3"}},
+		{"due tomorrow", []checkoutDetails{{Barcode: "b1", Due: due(20 * time.Hour)}},
+			[]string{"checkout_due"}, []string{"due:b1:2024-03-02T08:00:00Z:1"}},
+		{"overdue", []checkoutDetails{{Barcode: "b1", Due: due(-time.Hour)}},
+			[]string{"checkout_overdue"}, []string{"overdue:b1:2024-03-01T11:00:00Z"}},
+		{"recalled", []checkoutDetails{{Barcode: "b1", Due: due(-time.Hour), RecallDueDate: "2024-03-05"}},
+			[]string{"checkout_recalled"}, []string{"recall:b1:2024-03-05"}},
+		{"invalid due date", []checkoutDetails{{Barcode: "b1", Due: "NEVER"}}, nil, nil},
+		{"grouped by notice", []checkoutDetails{{Barcode: "b1", Due: due(50 * time.Hour)}, {Barcode: "b2", Due: due(-time.Hour)},
+			{Barcode: "b3", Due: due(70 * time.Hour)}, {Barcode: "b4", Due: due(time.Hour)}},
+			[]string{"checkout_overdue", "checkout_due", "checkout_due"},
+			[]string{"overdue:b2:2024-03-01T11:00:00Z", "due:b4:2024-03-01T13:00:00Z:1", "due:b1:2024-03-03T14:00:00Z:3", "due:b3:2024-03-04T10:00:00Z:3"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			templates := make([]string, 0)
+			keys := make([]string, 0)
+			for _, n := range dueNotices(context.Background(), "mst3k", tc.checkouts, []int{3, 1}, now) {
+				templates = append(templates, n.Template)
+				keys = append(keys, n.Keys...)
+			}
+			if strings.Join(templates, ",") != strings.Join(tc.templates, ",") {
+				t.Errorf("expected notices %v, got %v", tc.templates, templates)
+			}
+			if strings.Join(keys, ",") != strings.Join(tc.keys, ",") {
+				t.Errorf("expected keys %v, got %v", tc.keys, keys)
+			}
+		})
+	}
+}
+
+// mst3kWithCheckouts returns the fixture patron with a checkout due for each of dueDates
+func mst3kWithCheckouts(t *testing.T, dueDates ...time.Time) fakeResponse {
+	t.Helper()
+	raw, err := os.ReadFile("cmd/testdata/ils/patron/mst3k.json")
+	if err != nil {
+		t.Fatalf("unable to read patron: %s", err.Error())
+	}
+	var patron map[string]any
+	if err := json.Unmarshal(raw, &patron); err != nil {
+		t.Fatalf("unable to parse patron: %s", err.Error())
+	}
+	fields := patron["fields"].(map[string]any)
+	circRec, _ := json.Marshal(fields["circRecordList"].([]any)[0])
+	fields["blockList"] = []any{}
+	circRecs := make([]any, 0)
+	for i, due := range dueDates {
+		var rec map[string]any
+		json.Unmarshal(circRec, &rec)
+		rec["fields"].(map[string]any)["dueDate"] = due.Format(time.RFC3339)
+		item := rec["fields"].(map[string]any)["item"].(map[string]any)
+		item["fields"].(map[string]any)["barcode"] = "X00011111" + string(rune('0'+i))
+		circRecs = append(circRecs, rec)
+	}
+	fields["circRecordList"] = circRecs
+	out, _ := json.Marshal(patron)
+	return fakeResponse{status: http.StatusOK, body: string(out)}
+}
+
+func TestDueReminders(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	dueSoon := mst3kWithCheckouts(t, time.Now().Add(48*time.Hour), time.Now().Add(-24*time.Hour))
+	check := func(t *testing.T, resp fakeResponse) []smtpMessage {
+		t.Helper()
+		h.sirsi.reset()
+		h.smtp.reset()
+		h.sirsi.override("GET", "/user/patron/alternateID/mst3k", resp, resp, resp)
+		h.svc.sendDueReminders(context.Background(), []int{3, 1})
+		return h.smtp.sent()
+	}
+
+	t.Run("viewing checkouts watches the patron", func(t *testing.T) {
+		if resp := h.do("GET", "/users/mst3k/checkouts", "", auth); resp.Code != http.StatusOK {
+			t.Fatalf("unable to get checkouts: %d", resp.Code)
+		}
+		if watched := h.svc.Notices.watched(noticeCheckouts); len(watched) != 1 || watched[0] != "mst3k" {
+			t.Errorf("expected mst3k to be watched, got %v", watched)
+		}
+	})
+	t.Run("dry run", func(t *testing.T) {
+		h.svc.SMTP.DevMode = true
+		defer func() { h.svc.SMTP.DevMode = false }()
+		if sent := check(t, dueSoon); len(sent) != 0 {
+			t.Errorf("expected dev mode to only log email, got %d sent", len(sent))
+		}
+	})
+	t.Run("due and overdue", func(t *testing.T) {
+		sent := check(t, dueSoon)
+		if len(sent) != 2 {
+			t.Fatalf("expected 2 notices, got %d", len(sent))
+		}
+		if strings.Contains(sent[0].Data, "are overdue") == false || strings.Contains(sent[1].Data, "due in 3 days") == false {
+			t.Errorf("unexpected notices %+v", sent)
+		}
+		if sent[0].To[0] != "mst3k@virginia.edu" {
+			t.Errorf("notice sent to %v", sent[0].To)
+		}
+	})
+	t.Run("reminders are only sent once", func(t *testing.T) {
+		if sent := check(t, dueSoon); len(sent) != 0 {
+			t.Errorf("expected no notices, got %d", len(sent))
+		}
+	})
+	t.Run("renewed checkout is reminded again", func(t *testing.T) {
+		sent := check(t, mst3kWithCheckouts(t, time.Now().Add(49*time.Hour), time.Now().Add(-24*time.Hour)))
+		if len(sent) != 1 || strings.Contains(sent[0].Data, "due in 3 days") == false {
+			t.Errorf("expected a reminder for the new due date, got %+v", sent)
+		}
+	})
+	t.Run("opted out", func(t *testing.T) {
+		h.svc.Notices.setOptOut("mst3k", noticeCheckouts, true)
+		defer h.svc.Notices.setOptOut("mst3k", noticeCheckouts, false)
+		if sent := check(t, mst3kWithCheckouts(t, time.Now().Add(20*time.Hour))); len(sent) != 0 {
+			t.Errorf("expected no notices, got %d", len(sent))
+		}
+	})
+	t.Run("patron without checkouts is no longer watched", func(t *testing.T) {
+		check(t, mst3kWithCheckouts(t))
+		if watched := h.svc.Notices.watched(noticeCheckouts); len(watched) != 0 {
+			t.Errorf("expected mst3k to be dropped, got %v", watched)
+		}
+	})
+}
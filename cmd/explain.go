@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+// optionPatron is the patron that request options are generated for
+type optionPatron struct {
+	UserID          string `json:"userID,omitempty"`
+	Profile         string `json:"profile"`
+	HomeLibrary     string `json:"homeLibrary"`
+	CanPlaceReserve bool   `json:"canPlaceReserve"`
+}
+
+func patronFromClaims(c *gin.Context) optionPatron {
+	claims, err := getVirgoClaims(c)
+	if err != nil {
+		logf(c.Request.Context(), "ERROR: unable to get claims: %s", err.Error())
+		return optionPatron{}
+	}
+	return optionPatron{UserID: claims.UserID, Profile: claims.Profile, HomeLibrary: claims.HomeLibrary, CanPlaceReserve: claims.CanPlaceReserve}
+}
+
+type optionDecision struct {
+	Option  string `json:"option"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+type itemDecisions struct {
+	Barcode    string           `json:"barcode"`
+	CallNumber string           `json:"callNumber"`
+	Library    string           `json:"library"`
+	Location   string           `json:"location"`
+	Decisions  []optionDecision `json:"decisions"`
+}
+
+// optionTrace records why each request option was allowed or blocked. Request options are generated with a
+// nil trace except when explaining them; all methods are safe to call on a nil trace.
+type optionTrace struct {
+	Title []optionDecision `json:"title"`
+	Items []*itemDecisions `json:"items"`
+}
+
+func newOptionTrace() *optionTrace {
+	return &optionTrace{Title: make([]optionDecision, 0), Items: make([]*itemDecisions, 0)}
+}
+
+// decide records a decision for a title level option
+func (ot *optionTrace) decide(option string, allowed bool, reason string, args ...any) {
+	if ot == nil {
+		return
+	}
+	ot.Title = append(ot.Title, optionDecision{Option: option, Allowed: allowed, Reason: fmt.Sprintf(reason, args...)})
+}
+
+// decideItem records a decision for an option of an item
+func (ot *optionTrace) decideItem(item availItem, option string, allowed bool, reason string, args ...any) {
+	if ot == nil {
+		return
+	}
+	var rec *itemDecisions
+	for _, id := range ot.Items {
+		if id.Barcode == item.Barcode {
+			rec = id
+		}
+	}
+	if rec == nil {
+		rec = &itemDecisions{Barcode: item.Barcode, CallNumber: item.CallNumber, Library: item.LibraryID,
+			Location: item.CurrentLocationID, Decisions: make([]optionDecision, 0)}
+		ot.Items = append(ot.Items, rec)
+	}
+	rec.Decisions = append(rec.Decisions, optionDecision{Option: option, Allowed: allowed, Reason: fmt.Sprintf(reason, args...)})
+}
+
+// GET /availability/:cat_key/explain : admin request for the decision trail behind the request options of a
+// title for a patron, given as user=<computing id> or profile=<profile>&home_library=<library>. Reserve
+// permission is not in sirsi; pass can_place_reserve=true to explain options for a patron that has it.
+func (svc *serviceContext) explainRequestOptions(c *gin.Context) {
+	ctx := c.Request.Context()
+	catKey := c.Param("cat_key")
+	claims, err := getVirgoClaims(c)
+	if err != nil {
+		logf(ctx, "ERROR: attempt to explain request options with bad claims: %s", err.Error())
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+	if claims.Role != v4jwt.Admin {
+		logf(ctx, "ERROR: non-admin user %s attempted to explain request options for %s", claims.UserID, catKey)
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+
+	patron := optionPatron{UserID: c.Query("user"), Profile: strings.ToUpper(c.Query("profile")),
+		HomeLibrary: strings.ToUpper(c.Query("home_library")), CanPlaceReserve: c.Query("can_place_reserve") == "true"}
+	if (patron.UserID == "") == (patron.Profile == "" && patron.HomeLibrary == "") {
+		c.String(http.StatusBadRequest, "either user or profile and home_library is required")
+		return
+	}
+	if patron.UserID == "" && (patron.Profile == "" || patron.HomeLibrary == "") {
+		c.String(http.StatusBadRequest, "profile and home_library are both required")
+		return
+	}
+	if patron.UserID != "" {
+		logf(ctx, "INFO: lookup profile and home library of %s to explain request options", patron.UserID)
+		sirsiRaw, sirsiErr := svc.ILS.getPatron(ctx, patron.UserID, patronInfo)
+		if sirsiErr != nil {
+			logf(ctx, "ERROR: get sirsi user %s failed: %s", patron.UserID, sirsiErr.string())
+			c.String(sirsiErr.StatusCode, sirsiErr.Message)
+			return
+		}
+		var sirsiResp sirsiUserData
+		if parseErr := json.Unmarshal(sirsiRaw, &sirsiResp); parseErr != nil {
+			logf(ctx, "ERROR: unable to parse sirsi user %s response: %s", patron.UserID, parseErr.Error())
+			c.String(http.StatusInternalServerError, parseErr.Error())
+			return
+		}
+		patron.Profile = sirsiResp.Fields.Profile.Key
+		patron.HomeLibrary = sirsiResp.Fields.Library.Key
+	}
+
+	data, reqErr := svc.getAvailabilityData(ctx, catKey)
+	if reqErr != nil {
+		c.String(reqErr.StatusCode, reqErr.Message)
+		return
+	}
+	logf(ctx, "INFO: %s explains request options of %s for %+v", claims.UserID, catKey, patron)
+	trace := newOptionTrace()
+	availResp := svc.buildAvailabilityResponse(patron, data, trace)
+	c.JSON(http.StatusOK, struct {
+		TitleID        string          `json:"titleID"`
+		Patron         optionPatron    `json:"patron"`
+		RequestOptions *requestOptions `json:"requestOptions"`
+		*optionTrace
+	}{TitleID: availResp.TitleID, Patron: patron, RequestOptions: availResp.RequestOptions, optionTrace: trace})
+}
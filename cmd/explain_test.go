@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestExplainRequestOptions(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	adminClaims := mst3kClaims()
+	adminClaims.Role = v4jwt.Admin
+	admin := map[string]string{"Authorization": bearer(t, adminClaims)}
+
+	type explanation struct {
+		Patron optionPatron     `json:"patron"`
+		Title  []optionDecision `json:"title"`
+		Items  []itemDecisions  `json:"items"`
+	}
+	parse := func(t *testing.T, resp *httptest.ResponseRecorder) explanation {
+		t.Helper()
+		var out explanation
+		if err := json.Unmarshal(resp.Body.Bytes(), &out); err != nil {
+			t.Fatalf("unable to parse explanation: %s", err.Error())
+		}
+		return out
+	}
+	itemDecision := func(out explanation, barcode, option string) *optionDecision {
+		for _, item := range out.Items {
+			for _, dec := range item.Decisions {
+				if item.Barcode == barcode && dec.Option == option {
+					return &dec
+				}
+			}
+		}
+		return nil
+	}
+	titleDecision := func(out explanation, option string) *optionDecision {
+		for _, dec := range out.Title {
+			if dec.Option == option {
+				return &dec
+			}
+		}
+		return nil
+	}
+
+	h.run(t, []routeTest{
+		{name: "requires an admin", method: "GET", path: "/availability/u2419229/explain?user=mst3k", headers: auth,
+			status: http.StatusForbidden},
+		{name: "requires a patron", method: "GET", path: "/availability/u2419229/explain", headers: admin,
+			status: http.StatusBadRequest},
+		{name: "user or profile but not both", method: "GET", path: "/availability/u2419229/explain?user=mst3k&profile=UNDERGRAD",
+			headers: admin, status: http.StatusBadRequest},
+		{name: "profile needs a home library", method: "GET", path: "/availability/u2419229/explain?profile=UNDERGRAD",
+			headers: admin, status: http.StatusBadRequest},
+		{name: "explains options for a user", method: "GET", path: "/availability/u2419229/explain?user=mst3k", headers: admin,
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				out := parse(t, resp)
+				if out.Patron.Profile != "GRADUATE" || out.Patron.HomeLibrary != "ALDERMAN" {
+					t.Errorf("expected the patron from sirsi, got %+v", out.Patron)
+				}
+				if dec := itemDecision(out, "X000111111", "scan"); dec == nil || dec.Allowed == false {
+					t.Errorf("expected a scan of X000111111, got %+v", dec)
+				}
+				if dec := itemDecision(out, "X000111112", "hold"); dec == nil || dec.Allowed || dec.Reason != "another copy of this item already has a hold option" {
+					t.Errorf("expected a duplicate hold of X000111112, got %+v", dec)
+				}
+				if dec := itemDecision(out, "X000111113", "hold"); dec == nil || dec.Allowed || dec.Reason != "library SPEC-COLL or location SC-STKS is not circulating" {
+					t.Errorf("expected X000111113 to be non-circulating, got %+v", dec)
+				}
+				if dec := itemDecision(out, "X000111113", "aeon"); dec == nil || dec.Allowed == false {
+					t.Errorf("expected an aeon request for X000111113, got %+v", dec)
+				}
+				if dec := titleDecision(out, "streaming"); dec == nil || dec.Reason != "patron cannot place reserves" {
+					t.Errorf("unexpected streaming decision %+v", dec)
+				}
+			}},
+		{name: "explains options for a profile", method: "GET", headers: admin,
+			path:   "/availability/u5841451/explain?profile=undergrad&home_library=healthsci&can_place_reserve=true",
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				out := parse(t, resp)
+				if dec := itemDecision(out, "X000222221", "scan"); dec == nil || dec.Allowed || dec.Reason != "item is a video" {
+					t.Errorf("expected videos to block scans, got %+v", dec)
+				}
+				if dec := itemDecision(out, "X000222221", "videoReserve"); dec == nil || dec.Allowed == false {
+					t.Errorf("expected a video reserve, got %+v", dec)
+				}
+				if dec := titleDecision(out, "hslScan"); dec == nil || dec.Allowed == false {
+					t.Errorf("expected an hsl scan, got %+v", dec)
+				}
+				if dec := titleDecision(out, "aeon"); dec == nil || dec.Allowed {
+					t.Errorf("expected no aeon request, got %+v", dec)
+				}
+			}},
+		{name: "unknown user", method: "GET", path: "/availability/u2419229/explain?user=abc9z", headers: admin,
+			status: http.StatusNotFound},
+	})
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeResponse is a canned response returned by a fake service. The response is sent after delay;
+// a queued response with only a delay slows down the response from the default handler.
+type fakeResponse struct {
+	status int
+	body   string
+	delay  time.Duration
+}
+
+// recordedRequest is a request received by a fake service
+type recordedRequest struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// fakeServer is an httptest server that records every request it receives. Responses queued with
+// override are returned in order for the matching method and path; once the queue is empty, requests
+// are passed to the default handler.
+type fakeServer struct {
+	server    *httptest.Server
+	mutex     sync.Mutex
+	requests  []recordedRequest
+	overrides map[string][]fakeResponse
+	handler   func(req recordedRequest) fakeResponse
+}
+
+func newFakeServer(handler func(req recordedRequest) fakeResponse) *fakeServer {
+	fs := fakeServer{handler: handler, overrides: make(map[string][]fakeResponse)}
+	fs.server = httptest.NewServer(http.HandlerFunc(fs.serve))
+	return &fs
+}
+
+func (fs *fakeServer) url() string {
+	return fs.server.URL
+}
+
+func (fs *fakeServer) close() {
+	fs.server.Close()
+}
+
+func (fs *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	// some sirsi urls are generated with a double slash; clean them so they match the override keys
+	req := recordedRequest{method: r.Method, path: path.Clean(r.URL.Path), query: r.URL.Query(), header: r.Header.Clone(), body: body}
+
+	fs.mutex.Lock()
+	fs.requests = append(fs.requests, req)
+	key := fmt.Sprintf("%s %s", req.method, req.path)
+	var resp fakeResponse
+	queued := fs.overrides[key]
+	if len(queued) > 0 {
+		resp = queued[0]
+		fs.overrides[key] = queued[1:]
+	}
+	fs.mutex.Unlock()
+
+	if resp.delay > 0 {
+		time.Sleep(resp.delay)
+	}
+	if resp.status == 0 {
+		resp = fs.handler(req)
+	}
+	if strings.HasPrefix(resp.body, "{") || strings.HasPrefix(resp.body, "[") {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(resp.status)
+	w.Write([]byte(resp.body))
+}
+
+// override queues responses for the next requests that match method and path
+func (fs *fakeServer) override(method, path string, resps ...fakeResponse) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	key := fmt.Sprintf("%s %s", method, path)
+	fs.overrides[key] = append(fs.overrides[key], resps...)
+}
+
+// received returns all requests that matched method and path
+func (fs *fakeServer) received(method, path string) []recordedRequest {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	out := make([]recordedRequest, 0)
+	for _, req := range fs.requests {
+		if req.method == method && req.path == path {
+			out = append(out, req)
+		}
+	}
+	return out
+}
+
+func (fs *fakeServer) reset() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.requests = nil
+	fs.overrides = make(map[string][]fakeResponse)
+}
+
+func sirsiMessageResponse(status int, code, message string) fakeResponse {
+	msgs := sirsiMessageList{MessageList: []sirsiMessage{{Code: code, Message: message}}}
+	msgBytes, _ := json.Marshal(msgs)
+	return fakeResponse{status: status, body: string(msgBytes)}
+}
+
+// fakeSirsi stands in for Sirsi Web Services and the sirsi script server. Responses are generated by a
+// fixtureILS so the data matches what the service sees when it is run with the fixture backend.
+type fakeSirsi struct {
+	*fakeServer
+	ils     *fixtureILS
+	mutex   sync.Mutex
+	expired map[string]bool
+	logins  int
+}
+
+func newFakeSirsi(fixtureDir string) (*fakeSirsi, error) {
+	ils, err := newFixtureILS(fixtureDir)
+	if err != nil {
+		return nil, err
+	}
+	fs := fakeSirsi{ils: ils, expired: make(map[string]bool)}
+	fs.fakeServer = newFakeServer(fs.handle)
+	return &fs, nil
+}
+
+// expire causes all further requests using the session token to fail with sessionTimedOut
+func (fs *fakeSirsi) expire(token string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.expired[token] = true
+}
+
+func (fs *fakeSirsi) loginCount() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.logins
+}
+
+// fixtureHoldChange responds to a hold change with the changed hold, as sirsi does
+func fixtureHoldChange(ils *fixtureILS, holdID string, err *requestError) fakeResponse {
+	if err != nil {
+		return ilsResponse(nil, err)
+	}
+	return ilsResponse(ils.getHold(context.Background(), holdID))
+}
+
+func ilsResponse(raw []byte, err *requestError) fakeResponse {
+	if err != nil {
+		return fakeResponse{status: err.StatusCode, body: err.Message}
+	}
+	return fakeResponse{status: http.StatusOK, body: string(raw)}
+}
+
+func (fs *fakeSirsi) handle(req recordedRequest) fakeResponse {
+	fs.mutex.Lock()
+	expired := fs.expired[req.header.Get("x-sirs-sessionToken")]
+	fs.mutex.Unlock()
+	if expired {
+		return sirsiMessageResponse(http.StatusUnauthorized, "sessionTimedOut", "The session has timed out.")
+	}
+
+	var payload map[string]any
+	json.Unmarshal(req.body, &payload)
+	fields := fixtureFields(payload)
+	token := req.header.Get("x-sirs-sessionToken")
+	dir, key := path.Split(req.path)
+
+	switch {
+	case req.method == "POST" && req.path == "/user/staff/login":
+		fs.mutex.Lock()
+		fs.logins++
+		fs.mutex.Unlock()
+		return ilsResponse(fs.ils.staffLogin(context.Background(), fields["login"], fields["password"]))
+	case req.method == "POST" && req.path == "/user/staff/logout":
+		return ilsResponse([]byte("{}"), fs.ils.staffLogout(context.Background(), token))
+	case req.method == "GET" && dir == "/user/staff/key/":
+		return ilsResponse(fs.ils.getStaffUser(context.Background(), key))
+
+	case req.method == "GET" && dir == "/catalog/bib/key/":
+		if req.header.Get("x-sirs-clientID") == "TRACKSYS" {
+			return ilsResponse(fs.ils.getMARC(context.Background(), key))
+		}
+		return ilsResponse(fs.ils.getBib(context.Background(), key))
+	case req.method == "PUT" && dir == "/catalog/bib/key/":
+		return ilsResponse(req.body, fs.ils.updateMARC(context.Background(), key, req.body))
+	case req.method == "GET" && req.path == "/catalog/bib/search":
+		keys := make([]string, 0)
+		for _, match := range regexp.MustCompile(`(\d+)\{CKEY\}`).FindAllStringSubmatch(req.query.Get("q"), -1) {
+			keys = append(keys, match[1])
+		}
+		if strings.Contains(req.query.Get("includeFields"), "bib{*}") {
+			return ilsResponse(fs.ils.getBibs(context.Background(), keys))
+		}
+		return ilsResponse(fs.ils.searchBibs(context.Background(), keys))
+	case req.method == "GET" && req.path == "/course_reserves":
+		return ilsResponse(fs.ils.getCourseReserveInfo(context.Background(), req.query.Get("item_id")))
+	case req.method == "GET" && dir == "/catalog/item/barcode/":
+		return ilsResponse(fs.ils.getItemHolds(context.Background(), key, token))
+
+	case req.method == "GET" && dir == "/user/patron/alternateID/":
+		view := patronInfo
+		fl := req.query.Get("includeFields")
+		if strings.Contains(fl, "holdRecordList") {
+			view = patronHolds
+		} else if strings.Contains(fl, "circRecordList") {
+			view = patronCheckouts
+		} else if strings.HasPrefix(fl, "blockList") {
+			view = patronBills
+		}
+		return ilsResponse(fs.ils.getPatron(context.Background(), key, view))
+	case req.method == "POST" && req.path == "/user/patron/authenticate":
+		return ilsResponse(fs.ils.authenticatePatron(context.Background(), payload))
+	case req.method == "POST" && req.path == "/user/patron/login":
+		return ilsResponse(fs.ils.patronLogin(context.Background(), payload))
+	case req.method == "POST" && req.path == "/user/patron/changeMyPassword":
+		return ilsResponse(fs.ils.changePassword(context.Background(), payload, token))
+	case req.method == "POST" && req.path == "/user/patron/resetMyPassword":
+		return ilsResponse(fs.ils.resetPassword(context.Background(), payload))
+	case req.method == "POST" && req.path == "/user/patron/register":
+		return ilsResponse(fs.ils.registerPatron(context.Background(), payload))
+	case req.method == "POST" && req.path == "/user/patron/activate":
+		return ilsResponse(fs.ils.activatePatron(context.Background(), payload))
+	case req.method == "PUT" && dir == "/user/patron/key/":
+		return ilsResponse(fs.ils.updatePatron(context.Background(), key, payload))
+
+	case req.method == "GET" && dir == "/circulation/holdRecord/key/":
+		return ilsResponse(fs.ils.getHold(context.Background(), key))
+	case req.method == "DELETE" && dir == "/circulation/holdRecord/key/":
+		if err := fs.ils.cancelHold(context.Background(), key); err != nil {
+			return ilsResponse(nil, err)
+		}
+		return fakeResponse{status: http.StatusNoContent}
+	case req.method == "POST" && req.path == "/circulation/holdRecord/placeHold":
+		var holdReq sirsiHoldRequest
+		json.Unmarshal(req.body, &holdReq)
+		return ilsResponse(fs.ils.placeHold(context.Background(), holdReq, req.header.Get("sd-working-libraryid")))
+	case req.method == "POST" && req.path == "/circulation/holdRecord/changePickupLibrary":
+		var change sirsiHoldChange
+		json.Unmarshal(req.body, &change)
+		return fixtureHoldChange(fs.ils, change.HoldRecord.Key, fs.ils.changeHoldPickup(context.Background(), change.HoldRecord.Key, change.PickupLibrary.Key))
+	case req.method == "POST" && req.path == "/circulation/holdRecord/suspendHold":
+		var change sirsiHoldChange
+		json.Unmarshal(req.body, &change)
+		return fixtureHoldChange(fs.ils, change.HoldRecord.Key, fs.ils.suspendHold(context.Background(), change.HoldRecord.Key, change.SuspendBeginDate, change.SuspendEndDate))
+	case req.method == "POST" && req.path == "/circulation/holdRecord/unsuspendHold":
+		var change sirsiHoldChange
+		json.Unmarshal(req.body, &change)
+		return fixtureHoldChange(fs.ils, change.HoldRecord.Key, fs.ils.unsuspendHold(context.Background(), change.HoldRecord.Key))
+	case req.method == "POST" && req.path == "/circulation/circRecord/renew":
+		return ilsResponse(fs.ils.renew(context.Background(), fields["itemBarcode"]))
+	case req.method == "POST" && req.path == "/circulation/circRecord/checkOut":
+		return ilsResponse(fs.ils.checkout(context.Background(), fields["itemBarcode"], fields["patronBarcode"], req.header.Get("sd-working-libraryid"), token))
+	case req.method == "POST" && req.path == "/circulation/transit/untransit":
+		return ilsResponse(fs.ils.untransit(context.Background(), fields["itemBarcode"], req.header.Get("sd-working-libraryid"), token))
+
+	case req.method == "GET" && strings.HasPrefix(req.path, "/policy/") && key == "simpleQuery":
+		return ilsResponse(fs.ils.getPolicies(context.Background(), policyType(path.Base(dir))))
+	}
+
+	return sirsiMessageResponse(http.StatusNotFound, "unknownResource", fmt.Sprintf("%s %s is not supported", req.method, req.path))
+}
+
+// newFakeSolr stands in for the solr core. Documents are loaded from docs.json; id queries return
+// the matching document and course reserve queries return all documents with reserve data.
+func newFakeSolr(dataDir, core string) (*fakeServer, error) {
+	raw, err := os.ReadFile(filepath.Join(dataDir, "docs.json"))
+	if err != nil {
+		return nil, err
+	}
+	var docs []map[string]any
+	if err := json.Unmarshal(raw, &docs); err != nil {
+		return nil, err
+	}
+
+	handler := func(req recordedRequest) fakeResponse {
+		if req.path != fmt.Sprintf("/%s/select", core) {
+			return fakeResponse{status: http.StatusNotFound, body: "not found"}
+		}
+		q := req.query.Get("q")
+		hits := make([]map[string]any, 0)
+		for _, doc := range docs {
+			if strings.HasPrefix(q, "id:(") {
+				for _, match := range regexp.MustCompile(`"([^"]+)"`).FindAllStringSubmatch(q, -1) {
+					if doc["id"] == match[1] {
+						hits = append(hits, doc)
+					}
+				}
+			} else if strings.HasPrefix(q, "id:") {
+				if doc["id"] == strings.TrimPrefix(q, "id:") {
+					hits = append(hits, doc)
+				}
+			} else if _, found := doc["reserve_id_course_name_a"]; found {
+				hits = append(hits, doc)
+			}
+		}
+		var resp struct {
+			Response struct {
+				Docs     []map[string]any `json:"docs"`
+				NumFound int              `json:"numFound"`
+			} `json:"response"`
+		}
+		resp.Response.Docs = hits
+		resp.Response.NumFound = len(hits)
+		out, _ := json.Marshal(resp)
+		return fakeResponse{status: http.StatusOK, body: string(out)}
+	}
+	return newFakeServer(handler), nil
+}
+
+// newFakeUserWS stands in for user-ws. Users are loaded from <computing id>.json in dataDir
+func newFakeUserWS(dataDir string) *fakeServer {
+	handler := func(req recordedRequest) fakeResponse {
+		if req.path == "/healthcheck" {
+			return fakeResponse{status: http.StatusOK, body: `{"healthy": true}`}
+		}
+		dir, computeID := path.Split(req.path)
+		if dir != "/user/" {
+			return fakeResponse{status: http.StatusNotFound, body: "not found"}
+		}
+		if req.query.Get("auth") == "" {
+			return fakeResponse{status: http.StatusUnauthorized, body: "unauthorized"}
+		}
+		raw, err := os.ReadFile(filepath.Join(dataDir, fmt.Sprintf("%s.json", computeID)))
+		if err != nil {
+			return fakeResponse{status: http.StatusNotFound, body: fmt.Sprintf("%s not found", computeID)}
+		}
+		return fakeResponse{status: http.StatusOK, body: string(raw)}
+	}
+	return newFakeServer(handler)
+}
+
+// smtpMessage is a message delivered to the fake smtp server
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTP is a minimal smtp server that accepts all mail and keeps it in memory
+type fakeSMTP struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []smtpMessage
+}
+
+func newFakeSMTP() (*fakeSMTP, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	fs := fakeSMTP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fs.handleConnection(conn)
+		}
+	}()
+	return &fs, nil
+}
+
+func (fs *fakeSMTP) port() int {
+	return fs.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (fs *fakeSMTP) close() {
+	fs.listener.Close()
+}
+
+func (fs *fakeSMTP) sent() []smtpMessage {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return append([]smtpMessage{}, fs.messages...)
+}
+
+func (fs *fakeSMTP) reset() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.messages = nil
+}
+
+func (fs *fakeSMTP) handleConnection(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+
+	tp.PrintfLine("220 localhost fake smtp ready")
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = smtpMessage{From: smtpAddress(line)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, smtpAddress(line))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			fs.mutex.Lock()
+			fs.messages = append(fs.messages, msg)
+			fs.mutex.Unlock()
+			tp.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+func smtpAddress(line string) string {
+	start := strings.Index(line, "<")
+	end := strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+const microformFeature = "microform"
+
+// knownFeatures are the feature flags and what they enable
+var knownFeatures = map[string]string{
+	microformFeature: "Offer microform requests for titles whose MARC 856$u links to another catalog record",
+}
+
+type featureFlag struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Enabled     bool      `json:"enabled"`
+	UpdatedAt   time.Time `json:"updatedAt,omitzero"`
+	UpdatedBy   string    `json:"updatedBy,omitempty"`
+}
+
+// featureFlags holds the state of the feature flags. Flags start with the -features param and can be
+// changed at runtime by an admin; runtime changes are not kept across restarts.
+type featureFlags struct {
+	mutex sync.RWMutex
+	flags map[string]*featureFlag
+}
+
+func knownFeatureNames() []string {
+	out := make([]string, 0, len(knownFeatures))
+	for name := range knownFeatures {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// parseFeatures returns the feature names in a comma separated list, or an error naming the unknown ones
+func parseFeatures(list string) ([]string, error) {
+	out := make([]string, 0)
+	unknown := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, found := knownFeatures[name]; found == false {
+			unknown = append(unknown, name)
+			continue
+		}
+		out = append(out, name)
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown features %s; known features are %s", strings.Join(unknown, ", "), strings.Join(knownFeatureNames(), ", "))
+	}
+	return out, nil
+}
+
+func newFeatureFlags(enabled []string) *featureFlags {
+	ff := featureFlags{flags: make(map[string]*featureFlag)}
+	for name, desc := range knownFeatures {
+		ff.flags[name] = &featureFlag{Name: name, Description: desc, Enabled: slices.Contains(enabled, name)}
+	}
+	return &ff
+}
+
+func (ff *featureFlags) enabled(name string) bool {
+	ff.mutex.RLock()
+	defer ff.mutex.RUnlock()
+	flag, found := ff.flags[name]
+	return found && flag.Enabled
+}
+
+// set changes a flag and returns its new state; false if there is no such flag
+func (ff *featureFlags) set(name string, enabled bool, userID string) (featureFlag, bool) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+	flag, found := ff.flags[name]
+	if found == false {
+		return featureFlag{}, false
+	}
+	flag.Enabled = enabled
+	flag.UpdatedAt = time.Now()
+	flag.UpdatedBy = userID
+	return *flag, true
+}
+
+func (ff *featureFlags) list() []featureFlag {
+	ff.mutex.RLock()
+	defer ff.mutex.RUnlock()
+	out := make([]featureFlag, 0, len(ff.flags))
+	for _, name := range knownFeatureNames() {
+		out = append(out, *ff.flags[name])
+	}
+	return out
+}
+
+// GET /features : the state of the feature flags
+func (svc *serviceContext) getFeatures(c *gin.Context) {
+	c.JSON(http.StatusOK, svc.Features.list())
+}
+
+// PUT /features/:name : admin request to turn a feature flag on or off
+func (svc *serviceContext) updateFeature(c *gin.Context) {
+	name := strings.ToLower(strings.TrimSpace(c.Param("name")))
+	claims, err := getVirgoClaims(c)
+	if err != nil {
+		logf(c.Request.Context(), "ERROR: attempt to change feature %s with bad claims: %s", name, err.Error())
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+	if claims.Role != v4jwt.Admin {
+		logf(c.Request.Context(), "ERROR: non-admin user %s attempted to change feature %s", claims.UserID, name)
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		logf(c.Request.Context(), "ERROR: invalid request to change feature %s", name)
+		c.String(http.StatusBadRequest, "enabled is required")
+		return
+	}
+
+	flag, found := svc.Features.set(name, *req.Enabled, claims.UserID)
+	if found == false {
+		c.String(http.StatusNotFound, "%s is not a feature", name)
+		return
+	}
+	logf(c.Request.Context(), "INFO: %s sets feature %s to %t", claims.UserID, name, flag.Enabled)
+	c.JSON(http.StatusOK, flag)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestMicroformURL(t *testing.T) {
+	const other = "https://search.lib.virginia.edu/sources/uva_library/items/u9999999"
+	const self = "https://search.lib.virginia.edu/sources/uva_library/items/u2419229"
+	tests := []struct {
+		name   string
+		fields string
+		url    string
+	}{
+		{"no 856", `{"tag": "245", "subfields": [{"code": "a", "data": "Notes"}]}`, ""},
+		{"856u to another record", `{"tag": "856", "subfields": [{"code": "u", "data": "` + other + `"}]}`, other},
+		{"856u to the same record", `{"tag": "856", "subfields": [{"code": "u", "data": "` + self + `"}]}`, ""},
+		{"856u that is not a catalog record", `{"tag": "856", "subfields": [{"code": "u", "data": "https://doi.org/10.1000/182"}]}`, ""},
+		{"another subfield", `{"tag": "856", "subfields": [{"code": "z", "data": "` + other + `"}]}`, ""},
+		{"same record then another", `{"tag": "856", "subfields": [{"code": "u", "data": "` + self + `"}]},
+			{"tag": "856", "subfields": [{"code": "3", "data": "Microfilm"}, {"code": "u", "data": "` + other + `"}]}`, other},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var bib sirsiBibResponse
+			if err := json.Unmarshal([]byte(`{"key": "2419229", "fields": {"bib": {"fields": [`+tc.fields+`]}}}`), &bib); err != nil {
+				t.Fatalf("invalid bib: %s", err.Error())
+			}
+			if got := getMicroformURL("u2419229", &bib); got != tc.url {
+				t.Errorf("expected [%s], got [%s]", tc.url, got)
+			}
+		})
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	adminClaims := mst3kClaims()
+	adminClaims.Role = v4jwt.Admin
+	admin := map[string]string{"Authorization": bearer(t, adminClaims)}
+	raw, err := os.ReadFile("cmd/testdata/ils/bib/2419229.json")
+	if err != nil {
+		t.Fatalf("unable to read bib: %s", err.Error())
+	}
+	const microformURL = "https://search.lib.virginia.edu/sources/uva_library/items/u9999999"
+	microform := strings.Replace(string(raw), `{"tag": "001",`,
+		`{"tag": "856", "subfields": [{"code": "u", "data": "`+microformURL+`"}]}, {"tag": "001",`, 1)
+	setup := func(h *testHarness) {
+		h.sirsi.override("GET", "/catalog/bib/key/2419229", fakeResponse{status: http.StatusOK, body: microform})
+	}
+	options := func(t *testing.T, resp *httptest.ResponseRecorder) *requestOptions {
+		t.Helper()
+		var out availabilityResponse
+		if err := json.Unmarshal(resp.Body.Bytes(), &out); err != nil || out.RequestOptions == nil {
+			t.Fatalf("unable to parse request options: %v", err)
+		}
+		return out.RequestOptions
+	}
+
+	h.run(t, []routeTest{
+		{name: "flags are listed", method: "GET", path: "/features", status: http.StatusOK,
+			contains: []string{`"name":"microform"`, `"enabled":false`}, excludes: []string{"updatedAt"}},
+		{name: "microform is not offered when disabled", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: setup, status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				opts := options(t, resp)
+				if opts.MicroformURL != "" || len(opts.Items) == 0 || strings.Join(opts.Items[0].Requests, ",") != "scan,hold" {
+					t.Errorf("expected a hold and no microform, got %+v", opts.Items[0])
+				}
+			}},
+		{name: "requires an admin", method: "PUT", path: "/features/microform", body: `{"enabled": true}`, headers: auth,
+			status: http.StatusForbidden},
+		{name: "enabled is required", method: "PUT", path: "/features/microform", body: `{}`, headers: admin,
+			status: http.StatusBadRequest},
+		{name: "unknown feature", method: "PUT", path: "/features/teleport", body: `{"enabled": true}`, headers: admin,
+			status: http.StatusNotFound},
+		{name: "names are not case sensitive", method: "PUT", path: "/features/Microform", body: `{"enabled": false}`, headers: admin,
+			status: http.StatusOK, contains: []string{`"enabled":false`}},
+		{name: "admin enables microform", method: "PUT", path: "/features/microform", body: `{"enabled": true}`, headers: admin,
+			status: http.StatusOK, contains: []string{`"enabled":true`, `"updatedBy":"mst3k"`}},
+		{name: "microform is offered when enabled", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: setup, status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				opts := options(t, resp)
+				if opts.MicroformURL != microformURL || strings.Join(opts.Items[0].Requests, ",") != "scan,microform" {
+					t.Errorf("expected a microform option, got %s and %+v", opts.MicroformURL, opts.Items[0])
+				}
+				if h.svc.Features.enabled(microformFeature) == false {
+					t.Errorf("expected microform to be enabled")
+				}
+			}},
+	})
+
+	t.Run("features param", func(t *testing.T) {
+		if enabled, err := parseFeatures(" Microform ,"); err != nil || len(enabled) != 1 || enabled[0] != microformFeature {
+			t.Errorf("expected microform, got %v: %v", enabled, err)
+		}
+		if _, err := parseFeatures("microform,teleport"); err == nil || strings.Contains(err.Error(), "unknown features teleport") == false {
+			t.Errorf("expected an unknown feature, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fixtureILS is an in-memory ilsBackend that serves recorded Sirsi Web Services responses
+// from a directory of JSON files. It allows the full service to run without a Sirsi host.
+// The directory layout is:
+//
+//	bib/<cat key>.json            sirsiBibResponse; also used for MARC lookups and searches
+//	patron/<computing id>.json    sirsiUserData plus blockList, circRecordList and holdRecordList. An optional pin field holds the password
+//	hold/<hold key>.json          sirsiHoldRec
+//	item/<barcode>.json           sirsiBarcodeScanItem used to fill holds
+//	coursereserve/<barcode>.json  course reserve script response
+//	policy/<policy>.json          library, location and reserveCollection policy lists
+//
+// Holds placed or cancelled, MARC updates and registrations are kept in memory only.
+type fixtureILS struct {
+	dir        string
+	mutex      sync.Mutex
+	holds      map[string]*sirsiHoldRec
+	cancelled  map[string]bool
+	marc       map[string][]byte
+	nextHoldID int
+	nextUserID int
+}
+
+type fixturePatron struct {
+	sirsiUserData
+	AlternateID string `json:"alternateID"`
+	Pin         string `json:"pin"`
+}
+
+func newFixtureILS(dir string) (*fixtureILS, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ils fixtures: %s", err.Error())
+	}
+	if info.IsDir() == false {
+		return nil, fmt.Errorf("ils fixtures %s is not a directory", dir)
+	}
+	f := fixtureILS{dir: dir,
+		holds:      make(map[string]*sirsiHoldRec),
+		cancelled:  make(map[string]bool),
+		marc:       make(map[string][]byte),
+		nextHoldID: 900000,
+		nextUserID: 800000,
+	}
+	return &f, nil
+}
+
+func fixtureError(status int, code, message string) *requestError {
+	msgs := sirsiMessageList{MessageList: []sirsiMessage{{Code: code, Message: message}}}
+	msgBytes, _ := json.Marshal(msgs)
+	return &requestError{StatusCode: status, Message: string(msgBytes)}
+}
+
+func fixtureMarshal(data any) ([]byte, *requestError) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return nil, &requestError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
+	}
+	return out, nil
+}
+
+// fixtureFields converts a request payload into a map of field values
+func fixtureFields(payload any) map[string]string {
+	out := make(map[string]string)
+	raw, _ := json.Marshal(payload)
+	var parsed map[string]any
+	json.Unmarshal(raw, &parsed)
+	for k, v := range parsed {
+		if str, ok := v.(string); ok {
+			out[k] = str
+		}
+	}
+	return out
+}
+
+func (f *fixtureILS) load(kind, key string) ([]byte, *requestError) {
+	fileName := filepath.Join(f.dir, kind, fmt.Sprintf("%s.json", filepath.Base(key)))
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fixtureError(http.StatusNotFound, "recordNotFound", fmt.Sprintf("Could not find a(n) %s record with the key %s.", kind, key))
+		}
+		return nil, &requestError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
+	}
+	return raw, nil
+}
+
+func (f *fixtureILS) loadPatron(computeID string) (*fixturePatron, *requestError) {
+	raw, err := f.load("patron", computeID)
+	if err != nil {
+		return nil, err
+	}
+	var patron fixturePatron
+	if parseErr := json.Unmarshal(raw, &patron); parseErr != nil {
+		return nil, &requestError{StatusCode: http.StatusInternalServerError, Message: parseErr.Error()}
+	}
+	patron.AlternateID = computeID
+	return &patron, nil
+}
+
+// findPatron finds a patron by computing ID, falling back to a search of all patrons by barcode
+func (f *fixtureILS) findPatron(id string) *fixturePatron {
+	if patron, err := f.loadPatron(id); err == nil {
+		return patron
+	}
+	files, _ := filepath.Glob(filepath.Join(f.dir, "patron", "*.json"))
+	for _, fn := range files {
+		computeID := strings.TrimSuffix(filepath.Base(fn), ".json")
+		patron, err := f.loadPatron(computeID)
+		if err == nil && strings.EqualFold(patron.Fields.Barcode, id) {
+			return patron
+		}
+	}
+	return nil
+}
+
+func (f *fixtureILS) checkPatronPassword(id, password string) ([]byte, *requestError) {
+	patron := f.findPatron(id)
+	if patron == nil || patron.Pin == "" || patron.Pin != password {
+		return nil, fixtureError(http.StatusUnauthorized, "unableToLogin", "Unable to log in.")
+	}
+	resp := sirsiSigniResponse{SessionToken: fmt.Sprintf("fixture-patron-%s", patron.AlternateID), Name: patron.Fields.DisplayName}
+	return fixtureMarshal(resp)
+}
+
+func (f *fixtureILS) staffLogin(ctx context.Context, login, password string) ([]byte, *requestError) {
+	if login == "" || password == "" {
+		return nil, fixtureError(http.StatusUnauthorized, "unableToLogin", "Unable to log in.")
+	}
+	resp := sirsiSigniResponse{
+		StaffKey:     "1",
+		Name:         login,
+		SessionToken: fmt.Sprintf("fixture-staff-%s-%d", login, time.Now().UnixNano()),
+	}
+	return fixtureMarshal(resp)
+}
+
+func (f *fixtureILS) staffLogout(ctx context.Context, sessionToken string) *requestError {
+	return nil
+}
+
+func (f *fixtureILS) getStaffUser(ctx context.Context, staffKey string) ([]byte, *requestError) {
+	return fixtureMarshal(sirsiKey{Resource: "/user/staff", Key: staffKey})
+}
+
+func (f *fixtureILS) getBib(ctx context.Context, catKey string) ([]byte, *requestError) {
+	return f.load("bib", cleanCatKey(catKey))
+}
+
+func (f *fixtureILS) getBibs(ctx context.Context, catKeys []string) ([]byte, *requestError) {
+	resp := struct {
+		TotalResults int               `json:"totalResults"`
+		Result       []json.RawMessage `json:"result"`
+	}{Result: make([]json.RawMessage, 0)}
+	for _, key := range catKeys {
+		raw, err := f.getBib(ctx, key)
+		if err != nil {
+			continue
+		}
+		resp.Result = append(resp.Result, raw)
+	}
+	resp.TotalResults = len(resp.Result)
+	return fixtureMarshal(resp)
+}
+
+func (f *fixtureILS) searchBibs(ctx context.Context, catKeys []string) ([]byte, *requestError) {
+	type searchItem struct {
+		Key    string `json:"key"`
+		Fields struct {
+			ItemType sirsiKey `json:"itemType"`
+			Library  sirsiKey `json:"library"`
+		} `json:"fields"`
+	}
+	type searchCall struct {
+		Key    string `json:"key"`
+		Fields struct {
+			ItemList []searchItem `json:"itemList"`
+		} `json:"fields"`
+	}
+	type searchRec struct {
+		Key    string `json:"key"`
+		Fields struct {
+			CallList []searchCall `json:"callList"`
+		} `json:"fields"`
+	}
+	resp := struct {
+		TotalResults int         `json:"totalResults"`
+		Result       []searchRec `json:"result"`
+	}{Result: make([]searchRec, 0)}
+
+	for _, key := range catKeys {
+		raw, err := f.getBib(ctx, key)
+		if err != nil {
+			continue
+		}
+		var bib sirsiBibResponse
+		if parseErr := json.Unmarshal(raw, &bib); parseErr != nil {
+			continue
+		}
+		rec := searchRec{Key: bib.Key}
+		for _, cr := range bib.Fields.CallList {
+			call := searchCall{Key: cr.Key}
+			for _, ir := range cr.Fields.ItemList {
+				item := searchItem{Key: ir.Key}
+				item.Fields.ItemType = ir.Fields.ItemType
+				item.Fields.Library = sirsiKey{Resource: "/policy/library", Key: cr.Fields.Library.Key}
+				call.Fields.ItemList = append(call.Fields.ItemList, item)
+			}
+			rec.Fields.CallList = append(rec.Fields.CallList, call)
+		}
+		resp.Result = append(resp.Result, rec)
+	}
+	resp.TotalResults = len(resp.Result)
+	return fixtureMarshal(resp)
+}
+
+func (f *fixtureILS) getMARC(ctx context.Context, catKey string) ([]byte, *requestError) {
+	f.mutex.Lock()
+	updated, found := f.marc[cleanCatKey(catKey)]
+	f.mutex.Unlock()
+	if found {
+		return updated, nil
+	}
+	return f.load("bib", cleanCatKey(catKey))
+}
+
+func (f *fixtureILS) updateMARC(ctx context.Context, catKey string, marc []byte) *requestError {
+	if _, err := f.getMARC(ctx, catKey); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.marc[cleanCatKey(catKey)] = marc
+	return nil
+}
+
+func (f *fixtureILS) getCourseReserveInfo(ctx context.Context, barcode string) ([]byte, *requestError) {
+	raw, err := f.load("coursereserve", barcode)
+	if err != nil && err.StatusCode == http.StatusNotFound {
+		return []byte("[]"), nil
+	}
+	return raw, err
+}
+
+func (f *fixtureILS) getItemHolds(ctx context.Context, barcode, sessionToken string) ([]byte, *requestError) {
+	if sessionToken == "" {
+		return nil, fixtureError(http.StatusUnauthorized, "sessionTimedOut", "The session has timed out.")
+	}
+	return f.load("item", barcode)
+}
+
+func (f *fixtureILS) getPatron(ctx context.Context, computeID string, view patronView) ([]byte, *requestError) {
+	// the patron fixture contains all of the fields for every view
+	return f.load("patron", computeID)
+}
+
+func (f *fixtureILS) authenticatePatron(ctx context.Context, payload any) ([]byte, *requestError) {
+	fields := fixtureFields(payload)
+	id := fields["alternateID"]
+	if id == "" {
+		id = fields["barcode"]
+	}
+	return f.checkPatronPassword(id, fields["password"])
+}
+
+func (f *fixtureILS) patronLogin(ctx context.Context, payload any) ([]byte, *requestError) {
+	fields := fixtureFields(payload)
+	return f.checkPatronPassword(fields["login"], fields["password"])
+}
+
+func (f *fixtureILS) changePassword(ctx context.Context, payload any, sessionToken string) ([]byte, *requestError) {
+	fields := fixtureFields(payload)
+	if sessionToken == "" && fields["resetPasswordToken"] == "" {
+		return nil, fixtureError(http.StatusUnauthorized, "sessionTimedOut", "The session has timed out.")
+	}
+	if fields["newPassword"] == "" {
+		return fixtureMarshal(sirsiChangePassResponse{SessionToken: "fixture-reset", ErrorMessage: "The new PIN is invalid."})
+	}
+	return fixtureMarshal(sirsiChangePassResponse{SessionToken: "fixture-reset"})
+}
+
+func (f *fixtureILS) resetPassword(ctx context.Context, payload any) ([]byte, *requestError) {
+	fields := fixtureFields(payload)
+	if f.findPatron(fields["barcode"]) == nil {
+		return nil, fixtureError(http.StatusNotFound, "recordNotFound", "Could not find a(n) /user/patron record.")
+	}
+	return []byte("{}"), nil
+}
+
+func (f *fixtureILS) registerPatron(ctx context.Context, payload any) ([]byte, *requestError) {
+	f.mutex.Lock()
+	f.nextUserID++
+	key := fmt.Sprintf("%d", f.nextUserID)
+	f.mutex.Unlock()
+	resp := sirsiRegistrationResponse{
+		Patron:       sirsiKey{Resource: "/user/patron", Key: key},
+		SessionToken: fmt.Sprintf("fixture-patron-%s", key),
+		Barcode:      fmt.Sprintf("TEMP%s", key),
+	}
+	return fixtureMarshal(resp)
+}
+
+func (f *fixtureILS) updatePatron(ctx context.Context, patronKey string, payload any) ([]byte, *requestError) {
+	return fixtureMarshal(sirsiKey{Resource: "/user/patron", Key: patronKey})
+}
+
+func (f *fixtureILS) activatePatron(ctx context.Context, payload any) ([]byte, *requestError) {
+	fields := fixtureFields(payload)
+	return fixtureMarshal(sirsiActivateResponse{Success: fields["activationToken"] != ""})
+}
+
+func (f *fixtureILS) getHold(ctx context.Context, holdID string) ([]byte, *requestError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.cancelled[holdID] {
+		return nil, fixtureError(http.StatusNotFound, "recordNotFound", fmt.Sprintf("Could not find a(n) /circulation/holdRecord record with the key %s.", holdID))
+	}
+	if hold, found := f.holds[holdID]; found {
+		return fixtureMarshal(hold)
+	}
+	return f.load("hold", holdID)
+}
+
+func (f *fixtureILS) placeHold(ctx context.Context, req sirsiHoldRequest, workLibrary string) ([]byte, *requestError) {
+	patron := f.findPatron(req.PatronBarcode)
+	if patron == nil {
+		return nil, fixtureError(http.StatusBadRequest, "patronNotFound", fmt.Sprintf("Patron %s not found.", req.PatronBarcode))
+	}
+	bibKey := ""
+	if req.Call != nil {
+		if f.findCall(req.Call.Key) == false {
+			return nil, fixtureError(http.StatusBadRequest, "callNotFound", fmt.Sprintf("Call %s not found.", req.Call.Key))
+		}
+		bibKey = strings.Split(req.Call.Key, ":")[0]
+	} else {
+		raw, err := f.load("item", req.ItemBarcode)
+		if err != nil {
+			return nil, fixtureError(http.StatusBadRequest, "itemNotFound", fmt.Sprintf("Item %s not found.", req.ItemBarcode))
+		}
+		var item struct {
+			Fields struct {
+				Bib sirsiKey `json:"bib"`
+			} `json:"fields"`
+		}
+		json.Unmarshal(raw, &item)
+		bibKey = item.Fields.Bib.Key
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.nextHoldID++
+	hold := sirsiHoldRec{Key: fmt.Sprintf("%d", f.nextHoldID)}
+	hold.Fields.Status = "PLACED"
+	hold.Fields.Bib = sirsiKey{Resource: "/catalog/bib", Key: bibKey}
+	hold.Fields.RecallStatus = req.RecallStatus
+	hold.Fields.PickupLibrary = req.PickupLibrary
+	hold.Fields.PlacedLibrary = sirsiKey{Resource: "/policy/library", Key: workLibrary}
+	hold.Fields.Patron.Key = patron.Key
+	hold.Fields.Patron.Fields.AlternateID = patron.AlternateID
+	hold.Fields.Patron.Fields.Barcode = patron.Fields.Barcode
+	hold.Fields.Patron.Fields.DisplayName = patron.Fields.DisplayName
+	f.holds[hold.Key] = &hold
+	logf(ctx, "INFO: fixture hold %s placed for %s", hold.Key, patron.AlternateID)
+	return fixtureMarshal(struct {
+		HoldRecord sirsiHoldRec `json:"holdRecord"`
+	}{HoldRecord: hold})
+}
+
+// findCall returns true if the callList of the bib for callKey has the call
+func (f *fixtureILS) findCall(callKey string) bool {
+	raw, err := f.load("bib", strings.Split(callKey, ":")[0])
+	if err != nil {
+		return false
+	}
+	var bib sirsiBibResponse
+	json.Unmarshal(raw, &bib)
+	for _, call := range bib.Fields.CallList {
+		if call.Key == callKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fixtureILS) cancelHold(ctx context.Context, holdID string) *requestError {
+	if _, err := f.getHold(ctx, holdID); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.holds, holdID)
+	f.cancelled[holdID] = true
+	return nil
+}
+
+// holdRecord returns the in-memory copy of a hold, loading it from the fixtures the first time it is changed.
+// The caller must hold the mutex.
+func (f *fixtureILS) holdRecord(holdID string) (*sirsiHoldRec, *requestError) {
+	if hold, found := f.holds[holdID]; found {
+		return hold, nil
+	}
+	if f.cancelled[holdID] {
+		return nil, fixtureError(http.StatusNotFound, "recordNotFound", fmt.Sprintf("Could not find a(n) /circulation/holdRecord record with the key %s.", holdID))
+	}
+	raw, err := f.load("hold", holdID)
+	if err != nil {
+		return nil, err
+	}
+	var hold sirsiHoldRec
+	if parseErr := json.Unmarshal(raw, &hold); parseErr != nil {
+		return nil, &requestError{StatusCode: http.StatusInternalServerError, Message: parseErr.Error()}
+	}
+	f.holds[holdID] = &hold
+	return &hold, nil
+}
+
+func (f *fixtureILS) changeHoldPickup(ctx context.Context, holdID, library string) *requestError {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	hold, err := f.holdRecord(holdID)
+	if err != nil {
+		return err
+	}
+	hold.Fields.PickupLibrary = sirsiKey{Resource: "/policy/library", Key: library}
+	return nil
+}
+
+func (f *fixtureILS) suspendHold(ctx context.Context, holdID, begin, end string) *requestError {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	hold, err := f.holdRecord(holdID)
+	if err != nil {
+		return err
+	}
+	hold.Fields.SuspendBegin = begin
+	hold.Fields.SuspendEnd = end
+	return nil
+}
+
+func (f *fixtureILS) unsuspendHold(ctx context.Context, holdID string) *requestError {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	hold, err := f.holdRecord(holdID)
+	if err != nil {
+		return err
+	}
+	if hold.Fields.SuspendBegin == "" {
+		return fixtureError(http.StatusBadRequest, "holdNotSuspended", "The hold is not suspended.")
+	}
+	hold.Fields.SuspendBegin = ""
+	hold.Fields.SuspendEnd = ""
+	return nil
+}
+
+func (f *fixtureILS) renew(ctx context.Context, itemBarcode string) ([]byte, *requestError) {
+	var resp sirsiRenewResponse
+	now := time.Now()
+	resp.CircRecord.Fields.CheckOutDate = now.AddDate(0, -1, 0).Format(time.RFC3339)
+	resp.CircRecord.Fields.DueDate = now.AddDate(0, 0, 28).Format(time.RFC3339)
+	resp.CircRecord.Fields.RenewalDate = now.Format(time.RFC3339)
+	resp.CircRecord.Fields.Status = "ACTIVE"
+	return fixtureMarshal(resp)
+}
+
+func (f *fixtureILS) checkout(ctx context.Context, itemBarcode, patronBarcode, workLibrary, sessionToken string) ([]byte, *requestError) {
+	if sessionToken == "" {
+		return nil, fixtureError(http.StatusUnauthorized, "sessionTimedOut", "The session has timed out.")
+	}
+	if f.findPatron(patronBarcode) == nil {
+		return nil, fixtureError(http.StatusBadRequest, "patronNotFound", fmt.Sprintf("Patron %s not found.", patronBarcode))
+	}
+	return fixtureMarshal(struct {
+		CircRecord sirsiKey `json:"circRecord"`
+	}{CircRecord: sirsiKey{Resource: "/circulation/circRecord", Key: itemBarcode}})
+}
+
+func (f *fixtureILS) untransit(ctx context.Context, itemBarcode, workLibrary, sessionToken string) ([]byte, *requestError) {
+	if sessionToken == "" {
+		return nil, fixtureError(http.StatusUnauthorized, "sessionTimedOut", "The session has timed out.")
+	}
+	resp := sirsiUntransitResp{
+		Item:          sirsiKey{Resource: "/catalog/item", Key: itemBarcode},
+		CurrentStatus: "ON_SHELF",
+	}
+	return fixtureMarshal(resp)
+}
+
+func (f *fixtureILS) getPolicies(ctx context.Context, policy policyType) ([]byte, *requestError) {
+	return f.load("policy", string(policy))
+}
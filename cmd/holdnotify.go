@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hold states that patrons are told about
+const (
+	holdPlaced    = "placed"
+	holdInTransit = "in_transit"
+	holdReady     = "ready"
+	holdExpired   = "expired"
+)
+
+// holdSnapshot is the state of a hold when it was last polled
+type holdSnapshot struct {
+	PatronID      string `json:"patronID"`
+	State         string `json:"state"`
+	QueuePosition uint64 `json:"queuePosition"`
+}
+
+// holdState returns the state of a sirsi hold record
+func holdState(hr sirsiHoldRecord, today string) string {
+	if hr.Fields.Status == "EXPIRED" || (hr.Fields.ExpirationDate != "" && hr.Fields.ExpirationDate < today) {
+		return holdExpired
+	}
+	if hr.Fields.Status == "BEING_HELD" {
+		return holdReady
+	}
+	if strings.TrimSpace(hr.Fields.Item.Fields.CurrentLocation.Key) == "INTRANSIT" &&
+		hr.Fields.Item.Fields.Transit.Fields.TransitReason == "HOLD" {
+		return holdInTransit
+	}
+	return holdPlaced
+}
+
+// holdNotices returns the notices for the changes to a hold since it was last polled. A hold that has not been
+// seen before only gets a notice if it is ready for pickup or has expired.
+func holdNotices(computeID string, hr sirsiHoldRecord, state string, prior *holdSnapshot) []notice {
+	hold := newHoldDetails(computeID, hr)
+	out := make([]notice, 0)
+	stateChanged := (prior == nil && (state == holdReady || state == holdExpired)) ||
+		(prior != nil && prior.State != state && state != holdPlaced)
+	if stateChanged {
+		n := notice{ComputeID: computeID, Kind: noticeHolds, Keys: []string{fmt.Sprintf("hold:%s:%s", hr.Key, state)}, Data: hold}
+		switch state {
+		case holdReady:
+			n.Template = "hold_ready"
+			n.Subject = fmt.Sprintf("Ready for pickup: %s", hold.Title)
+		case holdInTransit:
+			n.Template = "hold_in_transit"
+			n.Subject = fmt.Sprintf("On its way: %s", hold.Title)
+		case holdExpired:
+			n.Template = "hold_expired"
+			n.Subject = fmt.Sprintf("Hold expired: %s", hold.Title)
+		}
+		out = append(out, n)
+	}
+	if prior != nil && state == holdPlaced && hr.Fields.QueuePosition > 0 && hr.Fields.QueuePosition < prior.QueuePosition {
+		out = append(out, notice{ComputeID: computeID, Kind: noticeHolds, Template: "hold_queue", Data: hold,
+			Keys:    []string{fmt.Sprintf("hold:%s:queue:%d", hr.Key, hr.Fields.QueuePosition)},
+			Subject: fmt.Sprintf("You are number %d in line for %s", hr.Fields.QueuePosition, hold.Title)})
+	}
+	return out
+}
+
+// pollHolds checks the holds of each watched patron and emails them about holds that have changed state. Patrons
+// are watched once they have looked at or placed a hold, and are dropped when they no longer have any holds.
+func (svc *serviceContext) pollHolds(ctx context.Context) {
+	patrons := svc.Notices.watched(noticeHolds)
+	logf(ctx, "INFO: poll holds for %d patrons", len(patrons))
+	if len(patrons) == 0 {
+		return
+	}
+	if err := svc.SirsiSession.ensureSession(); err != nil {
+		logf(ctx, "ERROR: unable to poll holds: %s", err.string())
+		return
+	}
+	today := time.Now().Format("2006-01-02")
+	sent := 0
+	for _, computeID := range patrons {
+		if ctx.Err() != nil {
+			logf(ctx, "WARNING: hold poll stopped: %s", ctx.Err().Error())
+			break
+		}
+		sirsiRaw, sirsiErr := svc.ILS.getPatron(ctx, computeID, patronHolds)
+		if sirsiErr != nil {
+			if sirsiErr.StatusCode == http.StatusNotFound {
+				logf(ctx, "INFO: %s no longer exists; stop watching holds", computeID)
+				svc.Notices.unwatch(noticeHolds, computeID)
+				svc.Notices.dropHolds(computeID, nil)
+			} else {
+				logf(ctx, "ERROR: unable to get %s holds: %s", computeID, sirsiErr.string())
+			}
+			continue
+		}
+		var holdResp sirsiHolds
+		if err := json.Unmarshal(sirsiRaw, &holdResp); err != nil {
+			logf(ctx, "ERROR: unable to parse %s holds: %s", computeID, err.Error())
+			continue
+		}
+
+		current := make(map[string]bool)
+		for _, hr := range holdResp.Fields.HoldRecordList {
+			current[hr.Key] = true
+			state := holdState(hr, today)
+			prior := svc.Notices.getHold(hr.Key)
+			delivered := true
+			for _, n := range holdNotices(computeID, hr, state, prior) {
+				ok, err := svc.sendNotice(ctx, n)
+				if err != nil {
+					// leave the snapshot alone so the notice is tried again on the next poll
+					logf(ctx, "ERROR: unable to send %s notice to %s: %s", n.Template, computeID, err.Error())
+					delivered = false
+					continue
+				}
+				if ok {
+					sent++
+				}
+			}
+			if delivered {
+				svc.Notices.setHold(hr.Key, holdSnapshot{PatronID: computeID, State: state, QueuePosition: hr.Fields.QueuePosition})
+			}
+		}
+		svc.Notices.dropHolds(computeID, current)
+		if len(current) == 0 {
+			logf(ctx, "INFO: %s has no holds; stop watching holds", computeID)
+			svc.Notices.unwatch(noticeHolds, computeID)
+		}
+	}
+
+	if err := svc.Notices.save(); err != nil {
+		logf(ctx, "ERROR: unable to save notice state: %s", err.Error())
+	}
+	logf(ctx, "INFO: hold poll done; %d notices sent", sent)
+}
+
+// runHoldNotifier polls holds every interval until the service exits
+func (svc *serviceContext) runHoldNotifier(interval time.Duration) {
+	log.Printf("INFO: poll holds every %s", interval)
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(withRequestID(context.Background(), newRequestID()), interval)
+		svc.pollHolds(ctx)
+		cancel()
+	}
+}
+
+func (ns *noticeStore) getHold(holdID string) *holdSnapshot {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if snap, ok := ns.state.Holds[holdID]; ok {
+		return &snap
+	}
+	return nil
+}
+
+func (ns *noticeStore) setHold(holdID string, snap holdSnapshot) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.state.Holds[holdID] = snap
+}
+
+// dropHolds forgets the holds of a patron that are not in current
+func (ns *noticeStore) dropHolds(computeID string, current map[string]bool) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	for id, snap := range ns.state.Holds {
+		if snap.PatronID == computeID && current[id] == false {
+			delete(ns.state.Holds, id)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+// mst3kWithHold returns the fixture patron with hold 1001 changed by update
+func mst3kWithHold(t *testing.T, update func(hold map[string]any)) fakeResponse {
+	t.Helper()
+	raw, err := os.ReadFile("cmd/testdata/ils/patron/mst3k.json")
+	if err != nil {
+		t.Fatalf("unable to read patron: %s", err.Error())
+	}
+	var patron map[string]any
+	if err := json.Unmarshal(raw, &patron); err != nil {
+		t.Fatalf("unable to parse patron: %s", err.Error())
+	}
+	fields := patron["fields"].(map[string]any)
+	hold := fields["holdRecordList"].([]any)[0].(map[string]any)["fields"].(map[string]any)
+	update(hold)
+	out, _ := json.Marshal(patron)
+	return fakeResponse{status: http.StatusOK, body: string(out)}
+}
+
+func TestHoldNotifications(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.Notices.watch(noticeHolds, "mst3k")
+	inTransit := func(hold map[string]any) {
+		item := hold["item"].(map[string]any)["fields"].(map[string]any)
+		item["currentLocation"] = map[string]any{"key": "INTRANSIT"}
+		item["transit"] = map[string]any{"fields": map[string]any{"transitReason": "HOLD"}}
+	}
+	ready := func(hold map[string]any) {
+		hold["status"] = "BEING_HELD"
+		hold["beingHeldDate"] = "2024-03-01"
+	}
+	poll := func(t *testing.T, resp fakeResponse) []smtpMessage {
+		t.Helper()
+		h.sirsi.reset()
+		h.smtp.reset()
+		h.sirsi.override("GET", "/user/patron/alternateID/mst3k", resp, resp, resp)
+		h.svc.pollHolds(context.Background())
+		return h.smtp.sent()
+	}
+	unchanged := mst3kWithHold(t, func(hold map[string]any) {})
+
+	t.Run("placed hold is not a notice", func(t *testing.T) {
+		if sent := poll(t, unchanged); len(sent) != 0 {
+			t.Errorf("expected no notices, got %d", len(sent))
+		}
+	})
+	t.Run("queue position moves up", func(t *testing.T) {
+		h.svc.Notices.setHold("1001", holdSnapshot{PatronID: "mst3k", State: holdPlaced, QueuePosition: 2})
+		sent := poll(t, unchanged)
+		if len(sent) != 1 || strings.Contains(sent[0].Data, "number 1 of 2") == false {
+			t.Fatalf("expected a queue notice, got %+v", sent)
+		}
+		if sent[0].To[0] != "mst3k@virginia.edu" {
+			t.Errorf("notice sent to %v", sent[0].To)
+		}
+	})
+	t.Run("in transit", func(t *testing.T) {
+		sent := poll(t, mst3kWithHold(t, inTransit))
+		if len(sent) != 1 || strings.Contains(sent[0].Data, "on its way") == false {
+			t.Fatalf("expected an in transit notice, got %+v", sent)
+		}
+	})
+	t.Run("ready for pickup", func(t *testing.T) {
+		sent := poll(t, mst3kWithHold(t, ready))
+		if len(sent) != 1 || strings.Contains(sent[0].Data, "ready for pickup") == false ||
+			strings.Contains(sent[0].Data, "Casablanca") == false {
+			t.Fatalf("expected a ready notice, got %+v", sent)
+		}
+	})
+	t.Run("same state is not sent twice", func(t *testing.T) {
+		h.svc.Notices.setHold("1001", holdSnapshot{PatronID: "mst3k", State: holdInTransit})
+		if sent := poll(t, mst3kWithHold(t, ready)); len(sent) != 0 {
+			t.Errorf("expected the ready notice to be deduplicated, got %d", len(sent))
+		}
+	})
+	t.Run("opted out patrons are not sent notices", func(t *testing.T) {
+		h.svc.Notices.setOptOut("mst3k", noticeHolds, true)
+		defer h.svc.Notices.setOptOut("mst3k", noticeHolds, false)
+		sent := poll(t, mst3kWithHold(t, func(hold map[string]any) { hold["status"] = "EXPIRED" }))
+		if len(sent) != 0 {
+			t.Errorf("expected no notices, got %d", len(sent))
+		}
+		if snap := h.svc.Notices.getHold("1001"); snap == nil || snap.State != holdExpired {
+			t.Errorf("expected the expired state to be recorded, got %+v", snap)
+		}
+	})
+	t.Run("past expiration date", func(t *testing.T) {
+		h.svc.Notices.setHold("1001", holdSnapshot{PatronID: "mst3k", State: holdPlaced, QueuePosition: 1})
+		sent := poll(t, mst3kWithHold(t, func(hold map[string]any) { hold["expirationDate"] = "2024-01-01" }))
+		if len(sent) != 1 || strings.Contains(sent[0].Data, "expired") == false {
+			t.Fatalf("expected an expired notice, got %+v", sent)
+		}
+	})
+	t.Run("patron without holds is no longer watched", func(t *testing.T) {
+		var patron map[string]any
+		json.Unmarshal([]byte(unchanged.body), &patron)
+		patron["fields"].(map[string]any)["holdRecordList"] = []any{}
+		out, _ := json.Marshal(patron)
+		poll(t, fakeResponse{status: http.StatusOK, body: string(out)})
+		if len(h.svc.Notices.watched(noticeHolds)) != 0 || h.svc.Notices.getHold("1001") != nil {
+			t.Errorf("expected mst3k and the hold to be dropped")
+		}
+	})
+	t.Run("sent notices are counted", func(t *testing.T) {
+		metrics := h.do("GET", "/metrics", "", nil).Body.String()
+		for _, want := range []string{`ils_connector_notices_sent_total{notice="hold_queue"} 1`,
+			`ils_connector_notices_sent_total{notice="hold_ready"} 1`, `ils_connector_notices_sent_total{notice="hold_expired"} 1`} {
+			if strings.Contains(metrics, want) == false {
+				t.Errorf("metrics do not contain %s", want)
+			}
+		}
+	})
+}
+
+func TestNoticeStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notices.json")
+	ns, err := newNoticeStore(path)
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err.Error())
+	}
+	ns.watch(noticeHolds, "mst3k")
+	ns.setOptOut("abc9z", noticeHolds, true)
+	ns.markSent("hold:1001:ready")
+	ns.setHold("1001", holdSnapshot{PatronID: "mst3k", State: holdReady})
+	if err := ns.save(); err != nil {
+		t.Fatalf("unable to save store: %s", err.Error())
+	}
+
+	loaded, err := newNoticeStore(path)
+	if err != nil {
+		t.Fatalf("unable to load store: %s", err.Error())
+	}
+	if watched := loaded.watched(noticeHolds); len(watched) != 1 || watched[0] != "mst3k" {
+		t.Errorf("unexpected watched patrons %v", watched)
+	}
+	if loaded.optedOut("abc9z", noticeHolds) == false || loaded.optedOut("mst3k", noticeHolds) {
+		t.Errorf("opt-outs were not restored")
+	}
+	if loaded.wasSent("hold:1001:ready") == false || loaded.wasSent("hold:1001:expired") {
+		t.Errorf("sent notices were not restored")
+	}
+	if snap := loaded.getHold("1001"); snap == nil || snap.State != holdReady {
+		t.Errorf("hold snapshot was not restored: %+v", snap)
+	}
+
+	os.WriteFile(path, []byte("not json"), 0644)
+	if _, err := newNoticeStore(path); err == nil {
+		t.Errorf("expected an error for an invalid file")
+	}
+}
+
+func TestNotificationPrefs(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	adminClaims := mst3kClaims()
+	adminClaims.UserID = "admin1"
+	adminClaims.Role = v4jwt.Admin
+	admin := map[string]string{"Authorization": bearer(t, adminClaims)}
+
+	h.run(t, []routeTest{
+		{name: "defaults to enabled", method: "GET", path: "/users/mst3k/notifications", headers: auth,
+			status: http.StatusOK, contains: []string{`"holds":true`}},
+		{name: "requires the patron", method: "PUT", path: "/users/abc9z/notifications", body: `{"holds": false}`,
+			headers: auth, status: http.StatusForbidden},
+		{name: "clients cannot change preferences", method: "PUT", path: "/users/mst3k/notifications", body: `{"holds": false}`,
+			headers: map[string]string{apiKeyHeader: "virgo-key", "Authorization": auth["Authorization"]}, status: http.StatusForbidden,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.Notices.optedOut("mst3k", noticeHolds) {
+					t.Errorf("expected the opt-outs to be unchanged")
+				}
+			}},
+		{name: "unknown notification", method: "PUT", path: "/users/mst3k/notifications", body: `{"fines": false}`,
+			headers: auth, status: http.StatusBadRequest},
+		{name: "opt out", method: "PUT", path: "/users/mst3k/notifications", body: `{"holds": false}`,
+			headers: auth, status: http.StatusOK, contains: []string{`"holds":false`},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.Notices.optedOut("mst3k", noticeHolds) == false {
+					t.Errorf("expected mst3k to be opted out")
+				}
+			}},
+		{name: "admin can see preferences", method: "GET", path: "/users/mst3k/notifications", headers: admin,
+			status: http.StatusOK, contains: []string{`"holds":false`}},
+		{name: "opt back in", method: "PUT", path: "/users/mst3k/notifications", body: `{"holds": true}`,
+			headers: auth, status: http.StatusOK, contains: []string{`"holds":true`}},
+		{name: "viewing holds watches the patron", method: "GET", path: "/users/mst3k/holds", headers: auth,
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if watched := h.svc.Notices.watched(noticeHolds); len(watched) != 1 || watched[0] != "mst3k" {
+					t.Errorf("expected mst3k to be watched, got %v", watched)
+				}
+			}},
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import "context"
+
+// patronView selects the set of patron fields returned by a patron lookup
+type patronView int
+
+const (
+	patronInfo patronView = iota
+	patronBills
+	patronCheckouts
+	patronHolds
+)
+
+// policyType identifies the policy list returned by a policy query
+type policyType string
+
+const (
+	libraryPolicy  policyType = "library"
+	locationPolicy policyType = "location"
+	reservePolicy  policyType = "reserveCollection"
+)
+
+// ilsBackend defines all of the ILS operations used by the service. Responses are the raw JSON
+// payloads in the Sirsi Web Services format; handlers parse them into the sirsi* structures.
+// Failures are returned as a requestError with the ILS status code and response body so sirsi
+// messageList errors can be handled by handleSirsiErrorResponse.
+type ilsBackend interface {
+	// staff sessions
+	staffLogin(ctx context.Context, login, password string) ([]byte, *requestError)
+	staffLogout(ctx context.Context, sessionToken string) *requestError
+	getStaffUser(ctx context.Context, staffKey string) ([]byte, *requestError)
+
+	// catalog
+	getBib(ctx context.Context, catKey string) ([]byte, *requestError)
+	getBibs(ctx context.Context, catKeys []string) ([]byte, *requestError) // bib search returning the same fields as getBib
+	searchBibs(ctx context.Context, catKeys []string) ([]byte, *requestError)
+	getMARC(ctx context.Context, catKey string) ([]byte, *requestError)
+	updateMARC(ctx context.Context, catKey string, marc []byte) *requestError
+	getCourseReserveInfo(ctx context.Context, barcode string) ([]byte, *requestError)
+	getItemHolds(ctx context.Context, barcode, sessionToken string) ([]byte, *requestError)
+
+	// patrons and accounts
+	getPatron(ctx context.Context, computeID string, view patronView) ([]byte, *requestError)
+	authenticatePatron(ctx context.Context, payload any) ([]byte, *requestError)
+	patronLogin(ctx context.Context, payload any) ([]byte, *requestError)
+	changePassword(ctx context.Context, payload any, sessionToken string) ([]byte, *requestError)
+	resetPassword(ctx context.Context, payload any) ([]byte, *requestError)
+	registerPatron(ctx context.Context, payload any) ([]byte, *requestError)
+	updatePatron(ctx context.Context, patronKey string, payload any) ([]byte, *requestError)
+	activatePatron(ctx context.Context, payload any) ([]byte, *requestError)
+
+	// circulation
+	getHold(ctx context.Context, holdID string) ([]byte, *requestError)
+	placeHold(ctx context.Context, req sirsiHoldRequest, workLibrary string) ([]byte, *requestError)
+	cancelHold(ctx context.Context, holdID string) *requestError
+	changeHoldPickup(ctx context.Context, holdID, library string) *requestError
+	suspendHold(ctx context.Context, holdID, begin, end string) *requestError // dates are YYYY-MM-DD
+	unsuspendHold(ctx context.Context, holdID string) *requestError
+	renew(ctx context.Context, itemBarcode string) ([]byte, *requestError)
+	checkout(ctx context.Context, itemBarcode, patronBarcode, workLibrary, sessionToken string) ([]byte, *requestError)
+	untransit(ctx context.Context, itemBarcode, workLibrary, sessionToken string) ([]byte, *requestError)
+
+	// policies
+	getPolicies(ctx context.Context, policy policyType) ([]byte, *requestError)
+}
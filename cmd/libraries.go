@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
-	"slices"
+	"fmt"
 	"strings"
-	"time"
+	"sync/atomic"
 )
 
+// libraryContext holds the current snapshot of the sirsi libraries. Snapshots are built by refreshPolicies
+// and swapped in whole, so lookups never see a partial list.
 type libraryContext struct {
-	Records        []libraryRec
-	NonCirculating []string
-	OnShelf        []string
-	RefreshAt      time.Time
+	current atomic.Pointer[librarySnapshot]
+}
+
+type librarySnapshot struct {
+	Records []libraryRec
+	byKey   map[string]int
+	byName  map[string]string
 }
 
 type sirsiLibraryResp struct {
@@ -31,72 +36,55 @@ type libraryRec struct {
 	Circulating bool   `json:"circulating"`
 }
 
-func (svc *serviceContext) refreshLibraries() {
-	log.Printf("INFO: get sirsi libraries")
-	svc.Libraries.Records = make([]libraryRec, 0)
+// loadLibraries builds a new library snapshot from sirsi, with circulation flags from the circulation rules
+func (svc *serviceContext) loadLibraries(ctx context.Context) (*librarySnapshot, error) {
+	logf(ctx, "INFO: get sirsi libraries")
 
-	if len(svc.Libraries.NonCirculating) == 0 {
-		log.Printf("INFO: load non-circulating library data")
-		svc.Libraries.NonCirculating = loadDataFile("./data/noncirc-lib.txt")
-	}
-	if len(svc.Libraries.OnShelf) == 0 {
-		log.Printf("INFO: load on shelf library data")
-		svc.Libraries.OnShelf = loadDataFile("./data/onshelf-lib.txt")
-	}
-
-	url := "/policy/library/simpleQuery?key=*&includeFields=key,policyNumber,description"
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.HTTPClient, url)
+	sirsiRaw, sirsiErr := svc.ILS.getPolicies(ctx, libraryPolicy)
 	if sirsiErr != nil {
-		log.Printf("ERROR: get libraries failed: %s", sirsiErr.string())
-		svc.Libraries.RefreshAt = time.Now()
-		return
+		return nil, fmt.Errorf("get libraries failed: %s", sirsiErr.string())
 	}
 
 	var libResp []sirsiLibraryResp
 	parseErr := json.Unmarshal(sirsiRaw, &libResp)
 	if parseErr != nil {
-		log.Printf("ERROR: parse libraries response failed: %s", parseErr.Error())
-		svc.Libraries.RefreshAt = time.Now()
-		return
+		return nil, fmt.Errorf("parse libraries response failed: %s", parseErr.Error())
 	}
 
+	snap := librarySnapshot{Records: make([]libraryRec, 0, len(libResp)), byKey: make(map[string]int), byName: make(map[string]string)}
 	for _, sl := range libResp {
 		lib := libraryRec{ID: sl.Fields.PolicyNumber,
 			Key:         sl.Key,
 			Description: strings.TrimSpace(sl.Fields.Description),
 		}
-		lib.OnShelf = svc.Libraries.isOnShelf(sl.Key)
-		lib.Circulating = !svc.Libraries.isNonCirculating(sl.Key)
-		svc.Libraries.Records = append(svc.Libraries.Records, lib)
+		snap.byKey[lib.Key] = len(snap.Records)
+		snap.byName[lib.Description] = lib.Key
+		snap.Records = append(snap.Records, lib)
 	}
-	svc.Libraries.RefreshAt = time.Now().Add(24 * time.Hour)
-	log.Printf("INFO: libraries refreshed")
+	snap.applyRules(svc.Rules.rules())
+	return &snap, nil
 }
 
-func (lc *libraryContext) find(key string) *libraryRec {
-	matchIdx := slices.IndexFunc(lc.Records, func(lib libraryRec) bool {
-		return lib.Key == strings.TrimSpace(strings.ToUpper(key))
-	})
-	if matchIdx > -1 {
-		return &lc.Records[matchIdx]
+// snapshot returns the current libraries; empty until the first refresh succeeds
+func (lc *libraryContext) snapshot() *librarySnapshot {
+	if snap := lc.current.Load(); snap != nil {
+		return snap
 	}
-	return nil
+	return &librarySnapshot{Records: make([]libraryRec, 0)}
 }
 
-func (lc *libraryContext) lookupID(name string) string {
-	matchIdx := slices.IndexFunc(lc.Records, func(lib libraryRec) bool {
-		return lib.Description == strings.TrimSpace(name)
-	})
-	if matchIdx > -1 {
-		return lc.Records[matchIdx].Key
-	}
-	return ""
+func (lc *libraryContext) records() []libraryRec {
+	return lc.snapshot().Records
 }
 
-func (lc *libraryContext) isNonCirculating(key string) bool {
-	return slices.Contains(lc.NonCirculating, strings.TrimSpace(strings.ToUpper(key)))
+func (lc *libraryContext) find(key string) *libraryRec {
+	snap := lc.snapshot()
+	if idx, found := snap.byKey[strings.TrimSpace(strings.ToUpper(key))]; found {
+		return &snap.Records[idx]
+	}
+	return nil
 }
 
-func (lc *libraryContext) isOnShelf(key string) bool {
-	return slices.Contains(lc.OnShelf, strings.TrimSpace(strings.ToUpper(key)))
+func (lc *libraryContext) lookupID(name string) string {
+	return lc.snapshot().byName[strings.TrimSpace(name)]
 }
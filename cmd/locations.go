@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
-	"slices"
+	"fmt"
 	"strings"
-	"time"
+	"sync/atomic"
 )
 
+// locationContext holds the current snapshot of the sirsi locations and course reserve locations. Snapshots are
+// built by refreshPolicies and swapped in whole, so lookups never see a partial list.
 type locationContext struct {
-	Records          []locationRec
-	ReserveLocations []string
-	NonCirculating   []string
-	OnShelf          []string
-	RefreshAt        time.Time
+	current atomic.Pointer[locationSnapshot]
+}
+
+type locationSnapshot struct {
+	Records  []locationRec
+	byKey    map[string]int
+	reserves map[string]bool
 }
 
 type sirsiReserveLocationRec struct {
@@ -44,101 +48,69 @@ type locationRec struct {
 	Circulating bool   `json:"circulating"`
 }
 
-func (svc *serviceContext) refreshLocations() {
-	if len(svc.Locations.NonCirculating) == 0 {
-		log.Printf("INFO: load non-circulating location data")
-		svc.Locations.NonCirculating = loadDataFile("./data/noncirc-loc.txt")
-	}
-	if len(svc.Locations.OnShelf) == 0 {
-		log.Printf("INFO: load on shelf location data")
-		svc.Locations.OnShelf = loadDataFile("./data/onshelf-loc.txt")
-	}
-
-	svc.Locations.RefreshAt = time.Now().Add(24 * time.Hour)
-	svc.getSirsiLocations()
-	svc.getSirsiReserveLocations()
-	log.Printf("INFO: locations refreshed")
-}
+// loadLocations builds a new location snapshot from sirsi, with circulation flags from the circulation rules
+func (svc *serviceContext) loadLocations(ctx context.Context) (*locationSnapshot, error) {
+	logf(ctx, "INFO: get sirsi locations")
 
-func (svc *serviceContext) getSirsiLocations() {
-	log.Printf("INFO: get sirsi locations")
-	svc.Locations.Records = make([]locationRec, 0)
-	url := "/policy/location/simpleQuery?key=*&includeFields=key,policyNumber,description,shadowed"
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.HTTPClient, url)
+	sirsiRaw, sirsiErr := svc.ILS.getPolicies(ctx, locationPolicy)
 	if sirsiErr != nil {
-		log.Printf("ERROR: unable to get locations: %s", sirsiErr.Message)
-		svc.Locations.RefreshAt = time.Now()
-		return
+		return nil, fmt.Errorf("unable to get locations: %s", sirsiErr.Message)
 	}
-
 	var locResp []sirsiLocationRec
 	parseErr := json.Unmarshal(sirsiRaw, &locResp)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse locations response: %s", parseErr)
-		svc.Locations.RefreshAt = time.Now()
-		return
+		return nil, fmt.Errorf("unable to parse locations response: %s", parseErr)
 	}
 
+	snap := locationSnapshot{Records: make([]locationRec, 0, len(locResp)), byKey: make(map[string]int), reserves: make(map[string]bool)}
 	for _, sl := range locResp {
 		loc := locationRec{ID: sl.Fields.PolicyNumber}
 		loc.Key = sl.Key
 		loc.Description = sl.Fields.Description
-		loc.OnShelf = svc.Locations.isOnShelf(sl.Key)
-		loc.Circulating = !svc.Locations.isNonCirculating(sl.Key)
-		loc.Online = svc.Locations.isOnline(sl.Key)
 		loc.Shadowed = sl.Fields.Shadowed
-		svc.Locations.Records = append(svc.Locations.Records, loc)
+		snap.byKey[loc.Key] = len(snap.Records)
+		snap.Records = append(snap.Records, loc)
 	}
-}
 
-func (svc *serviceContext) getSirsiReserveLocations() {
-	log.Printf("INFO: get sirsi reserve locations")
-	svc.Locations.ReserveLocations = make([]string, 0)
-	url := "/policy/reserveCollection/simpleQuery?key=*&includeFields=key,location{key}"
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.HTTPClient, url)
+	logf(ctx, "INFO: get sirsi reserve locations")
+	sirsiRaw, sirsiErr = svc.ILS.getPolicies(ctx, reservePolicy)
 	if sirsiErr != nil {
-		log.Printf("ERROR: unable to get reserve locations: %s", sirsiErr.Message)
-		svc.Locations.RefreshAt = time.Now()
-		return
+		return nil, fmt.Errorf("unable to get reserve locations: %s", sirsiErr.Message)
 	}
-
-	var locResp []sirsiReserveLocationRec
-	parseErr := json.Unmarshal(sirsiRaw, &locResp)
+	var reserveResp []sirsiReserveLocationRec
+	parseErr = json.Unmarshal(sirsiRaw, &reserveResp)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse reserve locations response: %s", parseErr)
-		svc.Locations.RefreshAt = time.Now()
-		return
+		return nil, fmt.Errorf("unable to parse reserve locations response: %s", parseErr)
 	}
-
-	for _, l := range locResp {
-		svc.Locations.ReserveLocations = append(svc.Locations.ReserveLocations, l.Fields.Location.Key)
+	for _, l := range reserveResp {
+		snap.reserves[l.Fields.Location.Key] = true
 	}
+	snap.applyRules(svc.Rules.rules())
+	return &snap, nil
 }
 
-func (lc *locationContext) find(key string) *locationRec {
-	matchIdx := slices.IndexFunc(lc.Records, func(loc locationRec) bool {
-		return loc.Key == strings.TrimSpace(strings.ToUpper(key))
-	})
-	if matchIdx > -1 {
-		return &lc.Records[matchIdx]
+// snapshot returns the current locations; empty until the first refresh succeeds
+func (lc *locationContext) snapshot() *locationSnapshot {
+	if snap := lc.current.Load(); snap != nil {
+		return snap
 	}
-	return nil
-}
-
-func (lc *locationContext) isCourseReserve(key string) bool {
-	return slices.Contains(lc.ReserveLocations, strings.TrimSpace(strings.ToUpper(key)))
+	return &locationSnapshot{Records: make([]locationRec, 0)}
 }
 
-func (lc *locationContext) isOnShelf(key string) bool {
-	return slices.Contains(lc.OnShelf, strings.TrimSpace(strings.ToUpper(key)))
+func (lc *locationContext) records() []locationRec {
+	return lc.snapshot().Records
 }
 
-func (lc *locationContext) isNonCirculating(key string) bool {
-	return slices.Contains(lc.NonCirculating, strings.TrimSpace(strings.ToUpper(key)))
+func (lc *locationContext) find(key string) *locationRec {
+	snap := lc.snapshot()
+	if idx, found := snap.byKey[strings.TrimSpace(strings.ToUpper(key))]; found {
+		return &snap.Records[idx]
+	}
+	return nil
 }
 
-func (lc *locationContext) isOnline(key string) bool {
-	return slices.Contains([]string{"INTERNET", "NOTOREPDA"}, strings.TrimSpace(strings.ToUpper(key)))
+func (lc *locationContext) isCourseReserve(key string) bool {
+	return lc.snapshot().reserves[strings.TrimSpace(strings.ToUpper(key))]
 }
 
 func (lc *locationContext) isIvyStacks(key string) bool {
@@ -152,8 +124,3 @@ func (lc *locationContext) isMediumRare(key string) bool {
 func (lc *locationContext) mediumRareMessage() string {
 	return "This item does not circulate outside of library spaces. When you request this item from Ivy, it will be delivered to the Small Special Collections Library for you to use in the reading room only."
 }
-
-func (lc *locationContext) isUnavailable(key string) bool {
-	unavail := []string{"LOST", "UNKNOWN", "MISSING", "DISCARD", "WITHDRAWN", "BARRED", "BURSARED", "ORD-CANCLD", "HEREDOC"}
-	return slices.Contains(unavail, strings.TrimSpace(strings.ToUpper(key)))
-}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader is used to accept a request ID from the caller, return it in the response
+// and pass it along to the upstream services called while handling the request
+const requestIDHeader = "X-Request-ID"
+
+// incoming request IDs that do not match are replaced with a generated ID
+var requestIDPattern = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the ID of the request being handled with ctx, or an empty string if there is none
+func requestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware assigns an ID to each request, adds it to the request context so it is included
+// in the logs written with logf and for all upstream calls, and echoes it in the response. Completed requests are logged here.
+func requestIDMiddleware(c *gin.Context) {
+	start := time.Now()
+	id := c.GetHeader(requestIDHeader)
+	if requestIDPattern.MatchString(id) == false {
+		if id != "" {
+			log.Printf("WARNING: replace invalid request id [%s]", id)
+		}
+		id = newRequestID()
+	}
+	c.Set("requestID", id)
+	c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+	c.Header(requestIDHeader, id)
+
+	c.Next()
+
+	attrs := []any{"method", c.Request.Method, "path", redactedPath(c), "route", c.FullPath(),
+		"status", c.Writer.Status(), "elapsed_ms", time.Since(start).Milliseconds(), "client_ip", c.ClientIP()}
+	if client := c.GetString("client"); client != "" {
+		attrs = append(attrs, "client", client)
+	}
+	slog.InfoContext(c.Request.Context(), "request complete", attrs...)
+}
+
+// redactedPath returns the request path with the values of sensitive path parameters, such as activation tokens, masked
+func redactedPath(c *gin.Context) string {
+	reqPath := c.Request.URL.Path
+	for _, param := range c.Params {
+		if param.Value != "" && logRedactor.sensitive(param.Key) {
+			reqPath = strings.ReplaceAll(reqPath, param.Value, redactedValue)
+		}
+	}
+	return reqPath
+}
+
+// requestIDHandler adds the request ID from the log context to every record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logPrefixLevels maps the message prefixes used with the standard log package to log levels
+var logPrefixLevels = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"DEBUG:", slog.LevelDebug},
+	{"INFO:", slog.LevelInfo},
+	{"WARNING:", slog.LevelWarn},
+	{"WARN:", slog.LevelWarn},
+	{"ERROR:", slog.LevelError},
+}
+
+// logPrefixLevel returns the level for the prefix of a message and the message without it. Messages without a
+// known prefix are info.
+func logPrefixLevel(msg string) (slog.Level, string) {
+	msg = strings.TrimSpace(msg)
+	for _, pl := range logPrefixLevels {
+		if strings.HasPrefix(msg, pl.prefix) {
+			return pl.level, strings.TrimSpace(strings.TrimPrefix(msg, pl.prefix))
+		}
+	}
+	return slog.LevelInfo, msg
+}
+
+// logf logs a message formatted like log.Printf, with the level from its prefix, and includes the request ID
+// from ctx. Use it in place of log.Printf wherever the context of the request being handled is available.
+func logf(ctx context.Context, format string, args ...any) {
+	level, msg := logPrefixLevel(fmt.Sprintf(format, args...))
+	slog.Log(ctx, level, msg)
+}
+
+// logLevelWriter sends output from the standard log package to a structured logger, using
+// the message prefix as the level. These messages have no context, so they do not include a request ID.
+type logLevelWriter struct {
+	logger *slog.Logger
+}
+
+func (w logLevelWriter) Write(p []byte) (int, error) {
+	level, msg := logPrefixLevel(string(p))
+	w.logger.Log(context.Background(), level, msg)
+	return len(p), nil
+}
+
+// initLogging makes a JSON logger writing to out the default for both slog and the standard log package.
+// Messages below level (debug, info, warn or error) are dropped, and values of the redactFields are masked.
+func initLogging(out io.Writer, level string, redactFields []string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %s", level)
+	}
+	logRedactor = newRedactor(redactFields)
+	opts := slog.HandlerOptions{Level: logLevel, ReplaceAttr: logRedactor.replaceAttr}
+	logger := slog.New(requestIDHandler{slog.NewJSONHandler(out, &opts)})
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+	log.SetOutput(logLevelWriter{logger: logger})
+	return nil
+}
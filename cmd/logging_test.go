@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+
+	// expectPropagated checks that all requests made to a fake service carried the request id
+	expectPropagated := func(t *testing.T, name string, fs *fakeServer, method, path, id string) {
+		t.Helper()
+		reqs := fs.received(method, path)
+		if len(reqs) == 0 {
+			t.Fatalf("no %s requests for %s", name, path)
+		}
+		for _, req := range reqs {
+			if got := req.header.Get(requestIDHeader); got != id {
+				t.Errorf("expected %s request id %s, got [%s]", name, id, got)
+			}
+		}
+	}
+
+	h.run(t, []routeTest{
+		{name: "generated id", method: "GET", path: "/availability/u2419229", headers: auth, status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				id := resp.Header().Get(requestIDHeader)
+				if regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(id) == false {
+					t.Fatalf("expected generated request id, got [%s]", id)
+				}
+				expectPropagated(t, "sirsi", h.sirsi.fakeServer, "GET", "/catalog/bib/key/2419229", id)
+				expectPropagated(t, "solr", h.solr, "GET", "/test_core/select", id)
+			}},
+		{name: "caller id", method: "GET", path: "/users/mst3k", status: http.StatusOK,
+			headers: map[string]string{requestIDHeader: "virgo-1234.5", "Authorization": bearer(t, mst3kClaims())},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if resp.Header().Get(requestIDHeader) != "virgo-1234.5" {
+					t.Errorf("expected caller request id to be echoed, got [%s]", resp.Header().Get(requestIDHeader))
+				}
+				expectPropagated(t, "sirsi", h.sirsi.fakeServer, "GET", "/user/patron/alternateID/mst3k", "virgo-1234.5")
+				expectPropagated(t, "user-ws", h.userWS, "GET", "/user/mst3k", "virgo-1234.5")
+			}},
+		{name: "invalid caller id", method: "GET", path: "/version", status: http.StatusOK,
+			headers: map[string]string{requestIDHeader: "bad id\"}"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				id := resp.Header().Get(requestIDHeader)
+				if id == "" || strings.Contains(id, "bad") {
+					t.Errorf("expected invalid request id to be replaced, got [%s]", id)
+				}
+			}},
+	})
+}
+
+func TestStructuredLogging(t *testing.T) {
+	h := newTestHarness(t)
+	prevLogger, prevOut, prevFlags := slog.Default(), log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		slog.SetDefault(prevLogger)
+		log.SetOutput(prevOut)
+		log.SetFlags(prevFlags)
+	})
+
+	// capture sets up logging at the given level and returns the parsed log records written by fn
+	capture := func(t *testing.T, level string, fn func()) []map[string]any {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := initLogging(&buf, level, defaultRedactFields); err != nil {
+			t.Fatalf("unable to init logging: %s", err.Error())
+		}
+		fn()
+		out := make([]map[string]any, 0)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var rec map[string]any
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("log line is not json: %s", line)
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+
+	t.Run("handler and upstream calls include request id", func(t *testing.T) {
+		recs := capture(t, "info", func() {
+			h.do("GET", "/users/mst3k", "", map[string]string{requestIDHeader: "log-test-1", "Authorization": bearer(t, mst3kClaims())})
+		})
+		services := make(map[any]bool)
+		completed, handled := false, false
+		for _, rec := range recs {
+			if rec["msg"] == "lookup user mst3k in user-ws" {
+				handled = rec["request_id"] == "log-test-1" && rec["level"] == "INFO"
+			}
+			// the service staff login is shared by all requests and is not tied to one
+			url, _ := rec["url"].(string)
+			if rec["msg"] == "upstream request complete" && strings.HasSuffix(url, "/user/staff/login") == false {
+				services[rec["service"]] = true
+				if rec["request_id"] != "log-test-1" {
+					t.Errorf("upstream log line is missing the request id: %v", rec)
+				}
+			}
+			if rec["msg"] == "request complete" {
+				completed = rec["request_id"] == "log-test-1" && rec["status"] == float64(http.StatusOK) && rec["route"] == "/users/:compute_id"
+			}
+		}
+		if services["sirsi"] == false || services["user-ws"] == false {
+			t.Errorf("expected sirsi and user-ws upstream log lines, got %v", services)
+		}
+		if completed == false {
+			t.Errorf("expected request complete log line")
+		}
+		if handled == false {
+			t.Errorf("expected the handler log line to include the request id")
+		}
+	})
+
+	t.Run("internal client is logged", func(t *testing.T) {
+		recs := capture(t, "info", func() {
+			h.do("GET", "/users/mst3k/bills", "", clientAuth("virgo"))
+		})
+		logged := false
+		for _, rec := range recs {
+			if rec["msg"] == "request complete" {
+				logged = rec["client"] == "virgo"
+			}
+		}
+		if logged == false {
+			t.Errorf("expected request complete log line with the client")
+		}
+	})
+
+	t.Run("standard log prefixes become levels", func(t *testing.T) {
+		recs := capture(t, "info", func() {
+			log.Printf("INFO: an info message")
+			log.Printf("ERROR: an error message")
+			log.Printf("WARNING: a warning message")
+			log.Printf("[CONFIG] a message with no level")
+		})
+		expect := []struct{ level, msg string }{
+			{"INFO", "an info message"}, {"ERROR", "an error message"}, {"WARN", "a warning message"}, {"INFO", "[CONFIG] a message with no level"},
+		}
+		if len(recs) != len(expect) {
+			t.Fatalf("expected %d records, got %d", len(expect), len(recs))
+		}
+		for i, e := range expect {
+			if recs[i]["level"] != e.level || recs[i]["msg"] != e.msg {
+				t.Errorf("expected %s %q, got %v", e.level, e.msg, recs[i])
+			}
+		}
+	})
+
+	t.Run("level filters messages", func(t *testing.T) {
+		recs := capture(t, "warn", func() {
+			h.do("GET", "/version", "", nil)
+			log.Printf("INFO: not logged")
+			slog.Debug("not logged")
+			log.Printf("ERROR: logged")
+		})
+		if len(recs) != 1 || recs[0]["msg"] != "logged" {
+			t.Errorf("expected only the error message, got %v", recs)
+		}
+	})
+
+	t.Run("invalid level", func(t *testing.T) {
+		if err := initLogging(&bytes.Buffer{}, "chatty", defaultRedactFields); err == nil {
+			t.Errorf("expected error for invalid level")
+		}
+	})
+}
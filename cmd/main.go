@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
@@ -27,71 +29,119 @@ func main() {
 
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
-	router := gin.Default()
+	router := svc.newRouter()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc,
+		syscall.SIGTERM,
+		syscall.SIGINT,
+	)
+	go func() {
+		s := <-sigc
+		log.Printf("INFO: caught %s ", s)
+		svc.terminateSession(context.Background())
+		os.Exit(0)
+	}()
+
+	svc.refreshPolicies(withRequestID(context.Background(), newRequestID()))
+	go svc.runPolicyRefresher()
+
+	if cfg.Notices.DueOnce {
+		svc.sendDueReminders(withRequestID(context.Background(), newRequestID()), cfg.Notices.DueDays)
+		svc.terminateSession(context.Background())
+		os.Exit(0)
+	}
+	if cfg.Notices.DueInterval > 0 {
+		go svc.runDueReminders(time.Duration(cfg.Notices.DueInterval)*time.Hour, cfg.Notices.DueDays)
+	}
+	if cfg.AutoRenew.Interval > 0 {
+		go svc.runAutoRenew(cfg.AutoRenew)
+	}
+	if cfg.Notices.HoldInterval > 0 {
+		go svc.runHoldNotifier(time.Duration(cfg.Notices.HoldInterval) * time.Minute)
+	}
+
+	portStr := fmt.Sprintf(":%d", cfg.Port)
+	log.Printf("Start service v%s on port %s", version, portStr)
+	log.Fatal(router.Run(portStr))
+}
+
+// newRouter creates the gin engine with all service routes and middleware
+func (svc *serviceContext) newRouter() *gin.Engine {
+	router := gin.New()
+	// the client IP keys the login rate limits, so X-Forwarded-For is only used when it comes from a known proxy
+	if err := router.SetTrustedProxies(svc.TrustedProxies); err != nil {
+		log.Printf("ERROR: invalid trusted proxies %v: %s", svc.TrustedProxies, err.Error())
+	}
+	router.Use(gin.Recovery(), requestIDMiddleware, svc.metricsMiddleware)
 	router.Use(gzip.Gzip(gzip.DefaultCompression))
 	corsCfg := cors.DefaultConfig()
 	corsCfg.AllowAllOrigins = true
 	corsCfg.AllowCredentials = true
-	corsCfg.AddAllowHeaders("Authorization")
+	corsCfg.AddAllowHeaders("Authorization", requestIDHeader, apiKeyHeader, serviceTokenHeader)
+	corsCfg.AddExposeHeaders(requestIDHeader, "X-Total-Count")
 	router.Use(cors.New(corsCfg))
+	router.Use(retryAfterMiddleware, deadlineMiddleware)
 
 	router.GET("/", svc.getVersion)
 	router.GET("/favicon.ico", svc.ignoreFavicon)
 	router.GET("/version", svc.getVersion)
 	router.GET("/healthcheck", svc.healthCheck)
+	router.GET("/policies/status", svc.getPolicyStatus)
+	router.GET("/circulation/rules", svc.getCirculationRules)
+	router.POST("/circulation/rules/reload", svc.virgoJWTMiddleware, svc.reloadCirculationRules)
+	router.GET("/features", svc.getFeatures)
+	router.PUT("/features/:name", svc.virgoJWTMiddleware, svc.updateFeature)
+	router.GET("/metrics", svc.getMetrics)
 
 	router.POST("/reauthenticate", svc.virgoJWTMiddleware, svc.sirsiReauthenticate)
 
 	// availability
 	router.GET("/availability/list", svc.sirsiAuthMiddleware, svc.refreshDataMiddleware, svc.getAvailabilityList)
 	router.GET("/availability/:cat_key", svc.refreshDataMiddleware, svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.getAvailability)
+	router.POST("/availability/batch", svc.refreshDataMiddleware, svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.getBatchAvailability)
+	router.GET("/availability/:cat_key/explain", svc.refreshDataMiddleware, svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.explainRequestOptions)
+	router.DELETE("/availability/cache/:cat_key", svc.virgoJWTMiddleware, svc.purgeAvailabilityCache)
 
 	// course reserves management
 	router.POST("/course_reserves", svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.refreshDataMiddleware, svc.createCourseReserves)
-	router.POST("/course_reserves/validate", svc.sirsiAuthMiddleware, svc.validateCourseReserves)
+	router.POST("/course_reserves/validate", svc.clientAuthMiddleware(scopeCourseReserves), svc.sirsiAuthMiddleware, svc.validateCourseReserves)
 	router.GET("/course_reserves/search", svc.sirsiAuthMiddleware, svc.searchCourseReserves)
 
-	// metadata rights update
-	router.POST("/metadata/:cat_key/update_rights", svc.sirsiAuthMiddleware, svc.updateMetadataRights)
+	// metadata rights update; called by tracksys
+	router.POST("/metadata/:cat_key/update_rights", svc.clientAuthMiddleware(scopeMetadata), svc.sirsiAuthMiddleware, svc.updateMetadataRights)
 
 	// account management
-	router.POST("/users/check_password", svc.sirsiAuthMiddleware, svc.checkPassword)   // verify user pass without creating a session
-	router.POST("/users/change_password", svc.sirsiAuthMiddleware, svc.changePassword) // signed in user changes password
-	router.POST("/users/forgot_password", svc.sirsiAuthMiddleware, svc.forgotPassword) // reset step 1: signed out user requests password reset email
-	router.POST("/users/reset_password", svc.sirsiAuthMiddleware, svc.resetPassword)   // reset step 2+: first use the reset token, subsequent tries use session
-	router.POST("/users/register", svc.sirsiAuthMiddleware, svc.registerNewUser)
+	router.POST("/users/check_password", svc.authRateLimitMiddleware, svc.sirsiAuthMiddleware, svc.checkPassword)   // verify user pass without creating a session
+	router.POST("/users/change_password", svc.sirsiAuthMiddleware, svc.changePassword)                              // signed in user changes password
+	router.POST("/users/forgot_password", svc.authRateLimitMiddleware, svc.sirsiAuthMiddleware, svc.forgotPassword) // reset step 1: signed out user requests password reset email
+	router.POST("/users/reset_password", svc.authRateLimitMiddleware, svc.sirsiAuthMiddleware, svc.resetPassword)   // reset step 2+: first use the reset token, subsequent tries use session
+	router.POST("/users/register", svc.authRateLimitMiddleware, svc.clientAuthMiddleware(scopeRegister), svc.sirsiAuthMiddleware, svc.registerNewUser)
+	router.POST("/users/clear_lockout", svc.virgoJWTMiddleware, svc.clearLockout) // admin clears the lockout after repeated failed logins
 	router.GET("/users/activate/:token", svc.sirsiAuthMiddleware, svc.activateUser)
 
-	// user data
-	router.GET("/users/:compute_id", svc.sirsiAuthMiddleware, svc.getUserInfo)
-	router.GET("/users/:compute_id/bills", svc.sirsiAuthMiddleware, svc.getUserBills)
-	router.GET("/users/:compute_id/checkouts", svc.sirsiAuthMiddleware, svc.refreshDataMiddleware, svc.getUserCheckouts)
-	router.GET("/users/:compute_id/checkouts.csv", svc.sirsiAuthMiddleware, svc.refreshDataMiddleware, svc.getUserCheckoutsCSV)
-	router.GET("/users/:compute_id/holds", svc.sirsiAuthMiddleware, svc.getUserHolds)
+	// user data; only available to the patron, an admin or an internal client with the patron_data scope
+	router.GET("/users/:compute_id", svc.patronAccessMiddleware, svc.sirsiAuthMiddleware, svc.getUserInfo)
+	router.GET("/users/:compute_id/bills", svc.patronAccessMiddleware, svc.sirsiAuthMiddleware, svc.getUserBills)
+	router.GET("/users/:compute_id/checkouts", svc.patronAccessMiddleware, svc.sirsiAuthMiddleware, svc.refreshDataMiddleware, svc.getUserCheckouts)
+	router.GET("/users/:compute_id/checkouts.csv", svc.patronAccessMiddleware, svc.sirsiAuthMiddleware, svc.refreshDataMiddleware, svc.getUserCheckoutsCSV)
+	router.GET("/users/:compute_id/holds", svc.patronAccessMiddleware, svc.sirsiAuthMiddleware, svc.getUserHolds)
+	router.GET("/users/:compute_id/notifications", svc.patronAccessMiddleware, svc.getNotificationPrefs)
+	router.PUT("/users/:compute_id/notifications", svc.patronUpdateMiddleware, svc.updateNotificationPrefs)
+	router.GET("/users/:compute_id/auto_renew", svc.patronAccessMiddleware, svc.getAutoRenew)
+	router.PUT("/users/:compute_id/auto_renew", svc.patronUpdateMiddleware, svc.updateAutoRenew)
 
 	// hold and scan requests; all but fill_hold is done by a virgo user and requires a virgo jwt
 	router.POST("/requests/hold", svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.createHold)
+	router.PATCH("/requests/hold/:id", svc.virgoJWTMiddleware, svc.sirsiAuthMiddleware, svc.refreshDataMiddleware, svc.modifyHold)
 	router.DELETE("/requests/hold/:id", svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.deleteHold)
 	router.POST("/requests/scan", svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.createScan)
 	router.POST("/requests/renew", svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.renewCheckouts)
+	router.POST("/requests/renew/all", svc.sirsiAuthMiddleware, svc.virgoJWTMiddleware, svc.renewAll)
 
 	// used by leo hold filler (or tedium reducer): barcode scanning
-	router.POST("/users/sirsi_staff_login", svc.sirsiAuthMiddleware, svc.staffLogin)
-	router.POST("/requests/fill_hold/:barcode", svc.sirsiAuthMiddleware, svc.fillHold)
+	router.POST("/users/sirsi_staff_login", svc.authRateLimitMiddleware, svc.sirsiAuthMiddleware, svc.staffLogin)
+	router.POST("/requests/fill_hold/:barcode", svc.clientAuthMiddleware(scopeFillHold), svc.sirsiAuthMiddleware, svc.fillHold)
 
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc,
-		syscall.SIGTERM,
-		syscall.SIGINT,
-	)
-	go func() {
-		s := <-sigc
-		log.Printf("INFO: caught %s ", s)
-		svc.terminateSession()
-		os.Exit(0)
-	}()
-
-	portStr := fmt.Sprintf(":%d", cfg.Port)
-	log.Printf("Start service v%s on port %s", version, portStr)
-	log.Fatal(router.Run(portStr))
+	return router
 }
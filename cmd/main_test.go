@@ -0,0 +1,344 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+const testJWTKey = "test-jwt-key"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	gin.SetMode(gin.TestMode)
+	if testing.Verbose() == false {
+		log.SetOutput(io.Discard)
+		gin.DefaultWriter = io.Discard
+	}
+
+	// the service loads data files and templates relative to the repository root
+	if err := os.Chdir(".."); err != nil {
+		log.Fatal(err.Error())
+	}
+	os.Exit(m.Run())
+}
+
+// testHarness is a fully configured service running against fake versions of
+// all external services. Requests are made against the real service router.
+type testHarness struct {
+	svc    *serviceContext
+	router *gin.Engine
+	sirsi  *fakeSirsi
+	solr   *fakeServer
+	userWS *fakeServer
+	smtp   *fakeSMTP
+}
+
+func newTestHarness(t *testing.T) *testHarness {
+	t.Helper()
+	var h testHarness
+	var err error
+
+	h.sirsi, err = newFakeSirsi("cmd/testdata/ils")
+	if err != nil {
+		t.Fatalf("unable to start fake sirsi: %s", err.Error())
+	}
+	h.solr, err = newFakeSolr("cmd/testdata/solr", "test_core")
+	if err != nil {
+		t.Fatalf("unable to start fake solr: %s", err.Error())
+	}
+	h.userWS = newFakeUserWS("cmd/testdata/userws")
+	h.smtp, err = newFakeSMTP()
+	if err != nil {
+		t.Fatalf("unable to start fake smtp: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		h.sirsi.close()
+		h.solr.close()
+		h.userWS.close()
+		h.smtp.close()
+	})
+
+	cfg := serviceConfig{
+		Secrets: secretsConfig{VirgoJWTKey: testJWTKey, UserJWTKey: "test-user-key"},
+		Sirsi: sirsiConfig{
+			WebServicesURL: h.sirsi.url(),
+			ScriptURL:      h.sirsi.url(),
+			User:           "tester",
+			Password:       "secret",
+			ClientID:       "TEST_CLIENT",
+			Library:        "UVA-LIB",
+		},
+		ILS:                ilsConfig{Backend: "sirsi"},
+		Solr:               solrConfig{URL: h.solr.url(), Core: "test_core"},
+		VirgoURL:           "https://search.lib.virginia.edu",
+		UserInfoURL:        h.userWS.url(),
+		HSILLiadURL:        "https://hsilliad.example.edu",
+		CourseReserveEmail: "reserves@virginia.edu",
+		LawReserveEmail:    "lawreserves@virginia.edu",
+		PolicyRefresh:      24,
+		RulesFile:          "./data/circulation-rules.yaml",
+		SMTP:               smtpConfig{Host: "127.0.0.1", Port: h.smtp.port(), Sender: "virgo4@virginia.edu"},
+		Clients:            testClients,
+	}
+	h.svc, err = intializeService(version, &cfg)
+	if err != nil {
+		t.Fatalf("unable to initialize service: %s", err.Error())
+	}
+	h.router = h.svc.newRouter()
+	return &h
+}
+
+// testClients are the internal clients known to the harness. Each has the api key <name>-key.
+var testClients = []clientConfig{
+	{Name: "tracksys", Scopes: []string{scopeMetadata}, APIKeys: []string{hashAPIKey("tracksys-key")}},
+	{Name: "virgo", Scopes: []string{scopeCourseReserves, scopeRegister, scopePatronData}, APIKeys: []string{hashAPIKey("virgo-key")}},
+	{Name: "leo", Scopes: []string{scopeFillHold}, APIKeys: []string{hashAPIKey("leo-key")}, TokenSecret: "leo-token-secret"},
+}
+
+// clientAuth returns the headers for a request made by a test client
+func clientAuth(name string) map[string]string {
+	return map[string]string{apiKeyHeader: name + "-key"}
+}
+
+// leoStaff returns the headers for a fill hold request made by leo with a staff session
+func leoStaff() map[string]string {
+	hdr := clientAuth("leo")
+	hdr["SirsiSessionToken"] = "leo-staff-session"
+	return hdr
+}
+
+// bearer returns an authorization header value containing a virgo jwt for the claims
+func bearer(t *testing.T, claims v4jwt.V4Claims) string {
+	t.Helper()
+	signed, err := v4jwt.Mint(claims, time.Hour, testJWTKey)
+	if err != nil {
+		t.Fatalf("unable to mint jwt: %s", err.Error())
+	}
+	return fmt.Sprintf("Bearer %s", signed)
+}
+
+// mst3kClaims are the virgo claims for the patron in testdata/ils/patron/mst3k.json
+func mst3kClaims() v4jwt.V4Claims {
+	return v4jwt.V4Claims{UserID: "mst3k", Barcode: "C000011111", IsUVA: true, HomeLibrary: "ALDERMAN",
+		Profile: "GRADUATE", CanPlaceReserve: true, Role: v4jwt.User}
+}
+
+// routeTest is a single request made against the service router
+type routeTest struct {
+	name     string
+	method   string
+	path     string
+	body     string
+	headers  map[string]string
+	setup    func(h *testHarness)
+	status   int
+	contains []string
+	excludes []string
+	check    func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder)
+}
+
+func (h *testHarness) do(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp := httptest.NewRecorder()
+	h.router.ServeHTTP(resp, req)
+	return resp
+}
+
+func (h *testHarness) run(t *testing.T, tests []routeTest) {
+	t.Helper()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h.sirsi.reset()
+			h.solr.reset()
+			h.userWS.reset()
+			h.smtp.reset()
+			if tc.setup != nil {
+				tc.setup(h)
+			}
+
+			resp := h.do(tc.method, tc.path, tc.body, tc.headers)
+			if resp.Code != tc.status {
+				t.Fatalf("%s %s: expected status %d, got %d: %s", tc.method, tc.path, tc.status, resp.Code, resp.Body.String())
+			}
+			for _, want := range tc.contains {
+				if strings.Contains(resp.Body.String(), want) == false {
+					t.Errorf("%s %s: response does not contain %q: %s", tc.method, tc.path, want, resp.Body.String())
+				}
+			}
+			for _, unwanted := range tc.excludes {
+				if strings.Contains(resp.Body.String(), unwanted) {
+					t.Errorf("%s %s: response contains %q: %s", tc.method, tc.path, unwanted, resp.Body.String())
+				}
+			}
+			if tc.check != nil {
+				tc.check(t, h, resp)
+			}
+		})
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	h := newTestHarness(t)
+	h.run(t, []routeTest{
+		{name: "version", method: "GET", path: "/version", status: http.StatusOK, contains: []string{version}},
+		{name: "no sirsi session", method: "GET", path: "/healthcheck", status: http.StatusOK,
+			contains: []string{`"userinfo":{"healthy":true}`}, excludes: []string{"sirsi"}},
+		{name: "active sirsi session", method: "GET", path: "/healthcheck", status: http.StatusOK,
+			setup:    func(h *testHarness) { h.svc.SirsiSession.ensureSession() },
+			contains: []string{`"sirsi":{"healthy":true}`, `"userinfo":{"healthy":true}`}},
+	})
+}
+
+func TestSessionTimeout(t *testing.T) {
+	h := newTestHarness(t)
+	if err := h.svc.SirsiSession.ensureSession(); err != nil {
+		t.Fatalf("unable to start session: %s", err.string())
+	}
+	staleToken := h.svc.SirsiSession.token()
+	logins := h.sirsi.loginCount()
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+
+	h.run(t, []routeTest{
+		{name: "expired session is renewed and the request retried", method: "GET", path: "/users/mst3k/holds", headers: auth,
+			setup:    func(h *testHarness) { h.sirsi.expire(staleToken) },
+			status:   http.StatusOK,
+			contains: []string{`"id":"1001"`},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.sirsi.loginCount() != logins+1 {
+					t.Errorf("expected one new login, got %d", h.sirsi.loginCount()-logins)
+				}
+				if h.svc.SirsiSession.token() == staleToken {
+					t.Errorf("session token was not replaced")
+				}
+				reqs := h.sirsi.received("GET", "/user/patron/alternateID/mst3k")
+				if len(reqs) != 2 {
+					t.Fatalf("expected original request and one retry, got %d requests", len(reqs))
+				}
+				if reqs[1].header.Get("x-sirs-sessionToken") != h.svc.SirsiSession.token() {
+					t.Errorf("retry did not use the new session token")
+				}
+			}},
+		{name: "failed relogin is reported", method: "GET", path: "/users/mst3k/holds", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.expire(h.svc.SirsiSession.token())
+				h.sirsi.override("POST", "/user/staff/login", sirsiMessageResponse(http.StatusUnauthorized, "unableToLogin", "Unable to log in."))
+			},
+			status:   http.StatusUnauthorized,
+			contains: []string{"unableToLogin"}},
+	})
+}
+
+func TestConcurrentSessionRenewal(t *testing.T) {
+	const callers = 10
+	h := newTestHarness(t)
+	if err := h.svc.SirsiSession.ensureSession(); err != nil {
+		t.Fatalf("unable to start session: %s", err.string())
+	}
+
+	t.Run("expired session", func(t *testing.T) {
+		staleToken := h.svc.SirsiSession.token()
+		logins := h.sirsi.loginCount()
+		h.svc.SirsiSession.mutex.Lock()
+		h.svc.SirsiSession.refreshAt = time.Now().Add(-time.Minute)
+		h.svc.SirsiSession.mutex.Unlock()
+		// a slow login makes sure every caller arrives while it is in flight
+		h.sirsi.override("POST", "/user/staff/login", fakeResponse{delay: 50 * time.Millisecond})
+
+		var wg sync.WaitGroup
+		errs := make([]*requestError, callers)
+		tokens := make([]string, callers)
+		for i := range callers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = h.svc.SirsiSession.ensureSession()
+				tokens[i] = h.svc.SirsiSession.token()
+			}()
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("caller %d failed: %s", i, err.string())
+			}
+		}
+		if h.sirsi.loginCount() != logins+1 {
+			t.Errorf("expected one new login, got %d", h.sirsi.loginCount()-logins)
+		}
+		newToken := h.svc.SirsiSession.token()
+		if newToken == staleToken || newToken == "" {
+			t.Fatalf("session token was not replaced")
+		}
+		for i, token := range tokens {
+			if token != newToken {
+				t.Errorf("caller %d has session token %s, expected %s", i, token, newToken)
+			}
+		}
+	})
+
+	t.Run("timed out session", func(t *testing.T) {
+		h.sirsi.reset()
+		staleToken := h.svc.SirsiSession.token()
+		logins := h.sirsi.loginCount()
+		h.sirsi.expire(staleToken)
+		auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+
+		var wg sync.WaitGroup
+		codes := make([]int, callers)
+		for i := range callers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes[i] = h.do("GET", "/users/mst3k/holds", "", auth).Code
+			}()
+		}
+		wg.Wait()
+		for i, code := range codes {
+			if code != http.StatusOK {
+				t.Errorf("request %d: expected %d, got %d", i, http.StatusOK, code)
+			}
+		}
+		if h.sirsi.loginCount() != logins+1 {
+			t.Errorf("expected one new login, got %d", h.sirsi.loginCount()-logins)
+		}
+		newToken := h.svc.SirsiSession.token()
+		if newToken == staleToken {
+			t.Fatalf("session token was not replaced")
+		}
+		// every request either used the new token first or was retried once with it
+		withNew := 0
+		for _, req := range h.sirsi.received("GET", "/user/patron/alternateID/mst3k") {
+			switch token := req.header.Get("x-sirs-sessionToken"); token {
+			case newToken:
+				withNew++
+			case staleToken:
+			default:
+				t.Errorf("request used unexpected session token %s", token)
+			}
+		}
+		if withNew != callers {
+			t.Errorf("expected %d requests with the new session token, got %d", callers, withNew)
+		}
+	})
+}
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
 	"slices"
@@ -43,6 +41,7 @@ type sisriBibRecord struct {
 //		--data '{"resource_uri": "https://search.lib.virginia.edu/sources/uva_library/items/u2442709",
 //					"name": " Copyright Undetermined", "uri": "http://rightsstatements.org/vocab/UND/1.0/"}'
 func (svc *serviceContext) updateMetadataRights(c *gin.Context) {
+	ctx := c.Request.Context()
 	// NOTE: the cat_key param will be in the form u2442709 but
 	// the sirsi API calls only use the numeric portion. Strip the leading 'u'
 	catKey := c.Param("cat_key")
@@ -55,23 +54,18 @@ func (svc *serviceContext) updateMetadataRights(c *gin.Context) {
 	}
 	err := c.ShouldBindJSON(&updateReq)
 	if err != nil {
-		log.Printf("ERROR: Unable to parse metadata %s update request: %s", catKey, err.Error())
+		logf(ctx, "ERROR: Unable to parse metadata %s update request: %s", catKey, err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	log.Printf("INFO: update metadata %s: %+v", catKey, updateReq)
-	url := fmt.Sprintf("%s/catalog/bib/key/%s", svc.SirsiConfig.WebServicesURL, cleanKey)
-	req, _ := http.NewRequest("GET", url, nil)
-	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.SessionToken)
-	req.Header.Set("SD-Originating-App-Id", "TrackSys")
-	req.Header.Set("x-sirs-clientID", "TRACKSYS")
-	bibBytes, bibErr := svc.sendRequest("sirsi", svc.HTTPClient, req)
+	logf(ctx, "INFO: update metadata %s: %+v", catKey, updateReq)
+	bibBytes, bibErr := svc.ILS.getMARC(ctx, cleanKey)
 	if bibErr != nil {
 		if bibErr.StatusCode == 404 {
-			log.Printf("INFO: %s not found", catKey)
+			logf(ctx, "INFO: %s not found", catKey)
 			c.String(http.StatusNotFound, fmt.Sprintf("%s not found", catKey))
 		} else {
-			log.Printf("WARNING: unable to load bib %s data: %s", catKey, bibErr.string())
+			logf(ctx, "WARNING: unable to load bib %s data: %s", catKey, bibErr.string())
 			c.String(bibErr.StatusCode, bibErr.Message)
 		}
 		return
@@ -80,7 +74,7 @@ func (svc *serviceContext) updateMetadataRights(c *gin.Context) {
 	var bibRec sisriBibRecord
 	parseErr := json.Unmarshal(bibBytes, &bibRec)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse sirsi bib %s response: %s", catKey, parseErr.Error())
+		logf(ctx, "ERROR: unable to parse sirsi bib %s response: %s", catKey, parseErr.Error())
 		c.String(http.StatusInternalServerError, parseErr.Error())
 		return
 	}
@@ -115,14 +109,14 @@ func (svc *serviceContext) updateMetadataRights(c *gin.Context) {
 	}
 
 	if existFieldIdx > 0 {
-		log.Printf("INFO: data already has tracksys user right data in field %d", existFieldIdx)
+		logf(ctx, "INFO: data already has tracksys user right data in field %d", existFieldIdx)
 		bibRec.Fields.Bib.Fields[existFieldIdx] = marcRights
 	} else {
 		if newIdx > -1 {
-			log.Printf("INFO: insert rights at index %d", newIdx)
+			logf(ctx, "INFO: insert rights at index %d", newIdx)
 			bibRec.Fields.Bib.Fields = slices.Insert(bibRec.Fields.Bib.Fields, newIdx, marcRights)
 		} else {
-			log.Printf("INFO: append rights after last field")
+			logf(ctx, "INFO: append rights after last field")
 			bibRec.Fields.Bib.Fields = append(bibRec.Fields.Bib.Fields, marcRights)
 		}
 	}
@@ -137,14 +131,9 @@ func (svc *serviceContext) updateMetadataRights(c *gin.Context) {
 	}
 
 	payloadBytes, _ := json.Marshal(bibRec)
-	url = fmt.Sprintf("%s/catalog/bib/key/%s", svc.SirsiConfig.WebServicesURL, cleanKey)
-	req, _ = http.NewRequest("PUT", url, bytes.NewBuffer(payloadBytes))
-	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.SessionToken)
-	req.Header.Set("SD-Originating-App-Id", "TrackSys")
-	req.Header.Set("x-sirs-clientID", "TRACKSYS")
-	_, putErr := svc.sendRequest("sirsi", svc.HTTPClient, req)
+	putErr := svc.ILS.updateMARC(ctx, cleanKey, payloadBytes)
 	if putErr != nil {
-		log.Printf("ERROR: update rights failed: %s", putErr.string())
+		logf(ctx, "ERROR: update rights failed: %s", putErr.string())
 		c.String(putErr.StatusCode, putErr.Message)
 		return
 	}
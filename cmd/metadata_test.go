@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpdateMetadataRights(t *testing.T) {
+	h := newTestHarness(t)
+	rights := `{"resource_uri": "https://search.lib.virginia.edu/sources/uva_library/items/u2419229",
+		"name": "Copyright Undetermined", "uri": "http://rightsstatements.org/vocab/UND/1.0/"}`
+	newRights := `{"resource_uri": "https://search.lib.virginia.edu/sources/uva_library/items/u2419229",
+		"name": "No Copyright - United States", "uri": "http://rightsstatements.org/vocab/NoC-US/1.0/"}`
+
+	// rightsFields returns the 856 fields sent to sirsi in the last bib update
+	rightsFields := func(t *testing.T, h *testHarness) []marcField {
+		reqs := h.sirsi.received("PUT", "/catalog/bib/key/2419229")
+		if len(reqs) != 1 {
+			t.Fatalf("expected one bib update, got %d", len(reqs))
+		}
+		if reqs[0].header.Get("x-sirs-clientID") != "TRACKSYS" || reqs[0].header.Get("SD-Originating-App-Id") != "TrackSys" {
+			t.Errorf("bib update is missing tracksys headers")
+		}
+		var bib sisriBibRecord
+		if err := json.Unmarshal(reqs[0].body, &bib); err != nil {
+			t.Fatalf("unable to parse bib update: %s", err.Error())
+		}
+		out := make([]marcField, 0)
+		for _, f := range bib.Fields.Bib.Fields {
+			if f.Tag == "856" {
+				out = append(out, f)
+			}
+		}
+		return out
+	}
+
+	h.run(t, []routeTest{
+		{name: "invalid request", method: "POST", path: "/metadata/u2419229/update_rights", headers: clientAuth("tracksys"), body: `{"name": `,
+			status: http.StatusBadRequest},
+		{name: "unknown bib", method: "POST", path: "/metadata/u9999999/update_rights", headers: clientAuth("tracksys"), body: rights,
+			status: http.StatusNotFound, contains: []string{"u9999999 not found"}},
+		{name: "rights added", method: "POST", path: "/metadata/u2419229/update_rights", headers: clientAuth("tracksys"), body: rights,
+			status: http.StatusOK, contains: []string{"http://rightsstatements.org/vocab/UND/1.0/"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				fields := rightsFields(t, h)
+				if len(fields) != 1 || fields[0].Inds != "41" || fields[0].Subfields[0].Data != "http://rightsstatements.org/vocab/UND/1.0/" {
+					t.Errorf("unexpected rights fields %+v", fields)
+				}
+			}},
+		{name: "rights replaced", method: "POST", path: "/metadata/u2419229/update_rights", headers: clientAuth("tracksys"), body: newRights,
+			status: http.StatusOK, contains: []string{"http://rightsstatements.org/vocab/NoC-US/1.0/"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				fields := rightsFields(t, h)
+				if len(fields) != 1 || fields[0].Subfields[1].Data != "No Copyright - United States" {
+					t.Errorf("unexpected rights fields %+v", fields)
+				}
+			}},
+		{name: "sirsi update failure", method: "POST", path: "/metadata/u2419229/update_rights", headers: clientAuth("tracksys"), body: rights,
+			setup: func(h *testHarness) {
+				h.sirsi.override("PUT", "/catalog/bib/key/2419229", sirsiMessageResponse(http.StatusBadRequest, "recordLocked", "The record is locked."))
+			},
+			status: http.StatusBadRequest, contains: []string{`"code":"recordLocked"`}},
+	})
+}
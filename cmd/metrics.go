@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// sirsiPathKeys are the sirsi path segments that are followed by an identifier. The identifier
+// is replaced with a placeholder so metrics are not labeled with cat keys, barcodes or user IDs
+var sirsiPathKeys = map[string]string{
+	"key":         ":key",
+	"barcode":     ":barcode",
+	"alternateID": ":id",
+}
+
+// serviceMetrics holds the prometheus collectors for the service. Each service has its own
+// registry so the metrics of one instance are not affected by another.
+type serviceMetrics struct {
+	registry          *prometheus.Registry
+	upstreamDuration  *prometheus.HistogramVec
+	upstreamErrors    *prometheus.CounterVec
+	sessionTimeouts   prometheus.Counter
+	sirsiLogins       *prometheus.CounterVec
+	breakerState      *prometheus.GaugeVec
+	breakerRejections *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	clientRequests    *prometheus.CounterVec
+	authThrottled     *prometheus.CounterVec
+	holdsPlaced       *prometheus.CounterVec
+	fillHolds         *prometheus.CounterVec
+	renewals          *prometheus.CounterVec
+	noticesSent       *prometheus.CounterVec
+}
+
+func newServiceMetrics() *serviceMetrics {
+	m := serviceMetrics{registry: prometheus.NewRegistry()}
+	m.upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ils_connector_upstream_request_duration_seconds",
+		Help:    "Duration of requests to upstream services. Path is only set for sirsi requests.",
+		Buckets: []float64{.025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"service", "method", "path"})
+	m.upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_upstream_errors_total",
+		Help: "Failed requests to upstream services by status code. Requests that got no response use the status reported to the caller.",
+	}, []string{"service", "method", "path", "status"})
+	m.sessionTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ils_connector_sirsi_session_timeouts_total",
+		Help: "Sirsi requests rejected because the staff session timed out.",
+	})
+	m.sirsiLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_sirsi_logins_total",
+		Help: "Sirsi staff session logins, including re-logins after a session timeout or refresh.",
+	}, []string{"result"})
+	m.breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ils_connector_upstream_breaker_state",
+		Help: "Circuit breaker state for each upstream service; 0 closed, 1 open, 2 half-open.",
+	}, []string{"service"})
+	m.breakerRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_upstream_breaker_rejections_total",
+		Help: "Upstream requests that were not sent because the circuit breaker was open.",
+	}, []string{"service"})
+	m.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ils_connector_http_request_duration_seconds",
+		Help:    "Duration of requests handled by the service, by route.",
+		Buckets: []float64{.025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"method", "route", "status"})
+	m.clientRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_client_requests_total",
+		Help: "Requests from internal clients by scope, and whether they were allowed.",
+	}, []string{"client", "scope", "outcome"})
+	m.authThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_auth_throttled_total",
+		Help: "Password and login requests rejected with a 429, by the limit that was hit: ip, target or lockout.",
+	}, []string{"limit"})
+	m.holdsPlaced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_holds_placed_total",
+		Help: "Hold and scan requests successfully placed in sirsi.",
+	}, []string{"type"})
+	m.fillHolds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_fill_holds_total",
+		Help: "Fill hold barcode scans by outcome.",
+	}, []string{"outcome"})
+	m.renewals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_renewals_total",
+		Help: "Item renewals by outcome.",
+	}, []string{"outcome"})
+	m.noticesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ils_connector_notices_sent_total",
+		Help: "Notification emails sent to patrons, by notice template.",
+	}, []string{"notice"})
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.upstreamDuration, m.upstreamErrors, m.sessionTimeouts, m.sirsiLogins, m.breakerState, m.breakerRejections,
+		m.requestDuration, m.clientRequests, m.authThrottled, m.holdsPlaced, m.fillHolds, m.renewals, m.noticesSent,
+	)
+
+	// pre-populate the outcomes so rates can be computed before the first event
+	for _, outcome := range []string{"success", "failure"} {
+		m.fillHolds.WithLabelValues(outcome)
+		m.renewals.WithLabelValues(outcome)
+		m.sirsiLogins.WithLabelValues(outcome)
+	}
+	for _, limit := range []string{"ip", "target", "lockout"} {
+		m.authThrottled.WithLabelValues(limit)
+	}
+	m.holdsPlaced.WithLabelValues("hold")
+	m.holdsPlaced.WithLabelValues("scan")
+	return &m
+}
+
+// observeUpstream records the duration of an upstream request, and counts it as an error if status is not a success
+func (m *serviceMetrics) observeUpstream(serviceName, method string, reqURL *url.URL, status int, elapsed time.Duration) {
+	path := ""
+	if serviceName == "sirsi" {
+		path = normalizeSirsiPath(reqURL.Path)
+	}
+	m.upstreamDuration.WithLabelValues(serviceName, method, path).Observe(elapsed.Seconds())
+	if status != 200 && status != 201 {
+		m.upstreamErrors.WithLabelValues(serviceName, method, path, strconv.Itoa(status)).Inc()
+	}
+}
+
+// normalizeSirsiPath replaces the identifiers in a sirsi request path with placeholders
+// /catalog/bib/key/2419229 becomes /catalog/bib/key/:key
+func normalizeSirsiPath(path string) string {
+	out := make([]string, 0)
+	replaceNext := ""
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "" {
+			continue
+		}
+		if replaceNext != "" {
+			seg = replaceNext
+		}
+		replaceNext = sirsiPathKeys[seg]
+		out = append(out, seg)
+	}
+	return "/" + strings.Join(out, "/")
+}
+
+func outcomeLabel(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+// metricsMiddleware records the latency of each request by matched route
+func (svc *serviceContext) metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	svc.Metrics.requestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+}
+
+// getMetrics serves the service metrics in the prometheus exposition format
+func (svc *serviceContext) getMetrics(c *gin.Context) {
+	promhttp.HandlerFor(svc.Metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+}
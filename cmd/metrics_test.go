@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSirsiPath(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"/catalog/bib/key/2419229", "/catalog/bib/key/:key"},
+		{"/user/patron/alternateID/mst3k", "/user/patron/alternateID/:id"},
+		{"/catalog/item/barcode/X000111111", "/catalog/item/barcode/:barcode"},
+		{"/circulation/holdRecord/key/1001", "/circulation/holdRecord/key/:key"},
+		{"//circulation/circRecord/checkOut", "/circulation/circRecord/checkOut"},
+		{"/policy/library/simpleQuery", "/policy/library/simpleQuery"},
+	}
+	for _, tc := range tests {
+		if got := normalizeSirsiPath(tc.in); got != tc.out {
+			t.Errorf("expected %s to normalize to %s, got %s", tc.in, tc.out, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	staff := leoStaff()
+
+	h.do("GET", "/availability/u2419229", "", auth)
+	h.do("GET", "/availability/u9999999", "", auth)
+	h.do("POST", "/requests/hold", `{"pickupLibrary": "CLEMONS", "itemBarcode": "X000111111"}`, auth)
+	h.do("POST", "/requests/renew", `{"computing_id": "mst3k", "barcodes": ["X000111112"]}`, auth)
+	h.sirsi.override("POST", "/circulation/circRecord/renew", sirsiMessageResponse(http.StatusBadRequest, "renewLimitReached", "Renewal limit reached."))
+	h.do("POST", "/requests/renew", `{"computing_id": "mst3k", "barcodes": ["X000111112"]}`, auth)
+	h.do("POST", "/requests/fill_hold/X000222221", "", staff)
+	h.do("POST", "/requests/fill_hold/X000111111", "", staff)
+	h.do("GET", "/no/such/route", "", nil)
+
+	resp := h.do("GET", "/metrics", "", nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+	out := resp.Body.String()
+	for _, want := range []string{
+		`ils_connector_upstream_request_duration_seconds_count{method="GET",path="/catalog/bib/key/:key",service="sirsi"} 2`,
+		`ils_connector_upstream_request_duration_seconds_count{method="GET",path="",service="solr"}`,
+		`ils_connector_upstream_errors_total{method="GET",path="/catalog/bib/key/:key",service="sirsi",status="404"} 1`,
+		`ils_connector_sirsi_logins_total{result="success"} 1`,
+		`ils_connector_http_request_duration_seconds_count{method="GET",route="/availability/:cat_key",status="200"} 2`,
+		`ils_connector_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+		`ils_connector_holds_placed_total{type="hold"} 1`,
+		`ils_connector_holds_placed_total{type="scan"} 0`,
+		`ils_connector_renewals_total{outcome="success"} 1`,
+		`ils_connector_renewals_total{outcome="failure"} 1`,
+		`ils_connector_fill_holds_total{outcome="success"} 1`,
+		`ils_connector_fill_holds_total{outcome="failure"} 1`,
+		`go_goroutines`,
+	} {
+		if strings.Contains(out, want) == false {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+	for _, unwanted := range []string{"2419229", "mst3k", "X000111111"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("metrics contain identifier %s", unwanted)
+		}
+	}
+}
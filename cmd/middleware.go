@@ -2,43 +2,104 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/uvalib/virgo4-jwt/v4jwt"
 )
 
 func (svc *serviceContext) virgoJWTMiddleware(c *gin.Context) {
-	log.Printf("INFO: authorize user jwt access to %s", c.Request.URL)
-	tokenStr, err := getBearerToken(c.Request.Header.Get("Authorization"))
-	if err != nil {
-		log.Printf("INFO: user jwt auth failed: [%s]", err.Error())
+	logf(c.Request.Context(), "INFO: authorize user jwt access to %s", redactedPath(c))
+	if err := svc.authorizeVirgoJWT(c); err != nil {
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
+	c.Next()
+}
+
+// authorizeVirgoJWT validates the virgo jwt in the authorization header and adds it to the request context
+func (svc *serviceContext) authorizeVirgoJWT(c *gin.Context) error {
+	tokenStr, err := getBearerToken(c.Request.Header.Get("Authorization"))
+	if err != nil {
+		logf(c.Request.Context(), "INFO: user jwt auth failed: [%s]", err.Error())
+		return err
+	}
 
 	if tokenStr == "undefined" {
-		log.Printf("INFO: user jwt auth failed; bearer token is undefined")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+		logf(c.Request.Context(), "INFO: user jwt auth failed; bearer token is undefined")
+		return fmt.Errorf("bearer token is undefined")
 	}
 
-	log.Printf("INFO: validate jwt auth token...")
+	logf(c.Request.Context(), "INFO: validate jwt auth token...")
 	v4Claims, jwtErr := v4jwt.Validate(tokenStr, svc.Secrets.VirgoJWTKey)
 	if jwtErr != nil {
-		log.Printf("ERROR: jwt signature for %s is invalid: %s", tokenStr, jwtErr.Error())
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+		logf(c.Request.Context(), "ERROR: jwt signature is invalid: %s", jwtErr.Error())
+		return fmt.Errorf("jwt signature is invalid")
 	}
 
 	// add the parsed claims and signed JWT string to the request context so other handlers can access it.
 	c.Set("jwt", tokenStr)
 	c.Set("claims", v4Claims)
-	log.Printf("INFO: got bearer token: [%s]: %+v", tokenStr, v4Claims)
-	c.Next()
+	logf(c.Request.Context(), "INFO: authorized user %s with role %s", v4Claims.UserID, v4Claims.Role)
+	return nil
+}
+
+// patronAccessMiddleware limits access to the data of the patron in :compute_id to that patron, admins and
+// internal clients with the patron_data scope.
+// Denied requests, and admin access to the data of another patron, are sent to the audit hook.
+func (svc *serviceContext) patronAccessMiddleware(c *gin.Context) {
+	computeID := c.Param("compute_id")
+	logf(c.Request.Context(), "INFO: authorize patron data access to %s", redactedPath(c))
+	if hasClientCredentials(c) {
+		if err := svc.authorizeClient(c, scopePatronData); err != nil {
+			c.AbortWithStatus(err.StatusCode)
+			return
+		}
+		c.Next()
+		return
+	}
+
+	evt := auditEvent{Action: scopePatronData, Route: c.FullPath(), Target: computeID, ClientIP: c.ClientIP()}
+	if err := svc.authorizeVirgoJWT(c); err != nil {
+		evt.Reason = err.Error()
+		svc.Audit(c.Request.Context(), evt)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	claims, _ := getVirgoClaims(c)
+	evt.Caller = claims.UserID
+	evt.Role = claims.Role.String()
+	if strings.EqualFold(claims.UserID, computeID) {
+		c.Next()
+		return
+	}
+	if claims.Role == v4jwt.Admin {
+		evt.Allowed = true
+		evt.Reason = "admin access"
+		svc.Audit(c.Request.Context(), evt)
+		c.Next()
+		return
+	}
+
+	logf(c.Request.Context(), "WARNING: user %s is not allowed to access data for %s", claims.UserID, computeID)
+	evt.Reason = "caller is not the patron"
+	svc.Audit(c.Request.Context(), evt)
+	c.AbortWithStatus(http.StatusForbidden)
+}
+
+// patronUpdateMiddleware limits changes to the account settings of the patron in :compute_id to that patron
+// and admins. Internal clients with the patron_data scope can read patron data but cannot change it.
+func (svc *serviceContext) patronUpdateMiddleware(c *gin.Context) {
+	if hasClientCredentials(c) {
+		logf(c.Request.Context(), "WARNING: client credentials cannot be used to change %s", redactedPath(c))
+		svc.Audit(c.Request.Context(), auditEvent{Action: scopePatronData, Route: c.FullPath(), Target: c.Param("compute_id"),
+			ClientIP: c.ClientIP(), Reason: "client credentials cannot change patron settings"})
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	svc.patronAccessMiddleware(c)
 }
 
 func getBearerToken(authorization string) (string, error) {
@@ -46,30 +107,22 @@ func getBearerToken(authorization string) (string, error) {
 
 	// must have two components, the first of which is "Bearer", and the second a non-empty token
 	if len(components) != 2 || components[0] != "Bearer" || components[1] == "" {
-		return "", fmt.Errorf("invalid authorization header: [%s]", authorization)
+		return "", fmt.Errorf("invalid authorization header")
 	}
 
 	return components[1], nil
 }
 
 func (svc *serviceContext) sirsiAuthMiddleware(c *gin.Context) {
-	log.Printf("INFO: ensure sirsi session exists for %s", c.Request.URL)
-	if svc.SirsiSession.SessionToken == "" || svc.SirsiSession.isExpired() {
-		log.Printf("INFO: authmiddleware detects expired or missing session token; logging in.")
-		if err := svc.sirsiLogin(); err != nil {
-			log.Printf("ERROR: %s", err.string())
-			c.AbortWithError(err.StatusCode, fmt.Errorf("%s", err.Message))
-			return
-		}
+	logf(c.Request.Context(), "INFO: ensure sirsi session exists for %s", redactedPath(c))
+	if err := svc.SirsiSession.ensureSession(); err != nil {
+		logf(c.Request.Context(), "ERROR: %s", err.string())
+		c.AbortWithError(err.StatusCode, fmt.Errorf("%s", err.Message))
+		return
 	}
 	c.Next()
 }
 func (svc *serviceContext) refreshDataMiddleware(c *gin.Context) {
-	if time.Now().After(svc.Locations.RefreshAt) {
-		svc.refreshLocations()
-	}
-	if time.Now().After(svc.Libraries.RefreshAt) {
-		svc.refreshLibraries()
-	}
+	svc.ensurePolicies(c.Request.Context())
 	c.Next()
 }
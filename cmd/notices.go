@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// noticeRetention is how long a sent notice is remembered to keep it from being sent again
+const noticeRetention = 90 * 24 * time.Hour
+
+// notice kinds; patrons can opt out of each kind, and each kind has its own list of watched patrons
+const (
+	noticeHolds     = "holds"
+	noticeCheckouts = "checkouts"
+)
+
+var noticeKinds = []string{noticeHolds, noticeCheckouts}
+
+// noticeState is the persistent state of the patron notification jobs
+type noticeState struct {
+	Watched map[string]map[string]time.Time `json:"watched"` // kind -> computing ID -> when last seen
+	OptOuts map[string]map[string]bool      `json:"optOuts"` // computing ID -> kinds the patron does not want
+	Sent    map[string]time.Time            `json:"sent"`    // notice key -> when sent
+	Holds   map[string]holdSnapshot         `json:"holds"`   // hold ID -> state when last polled
+
+	AutoRenew    map[string]bool         `json:"autoRenew"`    // computing IDs of patrons that turned on auto-renew
+	AutoRenewals map[string]autoRenewRun `json:"autoRenewals"` // computing ID -> last auto-renew results
+	AutoRenewDue map[string]autoRenewDue `json:"autoRenewDue"` // computing ID -> auto-renew results not yet emailed
+}
+
+// noticeStore keeps the patrons to check, their opt-outs and the notices already sent. It is saved to a
+// JSON file so notices are not sent again after a restart; with no file it is only kept in memory.
+type noticeStore struct {
+	path  string
+	mutex sync.Mutex
+	state noticeState
+}
+
+func newNoticeStore(path string) (*noticeStore, error) {
+	ns := noticeStore{path: path}
+	ns.state = noticeState{Watched: make(map[string]map[string]time.Time), OptOuts: make(map[string]map[string]bool),
+		Sent: make(map[string]time.Time), Holds: make(map[string]holdSnapshot),
+		AutoRenew: make(map[string]bool), AutoRenewals: make(map[string]autoRenewRun), AutoRenewDue: make(map[string]autoRenewDue)}
+	if path == "" {
+		return &ns, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("INFO: notice file %s does not exist and will be created", path)
+		return &ns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &ns.state); err != nil {
+		return nil, fmt.Errorf("invalid notice file %s: %s", path, err.Error())
+	}
+	return &ns, nil
+}
+
+// save writes the store to its file, dropping notices sent longer ago than the retention period
+func (ns *noticeStore) save() error {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	for key, sent := range ns.state.Sent {
+		if time.Since(sent) > noticeRetention {
+			delete(ns.state.Sent, key)
+		}
+	}
+	if ns.path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(ns.state)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a failed write does not lose the existing state
+	tmp, err := os.CreateTemp(filepath.Dir(ns.path), filepath.Base(ns.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ns.path)
+}
+
+// watch adds a patron to the list checked for notices of kind
+func (ns *noticeStore) watch(kind, computeID string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.state.Watched[kind] == nil {
+		ns.state.Watched[kind] = make(map[string]time.Time)
+	}
+	ns.state.Watched[kind][computeID] = time.Now()
+}
+
+func (ns *noticeStore) unwatch(kind, computeID string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	delete(ns.state.Watched[kind], computeID)
+}
+
+// watched returns the patrons checked for notices of kind
+func (ns *noticeStore) watched(kind string) []string {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	out := make([]string, 0, len(ns.state.Watched[kind]))
+	for id := range ns.state.Watched[kind] {
+		out = append(out, id)
+	}
+	return out
+}
+
+func (ns *noticeStore) optedOut(computeID, kind string) bool {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	return ns.state.OptOuts[computeID][kind]
+}
+
+func (ns *noticeStore) setOptOut(computeID, kind string, optOut bool) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if optOut == false {
+		delete(ns.state.OptOuts[computeID], kind)
+		if len(ns.state.OptOuts[computeID]) == 0 {
+			delete(ns.state.OptOuts, computeID)
+		}
+		return
+	}
+	if ns.state.OptOuts[computeID] == nil {
+		ns.state.OptOuts[computeID] = make(map[string]bool)
+	}
+	ns.state.OptOuts[computeID][kind] = true
+}
+
+func (ns *noticeStore) wasSent(key string) bool {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	_, sent := ns.state.Sent[key]
+	return sent
+}
+
+func (ns *noticeStore) markSent(key string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.state.Sent[key] = time.Now()
+}
+
+// notice is an email to a patron. Keys identify the events the notice is for, like a hold becoming ready;
+// a notice is only sent if one of its keys has not been sent before.
+type notice struct {
+	ComputeID string
+	Kind      string
+	Keys      []string
+	Template  string
+	Subject   string
+	Data      any
+}
+
+// noticeEmail is the data available to notice templates
+type noticeEmail struct {
+	Name     string
+	VirgoURL string
+	Data     any
+}
+
+// sendNotice emails a notice to a patron unless they have opted out of the kind, or it has already been sent.
+// Returns true if the notice was sent. With SMTP dev mode the email is logged and the notice is not recorded
+// as sent, so dev mode is a dry run of the notification jobs.
+func (svc *serviceContext) sendNotice(ctx context.Context, n notice) (bool, error) {
+	key := strings.Join(n.Keys, ",")
+	if svc.Notices.optedOut(n.ComputeID, n.Kind) {
+		logf(ctx, "INFO: %s has opted out of %s notices; skip %s", n.ComputeID, n.Kind, key)
+		return false, nil
+	}
+	unsent := false
+	for _, k := range n.Keys {
+		unsent = unsent || svc.Notices.wasSent(k) == false
+	}
+	if unsent == false {
+		return false, nil
+	}
+
+	name, email, err := svc.getPatronContact(ctx, n.ComputeID)
+	if err != nil {
+		return false, err
+	}
+	if email == "" {
+		logf(ctx, "WARNING: %s has no email address; %s notice %s not sent", n.ComputeID, n.Template, key)
+		return false, nil
+	}
+
+	var body bytes.Buffer
+	tpl, err := template.ParseFiles(fmt.Sprintf("templates/%s.txt", n.Template))
+	if err != nil {
+		return false, err
+	}
+	if err := tpl.Execute(&body, noticeEmail{Name: name, VirgoURL: svc.VirgoURL, Data: n.Data}); err != nil {
+		return false, fmt.Errorf("unable to render %s: %s", n.Template, err.Error())
+	}
+	req := emailRequest{Subject: n.Subject, To: []string{email}, From: svc.SMTP.Sender, Body: body.String()}
+	if err := svc.sendEmail(&req); err != nil {
+		return false, err
+	}
+	if svc.SMTP.DevMode {
+		logf(ctx, "INFO: dry run of %s notice %s to %s; not recorded as sent", n.Template, key, n.ComputeID)
+		return true, nil
+	}
+	logf(ctx, "INFO: sent %s notice %s to %s", n.Template, key, n.ComputeID)
+	for _, k := range n.Keys {
+		svc.Notices.markSent(k)
+	}
+	svc.Metrics.noticesSent.WithLabelValues(n.Template).Inc()
+	return true, nil
+}
+
+// getPatronContact returns the name and email address of a patron
+func (svc *serviceContext) getPatronContact(ctx context.Context, computeID string) (string, string, error) {
+	sirsiRaw, sirsiErr := svc.ILS.getPatron(ctx, computeID, patronInfo)
+	if sirsiErr != nil {
+		return "", "", fmt.Errorf("unable to get %s contact info: %s", computeID, sirsiErr.string())
+	}
+	var sirsiUser sirsiUserData
+	if err := json.Unmarshal(sirsiRaw, &sirsiUser); err != nil {
+		return "", "", fmt.Errorf("unable to parse %s contact info: %s", computeID, err.Error())
+	}
+	name := sirsiUser.Fields.PreferredName
+	if name == "" {
+		name = sirsiUser.Fields.FirstName
+	}
+	if name == "" {
+		name = sirsiUser.Fields.DisplayName
+	}
+	email := sirsiUser.Fields.PrimaryAddress.Fields.EmailAddress
+	for _, addr := range sirsiUser.Fields.Address3 {
+		if email == "" && addr.Fields.Code.Key == "EMAIL" {
+			email = addr.Fields.Data
+		}
+	}
+	return name, strings.TrimSpace(email), nil
+}
+
+// GET /users/:compute_id/notifications : the notice kinds a patron receives
+func (svc *serviceContext) getNotificationPrefs(c *gin.Context) {
+	computeID := c.Param("compute_id")
+	c.JSON(http.StatusOK, svc.notificationPrefs(computeID))
+}
+
+// PUT /users/:compute_id/notifications : turn notice kinds on or off for a patron, like {"holds": false}
+func (svc *serviceContext) updateNotificationPrefs(c *gin.Context) {
+	computeID := c.Param("compute_id")
+	var req map[string]bool
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logf(c.Request.Context(), "ERROR: invalid notification preferences for %s: %s", computeID, err.Error())
+		c.String(http.StatusBadRequest, "invalid request")
+		return
+	}
+	for kind := range req {
+		if svc.notificationKindKnown(kind) == false {
+			c.String(http.StatusBadRequest, "unknown notification %s", kind)
+			return
+		}
+	}
+	for kind, enabled := range req {
+		logf(c.Request.Context(), "INFO: %s sets %s notifications to %t", computeID, kind, enabled)
+		svc.Notices.setOptOut(computeID, kind, enabled == false)
+	}
+	if err := svc.Notices.save(); err != nil {
+		logf(c.Request.Context(), "ERROR: unable to save notification preferences: %s", err.Error())
+		c.String(http.StatusInternalServerError, "unable to save notification preferences")
+		return
+	}
+	c.JSON(http.StatusOK, svc.notificationPrefs(computeID))
+}
+
+func (svc *serviceContext) notificationKindKnown(kind string) bool {
+	for _, k := range noticeKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (svc *serviceContext) notificationPrefs(computeID string) map[string]bool {
+	out := make(map[string]bool)
+	for _, kind := range noticeKinds {
+		out[kind] = svc.Notices.optedOut(computeID, kind) == false
+	}
+	return out
+}
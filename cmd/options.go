@@ -7,7 +7,6 @@ import (
 	"slices"
 	"strings"
 
-	"github.com/gin-gonic/gin"
 	"github.com/google/go-querystring/query"
 )
 
@@ -17,6 +16,8 @@ type holdableItem struct {
 	Library    string   `json:"library"`
 	Location   string   `json:"location"`
 	Notice     string   `json:"notice,omitempty"`
+	Volume     string   `json:"volume,omitempty"`
+	CallKey    string   `json:"callKey,omitempty"`  // set for volumes; used to place a volume hold
 	SCNotes    string   `json:"scNotes,omitempty"`  // only set based on solr doc for aeon items
 	Requests   []string `json:"requests,omitempty"` // list of all types of options for requesting this item
 	AeonURL    string   `json:"aeonURL,omitempty"`  // each aeon item is unique and will have its own holdableItem with a single request (aeon) and aeonURL
@@ -41,18 +42,16 @@ func createRequestOptions() *requestOptions {
 	return &out
 }
 
-func (svc *serviceContext) addSirsiRequestOptions(c *gin.Context, resp *availabilityResponse, items []availItem) {
+func (svc *serviceContext) addSirsiRequestOptions(patron optionPatron, resp *availabilityResponse, items []availItem, trace *optionTrace) {
 	log.Printf("INFO: generate request options for %s with %d items", resp.TitleID, len(items))
-	noScans := false
+	noScans := ""
 
 	// check user profile and home location to see if scanning should be an option for this user
-	v4Claims, _ := getVirgoClaims(c)
-	ucaseProfile := strings.ToUpper(v4Claims.Profile)
-	noScanProfiles := []string{"VABORROWER", "OTHERVAFAC", "ALUMNI", "RESEARCHER"}
-	if slices.Contains(noScanProfiles, ucaseProfile) || v4Claims.HomeLibrary == "HEALTHSCI" {
-		noScans = true
+	ucaseProfile := strings.ToUpper(patron.Profile)
+	if svc.Rules.scansBlocked(ucaseProfile, patron.HomeLibrary) {
+		noScans = fmt.Sprintf("patron with profile [%s] and home library [%s] cannot request scans", patron.Profile, patron.HomeLibrary)
 		log.Printf("INFO: user %s with profile [%s] and home library [%s] is not able to request scans",
-			v4Claims.UserID, v4Claims.Profile, v4Claims.HomeLibrary)
+			patron.UserID, patron.Profile, patron.HomeLibrary)
 	}
 
 	for _, item := range items {
@@ -61,6 +60,8 @@ func (svc *serviceContext) addSirsiRequestOptions(c *gin.Context, resp *availabi
 		// item must be available to be held/scanned
 		if item.Unavailable {
 			log.Printf("INFO: item %s is unavailable", item.Barcode)
+			trace.decideItem(item, "scan", false, "current location %s is unavailable", item.CurrentLocationID)
+			trace.decideItem(item, "hold", false, "current location %s is unavailable", item.CurrentLocationID)
 			continue
 		}
 
@@ -72,23 +73,33 @@ func (svc *serviceContext) addSirsiRequestOptions(c *gin.Context, resp *availabi
 
 		// First check to see if an item can be scanned since some non-circulating items are eligible for scanning
 		itemJustAdded := false
-		if item.IsVideo == false && noScans == false && item.LibraryID != "SPEC-COLL" {
-			if slices.Contains([]string{"HISTCOL", "RARESHL", "RAREOVS", "RAREVLT"}, item.HomeLocationID) {
+		if item.IsVideo {
+			trace.decideItem(item, "scan", false, "item is a video")
+		} else if noScans != "" {
+			trace.decideItem(item, "scan", false, "%s", noScans)
+		} else if item.LibraryID == "SPEC-COLL" {
+			trace.decideItem(item, "scan", false, "SPEC-COLL items cannot be scanned")
+		} else {
+			if svc.Rules.scanBlockedLocation(item.HomeLocationID) {
 				log.Printf("INFO: %s with home location %s blocks this item from being scanned", item.Barcode, item.HomeLocationID)
-				noScans = true
+				noScans = fmt.Sprintf("home location %s of item %s blocks scans of this title", item.HomeLocationID, item.Barcode)
+				trace.decideItem(item, "scan", false, "home location %s blocks scans", item.HomeLocationID)
 			} else {
 				if ucaseProfile == "UNDERGRAD" && item.HomeLocationID != "BY-REQUEST" {
 					// Per Daniel Stewart, undergraduate users can make scan requests for items located in a closed stack (BY-REQUEST).
 					// Previous logic blocked all scan requests for undergraduate users
-					log.Printf("INFO: undergraduate user %s cannot make scan requests for items in %s", v4Claims.UserID, item.HomeLocationID)
+					log.Printf("INFO: undergraduate user %s cannot make scan requests for items in %s", patron.UserID, item.HomeLocationID)
+					trace.decideItem(item, "scan", false, "undergraduates can only scan items in BY-REQUEST, not %s", item.HomeLocationID)
 				} else {
 					if holdableExists("scan", item, resp.RequestOptions.Items) == false {
 						itemJustAdded = true
 						holdableItem.Requests = append(holdableItem.Requests, "scan")
 						resp.RequestOptions.Items = append(resp.RequestOptions.Items, &holdableItem)
 						log.Printf("INFO: add scan option for %s", item.Barcode)
+						trace.decideItem(item, "scan", true, "item can be scanned")
 					} else {
 						log.Printf("INFO: scan option already exists for %s", item.Barcode)
+						trace.decideItem(item, "scan", false, "another copy of this item already has a scan option")
 					}
 				}
 			}
@@ -98,6 +109,7 @@ func (svc *serviceContext) addSirsiRequestOptions(c *gin.Context, resp *availabi
 		// that all users can request onshelf items. NOTE: this blocks SPEC-COLL items from the holdable list
 		if svc.isNonCirculating(item) {
 			log.Printf("INFO: item %s is noncirculating", item.Barcode)
+			trace.decideItem(item, "hold", false, "library %s or location %s is not circulating", item.LibraryID, item.CurrentLocationID)
 			continue
 		}
 
@@ -105,9 +117,14 @@ func (svc *serviceContext) addSirsiRequestOptions(c *gin.Context, resp *availabi
 		// which allows holds and videos to be added.
 		optionType := "hold"
 		if item.MicroformURL != "" {
-			log.Printf("INFO: add microForm option %s for %s", item.MicroformURL, item.Barcode)
-			optionType = "microform"
-			resp.RequestOptions.MicroformURL = item.MicroformURL
+			if svc.Features.enabled(microformFeature) {
+				log.Printf("INFO: add microForm option %s for %s", item.MicroformURL, item.Barcode)
+				optionType = "microform"
+				resp.RequestOptions.MicroformURL = item.MicroformURL
+			} else {
+				log.Printf("INFO: %s is a microform but the microform feature is disabled", item.Barcode)
+				trace.decideItem(item, "microform", false, "microform feature is disabled")
+			}
 		}
 		if holdableExists(optionType, item, resp.RequestOptions.Items) == false || itemJustAdded {
 			if itemJustAdded == false {
@@ -116,21 +133,29 @@ func (svc *serviceContext) addSirsiRequestOptions(c *gin.Context, resp *availabi
 			}
 			log.Printf("INFO: add %s option for %s", optionType, item.Barcode)
 			holdableItem.Requests = append(holdableItem.Requests, optionType)
+			trace.decideItem(item, optionType, true, "item circulates")
 			if item.IsVideo {
 				log.Printf("INFO: add videoReserve option for %s", item.Barcode)
 				holdableItem.Requests = append(holdableItem.Requests, "videoReserve")
+				trace.decideItem(item, "videoReserve", true, "item is a video")
+			} else {
+				trace.decideItem(item, "videoReserve", false, "item is not a video")
 			}
 		} else {
 			log.Printf("INFO: hold option already exists for %s", item.Barcode)
+			trace.decideItem(item, optionType, false, "another copy of this item already has a %s option", optionType)
 		}
 	}
 }
 
-func (svc *serviceContext) addStreamingVideoOption(solrDoc *solrDocument, avail *availabilityResponse) {
+func (svc *serviceContext) addStreamingVideoOption(solrDoc *solrDocument, avail *availabilityResponse, trace *optionTrace) {
 	if solrDoc.Pool[0] == "video" && (slices.Contains(solrDoc.Location, "Internet materials") || slices.Contains(solrDoc.Source, "Avalon")) {
 		log.Printf("INFO: add streaming video reserve option")
 		avail.RequestOptions.StreamingReserve = true
+		trace.decide("streaming", true, "title is an online or Avalon video")
+		return
 	}
+	trace.decide("streaming", false, "title is not an online or Avalon video")
 }
 
 func (svc *serviceContext) addHSLScanOption(solrDoc *solrDocument, avail *availabilityResponse) {
@@ -138,16 +163,18 @@ func (svc *serviceContext) addHSLScanOption(solrDoc *solrDocument, avail *availa
 	avail.RequestOptions.HSAScanURL = openURLQuery(svc.HSILLiadURL, solrDoc)
 }
 
-func (svc *serviceContext) addAeonRequestOptions(result *availabilityResponse, solrDoc *solrDocument, availItems []availItem) {
+func (svc *serviceContext) addAeonRequestOptions(result *availabilityResponse, solrDoc *solrDocument, availItems []availItem, trace *optionTrace) {
 	log.Printf("INFO: add aeon request options")
 
 	if !(slices.Contains(solrDoc.Library, "Special Collections")) {
 		log.Printf("INFO: item %s library is not special collections; nothing to do", result.TitleID)
+		trace.decide("aeon", false, "title library is not Special Collections")
 		return
 	}
 
 	for _, item := range availItems {
 		if item.LibraryID != "SPEC-COLL" {
+			trace.decideItem(item, "aeon", false, "library %s is not SPEC-COLL", item.LibraryID)
 			continue
 		}
 		notes := ""
@@ -182,6 +209,7 @@ func (svc *serviceContext) addAeonRequestOptions(result *availabilityResponse, s
 			aeonItem.AeonURL = aeonURL
 		}
 		result.RequestOptions.Items = append(result.RequestOptions.Items, &aeonItem)
+		trace.decideItem(item, "aeon", true, "special collections item")
 	}
 }
 
@@ -266,7 +294,8 @@ func holdableExists(optionType string, tgtItem availItem, holdableItems []*holda
 	callExist := false
 	optExist := false
 	for _, hi := range holdableItems {
-		if strings.EqualFold(hi.CallNumber, tgtItem.CallNumber) {
+		// volumes of a set may share a call number; each volume is a separate request option
+		if strings.EqualFold(hi.CallNumber, tgtItem.CallNumber) && hi.Volume == tgtItem.Volume {
 			callExist = true
 		}
 		if slices.Contains(hi.Requests, optionType) {
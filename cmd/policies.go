@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// policyRetryBase is the delay before the first retry of a failed policy refresh; it doubles with each
+// further failure, up to the refresh interval
+const policyRetryBase = 30 * time.Second
+
+// policyStatus is the refresh state of a policy list
+type policyStatus struct {
+	Records     int       `json:"records"`
+	RefreshedAt time.Time `json:"refreshedAt"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	Failures    int       `json:"failures"`
+}
+
+// policyRefresher tracks the refreshes of the location and library snapshots. Refreshes are serialized;
+// a failed refresh keeps the last good snapshot and is retried with backoff.
+type policyRefresher struct {
+	Interval    time.Duration
+	refreshing  sync.Mutex
+	mutex       sync.Mutex
+	status      map[string]*policyStatus
+	nextRefresh time.Time
+}
+
+func newPolicyRefresher(interval time.Duration) *policyRefresher {
+	return &policyRefresher{Interval: interval, status: map[string]*policyStatus{
+		"locations": {},
+		"libraries": {},
+	}}
+}
+
+// backoff returns the delay before the next refresh after the given number of consecutive failures
+func (pr *policyRefresher) backoff(failures int) time.Duration {
+	if failures == 0 {
+		return pr.Interval
+	}
+	delay := policyRetryBase
+	for i := 1; i < failures && delay < pr.Interval; i++ {
+		delay *= 2
+	}
+	return min(delay, pr.Interval)
+}
+
+// failures returns the most consecutive failures of any policy list
+func (pr *policyRefresher) failures() int {
+	out := 0
+	for _, st := range pr.status {
+		out = max(out, st.Failures)
+	}
+	return out
+}
+
+func (pr *policyRefresher) record(name string, records int, err error) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	st := pr.status[name]
+	st.LastAttempt = time.Now()
+	if err != nil {
+		log.Printf("ERROR: %s refresh failed; keep the last %d records: %s", name, st.Records, err.Error())
+		st.LastError = err.Error()
+		st.Failures++
+		return
+	}
+	st.Records = records
+	st.RefreshedAt = st.LastAttempt
+	st.LastError = ""
+	st.Failures = 0
+}
+
+// scheduleNext sets the time of the next refresh from the failures of the last one
+func (pr *policyRefresher) scheduleNext() {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	delay := pr.backoff(pr.failures())
+	pr.nextRefresh = time.Now().Add(delay)
+	log.Printf("INFO: next location and library refresh in %s", delay)
+}
+
+// refreshPolicies builds new location and library snapshots and swaps them in. A list that fails to load
+// keeps its last good snapshot.
+func (svc *serviceContext) refreshPolicies(ctx context.Context) {
+	svc.Policies.refreshing.Lock()
+	defer svc.Policies.refreshing.Unlock()
+	svc.refreshPoliciesLocked(ctx)
+}
+
+func (svc *serviceContext) refreshPoliciesLocked(ctx context.Context) {
+	pr := svc.Policies
+	if sessionErr := svc.SirsiSession.ensureSession(); sessionErr != nil {
+		err := fmt.Errorf("unable to start sirsi session: %s", sessionErr.string())
+		pr.record("locations", 0, err)
+		pr.record("libraries", 0, err)
+		pr.scheduleNext()
+		return
+	}
+
+	locs, err := svc.loadLocations(ctx)
+	if err == nil {
+		svc.Locations.current.Store(locs)
+		pr.record("locations", len(locs.Records), nil)
+	} else {
+		pr.record("locations", 0, err)
+	}
+	libs, err := svc.loadLibraries(ctx)
+	if err == nil {
+		svc.Libraries.current.Store(libs)
+		pr.record("libraries", len(libs.Records), nil)
+	} else {
+		pr.record("libraries", 0, err)
+	}
+
+	pr.scheduleNext()
+}
+
+// runPolicyRefresher refreshes the location and library snapshots every interval, or sooner with backoff
+// after a failure, until the service exits
+func (svc *serviceContext) runPolicyRefresher() {
+	log.Printf("INFO: refresh locations and libraries every %s", svc.Policies.Interval)
+	for {
+		svc.Policies.mutex.Lock()
+		delay := time.Until(svc.Policies.nextRefresh)
+		svc.Policies.mutex.Unlock()
+		time.Sleep(max(delay, time.Second))
+		ctx, cancel := context.WithTimeout(withRequestID(context.Background(), newRequestID()), time.Minute)
+		svc.refreshPolicies(ctx)
+		cancel()
+	}
+}
+
+// ensurePolicies loads the snapshots on the first request if the startup refresh failed, unless a retry is
+// not yet due. Later refreshes are made by runPolicyRefresher.
+func (svc *serviceContext) ensurePolicies(ctx context.Context) {
+	if svc.Locations.current.Load() != nil && svc.Libraries.current.Load() != nil {
+		return
+	}
+	pr := svc.Policies
+	pr.refreshing.Lock()
+	defer pr.refreshing.Unlock()
+	pr.mutex.Lock()
+	due := (svc.Locations.current.Load() == nil || svc.Libraries.current.Load() == nil) && time.Now().After(pr.nextRefresh)
+	pr.mutex.Unlock()
+	if due {
+		svc.refreshPoliciesLocked(ctx)
+	}
+}
+
+// GET /policies/status : the refresh state of the location and library lists
+func (svc *serviceContext) getPolicyStatus(c *gin.Context) {
+	pr := svc.Policies
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	out := struct {
+		Locations   policyStatus `json:"locations"`
+		Libraries   policyStatus `json:"libraries"`
+		NextRefresh time.Time    `json:"nextRefresh"`
+	}{Locations: *pr.status["locations"], Libraries: *pr.status["libraries"], NextRefresh: pr.nextRefresh}
+	c.JSON(http.StatusOK, out)
+}
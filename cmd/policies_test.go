@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicyBackoff(t *testing.T) {
+	pr := newPolicyRefresher(time.Hour)
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, time.Hour}, {1, 30 * time.Second}, {2, time.Minute}, {4, 4 * time.Minute}, {8, time.Hour},
+	}
+	for _, tc := range tests {
+		if got := pr.backoff(tc.failures); got != tc.delay {
+			t.Errorf("expected %s after %d failures, got %s", tc.delay, tc.failures, got)
+		}
+	}
+}
+
+func TestPolicyRefresh(t *testing.T) {
+	h := newTestHarness(t)
+	down := fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"}
+	status := func(t *testing.T) (out struct {
+		Locations   policyStatus `json:"locations"`
+		Libraries   policyStatus `json:"libraries"`
+		NextRefresh time.Time    `json:"nextRefresh"`
+	}) {
+		t.Helper()
+		resp := h.do("GET", "/policies/status", "", nil)
+		if err := json.Unmarshal(resp.Body.Bytes(), &out); err != nil {
+			t.Fatalf("unable to parse status: %s", err.Error())
+		}
+		return out
+	}
+
+	h.run(t, []routeTest{
+		{name: "failed first load is not retried until the backoff", method: "GET", path: "/availability/list",
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/policy/location/simpleQuery", down)
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				h.do("GET", "/availability/list", "", nil)
+				if got := len(h.sirsi.received("GET", "/policy/location/simpleQuery")); got != 1 {
+					t.Errorf("expected one location request, got %d", got)
+				}
+				st := status(t)
+				if st.Locations.Failures != 1 || st.Locations.LastError == "" || st.Libraries.Records != 6 {
+					t.Errorf("unexpected status %+v", st)
+				}
+				if until := time.Until(st.NextRefresh); until > policyRetryBase || until < policyRetryBase-5*time.Second {
+					t.Errorf("expected a retry in %s, got %s", policyRetryBase, until)
+				}
+			}},
+	})
+
+	t.Run("failed refresh keeps the last good snapshot", func(t *testing.T) {
+		h.sirsi.reset()
+		h.svc.refreshPolicies(context.Background())
+		if h.svc.Locations.find("stacks") == nil || h.svc.Libraries.find("LAW") == nil {
+			t.Fatalf("expected locations and libraries to be loaded")
+		}
+		h.sirsi.override("GET", "/policy/library/simpleQuery", down)
+		h.svc.refreshPolicies(context.Background())
+		if lib := h.svc.Libraries.find("LAW"); lib == nil || lib.Description != "Law" {
+			t.Errorf("expected the last libraries to be kept, got %+v", lib)
+		}
+		if h.svc.Libraries.lookupID("Special Collections") != "SPEC-COLL" || h.svc.Locations.isCourseReserve("law-resv") == false {
+			t.Errorf("expected indexed lookups to work")
+		}
+		if st := status(t); st.Libraries.Failures != 1 || st.Locations.Failures != 0 || st.Libraries.Records != 6 {
+			t.Errorf("unexpected status %+v", st)
+		}
+	})
+}
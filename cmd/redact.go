@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces sensitive values in log output
+const redactedValue = "[REDACTED]"
+
+// defaultRedactFields are the field, header and parameter names with values that are masked in log output.
+// A name matches any key that ends with it, ignoring case; barcode matches itemBarcode and patronBarcode.
+var defaultRedactFields = []string{
+	"authorization", "auth", "jwt", "token", "session", "api-key",
+	"password", "pin",
+	"barcode",
+	"email", "emailAddress",
+}
+
+var (
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)[^\s"\],]+`)
+	jwtPattern    = regexp.MustCompile(`eyJ[\w-]*\.[\w-]+\.[\w-]*`)
+	emailPattern  = regexp.MustCompile(`[\w.%+-]+@[\w-]+(\.[\w-]+)+`)
+)
+
+// redactor masks sensitive values in log messages and attributes. Values are masked when they belong to a
+// configured field in JSON, query strings, headers or printed go structs. Bearer tokens, JWTs and email
+// addresses are masked wherever they appear.
+type redactor struct {
+	fields      []string
+	jsonField   *regexp.Regexp
+	queryField  *regexp.Regexp
+	structField *regexp.Regexp
+}
+
+// logRedactor is used by the service logger and for upstream request details returned in errors
+var logRedactor = newRedactor(defaultRedactFields)
+
+func newRedactor(fields []string) *redactor {
+	r := redactor{fields: make([]string, 0)}
+	names := make([]string, 0)
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		r.fields = append(r.fields, strings.ToLower(f))
+		names = append(names, regexp.QuoteMeta(f))
+	}
+	if len(names) > 0 {
+		key := `[\w@-]*(?:` + strings.Join(names, "|") + `)`
+		r.jsonField = regexp.MustCompile(`(?i)("` + key + `"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+		r.queryField = regexp.MustCompile(`(?i)([?&]` + key + `=)[^&\s"]*`)
+		r.structField = regexp.MustCompile(`(?i)\b(` + key + `:)(\[[^\]]*\]|[^\s,}\]]+)`)
+	}
+	return &r
+}
+
+// sensitive returns true if values for the named field should be masked
+func (r *redactor) sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, f := range r.fields {
+		if strings.HasSuffix(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns a copy of str with all sensitive values masked
+func (r *redactor) redact(str string) string {
+	if r.jsonField != nil {
+		str = r.jsonField.ReplaceAllString(str, `${1}"`+redactedValue+`"`)
+		str = r.queryField.ReplaceAllString(str, "${1}"+redactedValue)
+		str = r.structField.ReplaceAllString(str, "${1}"+redactedValue)
+	}
+	str = bearerPattern.ReplaceAllString(str, "${1}"+redactedValue)
+	str = jwtPattern.ReplaceAllString(str, redactedValue)
+	return emailPattern.ReplaceAllString(str, redactedValue)
+}
+
+// redactID masks a patron barcode or login logged as a plain value, keeping the last characters so log lines
+// for the same account can still be matched. It is not masked if barcode is not a redacted field.
+func (r *redactor) redactID(id string) string {
+	if r.sensitive("barcode") == false {
+		return id
+	}
+	if len(id) <= 6 {
+		return redactedValue
+	}
+	return strings.Repeat("*", len(id)-3) + id[len(id)-3:]
+}
+
+// redactID masks an account identifier for the service log
+func redactID(id string) string {
+	return logRedactor.redactID(id)
+}
+
+// redactHeader returns a copy of the headers with the values of sensitive headers masked
+func (r *redactor) redactHeader(hdr http.Header) http.Header {
+	out := make(http.Header)
+	for name, vals := range hdr {
+		for _, val := range vals {
+			if r.sensitive(name) {
+				val = redactedValue
+			} else {
+				val = r.redact(val)
+			}
+			out[name] = append(out[name], val)
+		}
+	}
+	return out
+}
+
+// replaceAttr is a slog ReplaceAttr function that masks sensitive attributes, including the message
+func (r *redactor) replaceAttr(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key != slog.MessageKey && r.sensitive(attr.Key) {
+		return slog.String(attr.Key, redactedValue)
+	}
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, r.redact(attr.Value.String()))
+	case slog.KindAny:
+		if hdr, ok := attr.Value.Any().(http.Header); ok {
+			return slog.Any(attr.Key, r.redactHeader(hdr))
+		}
+	}
+	return attr
+}
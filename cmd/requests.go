@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"slices"
 
@@ -16,9 +18,18 @@ import (
 type holdRequest struct {
 	PickupLibrary string `json:"pickupLibrary"`
 	ItemBarcode   string `json:"itemBarcode"`
+	HoldType      string `json:"holdType"` // title (default), copy or volume
+	CallKey       string `json:"callKey"`  // callList key of the volume for volume holds
 	IlliadTN      string `json:"illiadTN"` // only present in scan requests (illiad transaction ID)
 }
 
+// hold types accepted in a holdRequest
+const (
+	titleHold  = "title"
+	copyHold   = "copy"
+	volumeHold = "volume"
+)
+
 type holdResponse struct {
 	Hold holdResponseData `json:"hold"`
 }
@@ -28,6 +39,27 @@ type holdErrorsData struct {
 	ItemBarcode []string `json:"item_barcode"`
 }
 
+// holdChangeRequest is the body of a hold change. Only one of the changes can be made in a request.
+type holdChangeRequest struct {
+	PickupLibrary string `json:"pickupLibrary"`
+	SuspendBegin  string `json:"suspendBegin"`
+	SuspendEnd    string `json:"suspendEnd"`
+	Resume        bool   `json:"resume"`
+}
+
+type holdChangeResponse struct {
+	Hold holdChangeData `json:"hold"`
+}
+
+type holdChangeData struct {
+	ID            string          `json:"id"`
+	Status        string          `json:"status"`
+	PickupLibrary string          `json:"pickupLibrary"`
+	SuspendBegin  string          `json:"suspendBegin,omitempty"`
+	SuspendEnd    string          `json:"suspendEnd,omitempty"`
+	Errors        *holdErrorsData `json:"errors,omitempty"`
+}
+
 type holdResponseData struct {
 	PickupLibrary string          `json:"pickupLibrary"`
 	ItemBarcode   string          `json:"itemBarcode"`
@@ -36,13 +68,14 @@ type holdResponseData struct {
 }
 
 type sirsiHoldRequest struct {
-	Type          string   `json:"holdType"`
-	Range         string   `json:"holdRange"`
-	RecallStatus  string   `json:"recallStatus"`
-	PickupLibrary sirsiKey `json:"pickupLibrary"`
-	ItemBarcode   string   `json:"itemBarcode"`
-	PatronBarcode string   `json:"patronBarcode"`
-	Comment       string   `json:"comment"`
+	Type          string    `json:"holdType"`
+	Range         string    `json:"holdRange"`
+	RecallStatus  string    `json:"recallStatus"`
+	PickupLibrary sirsiKey  `json:"pickupLibrary"`
+	ItemBarcode   string    `json:"itemBarcode,omitempty"`
+	Call          *sirsiKey `json:"call,omitempty"`
+	PatronBarcode string    `json:"patronBarcode"`
+	Comment       string    `json:"comment"`
 }
 
 type sirsiHoldPatron struct {
@@ -58,13 +91,24 @@ type sirsiHoldRec struct {
 	Key    string `json:"key"`
 	Fields struct {
 		Patron        sirsiHoldPatron `json:"patron"`
+		Bib           sirsiKey        `json:"bib"`
 		RecallStatus  string          `json:"recallStatus"`
 		Status        string          `json:"status"`
 		PickupLibrary sirsiKey        `json:"pickupLibrary"`
 		PlacedLibrary sirsiKey        `json:"placedLibrary"`
+		SuspendBegin  string          `json:"suspendBeginDate,omitempty"`
+		SuspendEnd    string          `json:"suspendEndDate,omitempty"`
 	} `json:"fields"`
 }
 
+// sirsiHoldChange is the payload for the sirsi changePickupLibrary, suspendHold and unsuspendHold requests
+type sirsiHoldChange struct {
+	HoldRecord       sirsiKey  `json:"holdRecord"`
+	PickupLibrary    *sirsiKey `json:"pickupLibrary,omitempty"`
+	SuspendBeginDate string    `json:"suspendBeginDate,omitempty"`
+	SuspendEndDate   string    `json:"suspendEndDate,omitempty"`
+}
+
 type sirsiTransitRec struct {
 	Key    string `json:"key"`
 	Fields struct {
@@ -106,10 +150,11 @@ type barcodeScanResp struct {
 }
 
 func (svc *serviceContext) createHold(c *gin.Context) {
+	ctx := c.Request.Context()
 	var holdReq holdRequest
 	err := c.ShouldBindJSON(&holdReq)
 	if err != nil {
-		log.Printf("INFO: Unable to parse hold request: %s", err.Error())
+		logf(ctx, "INFO: Unable to parse hold request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
@@ -126,16 +171,19 @@ func (svc *serviceContext) createHold(c *gin.Context) {
 		UserID:        v4Claims.UserID,
 	}}
 
-	holdErr := svc.placeHold(holdReq, v4Claims.Barcode, v4Claims.HomeLibrary)
+	holdErr := svc.placeHold(ctx, holdReq, v4Claims.Barcode, v4Claims.HomeLibrary)
 	if holdErr != nil {
 		sirsiErr, err := svc.handleSirsiErrorResponse(holdErr)
 		if err != nil {
-			log.Printf("ERROR: patron %s place hold %+v failed: %s", v4Claims.Barcode, holdReq, holdErr.Message)
+			logf(ctx, "ERROR: user %s place hold %+v failed: %s", v4Claims.UserID, holdReq, holdErr.Message)
 			c.String(holdErr.StatusCode, holdErr.Message)
 			return
 		}
 		out.Hold.Errors = getHoldErrorMessages(sirsiErr)
-		log.Printf("INFO: patron %s unable to place hold %+v: %+v", v4Claims.Barcode, holdReq, *out.Hold.Errors)
+		logf(ctx, "INFO: user %s unable to place hold %+v: %+v", v4Claims.UserID, holdReq, *out.Hold.Errors)
+	} else {
+		svc.Metrics.holdsPlaced.WithLabelValues("hold").Inc()
+		svc.Notices.watch(noticeHolds, v4Claims.UserID)
 	}
 
 	c.JSON(http.StatusOK, out)
@@ -153,70 +201,185 @@ func getHoldErrorMessages(sirsiErr *sirsiError) *holdErrorsData {
 	return &errors
 }
 
+// getPatronHold gets a hold and checks that it belongs to the patron with computeID
+func (svc *serviceContext) getPatronHold(ctx context.Context, holdID, computeID string) (*sirsiHoldRec, *requestError) {
+	sirsiRaw, sirsiErr := svc.ILS.getHold(ctx, holdID)
+	if sirsiErr != nil {
+		if sirsiErr.StatusCode == 404 {
+			logf(ctx, "INFO: %s was not found", holdID)
+			return nil, &requestError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("%s not found", holdID)}
+		}
+		logf(ctx, "ERROR: unable to get hold info for %s: %s", holdID, sirsiErr.Message)
+		return nil, sirsiErr
+	}
+
+	var hold sirsiHoldRec
+	parseErr := json.Unmarshal(sirsiRaw, &hold)
+	if parseErr != nil {
+		logf(ctx, "ERROR: unable to parse sirsi hold response for %s: %s", holdID, parseErr.Error())
+		return nil, &requestError{StatusCode: http.StatusInternalServerError, Message: parseErr.Error()}
+	}
+	logf(ctx, "%+v", hold)
+
+	holdOwner := hold.Fields.Patron.Fields.AlternateID
+	if !strings.EqualFold(holdOwner, computeID) {
+		logf(ctx, "ERROR: hold user mismatch user %s vs hold patron %s", computeID, holdOwner)
+		return nil, &requestError{StatusCode: http.StatusBadRequest, Message: "you do not hold this item"}
+	}
+	return &hold, nil
+}
+
 func (svc *serviceContext) deleteHold(c *gin.Context) {
+	ctx := c.Request.Context()
 	holdID := c.Param("id")
 	v4Claims, claimErr := getVirgoClaims(c)
 	if claimErr != nil {
 		c.String(http.StatusUnauthorized, "you are not authorized to cancel a hold")
 		return
 	}
-	log.Printf("INFO: %s requests hold %s cancel", v4Claims.UserID, holdID)
+	logf(ctx, "INFO: %s requests hold %s cancel", v4Claims.UserID, holdID)
 
-	fields := "status,recallStatus,patron{alternateID}"
-	url := fmt.Sprintf("/circulation/holdRecord/key/%s?includeFields=%s", holdID, fields)
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.HTTPClient, url)
-	if sirsiErr != nil {
-		if sirsiErr.StatusCode == 404 {
-			log.Printf("INFO: %s was not found", holdID)
-			c.String(http.StatusNotFound, fmt.Sprintf("%s not found", holdID))
-		} else {
-			log.Printf("ERROR: unable to get hold info for %s: %s", holdID, sirsiErr.Message)
-			c.String(sirsiErr.StatusCode, sirsiErr.Message)
-		}
+	hold, holdErr := svc.getPatronHold(ctx, holdID, v4Claims.UserID)
+	if holdErr != nil {
+		c.String(holdErr.StatusCode, holdErr.Message)
 		return
 	}
 
-	var hold sirsiHoldRec
-	parseErr := json.Unmarshal(sirsiRaw, &hold)
-	if parseErr != nil {
-		log.Printf("ERROR: unable to parse sirsi hold response for %s: %s", holdID, parseErr.Error())
-		c.String(http.StatusInternalServerError, parseErr.Error())
+	if (hold.Fields.Status == "PLACED" && hold.Fields.RecallStatus != "RUSH") == false {
+		logf(ctx, "INFO: hold %s cannot be cancelled", holdID)
+		c.String(http.StatusBadRequest, "hold cannot be cancelled")
 		return
 	}
-	log.Printf("%+v", hold)
 
-	holdOwner := hold.Fields.Patron.Fields.AlternateID
-	if !strings.EqualFold(holdOwner, v4Claims.UserID) {
-		log.Printf("ERROR: hold user mismatch user %s vs hold patron %s", v4Claims.UserID, holdOwner)
-		c.String(http.StatusBadRequest, "you do not hold this item")
+	sirsiErr := svc.ILS.cancelHold(ctx, holdID)
+	if sirsiErr != nil {
+		logf(ctx, "INFO: unable to cancel hold: %s", sirsiErr.Message)
+		c.String(sirsiErr.StatusCode, sirsiErr.Message)
 		return
 	}
+	if hold.Fields.Bib.Key != "" {
+		svc.AvailabilityCache.purge("u" + hold.Fields.Bib.Key)
+	}
+	c.String(http.StatusOK, "deleted")
+}
 
-	if (hold.Fields.Status == "PLACED" && hold.Fields.RecallStatus != "RUSH") == false {
-		log.Printf("INFO: hold %s cannot be cancelled", holdID)
-		c.String(http.StatusBadRequest, "hold cannot be cancelled")
+// PATCH /requests/hold/:id : change the pickup library of a hold, suspend it between two dates or resume it.
+// Exactly one of pickupLibrary, suspendBegin and suspendEnd, or resume is given.
+func (svc *serviceContext) modifyHold(c *gin.Context) {
+	ctx := c.Request.Context()
+	holdID := c.Param("id")
+	var req holdChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logf(ctx, "INFO: unable to parse hold change request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	v4Claims, claimErr := getVirgoClaims(c)
+	if claimErr != nil {
+		c.String(http.StatusUnauthorized, "you are not authorized to change a hold")
+		return
+	}
+	logf(ctx, "INFO: %s requests hold %s change %+v", v4Claims.UserID, holdID, req)
+	if err := svc.validateHoldChange(&req); err != nil {
+		logf(ctx, "INFO: invalid hold %s change: %s", holdID, err.Message)
+		c.String(err.StatusCode, err.Message)
 		return
 	}
 
-	delURL := fmt.Sprintf("/circulation/holdRecord/key/%s", holdID)
-	_, sirsiErr = svc.sirsiDelete(svc.HTTPClient, delURL)
+	hold, holdErr := svc.getPatronHold(ctx, holdID, v4Claims.UserID)
+	if holdErr != nil {
+		c.String(holdErr.StatusCode, holdErr.Message)
+		return
+	}
+	if req.Resume == false && hold.Fields.Status != "PLACED" {
+		logf(ctx, "INFO: hold %s with status %s cannot be changed", holdID, hold.Fields.Status)
+		c.String(http.StatusBadRequest, "hold cannot be changed")
+		return
+	}
+
+	var sirsiErr *requestError
+	if req.PickupLibrary != "" {
+		sirsiErr = svc.ILS.changeHoldPickup(ctx, holdID, req.PickupLibrary)
+	} else if req.Resume {
+		sirsiErr = svc.ILS.unsuspendHold(ctx, holdID)
+	} else {
+		sirsiErr = svc.ILS.suspendHold(ctx, holdID, req.SuspendBegin, req.SuspendEnd)
+	}
+
+	out := holdChangeResponse{Hold: holdChangeData{ID: holdID, Status: hold.Fields.Status,
+		PickupLibrary: hold.Fields.PickupLibrary.Key, SuspendBegin: hold.Fields.SuspendBegin, SuspendEnd: hold.Fields.SuspendEnd}}
 	if sirsiErr != nil {
-		if sirsiErr.StatusCode == 204 {
-			c.String(http.StatusOK, "deleted")
-		} else {
-			log.Printf("INFO: unable to cancel hold: %s", sirsiErr.Message)
+		parsedErr, err := svc.handleSirsiErrorResponse(sirsiErr)
+		if err != nil {
+			logf(ctx, "ERROR: user %s change hold %s failed: %s", v4Claims.UserID, holdID, sirsiErr.Message)
 			c.String(sirsiErr.StatusCode, sirsiErr.Message)
+			return
 		}
+		out.Hold.Errors = getHoldErrorMessages(parsedErr)
+		logf(ctx, "INFO: user %s unable to change hold %s: %+v", v4Claims.UserID, holdID, *out.Hold.Errors)
+		c.JSON(http.StatusOK, out)
 		return
 	}
-	c.String(http.StatusOK, "deleted")
+
+	if req.PickupLibrary != "" {
+		out.Hold.PickupLibrary = req.PickupLibrary
+	} else if req.Resume {
+		out.Hold.SuspendBegin = ""
+		out.Hold.SuspendEnd = ""
+	} else {
+		out.Hold.SuspendBegin = req.SuspendBegin
+		out.Hold.SuspendEnd = req.SuspendEnd
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// validateHoldChange checks that a hold change has a single action, a valid pickup library and valid suspend dates
+func (svc *serviceContext) validateHoldChange(req *holdChangeRequest) *requestError {
+	suspend := req.SuspendBegin != "" || req.SuspendEnd != ""
+	actions := 0
+	for _, set := range []bool{req.PickupLibrary != "", suspend, req.Resume} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return &requestError{StatusCode: http.StatusBadRequest, Message: "one of pickupLibrary, suspendBegin and suspendEnd, or resume is required"}
+	}
+
+	if req.PickupLibrary != "" {
+		lib := svc.Libraries.find(req.PickupLibrary)
+		if lib == nil {
+			return &requestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("%s is not a valid library", req.PickupLibrary)}
+		}
+		if lib.Circulating == false {
+			return &requestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("%s is not a pickup library", req.PickupLibrary)}
+		}
+		req.PickupLibrary = lib.Key
+		return nil
+	}
+
+	if suspend {
+		begin, beginErr := time.Parse("2006-01-02", req.SuspendBegin)
+		end, endErr := time.Parse("2006-01-02", req.SuspendEnd)
+		if beginErr != nil || endErr != nil {
+			return &requestError{StatusCode: http.StatusBadRequest, Message: "suspendBegin and suspendEnd must be dates in YYYY-MM-DD format"}
+		}
+		if end.Before(begin) {
+			return &requestError{StatusCode: http.StatusBadRequest, Message: "suspendEnd must not be before suspendBegin"}
+		}
+		if req.SuspendEnd < time.Now().Format("2006-01-02") {
+			return &requestError{StatusCode: http.StatusBadRequest, Message: "suspendEnd must not be in the past"}
+		}
+	}
+	return nil
 }
 
 func (svc *serviceContext) createScan(c *gin.Context) {
+	ctx := c.Request.Context()
 	var holdReq holdRequest
 	err := c.ShouldBindJSON(&holdReq)
 	if err != nil {
-		log.Printf("INFO: Unable to parse scan request: %s", err.Error())
+		logf(ctx, "INFO: Unable to parse scan request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
@@ -233,24 +396,26 @@ func (svc *serviceContext) createScan(c *gin.Context) {
 		UserID:        v4Claims.UserID,
 	}}
 
-	log.Printf("INFO: scan request: %+v", holdReq)
-	holdErr := svc.placeHold(holdReq, "999999462", "LEO")
+	logf(ctx, "INFO: scan request: %+v", holdReq)
+	holdErr := svc.placeHold(ctx, holdReq, "999999462", "LEO")
 	if holdErr != nil {
 		sirsiErr, err := svc.handleSirsiErrorResponse(holdErr)
 		if err != nil {
-			log.Printf("ERROR: patron %s scan request %+v failed: %s", v4Claims.Barcode, holdReq, holdErr.Message)
+			logf(ctx, "ERROR: user %s scan request %+v failed: %s", v4Claims.UserID, holdReq, holdErr.Message)
 			c.String(holdErr.StatusCode, holdErr.Message)
 			return
 		}
 		out.Hold.Errors = getHoldErrorMessages(sirsiErr)
-		log.Printf("INFO: patron %s unable to place scan request %+v: %+v", v4Claims.Barcode, holdReq, *out.Hold.Errors)
+		logf(ctx, "INFO: user %s unable to place scan request %+v: %+v", v4Claims.UserID, holdReq, *out.Hold.Errors)
+	} else {
+		svc.Metrics.holdsPlaced.WithLabelValues("scan").Inc()
 	}
 
 	c.JSON(http.StatusOK, out)
 }
 
-func (svc *serviceContext) placeHold(holdReq holdRequest, patronBarcode, workLibrary string) *requestError {
-	log.Printf("INFO: place patron %s hold request: %+v", patronBarcode, holdReq)
+func (svc *serviceContext) placeHold(ctx context.Context, holdReq holdRequest, patronBarcode, workLibrary string) *requestError {
+	logf(ctx, "INFO: place hold request: %+v", holdReq)
 	req := sirsiHoldRequest{
 		Type:         "TITLE",
 		Range:        "GROUP",
@@ -263,17 +428,38 @@ func (svc *serviceContext) placeHold(holdReq holdRequest, patronBarcode, workLib
 		PatronBarcode: patronBarcode,
 		Comment:       holdReq.IlliadTN,
 	}
-	payloadBytes, _ := json.Marshal(req)
-	url := fmt.Sprintf("%s/circulation/holdRecord/placeHold?includeFields=holdRecord{*}", svc.SirsiConfig.WebServicesURL)
-	log.Printf("INFO: post request %s with payload %s", url, payloadBytes)
-	postReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
-	svc.setSirsiHeaders(postReq, "PATRON", svc.SirsiSession.SessionToken)
-	postReq.Header.Set("sd-working-libraryid", workLibrary)
-	_, holdErr := svc.sendRequest("sirsi", svc.HTTPClient, postReq)
+
+	// title holds are filled by any copy of the item's volume, copy holds only by the item, and
+	// volume holds by any copy in the callList entry
+	switch strings.ToLower(holdReq.HoldType) {
+	case "", titleHold:
+	case copyHold:
+		req.Type = "COPY"
+	case volumeHold:
+		if holdReq.CallKey == "" {
+			return &requestError{StatusCode: http.StatusBadRequest, Message: "callKey is required for a volume hold"}
+		}
+		req.ItemBarcode = ""
+		req.Call = &sirsiKey{Resource: "/catalog/call", Key: holdReq.CallKey}
+	default:
+		return &requestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("%s is not a valid hold type", holdReq.HoldType)}
+	}
+	if req.Call == nil && holdReq.ItemBarcode == "" {
+		return &requestError{StatusCode: http.StatusBadRequest, Message: "itemBarcode is required"}
+	}
+
+	_, holdErr := svc.ILS.placeHold(ctx, req, workLibrary)
 	if holdErr != nil {
 		return holdErr
 	}
-	log.Printf("INFO: hold placed")
+	logf(ctx, "INFO: hold placed")
+	if holdReq.ItemBarcode != "" {
+		svc.AvailabilityCache.purgeBarcode(holdReq.ItemBarcode)
+	}
+	if req.Call != nil {
+		// call keys are the bib key followed by the call sequence
+		svc.AvailabilityCache.purge("u" + strings.Split(holdReq.CallKey, ":")[0])
+	}
 	return nil
 }
 
@@ -298,27 +484,25 @@ type fillHoldInfo struct {
 // Instead, just ignore this param and always include
 // override OK in the untransit request. This will work on forst try and avoid looping
 func (svc *serviceContext) fillHold(c *gin.Context) {
+	ctx := c.Request.Context()
 	barcode := c.Param("barcode")
 	sessionToken := c.Request.Header.Get("SirsiSessionToken")
 	if sessionToken == "" {
-		log.Printf("INFO: fill hold request missing session token")
+		logf(ctx, "INFO: fill hold request missing session token")
 		c.String(http.StatusUnauthorized, "you are not authorized for this request")
 		return
 	}
 
+	// every scan that gets this far counts as a failure unless a hold is filled
+	success := false
+	defer func() {
+		svc.Metrics.fillHolds.WithLabelValues(outcomeLabel(success)).Inc()
+	}()
+
 	out := barcodeScanResp{Barcode: barcode}
-	fields := `bib{title,author,currentLocation},`
-	fields += `transit{destinationLibrary,holdRecord},`
-	fields += `fillableHoldList{placedLibrary,pickupLibrary,patron{alternateID,displayName,barcode}}`
-	url := fmt.Sprintf("%s/catalog/item/barcode/%s?includeFields=%s", svc.SirsiConfig.WebServicesURL, barcode, fields)
-	sirsiReq, _ := http.NewRequest("GET", url, nil)
-	svc.setSirsiHeaders(sirsiReq, "STAFF", sessionToken)
-	sirsiReq.Header.Set("SD-Working-LibraryID", "LEO")
-	sirsiReq.Header.Set("x-sirs-clientID", "ILL_CKOUT")
-	log.Printf("INFO: barcode scanner get item url %s with headers %+v", url, sirsiReq.Header)
-	itemResp, itemErr := svc.sendRequest("sirsi", svc.HTTPClient, sirsiReq)
+	itemResp, itemErr := svc.ILS.getItemHolds(ctx, barcode, sessionToken)
 	if itemErr != nil {
-		log.Printf("INFO: barcode scan item request failed: %s", itemErr.string())
+		logf(ctx, "INFO: barcode scan item request failed: %s", itemErr.string())
 		var msgs sirsiMessageList
 		err := json.Unmarshal([]byte(itemErr.Message), &msgs)
 		if err != nil {
@@ -333,7 +517,7 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 	var item sirsiBarcodeScanItem
 	err := json.Unmarshal(itemResp, &item)
 	if err != nil {
-		log.Printf("ERROR: unable to parse barcode scan item response: %s", err.Error())
+		logf(ctx, "ERROR: unable to parse barcode scan item response: %s", err.Error())
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -343,7 +527,7 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 	out.Author = item.Fields.Bib.Fields.Author
 
 	if len(item.Fields.FillableHolds) == 0 && (item.Fields.Transit == nil || (item.Fields.Transit != nil && item.Fields.Transit.Fields.HoldRecord == nil)) {
-		log.Printf("INFO: no hold or transit for %s", barcode)
+		logf(ctx, "INFO: no hold or transit for %s", barcode)
 		out.ErrorMessages = append(out.ErrorMessages, sirsiMessage{Message: "No hold for this item."})
 		c.JSON(http.StatusOK, out)
 		return
@@ -356,7 +540,7 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 		// if a transit record is found, find the hold details in the fillableHoldList
 		// IF there is a transit record, the item must be untransited first, then the checkout can proceed
 		var transitHold *sirsiHoldRec
-		log.Printf("INFO: %s is in transit; find hold details", barcode)
+		logf(ctx, "INFO: %s is in transit; find hold details", barcode)
 		holdKey := item.Fields.Transit.Fields.HoldRecord.Key
 		delIdx := -1
 		for hIdx, h := range item.Fields.FillableHolds {
@@ -367,7 +551,7 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 			}
 		}
 		if transitHold == nil {
-			log.Printf("ERROR: unable to find in-transit hold %s in fillable holds list", holdKey)
+			logf(ctx, "ERROR: unable to find in-transit hold %s in fillable holds list", holdKey)
 			c.String(http.StatusInternalServerError, "unable to find hold data in transit item")
 			return
 		}
@@ -383,9 +567,9 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 		})
 
 		// now remove the hold rec for the in-transit item so it is not processed twice
-		log.Printf("INFO: remove fillable hold index %d of %d for %s that was referenced by the transit record", delIdx, len(item.Fields.FillableHolds), transitHold.Key)
+		logf(ctx, "INFO: remove fillable hold index %d of %d for %s that was referenced by the transit record", delIdx, len(item.Fields.FillableHolds), transitHold.Key)
 		item.Fields.FillableHolds = slices.Delete(item.Fields.FillableHolds, delIdx, delIdx+1)
-		log.Printf("INFO: after delete, %d records remain", len(item.Fields.FillableHolds))
+		logf(ctx, "INFO: after delete, %d records remain", len(item.Fields.FillableHolds))
 	}
 
 	// collect details needed to fill hold from each rec
@@ -401,10 +585,16 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 		})
 	}
 
-	log.Printf("INFO: %s has %d holds to try", barcode, len(items))
+	logf(ctx, "INFO: %s has %d holds to try", barcode, len(items))
 	errors := make([]sirsiMessage, 0)
-	success := false
 	for _, tgt := range items {
+		if ctx.Err() != nil {
+			reqErr := contextError(ctx)
+			logf(ctx, "INFO: fill hold for %s stopped before all holds were tried: %s", barcode, reqErr.Message)
+			c.String(reqErr.StatusCode, reqErr.Message)
+			return
+		}
+
 		// populate more response data based on target hold; necessary for the next steps
 		out.UserName = tgt.UserName
 		out.UserID = tgt.UserID
@@ -412,24 +602,30 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 
 		// if necessary, first try an untransit
 		if tgt.Untransit {
-			status, err := svc.fillHoldUntransitItem(tgt, sessionToken)
+			status, err := svc.fillHoldUntransitItem(ctx, tgt, sessionToken)
 			if err != nil {
-				log.Printf("INFO: untransit request failed: %s", err.string())
+				logf(ctx, "INFO: untransit request failed: %s", err.string())
 				errors = append(errors, sirsiMessage{Code: fmt.Sprintf("%d", err.StatusCode), Message: err.Message})
 				continue
 			}
 			if status != "ON_SHELF" {
-				log.Printf("INFO: untransit returned incorrect status %s", status)
+				logf(ctx, "INFO: untransit returned incorrect status %s", status)
 				errors = append(errors, sirsiMessage{Message: status})
 				c.JSON(http.StatusOK, out)
 				continue
 			}
 		}
 
-		coErr := svc.fillHoldCheckout(tgt, sessionToken)
+		// once an item has been untransited, finish the checkout even if the caller has gone away so the
+		// item is not left off the shelf without being checked out. the http client timeout still applies.
+		coCtx := ctx
+		if tgt.Untransit {
+			coCtx = context.WithoutCancel(ctx)
+		}
+		coErr := svc.fillHoldCheckout(coCtx, tgt, sessionToken)
 		if coErr != nil {
 			// on failure, there willl be errors listed in the error string. parse and save
-			log.Printf("INFO: fill hold checkout for %s failed: %s", barcode, coErr.string())
+			logf(ctx, "INFO: fill hold checkout for %s failed: %s", barcode, coErr.string())
 			var msgs sirsiMessageList
 			json.Unmarshal([]byte(coErr.Message), &msgs)
 			errors = append(errors, msgs.MessageList...)
@@ -446,65 +642,37 @@ func (svc *serviceContext) fillHold(c *gin.Context) {
 	c.JSON(http.StatusOK, out)
 }
 
-func (svc *serviceContext) fillHoldUntransitItem(tgt fillHoldInfo, sessionToken string) (string, *requestError) {
-	log.Printf("INFO: untransit %s[%s]", tgt.Barcode, tgt.Key)
-	req := struct {
-		ItemBarcode string `json:"itemBarcode"`
-	}{
-		ItemBarcode: tgt.Barcode,
-	}
-	payloadBytes, _ := json.Marshal(req)
-	uri := "/circulation/transit/untransit"
-	overrides := []string{"CKOBLOCKS", "/OK"}
-	headers := make(map[string]string)
-	headers["x-sirs-clientID"] = "ILL_CKOUT"
-	headers["sd-working-libraryid"] = tgt.PickupLibraryID
-	headers["x-sirs-sessionToken"] = sessionToken
-	log.Printf("INFO: untransit payload: %s", payloadBytes)
-
-	sirsiResp, sirsiErr := svc.retrySirsiRequest(uri, payloadBytes, headers, overrides, "")
+func (svc *serviceContext) fillHoldUntransitItem(ctx context.Context, tgt fillHoldInfo, sessionToken string) (string, *requestError) {
+	logf(ctx, "INFO: untransit %s[%s]", tgt.Barcode, tgt.Key)
+	sirsiResp, sirsiErr := svc.ILS.untransit(ctx, tgt.Barcode, tgt.PickupLibraryID, sessionToken)
 	if sirsiErr != nil {
 		return "", sirsiErr
 	}
 	var untResp sirsiUntransitResp
 	err := json.Unmarshal(sirsiResp, &untResp)
 	if err != nil {
-		log.Printf("ERROR: unable to parse untransit response: %s", err)
+		logf(ctx, "ERROR: unable to parse untransit response: %s", err)
 		re := requestError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
 		return "", &re
 	}
-	log.Printf("INFO: %s[%s] untransit request results in status: %s", tgt.Barcode, tgt.Key, untResp.CurrentStatus)
+	logf(ctx, "INFO: %s[%s] untransit request results in status: %s", tgt.Barcode, tgt.Key, untResp.CurrentStatus)
 	return untResp.CurrentStatus, nil
 }
 
-func (svc *serviceContext) fillHoldCheckout(tgt fillHoldInfo, sessionToken string) *requestError {
-	log.Printf("INFO: fillhold checkout %s[%s] from user %s", tgt.Barcode, tgt.Key, tgt.UserID)
-	req := struct {
-		PatronBarcode string `json:"patronBarcode"`
-		ItemBarcode   string `json:"itemBarcode"`
-	}{
-		PatronBarcode: tgt.UserBarcode,
-		ItemBarcode:   tgt.Barcode,
-	}
-	payloadBytes, _ := json.Marshal(req)
-	uri := "/circulation/circRecord/checkOut"
-	overrides := []string{"CKOBLOCKS"}
-	headers := make(map[string]string)
-	headers["x-sirs-clientID"] = "ILL_CKOUT"
-	headers["sd-working-libraryid"] = tgt.PickupLibraryID
-	headers["x-sirs-sessionToken"] = sessionToken
-	log.Printf("INFO: fillhold checkout payload: %s", payloadBytes)
-	_, sirsiErr := svc.retrySirsiRequest(uri, payloadBytes, headers, overrides, "")
+func (svc *serviceContext) fillHoldCheckout(ctx context.Context, tgt fillHoldInfo, sessionToken string) *requestError {
+	logf(ctx, "INFO: fillhold checkout %s[%s] from user %s", tgt.Barcode, tgt.Key, tgt.UserID)
+	_, sirsiErr := svc.ILS.checkout(ctx, tgt.Barcode, tgt.UserBarcode, tgt.PickupLibraryID, sessionToken)
 	if sirsiErr != nil {
 		return sirsiErr
 	}
-	log.Printf("INFO: fillhold checkout %s[%s] was successful", tgt.Barcode, tgt.Key)
+	logf(ctx, "INFO: fillhold checkout %s[%s] was successful", tgt.Barcode, tgt.Key)
+	svc.AvailabilityCache.purgeBarcode(tgt.Barcode)
 	return nil
 }
 
 // this will retry the given request and payload. each try will add overrides to SD-Prompt-Return
-func (svc *serviceContext) retrySirsiRequest(uri string, payload []byte, headers map[string]string, overrides []string, overridePosifix string) ([]byte, *requestError) {
-	log.Printf("INFO: retry sirsi request %s and apply override headers each attempt", uri)
+func (svc *serviceContext) retrySirsiRequest(ctx context.Context, uri string, payload []byte, headers map[string]string, overrides []string, overridePosifix string) ([]byte, *requestError) {
+	slog.InfoContext(ctx, "retry sirsi request and apply override headers each attempt", "uri", uri)
 	attempt := 0
 	success := false
 	var lastErr *requestError
@@ -516,24 +684,24 @@ func (svc *serviceContext) retrySirsiRequest(uri string, payload []byte, headers
 	url := fmt.Sprintf("%s/%s", svc.SirsiConfig.WebServicesURL, uri)
 	for attempt < 5 {
 		attempt++
-		sirsiReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-		svc.setSirsiHeaders(sirsiReq, "STAFF", svc.SirsiSession.SessionToken)
+		sirsiReq, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
+		svc.setSirsiHeaders(sirsiReq, "STAFF", svc.SirsiSession.token())
 		for hdr, val := range headers {
 			// add all standard headers passed; x-sirs-sessionToken, x-sirs-clientID, etc
 			sirsiReq.Header.Set(hdr, val)
 		}
 		for _, hdr := range headerOverrides {
 			// now add any override headers
-			log.Printf("INFO: add %s to SD-Prompt-Return", hdr)
+			slog.InfoContext(ctx, "add SD-Prompt-Return override", "override", hdr)
 			sirsiReq.Header.Add("SD-Prompt-Return", hdr)
 		}
 
-		log.Printf("INFO: request attempt #%d with headers [%v]", attempt, sirsiReq.Header)
-		sirsiResp, sirsiErr := svc.sendRequest("sirsi", svc.HTTPClient, sirsiReq)
+		slog.InfoContext(ctx, "sirsi request attempt", "attempt", attempt, "headers", sirsiReq.Header)
+		sirsiResp, sirsiErr := svc.sendRequest(ctx, "sirsi", svc.HTTPClient, sirsiReq)
 		lastResp = sirsiResp
 		lastErr = sirsiErr
 		if sirsiErr != nil {
-			log.Printf("INFO: request failed: %s", sirsiErr.string())
+			slog.InfoContext(ctx, "sirsi request attempt failed", "attempt", attempt, "error", sirsiErr.string())
 			var errInfo sirsiError
 			json.Unmarshal([]byte(sirsiErr.Message), &errInfo)
 			if errInfo.DataMap.PromptType != "" {
@@ -541,21 +709,21 @@ func (svc *serviceContext) retrySirsiRequest(uri string, payload []byte, headers
 				if overridePosifix != "" {
 					newHeader += fmt.Sprintf("/%s", overridePosifix)
 				}
-				log.Printf("INFO: add override %s", newHeader)
+				slog.InfoContext(ctx, "add override for next attempt", "override", newHeader)
 				headerOverrides = append(headerOverrides, newHeader)
 			} else {
-				log.Printf("INFO: checkout failed with no override data; done")
+				slog.InfoContext(ctx, "sirsi request failed with no override data; done")
 				break
 			}
 		} else {
-			log.Printf("INFO: %s succeeded", url)
+			slog.InfoContext(ctx, "sirsi request succeeded", "url", url, "attempt", attempt)
 			success = true
 			break
 		}
 	}
 
 	if success == false {
-		log.Printf("INFO: %s failed after %d attempts: %s", uri, attempt, lastErr.string())
+		slog.InfoContext(ctx, "sirsi request failed", "uri", uri, "attempts", attempt, "error", lastErr.string())
 		return lastResp, lastErr
 	}
 
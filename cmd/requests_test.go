@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestCreateHold(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	holdBody := `{"pickupLibrary": "CLEMONS", "itemBarcode": "X000111111"}`
+
+	h.run(t, []routeTest{
+		{name: "missing jwt", method: "POST", path: "/requests/hold", body: holdBody, status: http.StatusUnauthorized},
+		{name: "invalid request", method: "POST", path: "/requests/hold", body: `{"pickupLibrary": `, headers: auth,
+			status: http.StatusBadRequest},
+		{name: "hold placed", method: "POST", path: "/requests/hold", body: holdBody, headers: auth,
+			status:   http.StatusOK,
+			contains: []string{`"user_id":"mst3k"`, `"itemBarcode":"X000111111"`, `"pickupLibrary":"CLEMONS"`},
+			excludes: []string{"errors"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/circulation/holdRecord/placeHold")
+				if len(reqs) != 1 {
+					t.Fatalf("expected one place hold request, got %d", len(reqs))
+				}
+				var holdReq sirsiHoldRequest
+				json.Unmarshal(reqs[0].body, &holdReq)
+				if holdReq.PatronBarcode != "C000011111" || holdReq.Type != "TITLE" || holdReq.PickupLibrary.Key != "CLEMONS" {
+					t.Errorf("unexpected place hold payload %s", reqs[0].body)
+				}
+				if reqs[0].header.Get("sd-working-libraryid") != "ALDERMAN" {
+					t.Errorf("expected working library ALDERMAN, got %s", reqs[0].header.Get("sd-working-libraryid"))
+				}
+				if reqs[0].header.Get("SD-Preferred-Role") != "PATRON" {
+					t.Errorf("expected PATRON role, got %s", reqs[0].header.Get("SD-Preferred-Role"))
+				}
+			}},
+		{name: "copy hold", method: "POST", path: "/requests/hold", headers: auth,
+			body:   `{"pickupLibrary": "CLEMONS", "itemBarcode": "X000111111", "holdType": "copy"}`,
+			status: http.StatusOK, excludes: []string{"errors"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var holdReq sirsiHoldRequest
+				json.Unmarshal(h.sirsi.received("POST", "/circulation/holdRecord/placeHold")[0].body, &holdReq)
+				if holdReq.Type != "COPY" || holdReq.ItemBarcode != "X000111111" || holdReq.Call != nil {
+					t.Errorf("unexpected place hold payload %+v", holdReq)
+				}
+			}},
+		{name: "volume hold", method: "POST", path: "/requests/hold", headers: auth,
+			body:   `{"pickupLibrary": "CLEMONS", "holdType": "volume", "callKey": "3330001:3"}`,
+			status: http.StatusOK, excludes: []string{"errors"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var holdReq sirsiHoldRequest
+				json.Unmarshal(h.sirsi.received("POST", "/circulation/holdRecord/placeHold")[0].body, &holdReq)
+				if holdReq.Type != "TITLE" || holdReq.ItemBarcode != "" || holdReq.Call == nil || holdReq.Call.Key != "3330001:3" {
+					t.Errorf("unexpected place hold payload %+v", holdReq)
+				}
+			}},
+		{name: "unknown volume", method: "POST", path: "/requests/hold", headers: auth,
+			body:     `{"pickupLibrary": "CLEMONS", "holdType": "volume", "callKey": "3330001:9"}`,
+			status:   http.StatusOK,
+			contains: []string{`"sirsi":["Call 3330001:9 not found."]`}},
+		{name: "volume hold needs a call key", method: "POST", path: "/requests/hold", headers: auth,
+			body:   `{"pickupLibrary": "CLEMONS", "itemBarcode": "X000333303", "holdType": "volume"}`,
+			status: http.StatusBadRequest, contains: []string{"callKey is required for a volume hold"}},
+		{name: "invalid hold type", method: "POST", path: "/requests/hold", headers: auth,
+			body:   `{"pickupLibrary": "CLEMONS", "itemBarcode": "X000111111", "holdType": "shelf"}`,
+			status: http.StatusBadRequest, contains: []string{"shelf is not a valid hold type"}},
+		{name: "unknown item", method: "POST", path: "/requests/hold", headers: auth,
+			body:     `{"pickupLibrary": "CLEMONS", "itemBarcode": "X999999999"}`,
+			status:   http.StatusOK,
+			contains: []string{`"errors":{"sirsi":["Item X999999999 not found."],"item_barcode":null}`}},
+		{name: "sirsi message list", method: "POST", path: "/requests/hold", body: holdBody, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/holdRecord/placeHold",
+					sirsiMessageResponse(http.StatusBadRequest, "hatErrorResponse.722", "User already has a hold on this material."))
+			},
+			status:   http.StatusOK,
+			contains: []string{`"sirsi":["User already has a hold on this material."]`}},
+		{name: "sirsi key parse error", method: "POST", path: "/requests/hold", body: holdBody, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/holdRecord/placeHold",
+					fakeResponse{status: http.StatusBadRequest, body: `{"messageList":[{"code":"keyParseError","message":"Unable to parse key X000111111"},{"code":"hatErrorResponse.141","message":"Item not holdable."}]}`})
+			},
+			status:   http.StatusOK,
+			contains: []string{`"errors":{"sirsi":["Item not holdable."],"item_barcode":["Invalid title key"]}`}},
+		{name: "sirsi system error", method: "POST", path: "/requests/hold", body: holdBody, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/holdRecord/placeHold", fakeResponse{status: http.StatusInternalServerError, body: "internal failure"})
+			},
+			status:   http.StatusInternalServerError,
+			contains: []string{"internal failure"}},
+	})
+}
+
+func TestCreateScan(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	scanBody := `{"pickupLibrary": "LEO", "itemBarcode": "X000111111", "illiadTN": "1234567"}`
+
+	h.run(t, []routeTest{
+		{name: "missing jwt", method: "POST", path: "/requests/scan", body: scanBody, status: http.StatusUnauthorized},
+		{name: "invalid request", method: "POST", path: "/requests/scan", body: `{"pickupLibrary": `, headers: auth,
+			status: http.StatusBadRequest},
+		{name: "scan placed", method: "POST", path: "/requests/scan", body: scanBody, headers: auth,
+			status:   http.StatusOK,
+			contains: []string{`"user_id":"mst3k"`, `"itemBarcode":"X000111111"`, `"pickupLibrary":"LEO"`},
+			excludes: []string{"errors"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/circulation/holdRecord/placeHold")
+				if len(reqs) != 1 {
+					t.Fatalf("expected one place hold request, got %d", len(reqs))
+				}
+				var holdReq sirsiHoldRequest
+				json.Unmarshal(reqs[0].body, &holdReq)
+				if holdReq.PatronBarcode != "999999462" || holdReq.Comment != "1234567" || holdReq.PickupLibrary.Key != "LEO" {
+					t.Errorf("unexpected place hold payload %s", reqs[0].body)
+				}
+				if reqs[0].header.Get("sd-working-libraryid") != "LEO" {
+					t.Errorf("expected working library LEO, got %s", reqs[0].header.Get("sd-working-libraryid"))
+				}
+			}},
+		{name: "unknown item", method: "POST", path: "/requests/scan", headers: auth,
+			body:     `{"pickupLibrary": "LEO", "itemBarcode": "X999999999", "illiadTN": "1234567"}`,
+			status:   http.StatusOK,
+			contains: []string{`"errors":{"sirsi":["Item X999999999 not found."],"item_barcode":null}`}},
+		{name: "sirsi message list", method: "POST", path: "/requests/scan", body: scanBody, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/holdRecord/placeHold",
+					sirsiMessageResponse(http.StatusBadRequest, "hatErrorResponse.141", "Item not holdable."))
+			},
+			status:   http.StatusOK,
+			contains: []string{`"sirsi":["Item not holdable."]`}},
+		{name: "sirsi system error", method: "POST", path: "/requests/scan", body: scanBody, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/holdRecord/placeHold", fakeResponse{status: http.StatusInternalServerError, body: "internal failure"})
+			},
+			status:   http.StatusInternalServerError,
+			contains: []string{"internal failure"}},
+	})
+}
+
+func TestDeleteHold(t *testing.T) {
+	h := newTestHarness(t)
+	otherClaims := mst3kClaims()
+	otherClaims.UserID = "xyz9z"
+
+	h.run(t, []routeTest{
+		{name: "missing jwt", method: "DELETE", path: "/requests/hold/1001", status: http.StatusUnauthorized},
+		{name: "not hold owner", method: "DELETE", path: "/requests/hold/1001",
+			headers: map[string]string{"Authorization": bearer(t, otherClaims)},
+			status:  http.StatusBadRequest, contains: []string{"you do not hold this item"}},
+		{name: "hold cancelled", method: "DELETE", path: "/requests/hold/1001",
+			headers: map[string]string{"Authorization": bearer(t, mst3kClaims())},
+			setup: func(h *testHarness) {
+				h.svc.AvailabilityCache = newAvailabilityCache(time.Minute)
+				h.do("GET", "/availability/u2419229", "", map[string]string{"Authorization": bearer(t, mst3kClaims())})
+				if h.svc.AvailabilityCache.get("u2419229") == nil {
+					t.Fatalf("expected u2419229 to be cached")
+				}
+			},
+			status: http.StatusOK, contains: []string{"deleted"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.AvailabilityCache.get("u2419229") != nil {
+					t.Errorf("expected the cancelled hold's title to be purged from the availability cache")
+				}
+			}},
+		{name: "hold already cancelled", method: "DELETE", path: "/requests/hold/1001",
+			headers: map[string]string{"Authorization": bearer(t, mst3kClaims())},
+			status:  http.StatusNotFound, contains: []string{"1001 not found"}},
+	})
+}
+
+func TestModifyHold(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	otherClaims := mst3kClaims()
+	otherClaims.UserID = "xyz9z"
+	future := time.Now().AddDate(0, 0, 7).Format("2006-01-02")
+	later := time.Now().AddDate(0, 0, 21).Format("2006-01-02")
+	suspend := fmt.Sprintf(`{"suspendBegin": %q, "suspendEnd": %q}`, future, later)
+
+	h.run(t, []routeTest{
+		{name: "missing jwt", method: "PATCH", path: "/requests/hold/1001", body: `{"pickupLibrary": "LAW"}`,
+			status: http.StatusUnauthorized,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("GET", "/policy/library/simpleQuery")) != 0 {
+					t.Errorf("expected no policy load for an unauthenticated request")
+				}
+			}},
+		{name: "not hold owner", method: "PATCH", path: "/requests/hold/1001", body: `{"pickupLibrary": "LAW"}`,
+			headers: map[string]string{"Authorization": bearer(t, otherClaims)},
+			status:  http.StatusBadRequest, contains: []string{"you do not hold this item"}},
+		{name: "hold not found", method: "PATCH", path: "/requests/hold/9999", body: `{"pickupLibrary": "LAW"}`, headers: auth,
+			status: http.StatusNotFound, contains: []string{"9999 not found"}},
+		{name: "one change at a time", method: "PATCH", path: "/requests/hold/1001", body: `{"pickupLibrary": "LAW", "resume": true}`,
+			headers: auth, status: http.StatusBadRequest},
+		{name: "unknown library", method: "PATCH", path: "/requests/hold/1001", body: `{"pickupLibrary": "MOON"}`, headers: auth,
+			status: http.StatusBadRequest, contains: []string{"MOON is not a valid library"}},
+		{name: "non-circulating library", method: "PATCH", path: "/requests/hold/1001", body: `{"pickupLibrary": "SPEC-COLL"}`,
+			headers: auth, status: http.StatusBadRequest, contains: []string{"SPEC-COLL is not a pickup library"}},
+		{name: "suspend dates out of order", method: "PATCH", path: "/requests/hold/1001", headers: auth,
+			body: fmt.Sprintf(`{"suspendBegin": %q, "suspendEnd": %q}`, later, future), status: http.StatusBadRequest},
+		{name: "suspend needs both dates", method: "PATCH", path: "/requests/hold/1001", headers: auth,
+			body: fmt.Sprintf(`{"suspendBegin": %q}`, future), status: http.StatusBadRequest},
+		{name: "change pickup library", method: "PATCH", path: "/requests/hold/1001", body: `{"pickupLibrary": "law"}`, headers: auth,
+			status: http.StatusOK, contains: []string{`"pickupLibrary":"LAW"`}, excludes: []string{"errors"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				changes := h.sirsi.received("POST", "/circulation/holdRecord/changePickupLibrary")
+				if len(changes) != 1 || strings.Contains(string(changes[0].body), `"key":"LAW"`) == false {
+					t.Errorf("expected the pickup library change to be sent to sirsi")
+				}
+			}},
+		{name: "suspend", method: "PATCH", path: "/requests/hold/1001", body: suspend, headers: auth,
+			status: http.StatusOK, contains: []string{`"pickupLibrary":"LAW"`, fmt.Sprintf(`"suspendBegin":%q`, future), fmt.Sprintf(`"suspendEnd":%q`, later)}},
+		{name: "resume", method: "PATCH", path: "/requests/hold/1001", body: `{"resume": true}`, headers: auth,
+			status: http.StatusOK, excludes: []string{"suspendBegin", "errors"}},
+		{name: "sirsi error", method: "PATCH", path: "/requests/hold/1001", body: `{"resume": true}`, headers: auth,
+			status: http.StatusOK, contains: []string{`"errors":{"sirsi":["The hold is not suspended."],"item_barcode":null}`}},
+		{name: "sirsi system error", method: "PATCH", path: "/requests/hold/1001", body: suspend, headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/holdRecord/suspendHold", fakeResponse{status: http.StatusInternalServerError, body: "internal failure"})
+			},
+			status: http.StatusInternalServerError, contains: []string{"internal failure"}},
+	})
+}
+
+// transitItem is a barcode scan response for an item in transit to fill hold 1001
+const transitItem = `{"key": "5841451:1:3", "fields": {
+	"bib": {"key": "5841451", "fields": {"author": "Curtiz, Michael", "title": "Casablanca"}},
+	"fillableHoldList": [{"key": "1001", "fields": {
+		"patron": {"key": "301234", "fields": {"displayName": "Science, Mystery", "alternateID": "mst3k", "barcode": "C000011111"}},
+		"status": "PLACED", "pickupLibrary": {"resource": "/policy/library", "key": "LEO"}}}],
+	"transit": {"key": "T1", "fields": {"destinationLibrary": {"key": "LEO"}, "holdRecord": {"resource": "/circulation/holdRecord", "key": "1001"}}}}}`
+
+func TestFillHold(t *testing.T) {
+	h := newTestHarness(t)
+	staff := leoStaff()
+
+	h.run(t, []routeTest{
+		{name: "missing client credentials", method: "POST", path: "/requests/fill_hold/X000222221",
+			headers: map[string]string{"SirsiSessionToken": "leo-staff-session"}, status: http.StatusUnauthorized},
+		{name: "missing session token", method: "POST", path: "/requests/fill_hold/X000222221", headers: clientAuth("leo"),
+			status: http.StatusUnauthorized, contains: []string{"not authorized"}},
+		{name: "hold filled", method: "POST", path: "/requests/fill_hold/X000222221", headers: staff,
+			status:   http.StatusOK,
+			contains: []string{`"item_id":"X000222221"`, `"title":"Casablanca"`, `"user_id":"mst3k"`, `"user_full_name":"Science, Mystery"`, `"pickup_library":"CLEMONS"`},
+			excludes: []string{"error_messages"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/circulation/circRecord/checkOut")
+				if len(reqs) != 1 {
+					t.Fatalf("expected one checkout request, got %d", len(reqs))
+				}
+				if reqs[0].header.Get("x-sirs-sessionToken") != "leo-staff-session" {
+					t.Errorf("checkout did not use the caller session")
+				}
+				if reqs[0].header.Get("x-sirs-clientID") != "ILL_CKOUT" || reqs[0].header.Get("sd-working-libraryid") != "CLEMONS" {
+					t.Errorf("unexpected checkout headers %v", reqs[0].header)
+				}
+				if len(h.sirsi.received("POST", "/circulation/transit/untransit")) != 0 {
+					t.Errorf("item not in transit should not be untransited")
+				}
+			}},
+		{name: "no holds", method: "POST", path: "/requests/fill_hold/X000111111", headers: staff,
+			status: http.StatusOK, contains: []string{"No hold for this item."}},
+		{name: "unknown item", method: "POST", path: "/requests/fill_hold/X999999999", headers: staff,
+			status: http.StatusNotFound, contains: []string{`"error_messages":[{"code":"recordNotFound"`}},
+		{name: "expired caller session is not renewed", method: "POST", path: "/requests/fill_hold/X000222221", headers: staff,
+			setup:  func(h *testHarness) { h.sirsi.expire("leo-staff-session") },
+			status: http.StatusUnauthorized, contains: []string{`"code":"sessionTimedOut"`},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/user/staff/login")) > 0 {
+					t.Errorf("caller session timeout triggered a service login")
+				}
+				h.sirsi.mutex.Lock()
+				delete(h.sirsi.expired, "leo-staff-session")
+				h.sirsi.mutex.Unlock()
+			}},
+		{name: "checkout override prompt is retried", method: "POST", path: "/requests/fill_hold/X000222221", headers: staff,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/circRecord/checkOut", fakeResponse{status: http.StatusBadRequest,
+					body: `{"messageList":[{"code":"CKOBLOCKS","message":"Item has holds"}],"dataMap":{"promptType":"CIRC_HOLDS_OVRCD"}}`})
+			},
+			status: http.StatusOK, excludes: []string{"error_messages"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/circulation/circRecord/checkOut")
+				if len(reqs) != 2 {
+					t.Fatalf("expected two checkout attempts, got %d", len(reqs))
+				}
+				prompts := reqs[1].header.Values("SD-Prompt-Return")
+				if len(prompts) != 2 || prompts[0] != "CKOBLOCKS" || prompts[1] != "CIRC_HOLDS_OVRCD" {
+					t.Errorf("unexpected override headers on retry: %v", prompts)
+				}
+			}},
+		{name: "checkout failure messages", method: "POST", path: "/requests/fill_hold/X000222221", headers: staff,
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/circulation/circRecord/checkOut",
+					sirsiMessageResponse(http.StatusBadRequest, "userBlocked", "The user is blocked."))
+			},
+			status: http.StatusOK, contains: []string{`"error_messages":[{"code":"userBlocked","message":"The user is blocked."}]`}},
+		{name: "in transit item is untransited", method: "POST", path: "/requests/fill_hold/X000222223", headers: staff,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/item/barcode/X000222223", fakeResponse{status: http.StatusOK, body: transitItem})
+			},
+			status:   http.StatusOK,
+			contains: []string{`"user_id":"mst3k"`, `"pickup_library":"LEO"`},
+			excludes: []string{"error_messages"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.sirsi.received("POST", "/circulation/transit/untransit")
+				if len(reqs) != 1 {
+					t.Fatalf("expected one untransit request, got %d", len(reqs))
+				}
+				prompts := reqs[0].header.Values("SD-Prompt-Return")
+				if len(prompts) != 2 || prompts[1] != "/OK" {
+					t.Errorf("unexpected untransit override headers: %v", prompts)
+				}
+				if len(h.sirsi.received("POST", "/circulation/circRecord/checkOut")) != 1 {
+					t.Errorf("expected checkout after untransit")
+				}
+			}},
+	})
+}
+
+func TestReauthenticate(t *testing.T) {
+	h := newTestHarness(t)
+	adminClaims := mst3kClaims()
+	adminClaims.Role = v4jwt.Admin
+
+	h.run(t, []routeTest{
+		{name: "non admin", method: "POST", path: "/reauthenticate",
+			headers: map[string]string{"Authorization": bearer(t, mst3kClaims())},
+			status:  http.StatusForbidden},
+		{name: "admin", method: "POST", path: "/reauthenticate",
+			headers: map[string]string{"Authorization": bearer(t, adminClaims)},
+			status:  http.StatusOK, contains: []string{"session refreshed"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("POST", "/user/staff/login")) != 1 {
+					t.Errorf("expected a new staff login")
+				}
+			}},
+		{name: "sirsi login failure", method: "POST", path: "/reauthenticate",
+			headers: map[string]string{"Authorization": bearer(t, adminClaims)},
+			setup: func(h *testHarness) {
+				h.sirsi.override("POST", "/user/staff/login", fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"})
+			},
+			status: http.StatusServiceUnavailable, contains: []string{"sirsi is down"}},
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-yaml"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+// circulationRules are the circulation policies that are not kept in sirsi. They are read from a YAML file
+// that circulation staff maintain; see data/circulation-rules.yaml.
+type circulationRules struct {
+	Libraries struct {
+		NonCirculating []string `yaml:"nonCirculating" json:"nonCirculating"`
+		OnShelf        []string `yaml:"onShelf" json:"onShelf"`
+	} `yaml:"libraries" json:"libraries"`
+	Locations struct {
+		NonCirculating []string `yaml:"nonCirculating" json:"nonCirculating"`
+		OnShelf        []string `yaml:"onShelf" json:"onShelf"`
+		Online         []string `yaml:"online" json:"online"`
+		Unavailable    []string `yaml:"unavailable" json:"unavailable"`
+	} `yaml:"locations" json:"locations"`
+	ItemTypes struct {
+		Video []string `yaml:"video" json:"video"`
+	} `yaml:"itemTypes" json:"itemTypes"`
+	Scans struct {
+		BlockedProfiles      []string `yaml:"blockedProfiles" json:"blockedProfiles"`
+		BlockedHomeLibraries []string `yaml:"blockedHomeLibraries" json:"blockedHomeLibraries"`
+		BlockedLocations     []string `yaml:"blockedLocations" json:"blockedLocations"`
+	} `yaml:"scans" json:"scans"`
+	CourseReserves struct {
+		VideoBlockedLibraries []string            `yaml:"videoBlockedLibraries" json:"videoBlockedLibraries"`
+		VideoBlockedItemTypes map[string][]string `yaml:"videoBlockedItemTypes" json:"videoBlockedItemTypes"`
+	} `yaml:"courseReserves" json:"courseReserves"`
+
+	sets map[string]map[string]bool
+}
+
+type ruleKeyType int
+
+const (
+	otherRuleKey ruleKeyType = iota
+	libraryRuleKey
+	locationRuleKey
+)
+
+// ruleList is one list of keys in the rules, named by its path in the file
+type ruleList struct {
+	Name    string
+	KeyType ruleKeyType
+	Keys    []string
+}
+
+// rulesContext holds the current circulation rules. Reloads swap in a new set whole.
+type rulesContext struct {
+	path    string
+	current atomic.Pointer[circulationRules]
+}
+
+func newRulesContext(path string) (*rulesContext, error) {
+	rc := rulesContext{path: path}
+	rules, err := loadCirculationRules(path)
+	if err != nil {
+		return nil, err
+	}
+	rc.current.Store(rules)
+	return &rc, nil
+}
+
+// loadCirculationRules reads and validates a rules file. Unknown fields and invalid keys are rejected.
+func loadCirculationRules(path string) (*circulationRules, error) {
+	log.Printf("INFO: load circulation rules from %s", path)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read circulation rules: %s", err.Error())
+	}
+	var rules circulationRules
+	err = yaml.UnmarshalWithOptions(raw, &rules, yaml.DisallowUnknownField())
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse circulation rules %s: %s", path, err.Error())
+	}
+	if problems := rules.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid circulation rules %s:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	return &rules, nil
+}
+
+func (cr *circulationRules) lists() []ruleList {
+	out := []ruleList{
+		{"libraries.nonCirculating", libraryRuleKey, cr.Libraries.NonCirculating},
+		{"libraries.onShelf", libraryRuleKey, cr.Libraries.OnShelf},
+		{"locations.nonCirculating", locationRuleKey, cr.Locations.NonCirculating},
+		{"locations.onShelf", locationRuleKey, cr.Locations.OnShelf},
+		{"locations.online", locationRuleKey, cr.Locations.Online},
+		{"locations.unavailable", locationRuleKey, cr.Locations.Unavailable},
+		{"itemTypes.video", otherRuleKey, cr.ItemTypes.Video},
+		{"scans.blockedProfiles", otherRuleKey, cr.Scans.BlockedProfiles},
+		{"scans.blockedHomeLibraries", libraryRuleKey, cr.Scans.BlockedHomeLibraries},
+		{"scans.blockedLocations", locationRuleKey, cr.Scans.BlockedLocations},
+		{"courseReserves.videoBlockedLibraries", libraryRuleKey, cr.CourseReserves.VideoBlockedLibraries},
+	}
+	libs := make([]string, 0, len(cr.CourseReserves.VideoBlockedItemTypes))
+	for lib := range cr.CourseReserves.VideoBlockedItemTypes {
+		libs = append(libs, lib)
+	}
+	sort.Strings(libs)
+	out = append(out, ruleList{"courseReserves.videoBlockedItemTypes", libraryRuleKey, libs})
+	for _, lib := range libs {
+		out = append(out, ruleList{"courseReserves.videoBlockedItemTypes." + lib, otherRuleKey, cr.CourseReserves.VideoBlockedItemTypes[lib]})
+	}
+	return out
+}
+
+// validate checks the keys of every list and indexes them for lookups. All problems are returned together.
+func (cr *circulationRules) validate() []string {
+	problems := make([]string, 0)
+	cr.sets = make(map[string]map[string]bool)
+	for _, rl := range cr.lists() {
+		set := make(map[string]bool)
+		for _, key := range rl.Keys {
+			clean := strings.ToUpper(strings.TrimSpace(key))
+			if clean == "" || strings.ContainsAny(clean, " \t") {
+				problems = append(problems, fmt.Sprintf("%s: [%s] is not a valid key", rl.Name, key))
+				continue
+			}
+			if set[clean] {
+				problems = append(problems, fmt.Sprintf("%s: %s is listed more than once", rl.Name, clean))
+			}
+			set[clean] = true
+		}
+		cr.sets[rl.Name] = set
+	}
+	for lib, types := range cr.CourseReserves.VideoBlockedItemTypes {
+		for _, itemType := range types {
+			if cr.has("itemTypes.video", itemType) == false {
+				problems = append(problems, fmt.Sprintf("courseReserves.videoBlockedItemTypes.%s: %s is not a video item type", lib, itemType))
+			}
+		}
+	}
+	return problems
+}
+
+func (cr *circulationRules) has(list, key string) bool {
+	return cr.sets[list][strings.ToUpper(strings.TrimSpace(key))]
+}
+
+// unknownKeys returns the library and location keys that are not in the current sirsi lists. Lists that
+// have not been loaded are not checked.
+func (svc *serviceContext) unknownRuleKeys(rules *circulationRules) []string {
+	out := make([]string, 0)
+	libs := svc.Libraries.snapshot()
+	locs := svc.Locations.snapshot()
+	for _, rl := range rules.lists() {
+		for _, key := range rl.Keys {
+			clean := strings.ToUpper(strings.TrimSpace(key))
+			if rl.KeyType == libraryRuleKey && len(libs.Records) > 0 && svc.Libraries.find(clean) == nil {
+				out = append(out, fmt.Sprintf("%s: %s is not a sirsi library", rl.Name, clean))
+			}
+			if rl.KeyType == locationRuleKey && len(locs.Records) > 0 && svc.Locations.find(clean) == nil {
+				out = append(out, fmt.Sprintf("%s: %s is not a sirsi location", rl.Name, clean))
+			}
+		}
+	}
+	return out
+}
+
+func (rc *rulesContext) rules() *circulationRules {
+	return rc.current.Load()
+}
+
+func (rc *rulesContext) isVideo(itemType string) bool {
+	return rc.rules().has("itemTypes.video", itemType)
+}
+
+func (rc *rulesContext) isUnavailable(location string) bool {
+	return rc.rules().has("locations.unavailable", location)
+}
+
+// scansBlocked is true if a patron with the profile and home library cannot request scans
+func (rc *rulesContext) scansBlocked(profile, homeLibrary string) bool {
+	rules := rc.rules()
+	return rules.has("scans.blockedProfiles", profile) || rules.has("scans.blockedHomeLibraries", homeLibrary)
+}
+
+func (rc *rulesContext) scanBlockedLocation(location string) bool {
+	return rc.rules().has("scans.blockedLocations", location)
+}
+
+// reserveBlocked returns the reason a video of the item type from the library cannot be put on reserve, or
+// an empty string if it can
+func (rc *rulesContext) reserveBlocked(library, itemType string) string {
+	rules := rc.rules()
+	if rules.has("courseReserves.videoBlockedLibraries", library) {
+		return fmt.Sprintf("invalid library %s", library)
+	}
+	if rules.has("courseReserves.videoBlockedItemTypes."+strings.ToUpper(strings.TrimSpace(library)), itemType) {
+		return fmt.Sprintf("%s from %s", itemType, library)
+	}
+	return ""
+}
+
+// applyRules sets the circulation flags of the locations from the rules
+func (snap *locationSnapshot) applyRules(rules *circulationRules) {
+	for idx := range snap.Records {
+		loc := &snap.Records[idx]
+		loc.OnShelf = rules.has("locations.onShelf", loc.Key)
+		loc.Circulating = !rules.has("locations.nonCirculating", loc.Key)
+		loc.Online = rules.has("locations.online", loc.Key)
+	}
+}
+
+// applyRules sets the circulation flags of the libraries from the rules
+func (snap *librarySnapshot) applyRules(rules *circulationRules) {
+	for idx := range snap.Records {
+		lib := &snap.Records[idx]
+		lib.OnShelf = rules.has("libraries.onShelf", lib.Key)
+		lib.Circulating = !rules.has("libraries.nonCirculating", lib.Key)
+	}
+}
+
+// GET /circulation/rules : the current circulation rules and any keys that are not in sirsi
+func (svc *serviceContext) getCirculationRules(c *gin.Context) {
+	rules := svc.Rules.rules()
+	c.JSON(http.StatusOK, gin.H{"rules": rules, "warnings": svc.unknownRuleKeys(rules)})
+}
+
+// POST /circulation/rules/reload : admin request to reload the circulation rules file. An invalid file is
+// rejected and the current rules are kept. Keys that are not in sirsi are returned as warnings.
+func (svc *serviceContext) reloadCirculationRules(c *gin.Context) {
+	claims, err := getVirgoClaims(c)
+	if err != nil {
+		logf(c.Request.Context(), "ERROR: attempt to reload circulation rules with bad claims: %s", err.Error())
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+	if claims.Role != v4jwt.Admin {
+		logf(c.Request.Context(), "ERROR: non-admin user %s attempted to reload circulation rules", claims.UserID)
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+
+	rules, err := loadCirculationRules(svc.Rules.path)
+	if err != nil {
+		logf(c.Request.Context(), "ERROR: %s requested a reload of invalid circulation rules: %s", claims.UserID, err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// hold off policy refreshes so that the new snapshots are not replaced by ones built with the old rules
+	svc.Policies.refreshing.Lock()
+	defer svc.Policies.refreshing.Unlock()
+	svc.Rules.current.Store(rules)
+	if curr := svc.Locations.current.Load(); curr != nil {
+		locs := *curr
+		locs.Records = slices.Clone(curr.Records)
+		locs.applyRules(rules)
+		svc.Locations.current.Store(&locs)
+	}
+	if curr := svc.Libraries.current.Load(); curr != nil {
+		libs := *curr
+		libs.Records = slices.Clone(curr.Records)
+		libs.applyRules(rules)
+		svc.Libraries.current.Store(&libs)
+	}
+
+	warnings := svc.unknownRuleKeys(rules)
+	for _, warning := range warnings {
+		logf(c.Request.Context(), "WARNING: circulation rules %s", warning)
+	}
+	logf(c.Request.Context(), "INFO: %s reloaded circulation rules from %s", claims.UserID, svc.Rules.path)
+	c.JSON(http.StatusOK, gin.H{"rules": rules, "warnings": warnings})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestCirculationRules(t *testing.T) {
+	rules, err := loadCirculationRules("./data/circulation-rules.yaml")
+	if err != nil {
+		t.Fatalf("unable to load the circulation rules: %s", err.Error())
+	}
+	rc := rulesContext{}
+	rc.current.Store(rules)
+	if rc.isVideo("video-dvd") == false || rc.isVideo("BOOK") || rc.isUnavailable("LOST") == false {
+		t.Errorf("unexpected item type and location rules")
+	}
+	if rc.scansBlocked("ALUMNI", "") == false || rc.scansBlocked("UNDERGRAD", "HEALTHSCI") == false || rc.scansBlocked("UNDERGRAD", "LAW") {
+		t.Errorf("unexpected scan rules")
+	}
+	if rc.reserveBlocked("LAW", "VIDEO-DVD") == "" || rc.reserveBlocked("LAW", "VIDEO-CASS") != "" || rc.reserveBlocked("SPEC-COLL", "VIDEO-CASS") == "" {
+		t.Errorf("unexpected course reserve rules")
+	}
+
+	fn := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(fn, []byte("locations:\n  online: [INTERNET, ' ', internet]\nitemTypes:\n  video: [VIDEO-DVD]\n"+
+		"courseReserves:\n  videoBlockedItemTypes:\n    LAW: [BOOK]\n"), 0644)
+	_, err = loadCirculationRules(fn)
+	if err == nil {
+		t.Fatalf("expected invalid rules")
+	}
+	for _, want := range []string{"locations.online: [ ] is not a valid key", "locations.online: INTERNET is listed more than once",
+		"courseReserves.videoBlockedItemTypes.LAW: BOOK is not a video item type"} {
+		if strings.Contains(err.Error(), want) == false {
+			t.Errorf("expected [%s] in %s", want, err.Error())
+		}
+	}
+	os.WriteFile(fn, []byte("locations:\n  offline: [INTERNET]\n"), 0644)
+	if _, err = loadCirculationRules(fn); err == nil || strings.Contains(err.Error(), "offline") == false {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+}
+
+func TestReloadCirculationRules(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.refreshPolicies(context.Background())
+	fn := filepath.Join(t.TempDir(), "rules.yaml")
+	h.svc.Rules.path = fn
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	adminClaims := mst3kClaims()
+	adminClaims.Role = v4jwt.Admin
+	admin := map[string]string{"Authorization": bearer(t, adminClaims)}
+	write := func(content string) func(h *testHarness) {
+		return func(h *testHarness) { os.WriteFile(fn, []byte(content), 0644) }
+	}
+	if h.svc.Locations.find("STACKS").Circulating == false || h.svc.Libraries.find("SPEC-COLL").Circulating ||
+		h.svc.Locations.find("INTERNET").Online == false {
+		t.Fatalf("expected the circulation flags from the default rules")
+	}
+
+	h.run(t, []routeTest{
+		{name: "requires an admin", method: "POST", path: "/circulation/rules/reload", headers: auth,
+			setup: write("locations:\n  nonCirculating: [STACKS]\n"), status: http.StatusForbidden,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.Locations.find("STACKS").Circulating == false {
+					t.Errorf("expected the rules to be unchanged")
+				}
+			}},
+		{name: "reload applies rules and reports unknown keys", method: "POST", path: "/circulation/rules/reload", headers: admin,
+			setup:  write("libraries:\n  onShelf: [LAW, SHANNON]\nlocations:\n  nonCirculating: [STACKS]\n  unavailable: [LOST]\n"),
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				var out struct {
+					Warnings []string `json:"warnings"`
+				}
+				json.Unmarshal(resp.Body.Bytes(), &out)
+				if len(out.Warnings) != 1 || out.Warnings[0] != "libraries.onShelf: SHANNON is not a sirsi library" {
+					t.Errorf("unexpected warnings %v", out.Warnings)
+				}
+				if h.svc.Locations.find("STACKS").Circulating || h.svc.Libraries.find("SPEC-COLL").Circulating == false ||
+					h.svc.Libraries.find("LAW").OnShelf == false || h.svc.Rules.isVideo("VIDEO-DVD") {
+					t.Errorf("expected the new rules to be applied")
+				}
+			}},
+		{name: "invalid rules are rejected", method: "POST", path: "/circulation/rules/reload", headers: admin,
+			setup: write("locations:\n  nonCirculating: [STACKS, STACKS]\n"), status: http.StatusBadRequest,
+			contains: []string{"STACKS is listed more than once"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if h.svc.Locations.find("STACKS").Circulating || h.svc.Rules.isUnavailable("LOST") == false {
+					t.Errorf("expected the last rules to be kept")
+				}
+			}},
+		{name: "current rules", method: "GET", path: "/circulation/rules", status: http.StatusOK,
+			contains: []string{`"nonCirculating":["STACKS"]`, "SHANNON is not a sirsi library"}},
+	})
+}
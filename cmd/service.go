@@ -2,14 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -65,16 +66,6 @@ type sirsiError struct {
 	} `json:"dataMap"`
 }
 
-type sirsiSessionData struct {
-	StaffKey     string
-	SessionToken string
-	RefreshAt    time.Time
-}
-
-func (sess *sirsiSessionData) isExpired() bool {
-	return time.Now().After(sess.RefreshAt)
-}
-
 type serviceContext struct {
 	Version            string
 	SirsiConfig        sirsiConfig
@@ -83,9 +74,22 @@ type serviceContext struct {
 	HSILLiadURL        string
 	CourseReserveEmail string
 	LawReserveEmail    string
-	SirsiSession       sirsiSessionData
-	Locations          locationContext
-	Libraries          libraryContext
+	SirsiSession       *sirsiSessionManager
+	ILS                ilsBackend
+	AvailabilityCache  *availabilityCache
+	Audit              auditHook
+	Clients            *clientRegistry
+	Throttle           *authThrottle
+	TrustedProxies     []string
+	Notices            *noticeStore
+	Metrics            *serviceMetrics
+	Breakers           map[string]*circuitBreaker
+	Retry              retryPolicy
+	Locations          *locationContext
+	Libraries          *libraryContext
+	Policies           *policyRefresher
+	Rules              *rulesContext
+	Features           *featureFlags
 	Secrets            secretsConfig
 	VirgoURL           string
 	UserInfoURL        string
@@ -123,6 +127,48 @@ func intializeService(version string, cfg *serviceConfig) (*serviceContext, erro
 		VirgoURL:           cfg.VirgoURL,
 		UserInfoURL:        cfg.UserInfoURL,
 	}
+	ctx.Metrics = newServiceMetrics()
+	ctx.Audit = logAuditEvent
+	clients, err := newClientRegistry(cfg.Clients)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Clients = clients
+	ctx.Throttle = newAuthThrottle(cfg.Throttle)
+	ctx.TrustedProxies = cfg.TrustedProxies
+	notices, err := newNoticeStore(cfg.Notices.File)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Notices = notices
+	ctx.Breakers = ctx.newCircuitBreakers(cfg.Upstream.BreakerThreshold, time.Duration(cfg.Upstream.BreakerCooldown)*time.Second)
+	ctx.Retry = retryPolicy{
+		MaxRetries: cfg.Upstream.Retries,
+		BaseDelay:  time.Duration(cfg.Upstream.RetryDelay) * time.Millisecond,
+		MaxDelay:   2 * time.Second,
+	}
+	ctx.SirsiSession = newSirsiSessionManager(ctx.sirsiLogin)
+	ctx.AvailabilityCache = newAvailabilityCache(time.Duration(cfg.AvailabilityTTL) * time.Second)
+	rules, err := newRulesContext(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Rules = rules
+	ctx.Features = newFeatureFlags(cfg.Features)
+	ctx.Locations = &locationContext{}
+	ctx.Libraries = &libraryContext{}
+	ctx.Policies = newPolicyRefresher(time.Duration(cfg.PolicyRefresh) * time.Hour)
+
+	if cfg.ILS.Backend == "fixture" {
+		log.Printf("INFO: use fixture ils backend with data from %s", cfg.ILS.FixtureDir)
+		fixtures, err := newFixtureILS(cfg.ILS.FixtureDir)
+		if err != nil {
+			return nil, err
+		}
+		ctx.ILS = fixtures
+	} else {
+		ctx.ILS = &sirsiILS{svc: &ctx}
+	}
 
 	log.Printf("INFO: create http client for external service calls")
 	defaultTransport := &http.Transport{
@@ -146,73 +192,64 @@ func intializeService(version string, cfg *serviceConfig) (*serviceContext, erro
 	return &ctx, nil
 }
 
-func (svc *serviceContext) terminateSession() {
-	if svc.SirsiSession.SessionToken != "" && svc.SirsiSession.isExpired() == false {
-		log.Printf("INFO: terminate active sirsi session")
-		empty := struct{}{}
-		_, err := svc.sirsiPost(svc.HTTPClient, "/user/staff/logout", empty)
-		svc.SirsiSession.SessionToken = ""
-		svc.SirsiSession.StaffKey = ""
+func (svc *serviceContext) terminateSession(ctx context.Context) {
+	activeToken := svc.SirsiSession.clear()
+	if activeToken != "" {
+		logf(ctx, "INFO: terminate active sirsi session")
+		err := svc.ILS.staffLogout(ctx, activeToken)
 		if err != nil {
-			log.Printf("ERROR: unable to end session: %s", err.string())
+			logf(ctx, "ERROR: unable to end session: %s", err.string())
 		} else {
-			log.Printf("INFO: sirsi session ended")
+			logf(ctx, "INFO: sirsi session ended")
 		}
 	} else {
-		log.Printf("INFO: no active sirsi session; ok to terminate")
+		logf(ctx, "INFO: no active sirsi session; ok to terminate")
 	}
 }
 
 // curl -X POST http://localhost:8185/reauthenticate -H "Authorization: Bearer Ym9zY236Ym9zY28="
 func (svc *serviceContext) sirsiReauthenticate(c *gin.Context) {
+	ctx := c.Request.Context()
 	claims, err := getVirgoClaims(c)
 	if err != nil {
-		log.Printf("ERROR: attempt to access reauthenticate with bad claims: %s", err.Error())
+		logf(ctx, "ERROR: attempt to access reauthenticate with bad claims: %s", err.Error())
 		c.String(http.StatusForbidden, "access forbidden")
 		return
 	}
 	if claims.Role != v4jwt.Admin {
-		log.Printf("ERROR: non-admin user %s attmpted to force a sirsi reauthenticate", claims.UserID)
+		logf(ctx, "ERROR: non-admin user %s attmpted to force a sirsi reauthenticate", claims.UserID)
 		c.String(http.StatusForbidden, "access forbidden")
 		return
 	}
 
-	svc.terminateSession()
-	if err := svc.sirsiLogin(); err != nil {
-		log.Printf("ERROR: reauthenticate failed: %s", err.string())
+	svc.terminateSession(ctx)
+	if err := svc.SirsiSession.refresh(); err != nil {
+		logf(ctx, "ERROR: reauthenticate failed: %s", err.string())
 		c.String(err.StatusCode, err.Message)
 		return
 	}
 	c.String(http.StatusOK, "session refreshed")
 }
 
-func (svc *serviceContext) sirsiLogin() *requestError {
+// sirsiLogin starts a new staff session. It is only called by the session manager, which
+// ensures that concurrent requests for a new session result in a single login
+func (svc *serviceContext) sirsiLogin() (*sirsiSigniResponse, *requestError) {
 	log.Printf("INFO: attempting sirsi login for %s", svc.SirsiConfig.User)
-	svc.SirsiSession.SessionToken = ""
-	svc.SirsiSession.StaffKey = ""
-	// return &requestError{StatusCode: 503, Message: "FAKE ERROR"}
-	payloadOBJ := sirsiStaffLoginReq{
-		Login:    svc.SirsiConfig.User,
-		Password: svc.SirsiConfig.Password,
-	}
-
-	resp, err := svc.sirsiPost(svc.HTTPClient, "/user/staff/login", payloadOBJ)
+	resp, err := svc.ILS.staffLogin(context.Background(), svc.SirsiConfig.User, svc.SirsiConfig.Password)
 	if err != nil {
-		return err
+		svc.Metrics.sirsiLogins.WithLabelValues(outcomeLabel(false)).Inc()
+		return nil, err
 	}
 
 	var respObj sirsiSigniResponse
 	parseErr := json.Unmarshal(resp, &respObj)
 	if parseErr != nil {
-		return &requestError{StatusCode: http.StatusInternalServerError, Message: "unable to parse sirsi login response"}
+		svc.Metrics.sirsiLogins.WithLabelValues(outcomeLabel(false)).Inc()
+		return nil, &requestError{StatusCode: http.StatusInternalServerError, Message: "unable to parse sirsi login response"}
 	}
 
-	svc.SirsiSession.SessionToken = respObj.SessionToken
-	svc.SirsiSession.StaffKey = respObj.StaffKey
-	svc.SirsiSession.RefreshAt = time.Now().Add(1 * time.Hour)
-	log.Printf("INFO: sirsi login success; refresh at %s", svc.SirsiSession.RefreshAt.String())
-
-	return nil
+	svc.Metrics.sirsiLogins.WithLabelValues(outcomeLabel(true)).Inc()
+	return &respObj, nil
 }
 
 // ignoreFavicon is a dummy to handle browser favicon requests without warnings
@@ -232,11 +269,12 @@ func (svc *serviceContext) getVersion(c *gin.Context) {
 	vMap := make(map[string]string)
 	vMap["version"] = svc.Version
 	vMap["build"] = build
-	log.Printf("INFO: version %+v", vMap)
+	logf(c.Request.Context(), "INFO: version %+v", vMap)
 	c.JSON(http.StatusOK, vMap)
 }
 
 func (svc *serviceContext) healthCheck(c *gin.Context) {
+	ctx := c.Request.Context()
 	type hcResp struct {
 		Healthy bool   `json:"healthy"`
 		Message string `json:"message,omitempty"`
@@ -244,9 +282,8 @@ func (svc *serviceContext) healthCheck(c *gin.Context) {
 	}
 	hcMap := make(map[string]hcResp)
 
-	if svc.SirsiSession.SessionToken != "" && svc.SirsiSession.isExpired() == false {
-		url := fmt.Sprintf("/user/staff/key/%s", svc.SirsiSession.StaffKey)
-		_, err := svc.sirsiGet(svc.HTTPClient, url)
+	if svc.SirsiSession.isActive() {
+		_, err := svc.ILS.getStaffUser(ctx, svc.SirsiSession.getStaffKey())
 		if err != nil {
 			hcMap["sirsi"] = hcResp{Healthy: false, Message: err.string()}
 		} else {
@@ -254,8 +291,8 @@ func (svc *serviceContext) healthCheck(c *gin.Context) {
 		}
 	}
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/healthcheck", svc.UserInfoURL), nil)
-	_, userErr := svc.sendRequest("user-ws", svc.HTTPClient, req)
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/healthcheck", svc.UserInfoURL), nil)
+	_, userErr := svc.sendRequest(ctx, "user-ws", svc.HTTPClient, req)
 	if userErr != nil {
 		hcMap["userinfo"] = hcResp{Healthy: false, Message: userErr.string()}
 	} else {
@@ -265,26 +302,26 @@ func (svc *serviceContext) healthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, hcMap)
 }
 
-func (svc *serviceContext) sirsiGet(client *http.Client, uri string) ([]byte, *requestError) {
+func (svc *serviceContext) sirsiGet(ctx context.Context, client *http.Client, uri string) ([]byte, *requestError) {
 	url := fmt.Sprintf("%s%s", svc.SirsiConfig.WebServicesURL, uri)
-	req, _ := http.NewRequest("GET", url, nil)
-	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.SessionToken)
-	return svc.sendRequest("sirsi", client, req)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.token())
+	return svc.sendRequest(ctx, "sirsi", client, req)
 }
 
-func (svc *serviceContext) sirsiDelete(client *http.Client, uri string) ([]byte, *requestError) {
+func (svc *serviceContext) sirsiDelete(ctx context.Context, client *http.Client, uri string) ([]byte, *requestError) {
 	url := fmt.Sprintf("%s%s", svc.SirsiConfig.WebServicesURL, uri)
-	req, _ := http.NewRequest("DELETE", url, nil)
-	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.SessionToken)
-	return svc.sendRequest("sirsi", client, req)
+	req, _ := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.token())
+	return svc.sendRequest(ctx, "sirsi", client, req)
 }
 
-func (svc *serviceContext) sirsiPost(client *http.Client, uri string, data interface{}) ([]byte, *requestError) {
+func (svc *serviceContext) sirsiPost(ctx context.Context, client *http.Client, uri string, data interface{}) ([]byte, *requestError) {
 	url := fmt.Sprintf("%s%s", svc.SirsiConfig.WebServicesURL, uri)
 	b, _ := json.Marshal(data)
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(b))
-	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.SessionToken)
-	return svc.sendRequest("sirsi", client, req)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(b))
+	svc.setSirsiHeaders(req, "STAFF", svc.SirsiSession.token())
+	return svc.sendRequest(ctx, "sirsi", client, req)
 }
 
 func (svc *serviceContext) setSirsiHeaders(req *http.Request, role string, authToken string) {
@@ -303,51 +340,120 @@ func (svc *serviceContext) setSirsiHeaders(req *http.Request, role string, authT
 	// log.Printf("HEADERS: %s", jsonH)
 }
 
-func (svc *serviceContext) sendRequest(serviceName string, httpClient *http.Client, request *http.Request) ([]byte, *requestError) {
-	log.Printf("INFO: %s %s request: %s", serviceName, request.Method, request.URL.String())
+// sendRequest sends a request to an upstream service, guarded by the circuit breaker for the service.
+// Idempotent requests that fail because the service is unhealthy are retried according to the retry policy.
+// Nothing is sent once ctx is done, and calls cut short because ctx is done do not count against the breaker;
+// a cancelled probe reopens it.
+func (svc *serviceContext) sendRequest(ctx context.Context, serviceName string, httpClient *http.Client, request *http.Request) ([]byte, *requestError) {
+	breaker := svc.Breakers[serviceName]
+	maxRetries := 0
+	if retryable(request.Method) {
+		maxRetries = svc.Retry.MaxRetries
+	}
+	for retry := 0; ; retry++ {
+		if ctx.Err() != nil {
+			slog.InfoContext(ctx, "upstream request not sent", "service", serviceName, "method", request.Method, "url", request.URL.String(), "error", ctx.Err().Error())
+			return nil, contextError(ctx)
+		}
+		if allowed, wait := breaker.allow(); allowed == false {
+			slog.WarnContext(ctx, "upstream request rejected by open circuit breaker", "service", serviceName, "method", request.Method, "url", request.URL.String())
+			svc.Metrics.breakerRejections.WithLabelValues(serviceName).Inc()
+			noteBreakerRejection(ctx, wait)
+			return nil, unavailableError(serviceName, wait)
+		}
+		resp, err := svc.sendRequestAttempt(ctx, serviceName, httpClient, request, true)
+		if err != nil && ctx.Err() != nil {
+			breaker.cancelled()
+			return resp, err
+		}
+		failed := err != nil && upstreamFailure(err.StatusCode)
+		breaker.record(failed == false)
+		if failed == false || retry >= maxRetries {
+			return resp, err
+		}
+
+		delay := svc.Retry.backoff(retry + 1)
+		slog.InfoContext(ctx, "retry upstream request", "service", serviceName, "method", request.Method, "url", request.URL.String(),
+			"status", err.StatusCode, "retry", retry+1, "delay_ms", delay.Milliseconds())
+		select {
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		case <-time.After(delay):
+		}
+		retryReq, cloneErr := cloneRequest(request)
+		if cloneErr != nil {
+			slog.ErrorContext(ctx, "unable to prepare retry", "url", request.URL.String(), "error", cloneErr.Error())
+			return resp, err
+		}
+		request = retryReq
+	}
+}
+
+func (svc *serviceContext) sendRequestAttempt(ctx context.Context, serviceName string, httpClient *http.Client, request *http.Request, allowRetry bool) ([]byte, *requestError) {
+	slog.InfoContext(ctx, "upstream request", "service", serviceName, "method", request.Method, "url", request.URL.String())
 	startTime := time.Now()
 	request.Header.Set("User-Agent", "Golang_ILS_Connector") // NOTE: required or sirsi responds with 403
+	if id := requestID(ctx); id != "" {
+		request.Header.Set(requestIDHeader, id)
+	}
 	rawResp, rawErr := httpClient.Do(request)
 
 	var reqErr *requestError
 	var respBytes []byte
 
 	if rawErr != nil {
-		status := http.StatusBadRequest
-		errMsg := rawErr.Error()
-		if strings.Contains(rawErr.Error(), "Timeout") {
-			status = http.StatusRequestTimeout
-			errMsg = fmt.Sprintf("%s timed out", request.URL.String())
-		} else if strings.Contains(rawErr.Error(), "connection refused") {
-			status = http.StatusServiceUnavailable
-			errMsg = fmt.Sprintf("%s refused connection", request.URL.String())
+		// url query params may include credentials; they must not be returned in error messages
+		status, reason := classifyNetworkError(rawErr)
+		errMsg := fmt.Sprintf("%s %s", logRedactor.redact(request.URL.String()), reason)
+		if ctx.Err() != nil {
+			// the caller went away or the request ran out of time; the upstream service is not at fault
+			ctxErr := contextError(ctx)
+			status = ctxErr.StatusCode
+			errMsg = fmt.Sprintf("%s: %s", ctxErr.Message, errMsg)
 		}
+		svc.Metrics.observeUpstream(serviceName, request.Method, request.URL, status, time.Since(startTime))
+		slog.ErrorContext(ctx, "upstream request failed", "service", serviceName, "method", request.Method, "url", request.URL.String(),
+			"status", status, "error", rawErr.Error(), "elapsed_ms", time.Since(startTime).Milliseconds())
 		return nil, &requestError{StatusCode: status, Message: errMsg}
 	}
 
 	respBytes, _ = io.ReadAll(rawResp.Body)
 	rawResp.Body.Close()
+	svc.Metrics.observeUpstream(serviceName, request.Method, request.URL, rawResp.StatusCode, time.Since(startTime))
 	if rawResp.StatusCode != http.StatusOK && rawResp.StatusCode != http.StatusCreated {
 		if serviceName == "sirsi" && rawResp.StatusCode == http.StatusUnauthorized {
 			// if the sirsi API drops for any reason, the current session will be invalidated and
 			// all requests will return: 401: {"messageList":[{"code":"sessionTimedOut","message":"The session has timed out."}]}
-			// Detect this, reestablish the session and let this request fail. The client can retry.
+			// Detect this, reestablish the session and retry this request once with the new session. Only requests made
+			// with the service staff session are retried; sessions supplied by the caller (fill hold, password reset) are not.
 			// NOTE: dont care if the parse fails. If it does, sessionTimeout wont be detected and the call will fail as it would have normally
-			log.Printf("INFO: extract message list from failed sirsi response %s", respBytes)
 			var parsedErr sirsiError
 			json.Unmarshal(respBytes, &parsedErr)
-			if len(parsedErr.MessageList) == 1 && parsedErr.MessageList[0].Code == "sessionTimedOut" {
-				log.Printf("INFO: session timeout detected; re-establish session")
-				svc.terminateSession()
-				if err := svc.sirsiLogin(); err != nil {
+			staleToken := request.Header.Get("x-sirs-sessionToken")
+			if len(parsedErr.MessageList) == 1 && parsedErr.MessageList[0].Code == "sessionTimedOut" && svc.SirsiSession.owns(staleToken) {
+				slog.InfoContext(ctx, "sirsi session timeout detected; re-establish session", "url", request.URL.String())
+				svc.Metrics.sessionTimeouts.Inc()
+				newToken, err := svc.SirsiSession.renew(staleToken)
+				if err != nil {
 					// can't authenticate. abort with an internal server error
-					log.Printf("ERROR: unable to reestablish sirsi session: %s", err.string())
+					slog.ErrorContext(ctx, "unable to reestablish sirsi session", "error", err.string())
 					return nil, err
 				}
+				if allowRetry {
+					retryReq, err := cloneRequest(request)
+					if err != nil {
+						slog.ErrorContext(ctx, "unable to prepare retry", "url", request.URL.String(), "error", err.Error())
+					} else {
+						slog.InfoContext(ctx, "retry upstream request with new session", "service", serviceName, "url", request.URL.String())
+						retryReq.Header.Set("x-sirs-sessionToken", newToken)
+						return svc.sendRequestAttempt(ctx, serviceName, httpClient, retryReq, false)
+					}
+				}
 			}
 		}
 
-		log.Printf("INFO: return fail info %s %s - %d:%s", serviceName, request.URL.String(), rawResp.StatusCode, respBytes)
+		slog.InfoContext(ctx, "upstream request returned an error", "service", serviceName, "method", request.Method, "url", request.URL.String(),
+			"status", rawResp.StatusCode, "response", string(respBytes), "elapsed_ms", time.Since(startTime).Milliseconds())
 		status := rawResp.StatusCode
 		errMsg := string(respBytes)
 		respBytes = nil
@@ -356,12 +462,25 @@ func (svc *serviceContext) sendRequest(serviceName string, httpClient *http.Clie
 
 	elapsedNanoSec := time.Since(startTime)
 	elapsedMS := int64(elapsedNanoSec / time.Millisecond)
-	log.Printf("INFO: %s %s request processed in %d (ms)", serviceName, request.Method, elapsedMS)
-	// log.Printf("INFO: %s %s response: %s", serviceName, request.Method, respBytes)
+	slog.InfoContext(ctx, "upstream request complete", "service", serviceName, "method", request.Method, "url", request.URL.String(),
+		"status", rawResp.StatusCode, "elapsed_ms", elapsedMS)
 
 	return respBytes, reqErr
 }
 
+// cloneRequest makes a copy of a request that has already been sent, including a fresh copy of its body
+func cloneRequest(request *http.Request) (*http.Request, error) {
+	out := request.Clone(request.Context())
+	if request.Body != nil && request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	return out, nil
+}
+
 func (svc *serviceContext) handleSirsiErrorResponse(errResp *requestError) (*sirsiError, *requestError) {
 	// check the error response for messageList data. If it is present, this is not considered a
 	// system error and should be logged as an informative message. If it is not present, return an
@@ -418,12 +537,12 @@ func (svc *serviceContext) sendEmail(request *emailRequest) error {
 func getVirgoClaims(c *gin.Context) (*v4jwt.V4Claims, error) {
 	claims, exist := c.Get("claims")
 	if exist == false {
-		log.Printf("ERROR: no claims found for user requesting a hold")
+		logf(c.Request.Context(), "ERROR: no claims found for user requesting a hold")
 		return nil, fmt.Errorf("request is not authorized")
 	}
 	v4Claims, ok := claims.(*v4jwt.V4Claims)
 	if !ok {
-		log.Printf("ERROR: invalid claims found for user requesting a hold")
+		logf(c.Request.Context(), "ERROR: invalid claims found for user requesting a hold")
 		return nil, fmt.Errorf("request is not authorized")
 	}
 	return v4Claims, nil
@@ -448,12 +567,3 @@ func cleanCatKey(catKey string) string {
 	re := regexp.MustCompile("^u")
 	return re.ReplaceAllString(catKey, "")
 }
-
-func loadDataFile(filename string) []string {
-	bytes, err := os.ReadFile(filename)
-	if err != nil {
-		log.Printf("ERROR: unable to load %s: %s", filename, err.Error())
-		return make([]string, 0)
-	}
-	return strings.Split(string(bytes), "\n")
-}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// sirsiSessionLifetime is how long a staff session is used before it is replaced
+const sirsiSessionLifetime = 1 * time.Hour
+
+// sirsiSessionRefreshLead is how long before the session refresh time a new session
+// will be requested in the background so active requests never see an expired session
+const sirsiSessionRefreshLead = 5 * time.Minute
+
+// sirsiLoginCall tracks an in-flight staff login. All callers that need a new session
+// while a login is in progress wait on done and share the result.
+type sirsiLoginCall struct {
+	done chan struct{}
+	err  *requestError
+}
+
+// sirsiSessionManager owns the staff session token and key used for all sirsi
+// requests made on behalf of the service. It is safe for concurrent use.
+type sirsiSessionManager struct {
+	mutex         sync.Mutex
+	staffKey      string
+	sessionToken  string
+	previousToken string
+	refreshAt     time.Time
+	inFlight      *sirsiLoginCall
+	login         func() (*sirsiSigniResponse, *requestError)
+}
+
+func newSirsiSessionManager(login func() (*sirsiSigniResponse, *requestError)) *sirsiSessionManager {
+	return &sirsiSessionManager{login: login}
+}
+
+// token returns the current session token; it will be empty if there is no session
+func (sm *sirsiSessionManager) token() string {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.sessionToken
+}
+
+// getStaffKey returns the staff key associated with the current session
+func (sm *sirsiSessionManager) getStaffKey() string {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.staffKey
+}
+
+// isActive returns true if there is a session that has not reached its refresh time
+func (sm *sirsiSessionManager) isActive() bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.isActiveLocked()
+}
+
+func (sm *sirsiSessionManager) isActiveLocked() bool {
+	return sm.sessionToken != "" && time.Now().Before(sm.refreshAt)
+}
+
+// owns returns true if the token was issued by this manager. The previous token is
+// included so requests that were in flight during a re-login are still recognized
+func (sm *sirsiSessionManager) owns(token string) bool {
+	if token == "" {
+		return false
+	}
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return token == sm.sessionToken || token == sm.previousToken
+}
+
+// ensureSession makes sure a usable session exists. If there is no session, or it has expired,
+// this blocks until a login completes. If the session is close to its refresh time, a new login
+// is started in the background and the current session continues to be used until it completes.
+func (sm *sirsiSessionManager) ensureSession() *requestError {
+	sm.mutex.Lock()
+	if sm.isActiveLocked() {
+		if time.Now().After(sm.refreshAt.Add(-sirsiSessionRefreshLead)) && sm.inFlight == nil {
+			log.Printf("INFO: sirsi session refreshes at %s; start proactive login", sm.refreshAt.String())
+			sm.startLoginLocked()
+		}
+		sm.mutex.Unlock()
+		return nil
+	}
+	call := sm.inFlight
+	if call == nil {
+		call = sm.startLoginLocked()
+	}
+	sm.mutex.Unlock()
+
+	<-call.done
+	return call.err
+}
+
+// renew replaces a session that sirsi has reported as timed out. Concurrent callers that present the
+// same stale token share a single login; callers that present a token that has already been replaced
+// do not trigger another login. The current session token is returned.
+func (sm *sirsiSessionManager) renew(staleToken string) (string, *requestError) {
+	sm.mutex.Lock()
+	if sm.sessionToken != "" && sm.sessionToken != staleToken {
+		token := sm.sessionToken
+		sm.mutex.Unlock()
+		return token, nil
+	}
+	if sm.sessionToken == staleToken {
+		sm.previousToken = staleToken
+		sm.sessionToken = ""
+		sm.staffKey = ""
+	}
+	call := sm.inFlight
+	if call == nil {
+		call = sm.startLoginLocked()
+	}
+	sm.mutex.Unlock()
+
+	<-call.done
+	if call.err != nil {
+		return "", call.err
+	}
+	return sm.token(), nil
+}
+
+// refresh unconditionally waits for a new login, joining one that is already in flight
+func (sm *sirsiSessionManager) refresh() *requestError {
+	sm.mutex.Lock()
+	call := sm.inFlight
+	if call == nil {
+		call = sm.startLoginLocked()
+	}
+	sm.mutex.Unlock()
+
+	<-call.done
+	return call.err
+}
+
+// clear drops the current session and returns the token that was in use so it can be logged out
+func (sm *sirsiSessionManager) clear() string {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	token := ""
+	if sm.isActiveLocked() {
+		token = sm.sessionToken
+	}
+	if sm.sessionToken != "" {
+		sm.previousToken = sm.sessionToken
+	}
+	sm.sessionToken = ""
+	sm.staffKey = ""
+	return token
+}
+
+// startLoginLocked launches a login goroutine. The mutex must be held by the caller.
+func (sm *sirsiSessionManager) startLoginLocked() *sirsiLoginCall {
+	call := &sirsiLoginCall{done: make(chan struct{})}
+	sm.inFlight = call
+	go func() {
+		resp, err := sm.login()
+
+		sm.mutex.Lock()
+		if err == nil {
+			if sm.sessionToken != "" {
+				sm.previousToken = sm.sessionToken
+			}
+			sm.sessionToken = resp.SessionToken
+			sm.staffKey = resp.StaffKey
+			sm.refreshAt = time.Now().Add(sirsiSessionLifetime)
+			log.Printf("INFO: sirsi login success; refresh at %s", sm.refreshAt.String())
+		}
+		call.err = err
+		sm.inFlight = nil
+		sm.mutex.Unlock()
+
+		close(call.done)
+	}()
+	return call
+}
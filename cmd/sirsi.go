@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// sirsiILS is the ilsBackend implementation that communicates with Sirsi Web Services
+type sirsiILS struct {
+	svc *serviceContext
+}
+
+func (s *sirsiILS) staffLogin(ctx context.Context, login, password string) ([]byte, *requestError) {
+	payloadBytes, _ := json.Marshal(sirsiStaffLoginReq{Login: login, Password: password})
+	url := fmt.Sprintf("%s/user/staff/login", s.svc.SirsiConfig.WebServicesURL)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
+	s.svc.setSirsiHeaders(req, "STAFF", "")
+	return s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, req)
+}
+
+func (s *sirsiILS) staffLogout(ctx context.Context, sessionToken string) *requestError {
+	url := fmt.Sprintf("%s/user/staff/logout", s.svc.SirsiConfig.WebServicesURL)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBufferString("{}"))
+	s.svc.setSirsiHeaders(req, "STAFF", sessionToken)
+	_, err := s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, req)
+	return err
+}
+
+func (s *sirsiILS) getStaffUser(ctx context.Context, staffKey string) ([]byte, *requestError) {
+	return s.svc.sirsiGet(ctx, s.svc.HTTPClient, fmt.Sprintf("/user/staff/key/%s", staffKey))
+}
+
+// bibDetailFields are the bib fields needed to build availability
+const bibDetailFields = "boundWithList{*},bib{*},callList{dispCallNumber,volumetric,shadowed,library{description}," +
+	"itemList{barcode,copyNumber,shadowed,itemType{key},homeLocation{key},currentLocation{key,description,shadowed}}}"
+
+func (s *sirsiILS) getBib(ctx context.Context, catKey string) ([]byte, *requestError) {
+	url := fmt.Sprintf("/catalog/bib/key/%s?includeFields=%s", cleanCatKey(catKey), bibDetailFields)
+	return s.svc.sirsiGet(ctx, s.svc.SlowHTTPClient, url)
+}
+
+func (s *sirsiILS) getBibs(ctx context.Context, catKeys []string) ([]byte, *requestError) {
+	uri := fmt.Sprintf("/catalog/bib/search?includeFields=%s&q=%s&ct=%d", bibDetailFields, url.QueryEscape(catKeyQuery(catKeys)), len(catKeys))
+	return s.svc.sirsiGet(ctx, s.svc.SlowHTTPClient, uri)
+}
+
+func (s *sirsiILS) searchBibs(ctx context.Context, catKeys []string) ([]byte, *requestError) {
+	fields := "callList{itemList{itemType,library}}"
+	uri := fmt.Sprintf("/catalog/bib/search?includeFields=%s&q=%s&ct=%d", fields, url.QueryEscape(catKeyQuery(catKeys)), len(catKeys))
+	return s.svc.sirsiGet(ctx, s.svc.HTTPClient, uri)
+}
+
+// catKeyQuery builds a bib search query that matches any of the cat keys
+func catKeyQuery(catKeys []string) string {
+	var bits []string
+	for _, key := range catKeys {
+		bits = append(bits, fmt.Sprintf("%s{CKEY}", cleanCatKey(key)))
+	}
+	return fmt.Sprintf("GENERAL:\"%s\"", strings.Join(bits, " OR "))
+}
+
+func (s *sirsiILS) getMARC(ctx context.Context, catKey string) ([]byte, *requestError) {
+	url := fmt.Sprintf("%s/catalog/bib/key/%s", s.svc.SirsiConfig.WebServicesURL, cleanCatKey(catKey))
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	s.setTrackSysHeaders(req)
+	return s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, req)
+}
+
+func (s *sirsiILS) updateMARC(ctx context.Context, catKey string, marc []byte) *requestError {
+	url := fmt.Sprintf("%s/catalog/bib/key/%s", s.svc.SirsiConfig.WebServicesURL, cleanCatKey(catKey))
+	req, _ := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(marc))
+	s.setTrackSysHeaders(req)
+	_, err := s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, req)
+	return err
+}
+
+func (s *sirsiILS) setTrackSysHeaders(req *http.Request) {
+	s.svc.setSirsiHeaders(req, "STAFF", s.svc.SirsiSession.token())
+	req.Header.Set("SD-Originating-App-Id", "TrackSys")
+	req.Header.Set("x-sirs-clientID", "TRACKSYS")
+}
+
+func (s *sirsiILS) getCourseReserveInfo(ctx context.Context, barcode string) ([]byte, *requestError) {
+	crURL := fmt.Sprintf("%s/course_reserves?item_id=%s", s.svc.SirsiConfig.ScriptURL, barcode)
+	req, _ := http.NewRequestWithContext(ctx, "GET", crURL, nil)
+	return s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, req)
+}
+
+func (s *sirsiILS) getItemHolds(ctx context.Context, barcode, sessionToken string) ([]byte, *requestError) {
+	fields := `bib{title,author,currentLocation},`
+	fields += `transit{destinationLibrary,holdRecord},`
+	fields += `fillableHoldList{placedLibrary,pickupLibrary,patron{alternateID,displayName,barcode}}`
+	url := fmt.Sprintf("%s/catalog/item/barcode/%s?includeFields=%s", s.svc.SirsiConfig.WebServicesURL, barcode, fields)
+	sirsiReq, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	s.svc.setSirsiHeaders(sirsiReq, "STAFF", sessionToken)
+	sirsiReq.Header.Set("SD-Working-LibraryID", "LEO")
+	sirsiReq.Header.Set("x-sirs-clientID", "ILL_CKOUT")
+	slog.InfoContext(ctx, "barcode scanner get item", "url", url, "headers", sirsiReq.Header)
+	return s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, sirsiReq)
+}
+
+func (s *sirsiILS) getPatron(ctx context.Context, computeID string, view patronView) ([]byte, *requestError) {
+	client := s.svc.HTTPClient
+	fields := ""
+	switch view {
+	case patronInfo:
+		fields = "barcode,primaryAddress{*},address1,address2,address3,displayName,preferredName,firstName,middleName,lastName,"
+		fields += "profile,patronStatusInfo{standing,amountOwed},library"
+	case patronBills:
+		fields = "blockList{title,callNumber,amount,createDate,library{description},block{description},item{itemType{description},barcode,bib{author}}}"
+	case patronCheckouts:
+		fields = "blockList{amount,block{description},item{key}},"
+		fields += "circRecordList{circulationRule{billStructure{maxFee}},dueDate,overdue,estimatedOverdueAmount,recallDueDate,renewalDate,"
+		fields += "library{description},item{key,barcode,currentLocation,holdRecordList{status},call{dispCallNumber,bib{key,author,title}}}}"
+		client = s.svc.SlowHTTPClient
+	case patronHolds:
+		fields = "holdRecordList{*,bib{title,author},item{barcode,currentLocation,library,transit{transitReason},call{dispCallNumber}}}"
+		client = s.svc.SlowHTTPClient
+	}
+	url := fmt.Sprintf("/user/patron/alternateID/%s?includeFields=%s", computeID, fields)
+	if view == patronCheckouts || view == patronHolds {
+		url = fmt.Sprintf("/user/patron/alternateID/%s?i&includeFields=%s", computeID, fields)
+	}
+	return s.svc.sirsiGet(ctx, client, url)
+}
+
+func (s *sirsiILS) authenticatePatron(ctx context.Context, payload any) ([]byte, *requestError) {
+	return s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/user/patron/authenticate", payload)
+}
+
+func (s *sirsiILS) patronLogin(ctx context.Context, payload any) ([]byte, *requestError) {
+	return s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/user/patron/login", payload)
+}
+
+func (s *sirsiILS) changePassword(ctx context.Context, payload any, sessionToken string) ([]byte, *requestError) {
+	payloadBytes, _ := json.Marshal(payload)
+	url := fmt.Sprintf("%s/user/patron/changeMyPassword", s.svc.SirsiConfig.WebServicesURL)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
+	s.svc.setSirsiHeaders(req, "", sessionToken)
+	return s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, req)
+}
+
+func (s *sirsiILS) resetPassword(ctx context.Context, payload any) ([]byte, *requestError) {
+	return s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/user/patron/resetMyPassword", payload)
+}
+
+func (s *sirsiILS) registerPatron(ctx context.Context, payload any) ([]byte, *requestError) {
+	return s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/user/patron/register", payload)
+}
+
+func (s *sirsiILS) updatePatron(ctx context.Context, patronKey string, payload any) ([]byte, *requestError) {
+	payloadBytes, _ := json.Marshal(payload)
+	url := fmt.Sprintf("%s/user/patron/key/%s", s.svc.SirsiConfig.WebServicesURL, patronKey)
+	req, _ := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(payloadBytes))
+	s.svc.setSirsiHeaders(req, "STAFF", s.svc.SirsiSession.token())
+	req.Header.Set("Accept", "application/vnd.sirsidynix.roa.resource.v2+json")
+	req.Header.Set("Content-Type", "application/vnd.sirsidynix.roa.resource.v2+json")
+	req.Header.Set("SD-Working-LibraryID", s.svc.SirsiConfig.Library)
+	return s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, req)
+}
+
+func (s *sirsiILS) activatePatron(ctx context.Context, payload any) ([]byte, *requestError) {
+	return s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/user/patron/activate", payload)
+}
+
+func (s *sirsiILS) getHold(ctx context.Context, holdID string) ([]byte, *requestError) {
+	fields := "bib,status,recallStatus,pickupLibrary,suspendBeginDate,suspendEndDate,patron{alternateID}"
+	url := fmt.Sprintf("/circulation/holdRecord/key/%s?includeFields=%s", holdID, fields)
+	return s.svc.sirsiGet(ctx, s.svc.HTTPClient, url)
+}
+
+func (s *sirsiILS) placeHold(ctx context.Context, holdReq sirsiHoldRequest, workLibrary string) ([]byte, *requestError) {
+	payloadBytes, _ := json.Marshal(holdReq)
+	url := fmt.Sprintf("%s/circulation/holdRecord/placeHold?includeFields=holdRecord{*}", s.svc.SirsiConfig.WebServicesURL)
+	slog.InfoContext(ctx, "place hold request", "url", url, "payload", string(payloadBytes))
+	postReq, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
+	s.svc.setSirsiHeaders(postReq, "PATRON", s.svc.SirsiSession.token())
+	postReq.Header.Set("sd-working-libraryid", workLibrary)
+	return s.svc.sendRequest(ctx, "sirsi", s.svc.HTTPClient, postReq)
+}
+
+func (s *sirsiILS) cancelHold(ctx context.Context, holdID string) *requestError {
+	delURL := fmt.Sprintf("/circulation/holdRecord/key/%s", holdID)
+	_, sirsiErr := s.svc.sirsiDelete(ctx, s.svc.HTTPClient, delURL)
+	if sirsiErr != nil && sirsiErr.StatusCode == http.StatusNoContent {
+		// sirsi responds to a successful delete with no content
+		return nil
+	}
+	return sirsiErr
+}
+
+func (s *sirsiILS) changeHoldPickup(ctx context.Context, holdID, library string) *requestError {
+	req := sirsiHoldChange{HoldRecord: sirsiKey{Resource: "/circulation/holdRecord", Key: holdID},
+		PickupLibrary: &sirsiKey{Resource: "/policy/library", Key: library}}
+	_, sirsiErr := s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/circulation/holdRecord/changePickupLibrary", req)
+	return sirsiErr
+}
+
+func (s *sirsiILS) suspendHold(ctx context.Context, holdID, begin, end string) *requestError {
+	req := sirsiHoldChange{HoldRecord: sirsiKey{Resource: "/circulation/holdRecord", Key: holdID},
+		SuspendBeginDate: begin, SuspendEndDate: end}
+	_, sirsiErr := s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/circulation/holdRecord/suspendHold", req)
+	return sirsiErr
+}
+
+func (s *sirsiILS) unsuspendHold(ctx context.Context, holdID string) *requestError {
+	req := sirsiHoldChange{HoldRecord: sirsiKey{Resource: "/circulation/holdRecord", Key: holdID}}
+	_, sirsiErr := s.svc.sirsiPost(ctx, s.svc.HTTPClient, "/circulation/holdRecord/unsuspendHold", req)
+	return sirsiErr
+}
+
+func (s *sirsiILS) renew(ctx context.Context, itemBarcode string) ([]byte, *requestError) {
+	payload := struct {
+		Barcode string `json:"itemBarcode"`
+	}{
+		Barcode: itemBarcode,
+	}
+	fields := "circRecord{checkOutDate,dueDate,renewalDate,status,recallDueDate}"
+	return s.svc.sirsiPost(ctx, s.svc.HTTPClient, fmt.Sprintf("/circulation/circRecord/renew?includeFields=%s", fields), payload)
+}
+
+func (s *sirsiILS) checkout(ctx context.Context, itemBarcode, patronBarcode, workLibrary, sessionToken string) ([]byte, *requestError) {
+	req := struct {
+		PatronBarcode string `json:"patronBarcode"`
+		ItemBarcode   string `json:"itemBarcode"`
+	}{
+		PatronBarcode: patronBarcode,
+		ItemBarcode:   itemBarcode,
+	}
+	payloadBytes, _ := json.Marshal(req)
+	uri := "/circulation/circRecord/checkOut"
+	overrides := []string{"CKOBLOCKS"}
+	headers := make(map[string]string)
+	headers["x-sirs-clientID"] = "ILL_CKOUT"
+	headers["sd-working-libraryid"] = workLibrary
+	headers["x-sirs-sessionToken"] = sessionToken
+	slog.InfoContext(ctx, "fill hold checkout request", "payload", string(payloadBytes))
+	return s.svc.retrySirsiRequest(ctx, uri, payloadBytes, headers, overrides, "")
+}
+
+func (s *sirsiILS) untransit(ctx context.Context, itemBarcode, workLibrary, sessionToken string) ([]byte, *requestError) {
+	req := struct {
+		ItemBarcode string `json:"itemBarcode"`
+	}{
+		ItemBarcode: itemBarcode,
+	}
+	payloadBytes, _ := json.Marshal(req)
+	uri := "/circulation/transit/untransit"
+	overrides := []string{"CKOBLOCKS", "/OK"}
+	headers := make(map[string]string)
+	headers["x-sirs-clientID"] = "ILL_CKOUT"
+	headers["sd-working-libraryid"] = workLibrary
+	headers["x-sirs-sessionToken"] = sessionToken
+	slog.InfoContext(ctx, "untransit request", "payload", string(payloadBytes))
+	return s.svc.retrySirsiRequest(ctx, uri, payloadBytes, headers, overrides, "")
+}
+
+func (s *sirsiILS) getPolicies(ctx context.Context, policy policyType) ([]byte, *requestError) {
+	fields := "key,policyNumber,description"
+	switch policy {
+	case locationPolicy:
+		fields = "key,policyNumber,description,shadowed"
+	case reservePolicy:
+		fields = "key,location{key}"
+	}
+	url := fmt.Sprintf("/policy/%s/simpleQuery?key=*&includeFields=%s", policy, fields)
+	return s.svc.sirsiGet(ctx, s.svc.HTTPClient, url)
+}
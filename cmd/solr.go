@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -59,6 +61,9 @@ func (doc solrDocument) fieldList() string {
 	return fields
 }
 
+// errNoSolrDoc is returned by getSolrDoc when no document matches the requested ID
+var errNoSolrDoc = errors.New("no solr document found")
+
 type solrResponse struct {
 	Response struct {
 		Docs     []solrDocument `json:"docs,omitempty"`
@@ -66,12 +71,12 @@ type solrResponse struct {
 	} `json:"response,omitempty"`
 }
 
-func (svc *serviceContext) getSolrDoc(catKey string) (*solrDocument, error) {
-	log.Printf("INFO: get solr doc for %s", catKey)
+func (svc *serviceContext) getSolrDoc(ctx context.Context, catKey string) (*solrDocument, error) {
+	slog.InfoContext(ctx, "get solr doc", "id", catKey)
 	fields := solrDocument{}.fieldList()
 	solrPath := fmt.Sprintf(`select?fl=%s,&q=id%%3A%s`, fields, catKey)
 
-	respBytes, solrErr := svc.solrGet(solrPath)
+	respBytes, solrErr := svc.solrGet(ctx, solrPath)
 	if solrErr != nil {
 		return nil, fmt.Errorf("get solr doc failed: %s", solrErr.string())
 	}
@@ -80,17 +85,44 @@ func (svc *serviceContext) getSolrDoc(catKey string) (*solrDocument, error) {
 		return nil, fmt.Errorf("unable to parse solr response: %s", err.Error())
 	}
 	if solrResp.Response.NumFound == 0 {
-		return nil, fmt.Errorf("no solr document found for %s", catKey)
+		return nil, fmt.Errorf("%w for %s", errNoSolrDoc, catKey)
 	}
 	if solrResp.Response.NumFound > 1 {
-		log.Printf("WARNING: more than one record found for the id: %s", catKey)
+		slog.WarnContext(ctx, "more than one record found for id", "id", catKey)
 	}
 	solrDoc := solrResp.Response.Docs[0]
 	return &solrDoc, nil
 }
 
-func (svc *serviceContext) solrGet(query string) ([]byte, *requestError) {
+// getSolrDocs gets the solr documents for a list of cat keys in one query. The result is keyed by
+// document ID; keys with no matching document are omitted
+func (svc *serviceContext) getSolrDocs(ctx context.Context, catKeys []string) (map[string]*solrDocument, error) {
+	slog.InfoContext(ctx, "get solr docs", "count", len(catKeys))
+	ids := make([]string, 0, len(catKeys))
+	for _, key := range catKeys {
+		ids = append(ids, fmt.Sprintf(`"%s"`, strings.ReplaceAll(key, `"`, `\"`)))
+	}
+	fields := solrDocument{}.fieldList()
+	q := url.QueryEscape(fmt.Sprintf("id:(%s)", strings.Join(ids, " OR ")))
+	solrPath := fmt.Sprintf(`select?fl=%s,&rows=%d&q=%s`, fields, len(catKeys), q)
+
+	respBytes, solrErr := svc.solrGet(ctx, solrPath)
+	if solrErr != nil {
+		return nil, fmt.Errorf("get solr docs failed: %s", solrErr.string())
+	}
+	var solrResp solrResponse
+	if err := json.Unmarshal(respBytes, &solrResp); err != nil {
+		return nil, fmt.Errorf("unable to parse solr response: %s", err.Error())
+	}
+	out := make(map[string]*solrDocument)
+	for _, doc := range solrResp.Response.Docs {
+		out[doc.ID] = &doc
+	}
+	return out, nil
+}
+
+func (svc *serviceContext) solrGet(ctx context.Context, query string) ([]byte, *requestError) {
 	url := fmt.Sprintf("%s/%s/%s", svc.Solr.URL, svc.Solr.Core, query)
-	req, _ := http.NewRequest("GET", url, nil)
-	return svc.sendRequest("solr", svc.HTTPClient, req)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	return svc.sendRequest(ctx, "solr", svc.HTTPClient, req)
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+// maxLockout caps the length of a lockout, however many failures there have been
+const maxLockout = time.Hour
+
+// idle rate limit buckets and old lockout entries are removed once a sweep interval has passed
+const throttleSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket limiter for each key. Each bucket holds up to perMinute tokens and
+// refills at perMinute tokens a minute; a request takes a token. A limit of 0 disables the limiter.
+type rateLimiter struct {
+	perMinute int
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes a token for key. If there are none, the time until the next one is available is returned.
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	if rl.perMinute <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	burst := float64(rl.perMinute)
+	rate := burst / 60.0
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if now.Sub(rl.lastSweep) > throttleSweepInterval {
+		// a bucket that has refilled is the same as no bucket
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[key]
+	if ok == false {
+		b = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func (rl *rateLimiter) reset(key string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	delete(rl.buckets, key)
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// lockoutTracker locks an account out after threshold consecutive failed logins. The first lockout lasts for
+// duration, and each further failure doubles it, up to maxLockout. Failures are forgotten after a success, or
+// once maxLockout has passed since the last one. A threshold of 0 disables lockouts.
+type lockoutTracker struct {
+	threshold int
+	duration  time.Duration
+	mutex     sync.Mutex
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+}
+
+func newLockoutTracker(threshold int, duration time.Duration) *lockoutTracker {
+	return &lockoutTracker{threshold: threshold, duration: duration, entries: make(map[string]*lockoutEntry), lastSweep: time.Now()}
+}
+
+// locked returns the time remaining on the lockout for key, or 0 if it is not locked out
+func (lt *lockoutTracker) locked(key string) time.Duration {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if e, ok := lt.entries[key]; ok {
+		if wait := time.Until(e.lockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// failure records a failed login for key. If key is now locked out, the length of the lockout is returned.
+func (lt *lockoutTracker) failure(key string) time.Duration {
+	if lt.threshold <= 0 {
+		return 0
+	}
+	now := time.Now()
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if now.Sub(lt.lastSweep) > throttleSweepInterval {
+		for k, e := range lt.entries {
+			if lt.expired(e, now) {
+				delete(lt.entries, k)
+			}
+		}
+		lt.lastSweep = now
+	}
+
+	e, ok := lt.entries[key]
+	if ok == false || lt.expired(e, now) {
+		e = &lockoutEntry{}
+		lt.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < lt.threshold {
+		return 0
+	}
+	lockout := time.Duration(float64(lt.duration) * math.Pow(2, float64(e.failures-lt.threshold)))
+	if lockout > maxLockout || lockout <= 0 {
+		lockout = maxLockout
+	}
+	e.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+func (lt *lockoutTracker) expired(e *lockoutEntry, now time.Time) bool {
+	return now.After(e.lockedUntil) && now.Sub(e.lastFailure) > maxLockout
+}
+
+// success forgets the failures for key
+func (lt *lockoutTracker) success(key string) {
+	lt.clear(key)
+}
+
+// clear removes any lockout and failures for key, and returns true if there were any
+func (lt *lockoutTracker) clear(key string) bool {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	_, ok := lt.entries[key]
+	delete(lt.entries, key)
+	return ok
+}
+
+// authThrottle limits requests to the password and login routes by client IP and by target account,
+// and locks out accounts after repeated failed logins
+type authThrottle struct {
+	perIP     *rateLimiter
+	perTarget *rateLimiter
+	lockouts  *lockoutTracker
+}
+
+func newAuthThrottle(cfg throttleConfig) *authThrottle {
+	return &authThrottle{
+		perIP:     newRateLimiter(cfg.IPRate),
+		perTarget: newRateLimiter(cfg.TargetRate),
+		lockouts:  newLockoutTracker(cfg.LockoutThreshold, time.Duration(cfg.LockoutSeconds)*time.Second),
+	}
+}
+
+// throttleKey identifies an account. Kind is patron or staff, as a patron barcode and a staff username may match.
+func throttleKey(kind, account string) string {
+	return fmt.Sprintf("%s:%s", kind, strings.ToLower(strings.TrimSpace(account)))
+}
+
+// tooManyRequests responds with a 429 that tells the caller when to try again
+func tooManyRequests(c *gin.Context, wait time.Duration, message string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.String(http.StatusTooManyRequests, message)
+	c.Abort()
+}
+
+// authRateLimitMiddleware limits requests to the password and login routes from each client IP
+func (svc *serviceContext) authRateLimitMiddleware(c *gin.Context) {
+	if ok, wait := svc.Throttle.perIP.allow(c.ClientIP()); ok == false {
+		logf(c.Request.Context(), "WARNING: too many requests to %s from %s", c.FullPath(), c.ClientIP())
+		svc.Metrics.authThrottled.WithLabelValues("ip").Inc()
+		tooManyRequests(c, wait, "too many requests; try again later")
+		return
+	}
+	c.Next()
+}
+
+// throttleTarget checks the lockout and rate limit for an account before a login attempt. If the attempt is
+// not allowed a 429 response is sent and false is returned.
+func (svc *serviceContext) throttleTarget(c *gin.Context, kind, account string) bool {
+	key := throttleKey(kind, account)
+	if wait := svc.Throttle.lockouts.locked(key); wait > 0 {
+		logf(c.Request.Context(), "WARNING: %s %s is locked out for another %s", kind, redactID(account), wait.Round(time.Second))
+		svc.Metrics.authThrottled.WithLabelValues("lockout").Inc()
+		tooManyRequests(c, wait, "too many failed attempts; try again later")
+		return false
+	}
+	if ok, wait := svc.Throttle.perTarget.allow(key); ok == false {
+		logf(c.Request.Context(), "WARNING: too many requests for %s %s", kind, redactID(account))
+		svc.Metrics.authThrottled.WithLabelValues("target").Inc()
+		tooManyRequests(c, wait, "too many requests; try again later")
+		return false
+	}
+	return true
+}
+
+// loginFailed records a failed login for an account, and locks it out after too many
+func (svc *serviceContext) loginFailed(c *gin.Context, kind, account string) {
+	if lockout := svc.Throttle.lockouts.failure(throttleKey(kind, account)); lockout > 0 {
+		logf(c.Request.Context(), "WARNING: %s %s locked out for %s after repeated failed logins", kind, redactID(account), lockout)
+		svc.Audit(c.Request.Context(), auditEvent{Action: "lockout", Route: c.FullPath(), Target: redactID(account),
+			ClientIP: c.ClientIP(), Reason: fmt.Sprintf("%s locked out for %s", kind, lockout)})
+	}
+}
+
+func (svc *serviceContext) loginSucceeded(kind, account string) {
+	svc.Throttle.lockouts.success(throttleKey(kind, account))
+}
+
+//	curl --request POST \
+//	  --url http://localhost:8185/users/clear_lockout \
+//	  --header 'Authorization: Bearer ADMIN_JWT' \
+//	  --data '{"barcode": "C000011111"}'
+//
+// admin request to clear the lockout for a patron barcode or staff username
+func (svc *serviceContext) clearLockout(c *gin.Context) {
+	claims, err := getVirgoClaims(c)
+	if err != nil {
+		logf(c.Request.Context(), "ERROR: attempt to clear a lockout with bad claims: %s", err.Error())
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+	if claims.Role != v4jwt.Admin {
+		logf(c.Request.Context(), "ERROR: non-admin user %s attempted to clear a lockout", claims.UserID)
+		c.String(http.StatusForbidden, "access forbidden")
+		return
+	}
+
+	var req struct {
+		Barcode  string `json:"barcode"`
+		Username string `json:"username"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Barcode == "") == (req.Username == "") {
+		logf(c.Request.Context(), "ERROR: invalid clear lockout request")
+		c.String(http.StatusBadRequest, "barcode or username is required")
+		return
+	}
+	kind, account := "patron", req.Barcode
+	if req.Username != "" {
+		kind, account = "staff", req.Username
+	}
+
+	key := throttleKey(kind, account)
+	svc.Throttle.perTarget.reset(key)
+	if svc.Throttle.lockouts.clear(key) == false {
+		logf(c.Request.Context(), "INFO: %s %s has no failed logins to clear", kind, redactID(account))
+		c.String(http.StatusNotFound, "%s %s is not locked out", kind, account)
+		return
+	}
+	logf(c.Request.Context(), "INFO: admin %s cleared the lockout for %s %s", claims.UserID, kind, redactID(account))
+	c.String(http.StatusOK, "lockout cleared")
+}
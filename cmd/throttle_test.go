@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2)
+	for i := range 2 {
+		if ok, _ := rl.allow("a"); ok == false {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	ok, wait := rl.allow("a")
+	if ok || wait <= 0 || wait > 30*time.Second {
+		t.Fatalf("expected the third request to wait for up to 30s, got %t %s", ok, wait)
+	}
+	if ok, _ := rl.allow("b"); ok == false {
+		t.Errorf("keys should have separate buckets")
+	}
+	rl.reset("a")
+	if ok, _ := rl.allow("a"); ok == false {
+		t.Errorf("reset bucket should be full")
+	}
+
+	disabled := newRateLimiter(0)
+	for range 100 {
+		if ok, _ := disabled.allow("a"); ok == false {
+			t.Fatalf("disabled limiter rejected a request")
+		}
+	}
+}
+
+func TestLockoutTracker(t *testing.T) {
+	lt := newLockoutTracker(3, time.Minute)
+	lt.failure("a")
+	lt.failure("a")
+	lt.success("a")
+	lt.failure("a")
+	if lockout := lt.failure("a"); lockout != 0 || lt.locked("a") != 0 {
+		t.Fatalf("a success should reset the failure count")
+	}
+	if lockout := lt.failure("a"); lockout != time.Minute {
+		t.Fatalf("expected a one minute lockout, got %s", lockout)
+	}
+	if wait := lt.locked("a"); wait <= 0 || wait > time.Minute {
+		t.Errorf("expected a to be locked for up to a minute, got %s", wait)
+	}
+	if lockout := lt.failure("a"); lockout != 2*time.Minute {
+		t.Errorf("expected the lockout to double, got %s", lockout)
+	}
+	for range 10 {
+		lt.failure("a")
+	}
+	if wait := lt.locked("a"); wait > maxLockout {
+		t.Errorf("lockout longer than the max: %s", wait)
+	}
+	if lt.locked("b") != 0 {
+		t.Errorf("b should not be locked")
+	}
+	if lt.clear("a") == false || lt.locked("a") != 0 {
+		t.Errorf("expected lockout to be cleared")
+	}
+	if lt.clear("a") {
+		t.Errorf("clear of an account without failures should return false")
+	}
+
+	disabled := newLockoutTracker(0, time.Minute)
+	for range 10 {
+		if disabled.failure("a") != 0 {
+			t.Fatalf("disabled tracker locked an account")
+		}
+	}
+}
+
+func TestAuthThrottle(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.Throttle = newAuthThrottle(throttleConfig{IPRate: 100, TargetRate: 100, LockoutThreshold: 2, LockoutSeconds: 60})
+	if err := h.svc.SirsiSession.ensureSession(); err != nil {
+		t.Fatalf("unable to start session: %s", err.string())
+	}
+	var events []auditEvent
+	h.svc.Audit = func(ctx context.Context, evt auditEvent) { events = append(events, evt) }
+	adminClaims := mst3kClaims()
+	adminClaims.Role = v4jwt.Admin
+	admin := map[string]string{"Authorization": bearer(t, adminClaims)}
+	wrongPin := `{"barcode": "C000011111", "password": "wrong"}`
+	rightPin := `{"barcode": "C000011111", "password": "fixture-pin"}`
+	expectRetryAfter := func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+		if secs, err := strconv.Atoi(resp.Header().Get("Retry-After")); err != nil || secs <= 0 {
+			t.Errorf("expected Retry-After seconds, got [%s]", resp.Header().Get("Retry-After"))
+		}
+	}
+
+	h.run(t, []routeTest{
+		{name: "failures lock the patron out", method: "POST", path: "/users/check_password", body: rightPin,
+			setup: func(h *testHarness) {
+				h.do("POST", "/users/check_password", wrongPin, nil)
+				h.do("POST", "/users/check_password", wrongPin, nil)
+			},
+			status: http.StatusTooManyRequests, contains: []string{"too many failed attempts"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				expectRetryAfter(t, h, resp)
+				if len(h.sirsi.received("POST", "/user/patron/authenticate")) != 4 {
+					t.Errorf("expected only the failed attempts to be sent to sirsi")
+				}
+				if len(events) != 1 || events[0].Action != "lockout" || events[0].Target != "*******111" {
+					t.Errorf("expected a lockout audit event, got %+v", events)
+				}
+			}},
+		{name: "lockout applies to forgot password", method: "POST", path: "/users/forgot_password",
+			body: `{"userBarcode": "c000011111"}`, status: http.StatusTooManyRequests},
+		{name: "other patrons are not locked out", method: "POST", path: "/users/check_password",
+			body: `{"barcode": "abc9z", "password": "wrong"}`, status: http.StatusUnauthorized},
+		{name: "non admin cannot clear a lockout", method: "POST", path: "/users/clear_lockout", body: `{"barcode": "mst3k"}`,
+			headers: map[string]string{"Authorization": bearer(t, mst3kClaims())}, status: http.StatusForbidden},
+		{name: "clear requires one account", method: "POST", path: "/users/clear_lockout",
+			body: `{"barcode": "mst3k", "username": "leo"}`, headers: admin, status: http.StatusBadRequest},
+		{name: "admin clears the lockout", method: "POST", path: "/users/clear_lockout", body: `{"barcode": "C000011111"}`,
+			headers: admin, status: http.StatusOK},
+		{name: "cleared patron can log in", method: "POST", path: "/users/check_password", body: rightPin,
+			status: http.StatusOK, contains: []string{"valid"}},
+		{name: "nothing to clear", method: "POST", path: "/users/clear_lockout", body: `{"barcode": "C000011111"}`,
+			headers: admin, status: http.StatusNotFound},
+		{name: "failed staff logins lock out the username", method: "POST", path: "/users/sirsi_staff_login",
+			body: `{"username": "leo", "password": "guess"}`,
+			setup: func(h *testHarness) {
+				denied := sirsiMessageResponse(http.StatusUnauthorized, "unableToLogin", "Unable to log in.")
+				h.sirsi.override("POST", "/user/staff/login", denied, denied)
+				h.do("POST", "/users/sirsi_staff_login", `{"username": "leo", "password": "guess"}`, nil)
+				h.do("POST", "/users/sirsi_staff_login", `{"username": "leo", "password": "guess"}`, nil)
+			},
+			status: http.StatusTooManyRequests, check: expectRetryAfter},
+		{name: "staff lockout is separate from patrons", method: "POST", path: "/users/check_password",
+			body: `{"barcode": "leo", "password": "wrong"}`, status: http.StatusUnauthorized},
+	})
+
+	t.Run("rate limits", func(t *testing.T) {
+		h.svc.Throttle = newAuthThrottle(throttleConfig{IPRate: 3, TargetRate: 2})
+		h.run(t, []routeTest{
+			{name: "target limit", method: "POST", path: "/users/forgot_password", body: `{"userBarcode": "mst3k"}`,
+				setup: func(h *testHarness) {
+					h.do("POST", "/users/forgot_password", `{"userBarcode": "mst3k"}`, nil)
+					h.do("POST", "/users/forgot_password", `{"userBarcode": "mst3k"}`, nil)
+				},
+				status: http.StatusTooManyRequests, contains: []string{"too many requests"}, check: expectRetryAfter},
+			{name: "ip limit", method: "POST", path: "/users/reset_password", body: `{"token": "t", "newPassword": "p"}`,
+				status: http.StatusTooManyRequests, contains: []string{"too many requests"},
+				check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+					expectRetryAfter(t, h, resp)
+					metrics := h.do("GET", "/metrics", "", nil).Body.String()
+					for _, want := range []string{`ils_connector_auth_throttled_total{limit="ip"} 1`,
+						`ils_connector_auth_throttled_total{limit="target"} 1`, `ils_connector_auth_throttled_total{limit="lockout"} 3`} {
+						if strings.Contains(metrics, want) == false {
+							t.Errorf("metrics do not contain %s", want)
+						}
+					}
+				}},
+		})
+	})
+	t.Run("forwarded for is not trusted", func(t *testing.T) {
+		h.svc.Throttle = newAuthThrottle(throttleConfig{IPRate: 3})
+		for i := 1; i <= 4; i++ {
+			resp := h.do("POST", "/users/reset_password", `{"token": "t", "newPassword": "p"}`,
+				map[string]string{"X-Forwarded-For": fmt.Sprintf("203.0.113.%d", i)})
+			if i <= 3 && resp.Code == http.StatusTooManyRequests {
+				t.Fatalf("request %d was limited", i)
+			}
+			if i == 4 && resp.Code != http.StatusTooManyRequests {
+				t.Errorf("expected %d from a rotating X-Forwarded-For, got %d", http.StatusTooManyRequests, resp.Code)
+			}
+		}
+	})
+}
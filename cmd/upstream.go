@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamServices are the external services that each have a circuit breaker
+var upstreamServices = []string{"sirsi", "solr", "user-ws"}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops calls to an upstream service after threshold consecutive failures. While open, calls
+// fail immediately. Once the cooldown has passed a single probe call is allowed through (half-open); if it
+// succeeds the breaker closes, otherwise it opens for another cooldown. A probe that has not reported back
+// within the cooldown is abandoned and another probe is allowed. A threshold of 0 disables the breaker.
+type circuitBreaker struct {
+	name          string
+	threshold     int
+	cooldown      time.Duration
+	mutex         sync.Mutex
+	state         breakerState
+	failures      int
+	openUntil     time.Time
+	probeStarted  time.Time
+	onStateChange func(name string, state breakerState)
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports if a call may be made. If not, the time until the next probe is allowed is returned.
+func (cb *circuitBreaker) allow() (bool, time.Duration) {
+	if cb.threshold <= 0 {
+		return true, 0
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		wait := time.Until(cb.openUntil)
+		if wait > 0 {
+			return false, wait
+		}
+		cb.setStateLocked(breakerHalfOpen)
+		cb.probeStarted = time.Now()
+		return true, 0
+	case breakerHalfOpen:
+		// a probe is in flight; hold other calls until it completes or is abandoned
+		wait := time.Until(cb.probeStarted.Add(cb.cooldown))
+		if wait > 0 {
+			return false, wait
+		}
+		cb.probeStarted = time.Now()
+		return true, 0
+	}
+	return true, 0
+}
+
+// record updates the breaker with the result of a call that allow permitted
+func (cb *circuitBreaker) record(success bool) {
+	if cb.threshold <= 0 {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if success {
+		cb.failures = 0
+		if cb.state != breakerClosed {
+			cb.setStateLocked(breakerClosed)
+		}
+		return
+	}
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		cb.setStateLocked(breakerOpen)
+	}
+}
+
+// cancelled releases a call that allow permitted but that was cut short because its context was done. The call
+// says nothing about the health of the service, but a cancelled probe opens the breaker for another cooldown
+// so that the next probe is not held up.
+func (cb *circuitBreaker) cancelled() {
+	if cb.threshold <= 0 {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		cb.setStateLocked(breakerOpen)
+	}
+}
+
+func (cb *circuitBreaker) currentState() breakerState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+func (cb *circuitBreaker) setStateLocked(state breakerState) {
+	cb.state = state
+	if cb.onStateChange != nil {
+		cb.onStateChange(cb.name, state)
+	}
+}
+
+// retryPolicy controls retries of idempotent upstream calls. The delay before each retry is a random
+// duration up to BaseDelay doubled for each previous retry, capped at MaxDelay.
+type retryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+func (rp retryPolicy) backoff(retry int) time.Duration {
+	limit := float64(rp.BaseDelay) * math.Pow(2, float64(retry-1))
+	if limit > float64(rp.MaxDelay) {
+		limit = float64(rp.MaxDelay)
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(limit)) + 1)
+}
+
+// retryable returns true for request methods that can safely be sent more than once
+func retryable(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// upstreamFailure returns true if an upstream call with the status indicates the service is unhealthy.
+// Other errors, such as a 404 or a sirsi message list, are normal responses from a working service.
+func upstreamFailure(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// classifyNetworkError maps an error from a call that got no response to the status reported to the
+// caller, and a description of the failure
+func classifyNetworkError(err error) (int, string) {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusRequestTimeout, "timed out"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusServiceUnavailable, "refused connection"
+	case errors.As(err, &dnsErr):
+		return http.StatusServiceUnavailable, "could not be resolved"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadGateway, "closed the connection"
+	}
+	return http.StatusBadGateway, "request failed"
+}
+
+// newCircuitBreakers creates a breaker for each upstream service
+func (svc *serviceContext) newCircuitBreakers(threshold int, cooldown time.Duration) map[string]*circuitBreaker {
+	out := make(map[string]*circuitBreaker)
+	for _, name := range upstreamServices {
+		cb := newCircuitBreaker(name, threshold, cooldown)
+		cb.onStateChange = svc.breakerStateChanged
+		svc.Metrics.breakerState.WithLabelValues(name).Set(float64(breakerClosed))
+		out[name] = cb
+	}
+	return out
+}
+
+func (svc *serviceContext) breakerStateChanged(name string, state breakerState) {
+	if state == breakerOpen {
+		log.Printf("WARNING: %s circuit breaker is open; calls will fail until it is probed", name)
+	} else {
+		log.Printf("INFO: %s circuit breaker is %s", name, state)
+	}
+	svc.Metrics.breakerState.WithLabelValues(name).Set(float64(state))
+}
+
+type breakerRejectionKey struct{}
+
+// breakerRejection records how long until a circuit breaker that rejected a call for the current request allows calls again
+type breakerRejection struct {
+	mutex      sync.Mutex
+	retryAfter time.Duration
+}
+
+func (br *breakerRejection) set(wait time.Duration) {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	if wait > br.retryAfter {
+		br.retryAfter = wait
+	}
+}
+
+func (br *breakerRejection) get() time.Duration {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	return br.retryAfter
+}
+
+// noteBreakerRejection records a rejected call with the request being handled with ctx, if there is one
+func noteBreakerRejection(ctx context.Context, wait time.Duration) {
+	if br, ok := ctx.Value(breakerRejectionKey{}).(*breakerRejection); ok {
+		br.set(wait)
+	}
+}
+
+// retryAfterWriter adds a Retry-After header to 503 responses for requests that failed because a circuit breaker is open
+type retryAfterWriter struct {
+	gin.ResponseWriter
+	rejection *breakerRejection
+}
+
+func (w *retryAfterWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable {
+		if wait := w.rejection.get(); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// retryAfterMiddleware tracks circuit breaker rejections for each request so the response can tell the caller when to retry
+func retryAfterMiddleware(c *gin.Context) {
+	rejection := &breakerRejection{}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), breakerRejectionKey{}, rejection))
+	c.Writer = &retryAfterWriter{ResponseWriter: c.Writer, rejection: rejection}
+	c.Next()
+}
+
+// unavailableError is returned for calls rejected by an open circuit breaker
+func unavailableError(serviceName string, wait time.Duration) *requestError {
+	return &requestError{StatusCode: http.StatusServiceUnavailable,
+		Message: fmt.Sprintf("%s is unavailable; retry in %d seconds", serviceName, int(math.Ceil(wait.Seconds())))}
+}
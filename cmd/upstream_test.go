@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker("sirsi", 2, 50*time.Millisecond)
+	expectAllowed := func(t *testing.T, expect bool) {
+		t.Helper()
+		if allowed, _ := cb.allow(); allowed != expect {
+			t.Fatalf("expected allowed %t in state %s", expect, cb.currentState())
+		}
+	}
+
+	expectAllowed(t, true)
+	cb.record(false)
+	expectAllowed(t, true)
+	cb.record(true)
+	expectAllowed(t, true)
+	cb.record(false)
+	if cb.currentState() != breakerClosed {
+		t.Fatalf("a success should reset the failure count")
+	}
+	expectAllowed(t, true)
+	cb.record(false)
+	if cb.currentState() != breakerOpen {
+		t.Fatalf("expected breaker to open after consecutive failures")
+	}
+	if allowed, wait := cb.allow(); allowed || wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatalf("expected open breaker to reject with a wait, got %t %s", allowed, wait)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	expectAllowed(t, true)
+	if cb.currentState() != breakerHalfOpen {
+		t.Fatalf("expected half-open breaker after cooldown, got %s", cb.currentState())
+	}
+	expectAllowed(t, false)
+	cb.record(false)
+	if cb.currentState() != breakerOpen {
+		t.Fatalf("expected failed probe to open the breaker, got %s", cb.currentState())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	expectAllowed(t, true)
+	cb.record(true)
+	if cb.currentState() != breakerClosed {
+		t.Fatalf("expected successful probe to close the breaker, got %s", cb.currentState())
+	}
+
+	// a probe that never reports back is abandoned after the cooldown
+	cb.record(false)
+	cb.record(false)
+	time.Sleep(60 * time.Millisecond)
+	expectAllowed(t, true)
+	expectAllowed(t, false)
+	time.Sleep(60 * time.Millisecond)
+	expectAllowed(t, true)
+	if cb.currentState() != breakerHalfOpen {
+		t.Fatalf("expected a new probe while half-open, got %s", cb.currentState())
+	}
+	expectAllowed(t, false)
+
+	disabled := newCircuitBreaker("solr", 0, time.Minute)
+	for range 10 {
+		disabled.record(false)
+	}
+	if allowed, _ := disabled.allow(); allowed == false {
+		t.Errorf("disabled breaker rejected a call")
+	}
+}
+
+func TestBreakerProbeCancelled(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.Breakers = h.svc.newCircuitBreakers(1, 50*time.Millisecond)
+	breaker := h.svc.Breakers["sirsi"]
+	breaker.record(false)
+	time.Sleep(60 * time.Millisecond)
+
+	h.sirsi.override("GET", "/catalog/bib/key/2419229", fakeResponse{status: http.StatusOK, body: "{}", delay: 200 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", h.sirsi.server.URL+"/catalog/bib/key/2419229", nil)
+	if _, err := h.svc.sendRequest(ctx, "sirsi", h.svc.HTTPClient, req); err == nil {
+		t.Fatalf("expected the probe to time out")
+	}
+	if breaker.currentState() != breakerOpen {
+		t.Fatalf("expected the cancelled probe to reopen the breaker, got %s", breaker.currentState())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if allowed, _ := breaker.allow(); allowed == false {
+		t.Errorf("expected a new probe after the cooldown")
+	}
+}
+
+func TestClassifyNetworkError(t *testing.T) {
+	// a listener that is closed right away gives an address that refuses connections
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	// dropped closes connections without responding
+	dropped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer dropped.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	client := &http.Client{Timeout: 20 * time.Millisecond}
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		reason string
+	}{
+		{"refused", fmt.Sprintf("http://%s/", closedAddr), http.StatusServiceUnavailable, "refused connection"},
+		{"timeout", slow.URL, http.StatusRequestTimeout, "timed out"},
+		{"dropped", dropped.URL, http.StatusBadGateway, "closed the connection"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.Get(tc.url)
+			if err == nil {
+				t.Fatalf("expected request to fail")
+			}
+			if status, reason := classifyNetworkError(err); status != tc.status || reason != tc.reason {
+				t.Errorf("expected %d %s, got %d %s for %s", tc.status, tc.reason, status, reason, err.Error())
+			}
+		})
+	}
+	dnsErr := &url.Error{Op: "Get", URL: "http://sirsi", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "sirsi", IsNotFound: true}}}
+	if status, reason := classifyNetworkError(dnsErr); status != http.StatusServiceUnavailable || reason != "could not be resolved" {
+		t.Errorf("expected dns failure to be unavailable, got %d %s", status, reason)
+	}
+	if status, _ := classifyNetworkError(io.ErrClosedPipe); status != http.StatusBadGateway {
+		t.Errorf("expected unknown errors to be a bad gateway, got %d", status)
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.Retry = retryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	sirsiDown := fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"}
+
+	h.run(t, []routeTest{
+		{name: "failed get is retried", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup:  func(h *testHarness) { h.sirsi.override("GET", "/catalog/bib/key/2419229", sirsiDown) },
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if n := len(h.sirsi.received("GET", "/catalog/bib/key/2419229")); n != 2 {
+					t.Errorf("expected the request and one retry, got %d requests", n)
+				}
+			}},
+		{name: "retries are limited", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/key/2419229", sirsiDown, sirsiDown, sirsiDown)
+			},
+			status:   http.StatusServiceUnavailable,
+			contains: []string{"sirsi is down"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if n := len(h.sirsi.received("GET", "/catalog/bib/key/2419229")); n != 3 {
+					t.Errorf("expected the request and two retries, got %d requests", n)
+				}
+			}},
+		{name: "sirsi errors are not retried", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/key/2419229", sirsiMessageResponse(http.StatusNotFound, "recordNotFound", "Not found."))
+			},
+			status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if n := len(h.sirsi.received("GET", "/catalog/bib/key/2419229")); n != 1 {
+					t.Errorf("expected one request, got %d", n)
+				}
+			}},
+		{name: "post is not retried", method: "POST", path: "/requests/hold", headers: auth,
+			body:   `{"pickupLibrary": "CLEMONS", "itemBarcode": "X000111111"}`,
+			setup:  func(h *testHarness) { h.sirsi.override("POST", "/circulation/holdRecord/placeHold", sirsiDown) },
+			status: http.StatusServiceUnavailable,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if n := len(h.sirsi.received("POST", "/circulation/holdRecord/placeHold")); n != 1 {
+					t.Errorf("expected one request, got %d", n)
+				}
+			}},
+	})
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	h := newTestHarness(t)
+	h.svc.Breakers = h.svc.newCircuitBreakers(2, time.Minute)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	sirsiDown := fakeResponse{status: http.StatusServiceUnavailable, body: "sirsi is down"}
+
+	h.run(t, []routeTest{
+		{name: "failures open the breaker", method: "GET", path: "/availability/u2419229", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/catalog/bib/key/2419229", sirsiDown, sirsiDown)
+				h.do("GET", "/availability/u2419229", "", auth)
+			},
+			status:   http.StatusServiceUnavailable,
+			contains: []string{"sirsi is down"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if resp.Header().Get("Retry-After") != "" {
+					t.Errorf("unexpected Retry-After for an upstream failure")
+				}
+				if h.svc.Breakers["sirsi"].currentState() != breakerOpen {
+					t.Errorf("expected sirsi breaker to be open")
+				}
+			}},
+		{name: "open breaker fails fast", method: "GET", path: "/availability/u2419229", headers: auth,
+			status:   http.StatusServiceUnavailable,
+			contains: []string{"sirsi is unavailable"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(h.sirsi.received("GET", "/catalog/bib/key/2419229")) != 0 {
+					t.Errorf("request was sent to sirsi while the breaker is open")
+				}
+				if resp.Header().Get("Retry-After") != "60" {
+					t.Errorf("expected Retry-After 60, got [%s]", resp.Header().Get("Retry-After"))
+				}
+				metrics := h.do("GET", "/metrics", "", nil).Body.String()
+				for _, want := range []string{`ils_connector_upstream_breaker_state{service="sirsi"} 1`,
+					`ils_connector_upstream_breaker_state{service="solr"} 0`,
+					`ils_connector_upstream_breaker_rejections_total{service="sirsi"} 1`} {
+					if strings.Contains(metrics, want) == false {
+						t.Errorf("metrics do not contain %s", want)
+					}
+				}
+			}},
+		{name: "other services are not affected", method: "GET", path: "/version", status: http.StatusOK,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if resp.Header().Get("Retry-After") != "" {
+					t.Errorf("unexpected Retry-After")
+				}
+			}},
+	})
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -136,6 +136,11 @@ type sirsiCheckout struct {
 						} `json:"call"`
 						Barcode         string   `json:"barcode"`
 						CurrentLocation sirsiKey `json:"currentLocation"`
+						HoldRecordList  []struct {
+							Fields struct {
+								Status string `json:"status"`
+							} `json:"fields"`
+						} `json:"holdRecordList"`
 					} `json:"fields"`
 				} `json:"item"`
 				DueDate string `json:"dueDate"`
@@ -159,44 +164,47 @@ type sirsiCheckout struct {
 type sirsiHolds struct {
 	Key    string `json:"key"`
 	Fields struct {
-		HoldRecordList []struct {
+		HoldRecordList []sirsiHoldRecord `json:"holdRecordList"`
+	} `json:"fields"`
+}
+
+type sirsiHoldRecord struct {
+	Key    string `json:"key"`
+	Fields struct {
+		Bib struct {
+			Key    string `json:"key"`
+			Fields struct {
+				Author string `json:"author"`
+				Title  string `json:"title"`
+			} `json:"fields"`
+		} `json:"bib"`
+		Item struct {
 			Key    string `json:"key"`
 			Fields struct {
-				Bib struct {
+				Call struct {
 					Key    string `json:"key"`
 					Fields struct {
-						Author string `json:"author"`
-						Title  string `json:"title"`
+						DispCallNumber string `json:"dispCallNumber"`
 					} `json:"fields"`
-				} `json:"bib"`
-				Item struct {
-					Key    string `json:"key"`
+				} `json:"call"`
+				Barcode         string   `json:"barcode"`
+				CurrentLocation sirsiKey `json:"currentLocation"`
+				Library         sirsiKey `json:"library"`
+				Transit         struct {
 					Fields struct {
-						Call struct {
-							Key    string `json:"key"`
-							Fields struct {
-								DispCallNumber string `json:"dispCallNumber"`
-							} `json:"fields"`
-						} `json:"call"`
-						Barcode         string   `json:"barcode"`
-						CurrentLocation sirsiKey `json:"currentLocation"`
-						Library         sirsiKey `json:"library"`
-						Transit         struct {
-							Fields struct {
-								TransitReason string `json:"transitReason"`
-							} `json:"fields"`
-						} `json:"transit"`
+						TransitReason string `json:"transitReason"`
 					} `json:"fields"`
-				} `json:"item"`
-				BeingHeldDate string   `json:"beingHeldDate"`
-				PickupLibrary sirsiKey `json:"pickupLibrary"`
-				PlacedDate    string   `json:"placedDate"`
-				QueueLength   uint64   `json:"queueLength"`
-				QueuePosition uint64   `json:"queuePosition"`
-				RecallStatus  string   `json:"recallStatus"`
-				Status        string   `json:"status"`
+				} `json:"transit"`
 			} `json:"fields"`
-		} `json:"holdRecordList"`
+		} `json:"item"`
+		BeingHeldDate  string   `json:"beingHeldDate"`
+		ExpirationDate string   `json:"expirationDate"`
+		PickupLibrary  sirsiKey `json:"pickupLibrary"`
+		PlacedDate     string   `json:"placedDate"`
+		QueueLength    uint64   `json:"queueLength"`
+		QueuePosition  uint64   `json:"queuePosition"`
+		RecallStatus   string   `json:"recallStatus"`
+		Status         string   `json:"status"`
 	} `json:"fields"`
 }
 
@@ -280,6 +288,12 @@ type checkoutDetails struct {
 	Bills           []checkoutBill `json:"bills"`
 	RecallDueDate   string         `json:"recallDueDate"`
 	RenewDate       string         `json:"renewDate"`
+	activeHolds     int
+}
+
+// renewable returns true if the checkout has not been recalled and no one else is waiting for the item
+func (co *checkoutDetails) renewable() bool {
+	return co.RecallDueDate == "" && co.activeHolds == 0
 }
 
 type billItem struct {
@@ -298,26 +312,27 @@ type billItem struct {
 }
 
 func (svc *serviceContext) getUserInfo(c *gin.Context) {
+	ctx := c.Request.Context()
 	computeID := c.Param("compute_id")
-	log.Printf("INFO: lookup user %s in user-ws", computeID)
+	logf(ctx, "INFO: lookup user %s in user-ws", computeID)
 	var userWsErr *requestError
 	var user userDetails
 	jwt := svc.mintUserServiceJWT()
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/user/%s?auth=%s", svc.UserInfoURL, computeID, jwt), nil)
-	raw, err := svc.sendRequest("user-ws", svc.HTTPClient, req)
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/user/%s?auth=%s", svc.UserInfoURL, computeID, jwt), nil)
+	raw, err := svc.sendRequest(ctx, "user-ws", svc.HTTPClient, req)
 	if err != nil {
 		if err.StatusCode == 404 {
-			log.Printf("INFO: user %s not found in user-ws; flagging as community user", computeID)
+			logf(ctx, "INFO: user %s not found in user-ws; flagging as community user", computeID)
 			user.CommunityUser = true
 		} else {
-			log.Printf("ERROR: got unexpected response %d:%s when looking for user %s; flagging user-ws failure", err.StatusCode, err.Message, computeID)
+			logf(ctx, "ERROR: got unexpected response %d:%s when looking for user %s; flagging user-ws failure", err.StatusCode, err.Message, computeID)
 			userWsErr = err
 		}
 	} else {
 		var userResp userInfoRespData
 		err := json.Unmarshal(raw, &userResp)
 		if err != nil {
-			log.Printf("ERROR: unable to parse user-ws response for %s: %s", computeID, err.Error())
+			logf(ctx, "ERROR: unable to parse user-ws response for %s: %s", computeID, err.Error())
 			c.String(http.StatusInternalServerError, err.Error())
 			return
 		}
@@ -338,20 +353,17 @@ func (svc *serviceContext) getUserInfo(c *gin.Context) {
 		user.Private = userResp.User.Private
 	}
 
-	log.Printf("INFO: lookup user %s in sirsi", computeID)
-	fields := "barcode,primaryAddress{*},address1,address2,address3,displayName,preferredName,firstName,middleName,lastName,"
-	fields += "profile,patronStatusInfo{standing,amountOwed},library"
-	sirsiURL := fmt.Sprintf("/user/patron/alternateID/%s?includeFields=%s", computeID, fields)
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.HTTPClient, sirsiURL)
+	logf(ctx, "INFO: lookup user %s in sirsi", computeID)
+	sirsiRaw, sirsiErr := svc.ILS.getPatron(ctx, computeID, patronInfo)
 	if sirsiErr != nil {
 		if sirsiErr.StatusCode == 404 {
-			log.Printf("INFO: user %s does not have a sirsi account: %s", computeID, sirsiErr.Message)
+			logf(ctx, "INFO: user %s does not have a sirsi account: %s", computeID, sirsiErr.Message)
 			if user.CommunityUser == true {
-				log.Printf("INFO: user %s not found in user-ws nor sirsi; flagging as not found", computeID)
+				logf(ctx, "INFO: user %s not found in user-ws nor sirsi; flagging as not found", computeID)
 				c.String(http.StatusNotFound, fmt.Sprintf("%s not found", computeID))
 			} else {
 				if userWsErr != nil {
-					log.Printf("INFO: user-ws failed; return %s for %s", userWsErr.string(), computeID)
+					logf(ctx, "INFO: user-ws failed; return %s for %s", userWsErr.string(), computeID)
 					c.String(userWsErr.StatusCode, userWsErr.Message)
 				} else {
 					user.NoAccount = true
@@ -359,7 +371,7 @@ func (svc *serviceContext) getUserInfo(c *gin.Context) {
 				}
 			}
 		} else {
-			log.Printf("ERROR: get sirsi user %s failed: %s", computeID, sirsiErr.string())
+			logf(ctx, "ERROR: get sirsi user %s failed: %s", computeID, sirsiErr.string())
 			c.String(sirsiErr.StatusCode, sirsiErr.Message)
 		}
 		return
@@ -368,7 +380,7 @@ func (svc *serviceContext) getUserInfo(c *gin.Context) {
 	var sirsiResp sirsiUserData
 	parseErr := json.Unmarshal(sirsiRaw, &sirsiResp)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse sirsi user %s response: %s", computeID, parseErr.Error())
+		logf(ctx, "ERROR: unable to parse sirsi user %s response: %s", computeID, parseErr.Error())
 		c.String(http.StatusInternalServerError, parseErr.Error())
 		return
 	}
@@ -393,7 +405,7 @@ func (svc *serviceContext) getUserInfo(c *gin.Context) {
 
 	// addr3 is email only
 	if len(userFields.Address3) > 1 {
-		log.Printf("WARNING: sirsi address3 field does not follow convention: %+v", userFields.Address3)
+		logf(ctx, "WARNING: sirsi address3 field does not follow convention: %+v", userFields.Address3)
 	} else {
 		for _, a3 := range userFields.Address3 {
 			if a3.Fields.Code.Key == "EMAIL" {
@@ -412,20 +424,19 @@ func (svc *serviceContext) getUserInfo(c *gin.Context) {
 
 	user.Email = primaryAddrFields.EmailAddress
 	if user.Email == "" {
-		log.Printf("WARNING: %s does not have a sirsi email", computeID)
+		logf(ctx, "WARNING: %s does not have a sirsi email", computeID)
 	}
 
 	c.JSON(http.StatusOK, user)
 }
 
 func (svc *serviceContext) getUserBills(c *gin.Context) {
+	ctx := c.Request.Context()
 	computeID := c.Param("compute_id")
-	log.Printf("INFO: get bills for %s", computeID)
-	fields := "blockList{title,callNumber,amount,createDate,library{description},block{description},item{itemType{description},barcode,bib{author}}}"
-	url := fmt.Sprintf("/user/patron/alternateID/%s?includeFields=%s", computeID, fields)
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.HTTPClient, url)
+	logf(ctx, "INFO: get bills for %s", computeID)
+	sirsiRaw, sirsiErr := svc.ILS.getPatron(ctx, computeID, patronBills)
 	if sirsiErr != nil {
-		log.Printf("ERROR: get sirsi user %s bills failed: %s", computeID, sirsiErr.string())
+		logf(ctx, "ERROR: get sirsi user %s bills failed: %s", computeID, sirsiErr.string())
 		c.String(sirsiErr.StatusCode, sirsiErr.Message)
 		return
 	}
@@ -433,7 +444,7 @@ func (svc *serviceContext) getUserBills(c *gin.Context) {
 	var billResp sirsiBillItem
 	parseErr := json.Unmarshal(sirsiRaw, &billResp)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse billd response: %s", parseErr.Error())
+		logf(ctx, "ERROR: unable to parse billd response: %s", parseErr.Error())
 		c.String(http.StatusInternalServerError, parseErr.Error())
 		return
 	}
@@ -460,11 +471,12 @@ func (svc *serviceContext) getUserBills(c *gin.Context) {
 }
 
 func (svc *serviceContext) getUserCheckoutsCSV(c *gin.Context) {
+	ctx := c.Request.Context()
 	computeID := c.Param("compute_id")
-	log.Printf("INFO: get checkouts csv for %s", computeID)
-	checkouts, err := svc.getSirsiUserCheckouts(computeID)
+	logf(ctx, "INFO: get checkouts csv for %s", computeID)
+	checkouts, err := svc.getSirsiUserCheckouts(ctx, computeID)
 	if err != nil {
-		log.Printf("ERROR: unable to get user %s checkouts csv: %s", computeID, err.string())
+		logf(ctx, "ERROR: unable to get user %s checkouts csv: %s", computeID, err.string())
 		c.String(err.StatusCode, err.Message)
 		return
 	}
@@ -496,23 +508,23 @@ func (svc *serviceContext) getUserCheckoutsCSV(c *gin.Context) {
 
 // ARK3CX and pc4v have bills on dev
 func (svc *serviceContext) getUserCheckouts(c *gin.Context) {
+	ctx := c.Request.Context()
 	computeID := c.Param("compute_id")
-	log.Printf("INFO: get checkouts for %s", computeID)
-	checkouts, err := svc.getSirsiUserCheckouts(computeID)
+	logf(ctx, "INFO: get checkouts for %s", computeID)
+	checkouts, err := svc.getSirsiUserCheckouts(ctx, computeID)
 	if err != nil {
-		log.Printf("ERROR: unable to get user %s checkouts: %s", computeID, err.string())
+		logf(ctx, "ERROR: unable to get user %s checkouts: %s", computeID, err.string())
 		c.String(err.StatusCode, err.Message)
 		return
 	}
+	if len(checkouts) > 0 {
+		svc.Notices.watch(noticeCheckouts, computeID)
+	}
 	c.JSON(http.StatusOK, checkouts)
 }
 
-func (svc *serviceContext) getSirsiUserCheckouts(computeID string) ([]checkoutDetails, *requestError) {
-	fields := "blockList{amount,block{description},item{key}},"
-	fields += "circRecordList{circulationRule{billStructure{maxFee}},dueDate,overdue,estimatedOverdueAmount,recallDueDate,renewalDate,"
-	fields += "library{description},item{key,barcode,currentLocation,call{dispCallNumber,bib{key,author,title}}}}"
-	url := fmt.Sprintf("/user/patron/alternateID/%s?i&includeFields=%s", computeID, fields)
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.SlowHTTPClient, url)
+func (svc *serviceContext) getSirsiUserCheckouts(ctx context.Context, computeID string) ([]checkoutDetails, *requestError) {
+	sirsiRaw, sirsiErr := svc.ILS.getPatron(ctx, computeID, patronCheckouts)
 	if sirsiErr != nil {
 		return nil, sirsiErr
 	}
@@ -552,6 +564,11 @@ func (svc *serviceContext) getSirsiUserCheckouts(computeID string) ([]checkoutDe
 		coItem.Bills = bills
 		coItem.RecallDueDate = cr.Fields.RecallDueDate
 		coItem.RenewDate = cr.Fields.RenewalDate
+		for _, hr := range cr.Fields.Item.Fields.HoldRecordList {
+			if hr.Fields.Status == "PLACED" || hr.Fields.Status == "BEING_HELD" {
+				coItem.activeHolds++
+			}
+		}
 
 		checkouts = append(checkouts, coItem)
 	}
@@ -559,13 +576,12 @@ func (svc *serviceContext) getSirsiUserCheckouts(computeID string) ([]checkoutDe
 }
 
 func (svc *serviceContext) getUserHolds(c *gin.Context) {
+	ctx := c.Request.Context()
 	computeID := c.Param("compute_id")
-	log.Printf("INFO: get holds for %s", computeID)
-	fields := "holdRecordList{*,bib{title,author},item{barcode,currentLocation,library,transit{transitReason},call{dispCallNumber}}}"
-	url := fmt.Sprintf("/user/patron/alternateID/%s?i&includeFields=%s", computeID, fields)
-	sirsiRaw, sirsiErr := svc.sirsiGet(svc.SlowHTTPClient, url)
+	logf(ctx, "INFO: get holds for %s", computeID)
+	sirsiRaw, sirsiErr := svc.ILS.getPatron(ctx, computeID, patronHolds)
 	if sirsiErr != nil {
-		log.Printf("ERROR: get sirsi user %s holds failed: %s", computeID, sirsiErr.string())
+		logf(ctx, "ERROR: get sirsi user %s holds failed: %s", computeID, sirsiErr.string())
 		c.String(sirsiErr.StatusCode, sirsiErr.Message)
 		return
 	}
@@ -573,47 +589,53 @@ func (svc *serviceContext) getUserHolds(c *gin.Context) {
 	var holdResp sirsiHolds
 	parseErr := json.Unmarshal(sirsiRaw, &holdResp)
 	if parseErr != nil {
-		log.Printf("ERROR: unable to parse holds response: %s", parseErr.Error())
+		logf(ctx, "ERROR: unable to parse holds response: %s", parseErr.Error())
 		c.String(http.StatusInternalServerError, parseErr.Error())
 		return
 	}
 
 	holds := make([]holdDetails, 0)
-	holdRecs := holdResp.Fields.HoldRecordList
-	for _, hr := range holdRecs {
-		hold := holdDetails{ID: hr.Key, UserID: computeID}
-		hold.Status = hr.Fields.Status
-		if hold.Status == "BEING_HELD" {
-			hold.Status = fmt.Sprintf("AWAITING PICKUP since %s", hr.Fields.BeingHeldDate)
-		}
-		hold.PickupLocation = hr.Fields.PickupLibrary.Key
-		if hold.PickupLocation == "LEO" {
-			hold.PickupLocation = "LEO delivery"
-		}
-		hold.ItemStatus = hr.Fields.Item.Fields.CurrentLocation.Key
-		if hold.ItemStatus == "CHECKEDOUT" && hr.Fields.RecallStatus == "RUSH" {
-			hold.ItemStatus = "CHECKED OUT, recalled from borrower."
-		} else if hold.ItemStatus == "INTRANSIT " {
-			if hr.Fields.Item.Fields.Transit.Fields.TransitReason == "HOLD" {
-				hold.ItemStatus = "IN TRANSIT for hold"
-			}
-		}
-		hold.Cancellable = hr.Fields.Status == "PLACED" && hr.Fields.RecallStatus != "RUSH"
-		hold.PlacedDate = hr.Fields.PlacedDate
-		hold.QueueLength = hr.Fields.QueueLength
-		hold.QuePosition = hr.Fields.QueuePosition
-		hold.TitleKey = hr.Fields.Bib.Key
-		hold.Title = hr.Fields.Bib.Fields.Title
-		hold.Author = hr.Fields.Bib.Fields.Author
-		hold.CallNumber = hr.Fields.Item.Fields.Call.Fields.DispCallNumber
-		hold.Barcode = hr.Fields.Item.Fields.Barcode
-
-		holds = append(holds, hold)
+	for _, hr := range holdResp.Fields.HoldRecordList {
+		holds = append(holds, newHoldDetails(computeID, hr))
+	}
+	if len(holds) > 0 {
+		svc.Notices.watch(noticeHolds, computeID)
 	}
 
 	c.JSON(http.StatusOK, userHoldsResponse{Holds: holds})
 }
 
+// newHoldDetails converts a sirsi hold record for a patron to the hold details returned by the service
+func newHoldDetails(computeID string, hr sirsiHoldRecord) holdDetails {
+	hold := holdDetails{ID: hr.Key, UserID: computeID}
+	hold.Status = hr.Fields.Status
+	if hold.Status == "BEING_HELD" {
+		hold.Status = fmt.Sprintf("AWAITING PICKUP since %s", hr.Fields.BeingHeldDate)
+	}
+	hold.PickupLocation = hr.Fields.PickupLibrary.Key
+	if hold.PickupLocation == "LEO" {
+		hold.PickupLocation = "LEO delivery"
+	}
+	hold.ItemStatus = hr.Fields.Item.Fields.CurrentLocation.Key
+	if hold.ItemStatus == "CHECKEDOUT" && hr.Fields.RecallStatus == "RUSH" {
+		hold.ItemStatus = "CHECKED OUT, recalled from borrower."
+	} else if hold.ItemStatus == "INTRANSIT " {
+		if hr.Fields.Item.Fields.Transit.Fields.TransitReason == "HOLD" {
+			hold.ItemStatus = "IN TRANSIT for hold"
+		}
+	}
+	hold.Cancellable = hr.Fields.Status == "PLACED" && hr.Fields.RecallStatus != "RUSH"
+	hold.PlacedDate = hr.Fields.PlacedDate
+	hold.QueueLength = hr.Fields.QueueLength
+	hold.QuePosition = hr.Fields.QueuePosition
+	hold.TitleKey = hr.Fields.Bib.Key
+	hold.Title = hr.Fields.Bib.Fields.Title
+	hold.Author = hr.Fields.Bib.Fields.Author
+	hold.CallNumber = hr.Fields.Item.Fields.Call.Fields.DispCallNumber
+	hold.Barcode = hr.Fields.Item.Fields.Barcode
+	return hold
+}
+
 func extractAddress(srcAddressData []sirsiAddressData) *userAddress {
 	if len(srcAddressData) == 0 {
 		return nil
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestPatronAccess(t *testing.T) {
+	h := newTestHarness(t)
+	var events []auditEvent
+	h.svc.Audit = func(ctx context.Context, evt auditEvent) { events = append(events, evt) }
+	otherClaims := mst3kClaims()
+	otherClaims.UserID = "abc9z"
+	adminClaims := otherClaims
+	adminClaims.Role = v4jwt.Admin
+	lastEvent := func(t *testing.T) auditEvent {
+		t.Helper()
+		if len(events) == 0 {
+			t.Fatalf("expected an audit event")
+		}
+		return events[len(events)-1]
+	}
+
+	h.run(t, []routeTest{
+		{name: "no jwt", method: "GET", path: "/users/mst3k/checkouts", status: http.StatusUnauthorized,
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if evt := lastEvent(t); evt.Allowed || evt.Target != "mst3k" || evt.Route != "/users/:compute_id/checkouts" || evt.Caller != "" {
+					t.Errorf("unexpected audit event %+v", evt)
+				}
+				if len(h.sirsi.received("GET", "/user/patron/alternateID/mst3k")) > 0 {
+					t.Errorf("patron data was requested for an unauthorized caller")
+				}
+			}},
+		{name: "invalid jwt", method: "GET", path: "/users/mst3k", status: http.StatusUnauthorized,
+			headers: map[string]string{"Authorization": "Bearer not-a-jwt"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if evt := lastEvent(t); evt.Allowed || evt.Reason != "jwt signature is invalid" {
+					t.Errorf("unexpected audit event %+v", evt)
+				}
+			}},
+		{name: "another patron", method: "GET", path: "/users/mst3k/bills", status: http.StatusForbidden,
+			headers: map[string]string{"Authorization": bearer(t, otherClaims)},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if evt := lastEvent(t); evt.Allowed || evt.Caller != "abc9z" || evt.Role != "user" || evt.Target != "mst3k" {
+					t.Errorf("unexpected audit event %+v", evt)
+				}
+			}},
+		{name: "same patron", method: "GET", path: "/users/mst3k/holds", status: http.StatusOK,
+			headers: map[string]string{"Authorization": bearer(t, mst3kClaims())},
+			setup:   func(h *testHarness) { events = nil },
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if len(events) > 0 {
+					t.Errorf("unexpected audit events %+v", events)
+				}
+			}},
+		{name: "admin", method: "GET", path: "/users/mst3k/holds", status: http.StatusOK,
+			headers: map[string]string{"Authorization": bearer(t, adminClaims)},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if evt := lastEvent(t); evt.Allowed == false || evt.Caller != "abc9z" || evt.Role != "admin" {
+					t.Errorf("unexpected audit event %+v", evt)
+				}
+			}},
+	})
+}
+
+func TestUsers(t *testing.T) {
+	h := newTestHarness(t)
+	auth := map[string]string{"Authorization": bearer(t, mst3kClaims())}
+	adminClaims := mst3kClaims()
+	adminClaims.Role = v4jwt.Admin
+	admin := map[string]string{"Authorization": bearer(t, adminClaims)}
+
+	h.run(t, []routeTest{
+		{name: "user-ws and sirsi user", method: "GET", path: "/users/mst3k", headers: auth, status: http.StatusOK,
+			contains: []string{`"id":"mst3k"`, `"communityUser":false`, `"title":"Graduate Student"`, `"department":"Media Studies, English"`,
+				`"barcode":"C000011111"`, `"email":"mst3k@virginia.edu"`, `"homeLibrary":"ALDERMAN"`, `"standing":"OK"`,
+				`"address1":{"line1":"1 Satellite Way","zip":"22904","phone":"434-555-1212"}`, `"address3Email":"mst3k@virginia.edu"`},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				reqs := h.userWS.received("GET", "/user/mst3k")
+				if len(reqs) != 1 || reqs[0].query.Get("auth") == "" {
+					t.Errorf("expected one authorized user-ws request")
+				}
+			}},
+		{name: "community user", method: "GET", path: "/users/mst3k", headers: auth, status: http.StatusOK,
+			setup: func(h *testHarness) {
+				h.userWS.override("GET", "/user/mst3k", fakeResponse{status: http.StatusNotFound, body: "not found"})
+			},
+			contains: []string{`"communityUser":true`, `"barcode":"C000011111"`}},
+		{name: "no sirsi account", method: "GET", path: "/users/noacct", headers: admin, status: http.StatusOK,
+			contains: []string{`"id":"noacct"`, `"noAccount":true`}},
+		{name: "user-ws failure without sirsi account", method: "GET", path: "/users/noacct", headers: admin,
+			setup: func(h *testHarness) {
+				h.userWS.override("GET", "/user/noacct", fakeResponse{status: http.StatusServiceUnavailable, body: "user-ws unavailable"})
+			},
+			status: http.StatusServiceUnavailable, contains: []string{"user-ws unavailable"}},
+		{name: "unknown user", method: "GET", path: "/users/nobody", headers: admin, status: http.StatusNotFound,
+			contains: []string{"nobody not found"}},
+		{name: "sirsi failure", method: "GET", path: "/users/mst3k", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/user/patron/alternateID/mst3k", fakeResponse{status: http.StatusInternalServerError, body: "sirsi failure"})
+			},
+			status: http.StatusInternalServerError, contains: []string{"sirsi failure"}},
+		{name: "bills", method: "GET", path: "/users/mst3k/bills", headers: auth, status: http.StatusOK,
+			contains: []string{`"reason":"Overdue"`, `"amount":5`, `"barcode":"X000111112"`, `"title":"Notes on the state of Virginia"`}},
+		{name: "bills for unknown user", method: "GET", path: "/users/nobody/bills", headers: admin, status: http.StatusNotFound,
+			contains: []string{`"code":"recordNotFound"`}},
+		{name: "checkouts", method: "GET", path: "/users/mst3k/checkouts", headers: auth, status: http.StatusOK,
+			contains: []string{`"barcode":"X000111112"`, `"overDue":true`, `"label":"Overdue"`, `"currentLocation":"Checked out"`}},
+		{name: "checkouts sirsi failure", method: "GET", path: "/users/mst3k/checkouts", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/user/patron/alternateID/mst3k", fakeResponse{status: http.StatusInternalServerError, body: "sirsi failure"})
+			},
+			status: http.StatusInternalServerError, contains: []string{"sirsi failure"}},
+		{name: "checkouts csv sirsi failure", method: "GET", path: "/users/mst3k/checkouts.csv", headers: auth,
+			setup: func(h *testHarness) {
+				h.sirsi.override("GET", "/user/patron/alternateID/mst3k", fakeResponse{status: http.StatusInternalServerError, body: "sirsi failure"})
+			},
+			status: http.StatusInternalServerError, contains: []string{"sirsi failure"}},
+		{name: "checkouts csv", method: "GET", path: "/users/mst3k/checkouts.csv", headers: auth, status: http.StatusOK,
+			contains: []string{"Id,Title,Author,Barcode", "X000111112"},
+			check: func(t *testing.T, h *testHarness, resp *httptest.ResponseRecorder) {
+				if resp.Header().Get("Content-Type") != "text/csv" {
+					t.Errorf("expected text/csv, got %s", resp.Header().Get("Content-Type"))
+				}
+				if strings.Contains(resp.Header().Get("Content-Disposition"), "mst3k_checkouts.csv") == false {
+					t.Errorf("unexpected content disposition %s", resp.Header().Get("Content-Disposition"))
+				}
+			}},
+		{name: "holds", method: "GET", path: "/users/mst3k/holds", headers: auth, status: http.StatusOK,
+			contains: []string{`"id":"1001"`, `"userID":"mst3k"`, `"cancellable":true`}},
+		{name: "holds for unknown user", method: "GET", path: "/users/nobody/holds", headers: admin, status: http.StatusNotFound,
+			contains: []string{`"code":"recordNotFound"`}},
+		{name: "valid password", method: "POST", path: "/users/check_password", status: http.StatusOK,
+			body: `{"barcode": "mst3k", "password": "fixture-pin"}`, contains: []string{"valid"}},
+		{name: "invalid password", method: "POST", path: "/users/check_password", status: http.StatusUnauthorized,
+			body: `{"barcode": "mst3k", "password": "wrong"}`, contains: []string{"invalid"}},
+	})
+}
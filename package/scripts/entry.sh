@@ -1,25 +1,36 @@
+# secrets are passed in the environment to keep them off the command line
+export ILS_USERKEY="${AUTH_SHARED_SECRET}"
+export ILS_JWTKEY="${JWT_KEY}"
+export ILS_SIRSIPASS="${SIRSI_PASSWORD}"
+if [ -n "${V4_SMPT_PASS}" ]; then
+   export ILS_SMTPPASS="${V4_SMPT_PASS}"
+fi
+
 # set blank options variables
 SMTP_USER_OPT=""
-SMTP_PASS_OPT=""
+CLIENTS_OPT=""
+NOTICE_OPT=""
 
 # SMTP username
 if [ -n "${V4_SMPT_USER}" ]; then
    SMTP_USER_OPT="-smtpuser ${V4_SMPT_USER}"
 fi
 
-# SMTP password
-if [ -n "${V4_SMPT_PASS}" ]; then
-   SMTP_PASS_OPT="-smtppass ${V4_SMPT_PASS}"
+# internal clients file
+if [ -n "${ILS_CLIENTS_FILE}" ]; then
+   CLIENTS_OPT="-clients ${ILS_CLIENTS_FILE}"
+fi
+
+# patron notification state file
+if [ -n "${ILS_NOTICE_FILE}" ]; then
+   NOTICE_OPT="-noticefile ${ILS_NOTICE_FILE}"
 fi
 
 # run from here
 cd bin; ./ils-connector-ws \
-  -userkey ${AUTH_SHARED_SECRET} \
-  -jwtkey ${JWT_KEY} \
   -port ${SERVICE_PORT} \
   -sirsiclient ${SIRSI_CLIENT_ID} \
   -sirsilibrary ${SIRSI_LIBRARY} \
-  -sirsipass ${SIRSI_PASSWORD} \
   -sirsiscript ${SIRSI_SCRIPT_URL} \
   -sirsiurl ${SIRSI_WEB_SERVICES_BASE} \
   -sirsiuser ${SIRSI_USER} \
@@ -34,7 +45,8 @@ cd bin; ./ils-connector-ws \
   -cremail ${V4_CR_EMAIL} \
   -lawemail ${V4_LAW_CR_EMAIL} \
   ${SMTP_USER_OPT} \
-  ${SMTP_PASS_OPT}
+  ${CLIENTS_OPT} \
+  ${NOTICE_OPT}
 
 return $?
 